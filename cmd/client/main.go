@@ -4,18 +4,22 @@ import (
 	"flag"
 	"log"
 	"net"
+	"strings"
 
 	"github.com/badboyd/tcp-hub/internal/client"
-	"github.com/badboyd/tcp-hub/pkg/id"
 	"github.com/badboyd/tcp-hub/pkg/message"
 )
 
 var (
-	ip    = flag.String("ip", "127.0.0.1", "TCP Server IP")
-	port  = flag.Int("port", 8000, "TCP server port")
-	cmd   = flag.String("cmd", "identity", "Command (identity, list, relay)")
-	recvs = flag.String("recvs", "", "List of receivers(uint 64) separated by comma")
-	msg   = flag.String("msg", "", "Message for relay cmd")
+	ip     = flag.String("ip", "127.0.0.1", "TCP Server IP")
+	port   = flag.Int("port", 8000, "TCP server port")
+	cmd    = flag.String("cmd", "identity", "Command (identity, list, relay, nick, whois)")
+	recvs  = flag.String("recvs", "", "List of receivers(uint 64 or nickname) separated by comma, or a label selector")
+	msg    = flag.String("msg", "", "Message for relay cmd")
+	name   = flag.String("name", "", "Nickname to register before running cmd")
+	target = flag.String("target", "", "Client ID or nickname for whois cmd")
+	names  = flag.Bool("names", false, "Show nicknames in list cmd")
+	labels = flag.String("labels", "", "Labels attached at connect time, e.g. region=eu,role=worker")
 )
 
 func init() {
@@ -26,13 +30,44 @@ func main() {
 	cli := client.New()
 	defer cli.Close()
 
+	if *labels != "" {
+		clientLabels, err := message.ParseLabels(*labels)
+		if err != nil {
+			log.Println("Labels in wrong format: ", err.Error())
+			return
+		}
+		cli.SetLabels(clientLabels)
+	}
+
 	serverAddr := net.TCPAddr{IP: net.ParseIP(*ip), Port: *port}
 	if err := cli.Connect(&serverAddr); err != nil {
 		log.Println("Cannot connet to server: ", err.Error())
 		return
 	}
 
+	if *name != "" {
+		if err := cli.SetNick(*name); err != nil {
+			log.Println("Cannot set nickname: ", err.Error())
+			return
+		}
+	}
+
 	switch *cmd {
+	case message.NickType:
+		if *name == "" {
+			log.Println("Name cannot be empty")
+			return
+		}
+
+		log.Println("Nickname is: ", *name)
+	case message.WhoisType:
+		clientID, clientName, err := cli.WhoIs(*target)
+		if err != nil {
+			log.Println("Cannot get whois: ", err.Error())
+			return
+		}
+
+		log.Printf("ClientID is: %d, nickname is: %q\n", clientID, clientName)
 	case message.IdentityType:
 		clientID, err := cli.WhoAmI()
 		if err != nil {
@@ -42,6 +77,17 @@ func main() {
 
 		log.Println("ClientID is: ", clientID)
 	case message.ListType:
+		if *names {
+			clients, err := cli.ListClients()
+			if err != nil {
+				log.Println("Cannot get list clients: ", err.Error())
+				return
+			}
+
+			log.Println("Other clients are: ", clients)
+			return
+		}
+
 		clientIDs, err := cli.ListClientIDs()
 		if err != nil {
 			log.Println("Cannot get list clientIDs: ", err.Error())
@@ -54,13 +100,13 @@ func main() {
 			log.Println("Receivers and Message cannot be empty")
 			return
 		}
-		receiverIDs, err := id.ConvertFromStringToArray(*recvs)
-		if err != nil {
-			log.Println("Receivers in wrong format: ", err.Error())
+		if message.IsSelector(*recvs) {
+			if err := cli.SendMsgToSelector(*recvs, []byte(*msg)); err != nil {
+				log.Println("Cannot send message: ", err.Error())
+			}
 			return
 		}
-
-		if err = cli.SendMsg(receiverIDs, []byte(*msg)); err != nil {
+		if err := cli.SendMsgTo(strings.Split(*recvs, ","), []byte(*msg)); err != nil {
 			log.Println("Receivers in wrong format: ", err.Error())
 			return
 		}
@@ -1,18 +1,35 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"log"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 
 	"github.com/badboyd/tcp-hub/internal/server"
+	"github.com/badboyd/tcp-hub/pkg/id"
+	"github.com/badboyd/tcp-hub/pkg/message"
 )
 
 var (
-	port = flag.Int("port", 8000, "TCP server port")
+	port            = flag.Int("port", 8000, "TCP server port")
+	eventLoop       = flag.Bool("event-loop", false, "serve connections from an epoll event loop, linux only")
+	idFile          = flag.String("id-file", "", "file keeping the client IDs high-water mark, IDs restart at 1 without it")
+	limit           = flag.String("limit", "", `limit of relays as JSON, e.g. {"messages":100,"bytes":1048576,"action":"delay"}`)
+	limitBy         = flag.String("limit-by", "client", "clients sharing a limit, client or ip")
+	maxClients      = flag.Int("max-clients", 0, "clients connected at once, unlimited with 0")
+	maxClientsPerIP = flag.Int("max-clients-per-ip", 0, "clients connected at once from an IP, unlimited with 0")
+	maxBodySize     = flag.Int("max-body-size", message.DefaultMaxBodySize, "largest relay body in bytes, clients announcing a larger one are disconnected")
+	acceptRate      = flag.Float64("accept-rate", 0, "connections accepted per second, unlimited with 0")
+	ipRules         = flag.String("ip-rules", "", "file of allow and deny CIDR rules, reloaded on SIGHUP, every network may connect without it")
+	proxyProtocol   = flag.String("proxy-protocol", "", "comma separated CIDRs of proxies sending PROXY protocol headers, e.g. 10.0.0.0/8")
+	policy          = flag.String("policy", "", "JSON file of the policy deciding what clients may do, reloaded on SIGHUP, everything is allowed without it")
+	admin           = flag.String("admin", "", "address of the HTTP admin interface, e.g. 127.0.0.1:8001, none without it")
 )
 
 func init() {
@@ -20,17 +37,104 @@ func init() {
 }
 
 func main() {
-	s := server.New()
+	opts := []server.Option{}
+	if *eventLoop {
+		opts = append(opts, server.WithEventLoop(0))
+	}
+	if *idFile != "" {
+		ids, err := id.NewPersistent(*idFile, id.DefaultBlock)
+		if err != nil {
+			log.Printf("Cannot open client IDs: %s", err.Error())
+			return
+		}
+		opts = append(opts, server.WithIDAllocator(ids))
+	}
+	var l server.Limit
+	if *limit != "" {
+		if err := json.Unmarshal([]byte(*limit), &l); err != nil {
+			log.Printf("Cannot parse limit: %s", err.Error())
+			return
+		}
+	}
+	if by := server.LimitBy(*limitBy); by != server.LimitByClient && by != server.LimitByIP {
+		log.Printf("Cannot limit by %q", *limitBy)
+		return
+	}
+	opts = append(opts, server.WithRateLimit(server.LimitBy(*limitBy), l),
+		server.WithMaxClients(*maxClients), server.WithMaxClientsPerIP(*maxClientsPerIP), server.WithAcceptRate(*acceptRate, 0),
+		server.WithMaxBodySize(*maxBodySize))
+	if *proxyProtocol != "" {
+		var trusted []*net.IPNet
+		for _, cidr := range strings.Split(*proxyProtocol, ",") {
+			_, ipNet, err := net.ParseCIDR(strings.TrimSpace(cidr))
+			if err != nil {
+				log.Printf("Cannot parse trusted proxies: %s", err.Error())
+				return
+			}
+			trusted = append(trusted, ipNet)
+		}
+		opts = append(opts, server.WithProxyProtocol(trusted...))
+	}
+	if *policy != "" {
+		p, err := server.LoadPolicy(*policy)
+		if err != nil {
+			log.Printf("Cannot load policy: %s", err.Error())
+			return
+		}
+		opts = append(opts, server.WithPolicy(p))
+	}
+	if *ipRules != "" {
+		rules, err := server.LoadIPRules(*ipRules)
+		if err != nil {
+			log.Printf("Cannot load IP rules: %s", err.Error())
+			return
+		}
+		opts = append(opts, server.WithIPRules(rules))
+	}
+	s := server.New(opts...)
 	defer s.Stop()
 
+	if *admin != "" {
+		go func() {
+			if err := http.ListenAndServe(*admin, s.AdminHandler()); err != nil {
+				log.Printf("Cannot serve admin interface: %s", err.Error())
+			}
+		}()
+	}
+
 	if err := s.Start(&net.TCPAddr{Port: *port}); err != nil {
 		log.Printf("Cannot start server: %s", err.Error())
 		return
 	}
 
 	// create a channel to catch interupt signal
-	quit := make(chan os.Signal)
+	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-	// wait for terminal signal
-	<-quit
+	// reload IP rules and policy on SIGHUP, a file failing to load keeps what is in use
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	for {
+		select {
+		case <-reload:
+			if *ipRules != "" {
+				if rules, err := server.LoadIPRules(*ipRules); err != nil {
+					log.Printf("Cannot reload IP rules: %s", err.Error())
+				} else {
+					s.SetIPRules(rules)
+					log.Printf("Reloaded IP rules from %s", *ipRules)
+				}
+			}
+			if *policy != "" {
+				if p, err := server.LoadPolicy(*policy); err != nil {
+					log.Printf("Cannot reload policy: %s", err.Error())
+				} else {
+					s.SetPolicy(p)
+					log.Printf("Reloaded policy from %s", *policy)
+				}
+			}
+		case <-quit:
+			// wait for terminal signal
+			return
+		}
+	}
 }
@@ -2,11 +2,14 @@ package client
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net"
+	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/badboyd/tcp-hub/pkg/id"
 	"github.com/badboyd/tcp-hub/pkg/message"
@@ -16,18 +19,69 @@ import (
 type IncomingMessage struct {
 	SenderID uint64
 	Body     []byte
+	// ID is assigned by server, it is used to ack the message
+	ID uint64
+	// AckRequired is set for at-least-once and queue group messages
+	AckRequired bool
+	// Group is the queue group the message was delivered through
+	Group string
+	// Redelivered is set when a previous receiver did not ack the message
+	Redelivered bool
+	// CorrelationID and ReplyTo are set for requests, see Reply
+	CorrelationID string
+	ReplyTo       uint64
+	// Headers are the key/value headers set by the sender
+	Headers map[string]string
+}
+
+// ClientInfo describes a client connecting to server
+type ClientInfo struct {
+	ID   uint64
+	Name string
 }
 
 // Client keeps needed to communicate with server
 type Client struct {
-	id   uint64
-	conn net.Conn
-	r    *bufio.Reader
+	id        uint64
+	labels    map[string]string
+	manualAck bool
+	conn      net.Conn
+	r         *bufio.Reader
+
+	// credit granted to server, see WithCredit
+	creditMsgs       int64
+	creditBytes      int64
+	rejectOverCredit bool
+	pullMode         bool
+	consumedMsgs     int64
+	consumedBytes    int64
+
+	rm       sync.Mutex
+	corrSeq  uint64
+	pending  map[string]chan response
+	handler  RequestHandler
+	expired  ExpiredHandler
+	rejected RejectedHandler
+	denied   DeniedHandler
 }
 
+// ExpiredHandler is told about sent messages which expired before reaching receiverID
+type ExpiredHandler func(msgID, receiverID uint64)
+
+// RejectedHandler is told about sent messages dropped as receiverID was out of credit
+type RejectedHandler func(msgID, receiverID uint64)
+
+// DeniedHandler is told about sent messages the policy of server did not let reach receivers,
+// comma separated IDs or a queue group
+type DeniedHandler func(msgID uint64, receivers string)
+
 // New returns new client
-func New() *Client {
-	return &Client{}
+func New(opts ...Option) *Client {
+	cli := &Client{}
+	for _, opt := range opts {
+		opt(cli)
+	}
+	return cli
 }
 
 // Connect to serverAddr
@@ -38,9 +92,82 @@ func (cli *Client) Connect(serverAddr *net.TCPAddr) error {
 	}
 	cli.conn = conn
 	cli.r = bufio.NewReader(conn)
+
+	if len(cli.labels) > 0 {
+		if err := cli.sendLabels(); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+	if cli.pullMode {
+		if err := cli.sendMode(message.ModePull); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+	if cli.creditMsgs > 0 || cli.creditBytes > 0 {
+		if err := cli.grantCredit(cli.creditMsgs, cli.creditBytes); err != nil {
+			conn.Close()
+			return err
+		}
+	}
 	return nil
 }
 
+func (cli *Client) grantCredit(msgs, bytes int64) error {
+	policy := message.CreditBuffer
+	if cli.rejectOverCredit {
+		policy = message.CreditReject
+	}
+	return message.Credit{Msgs: msgs, Bytes: bytes, Policy: policy}.Encode(cli.conn)
+}
+
+// consumed grants credit back to server once half of it was consumed
+func (cli *Client) consumed(size int) error {
+	if cli.creditMsgs == 0 && cli.creditBytes == 0 {
+		return nil
+	}
+	cli.consumedMsgs++
+	cli.consumedBytes += int64(size)
+	if (cli.creditMsgs == 0 || cli.consumedMsgs*2 < cli.creditMsgs) &&
+		(cli.creditBytes == 0 || cli.consumedBytes*2 < cli.creditBytes) {
+		return nil
+	}
+
+	var msgs, bytes int64
+	if cli.creditMsgs > 0 {
+		msgs = cli.consumedMsgs
+	}
+	if cli.creditBytes > 0 {
+		bytes = cli.consumedBytes
+	}
+	cli.consumedMsgs, cli.consumedBytes = 0, 0
+	return cli.grantCredit(msgs, bytes)
+}
+
+// SetLabels sets key/value labels attached to the client at connect time.
+// When the client is already connected labels are sent to server right away.
+func (cli *Client) SetLabels(labels map[string]string) error {
+	cli.labels = labels
+	if cli.conn == nil {
+		return nil
+	}
+	return cli.sendLabels()
+}
+
+func (cli *Client) sendLabels() error {
+	// labels cannot be cleared, without labels the message would ask for them
+	if len(cli.labels) == 0 {
+		return message.ErrInvalidLabel
+	}
+	if err := (message.Labels{Labels: cli.labels}).Encode(cli.conn); err != nil {
+		return err
+	}
+
+	var reply message.LabelsReply
+	return reply.Decode(cli.r)
+}
+
 // Close client
 func (cli *Client) Close() error {
 	if cli.conn != nil {
@@ -51,88 +178,398 @@ func (cli *Client) Close() error {
 
 // WhoAmI get the clientID from server
 func (cli *Client) WhoAmI() (uint64, error) {
-	msg := fmt.Sprintf("%s\n", message.IdentityType)
-	if _, err := cli.conn.Write([]byte(msg)); err != nil {
-		return 0, err
-	}
-
-	line, err := cli.r.ReadString('\n')
-	if err != nil {
+	if err := (message.Identity{}).Encode(cli.conn); err != nil {
 		return 0, err
 	}
 
-	var id uint64
-	if _, err := fmt.Sscanf(line, message.IdentityReplyFmt, &id); err != nil {
+	var reply message.IdentityReply
+	if err := reply.Decode(cli.r); err != nil {
 		return 0, err
 	}
 
-	cli.id = id
-	return id, nil
+	cli.id = reply.ID
+	return reply.ID, nil
 }
 
 // ListClientIDs gets others clientID that connecting to server
 func (cli *Client) ListClientIDs() ([]uint64, error) {
-	msg := fmt.Sprintf("%s\n", message.ListType)
-	if _, err := cli.conn.Write([]byte(msg)); err != nil {
+	reply, err := cli.list(message.List{})
+	if err != nil || len(reply.Clients) == 0 {
+		// you are the only one client
 		return nil, err
 	}
+	return reply.IDs(), nil
+}
 
-	line, err := cli.r.ReadString('\n')
-	if err != nil {
-		return nil, err
+// SetNick registers name as nickname of this client on server
+func (cli *Client) SetNick(name string) error {
+	if err := (message.Nick{Name: name}).Encode(cli.conn); err != nil {
+		return err
 	}
-	if line == "list \n" {
-		// you are the only one client
-		return nil, nil
+
+	var reply message.Nick
+	return reply.Decode(cli.r)
+}
+
+// WhoIs looks up a client by ID or nickname, returns its ID and nickname
+func (cli *Client) WhoIs(target string) (uint64, string, error) {
+	if err := (message.Whois{Target: target}).Encode(cli.conn); err != nil {
+		return 0, "", err
 	}
 
-	var clients string
-	if _, err := fmt.Sscanf(line, message.ListReplyFmt, &clients); err != nil {
+	var reply message.WhoisReply
+	if err := reply.Decode(cli.r); err != nil {
+		return 0, "", err
+	}
+	return reply.ID, reply.Name, nil
+}
+
+// ListClients gets others clients with their nicknames
+func (cli *Client) ListClients() ([]ClientInfo, error) {
+	reply, err := cli.list(message.List{Names: true})
+	if err != nil || len(reply.Clients) == 0 {
+		// you are the only one client
 		return nil, err
 	}
 
-	return id.ConvertFromStringToArray(clients)
+	clients := make([]ClientInfo, 0, len(reply.Clients))
+	for _, c := range reply.Clients {
+		clients = append(clients, ClientInfo{ID: c.ID, Name: c.Name})
+	}
+	return clients, nil
+}
+
+func (cli *Client) list(req message.List) (message.ListReply, error) {
+	var reply message.ListReply
+	if err := req.Encode(cli.conn); err != nil {
+		return reply, err
+	}
+	err := reply.Decode(cli.r)
+	return reply, err
+}
+
+// SendMsg sends body to recipients, each of them gets it once
+func (cli *Client) SendMsg(recipients []uint64, body []byte, opts ...SendOption) error {
+	return cli.relay(id.NewIDSet(recipients...).String(), body, opts)
+}
+
+// Send sends body to recipients given by ID or nickname and returns the message ID assigned by server.
+// HandleIncomingMessages must be running to receive the ID.
+func (cli *Client) Send(ctx context.Context, recipients []string, body []byte, opts ...SendOption) (uint64, error) {
+	ref, respCh := cli.addPending(1)
+	defer cli.removePending(ref)
+
+	if err := cli.relay(strings.Join(recipients, ","), body, append(opts, withRef(ref))); err != nil {
+		return 0, err
+	}
+
+	select {
+	case resp := <-respCh:
+		return resp.msgID, resp.err
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+// Cancel drops a message scheduled with WithDelay or At before server delivers it.
+// HandleIncomingMessages must be running to receive the answer.
+func (cli *Client) Cancel(ctx context.Context, msgID uint64) error {
+	key := cancelKey(msgID)
+	respCh := make(chan response, 1)
+	cli.rm.Lock()
+	if cli.pending == nil {
+		cli.pending = make(map[string]chan response)
+	}
+	cli.pending[key] = respCh
+	cli.rm.Unlock()
+	defer cli.removePending(key)
+
+	if err := (message.Cancel{MsgID: msgID}).Encode(cli.conn); err != nil {
+		return err
+	}
+
+	select {
+	case resp := <-respCh:
+		return resp.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
-// SendMsg sends body to recipients
-func (cli *Client) SendMsg(recipients []uint64, body []byte) error {
-	receivers := id.JoinIDArray(recipients, ",")
-	msg := fmt.Sprintf("%s %s %d\n%s", message.RelayType, receivers, len(body), string(body))
+func cancelKey(msgID uint64) string {
+	return message.CancelType + "/" + strconv.FormatUint(msgID, 10)
+}
+
+// HandleRejected registers h to be told about sent messages dropped by server
+// as their receiver was out of credit, see WithRejectOverCredit
+func (cli *Client) HandleRejected(h RejectedHandler) {
+	cli.rm.Lock()
+	defer cli.rm.Unlock()
+
+	cli.rejected = h
+}
+
+// HandleDenied registers h to be told about sent messages the policy of server denied to some receivers
+func (cli *Client) HandleDenied(h DeniedHandler) {
+	cli.rm.Lock()
+	defer cli.rm.Unlock()
+
+	cli.denied = h
+}
+
+// HandleExpired registers h to be told about sent messages which expired, see NotifyExpired
+func (cli *Client) HandleExpired(h ExpiredHandler) {
+	cli.rm.Lock()
+	defer cli.rm.Unlock()
+
+	cli.expired = h
+}
 
-	_, err := cli.conn.Write([]byte(msg))
-	return err
+// SendMsgTo sends body to recipients given by ID or nickname
+func (cli *Client) SendMsgTo(recipients []string, body []byte, opts ...SendOption) error {
+	return cli.relay(strings.Join(recipients, ","), body, opts)
+}
+
+// SendMsgToSelector sends body to clients matching label selector such as "role=worker,region=eu"
+func (cli *Client) SendMsgToSelector(selector string, body []byte, opts ...SendOption) error {
+	if _, err := message.ParseSelector(selector); err != nil {
+		return err
+	}
+	return cli.relay(selector, body, opts)
+}
+
+// SendMsgToQueue sends body to exactly one member of queue group
+func (cli *Client) SendMsgToQueue(group string, body []byte, opts ...SendOption) error {
+	return cli.relay(message.QueuePrefix+group, body, opts)
+}
+
+func (cli *Client) relay(receivers string, body []byte, opts []SendOption) error {
+	fields, err := fieldsOf(opts)
+	if err != nil {
+		return err
+	}
+	return message.Relay{Receivers: receivers, Fields: fields, Body: body}.Encode(cli.conn)
+}
+
+// JoinQueue makes the client a member of queue group
+func (cli *Client) JoinQueue(group string) error {
+	if err := (message.QueueJoin{Group: group}).Encode(cli.conn); err != nil {
+		return err
+	}
+
+	var reply message.QueueJoin
+	if err := reply.Decode(cli.r); err != nil {
+		return err
+	}
+	if reply.Group != group {
+		return fmt.Errorf("Unexpected reply: %+v", reply)
+	}
+	return nil
+}
+
+// LeaveQueue stops queue group deliveries to the client
+func (cli *Client) LeaveQueue(group string) error {
+	if err := (message.QueueLeave{Group: group}).Encode(cli.conn); err != nil {
+		return err
+	}
+
+	var reply message.QueueLeave
+	if err := reply.Decode(cli.r); err != nil {
+		return err
+	}
+	if reply.Group != group {
+		return fmt.Errorf("Unexpected reply: %+v", reply)
+	}
+	return nil
+}
+
+// Ack tells server message msgID has been processed
+func (cli *Client) Ack(msgID uint64) error {
+	return message.Ack{MsgID: msgID}.Encode(cli.conn)
+}
+
+// readReply reads a reply line and turns error replies into errors
+func (cli *Client) readReply() (string, error) {
+	line, err := cli.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(line, message.ErrorType+" ") {
+		return "", errors.New(strings.TrimSuffix(line[len(message.ErrorType)+1:], "\n"))
+	}
+	if strings.HasPrefix(line, message.BusyType+" ") {
+		return "", errors.New(strings.TrimSuffix(line, "\n"))
+	}
+	return line, nil
 }
 
 // HandleIncomingMessages handle incoming relayed message from server
-// should run in other goroutine
+// should run in other goroutine.
+// Messages requiring an ack are acked once handed to writeCh,
+// unless the client was created with WithManualAck.
 func (cli *Client) HandleIncomingMessages(writeCh chan<- IncomingMessage) {
 	for {
-		line, err := cli.r.ReadString('\n')
+		typ, err := message.PeekType(cli.r)
 		if err != nil {
 			log.Printf("[%d] Client error: %s\n", cli.id, err.Error())
 			return
 		}
-
-		parts := strings.SplitN(line[:len(line)-1], " ", 2)
-		switch parts[0] {
-		case message.RelayType:
-			var size int
-			var sender uint64
-
-			if _, err = fmt.Sscanf(parts[1], "%d %d", &sender, &size); err != nil {
-				log.Printf("Message in wrong format: %s\n", err.Error())
+		if typ != message.RelayType {
+			line, err := cli.r.ReadString('\n')
+			if err != nil {
+				log.Printf("[%d] Client error: %s\n", cli.id, err.Error())
 				return
 			}
+			cli.handleLine(typ, line)
+			continue
+		}
 
-			data := make([]byte, size)
-			if _, err = io.ReadFull(cli.r, data); err != nil {
-				log.Printf("Cannot read full data: %s\n", err.Error())
+		msg, fields, err := cli.readMessage()
+		if err != nil {
+			log.Printf("Message in wrong format: %s\n", err.Error())
+			return
+		}
+
+		consumed := cli.handleRPC(msg, fields)
+		if !consumed {
+			writeCh <- msg
+		}
+		if msg.AckRequired && (consumed || !cli.manualAck) {
+			if err := cli.Ack(msg.ID); err != nil {
+				log.Printf("[%d] Cannot ack message %d: %s\n", cli.id, msg.ID, err.Error())
 				return
 			}
+		}
+		if err := cli.consumed(len(msg.Body)); err != nil {
+			log.Printf("[%d] Cannot grant credit: %s\n", cli.id, err.Error())
+			return
+		}
+	}
+}
+
+// readMessage reads a relay frame, it returns the fields of the frame along the message
+func (cli *Client) readMessage() (IncomingMessage, map[string]string, error) {
+	var delivery message.Delivery
+	if err := delivery.Decode(cli.r); err != nil {
+		return IncomingMessage{}, nil, err
+	}
+	fields := delivery.Fields
 
-			writeCh <- IncomingMessage{SenderID: sender, Body: data}
-		default:
-			log.Println("Unknown message")
+	headers, err := message.Headers(fields)
+	if err != nil {
+		return IncomingMessage{}, nil, err
+	}
+
+	msg := IncomingMessage{
+		SenderID:    delivery.SenderID,
+		Body:        delivery.Body,
+		AckRequired: fields[message.FieldAck] == "1",
+		Group:       fields[message.FieldGroup],
+		Redelivered: fields[message.FieldRedelivered] == "1",
+
+		CorrelationID: fields[message.FieldCorr],
+		Headers:       headers,
+	}
+	if msgID, ok := fields[message.FieldID]; ok {
+		if msg.ID, err = strconv.ParseUint(msgID, 10, 64); err != nil {
+			return IncomingMessage{}, nil, err
+		}
+	}
+	if replyTo, ok := fields[message.FieldReplyTo]; ok {
+		if msg.ReplyTo, err = strconv.ParseUint(replyTo, 10, 64); err != nil {
+			return IncomingMessage{}, nil, err
+		}
+	}
+	return msg, fields, nil
+}
+
+// handleLine handles server notices and errors which are not relay frames
+func (cli *Client) handleLine(typ, line string) {
+	switch typ {
+	case message.TimeoutType:
+		var notice message.Timeout
+		if err := notice.DecodeLine(line); err != nil {
+			log.Printf("Notice in wrong format: %q\n", line)
+			return
+		}
+		cli.handleNotice(typ, notice.CorrelationID, notice.ReceiverIDs)
+	case message.NoResponderType:
+		var notice message.NoResponder
+		if err := notice.DecodeLine(line); err != nil {
+			log.Printf("Notice in wrong format: %q\n", line)
+			return
+		}
+		cli.handleNotice(typ, notice.CorrelationID, nil)
+	case message.UnreachableType:
+		var notice message.Unreachable
+		if err := notice.DecodeLine(line); err != nil {
+			log.Printf("Notice in wrong format: %q\n", line)
+			return
+		}
+		cli.handleNotice(typ, notice.CorrelationID, notice.ReceiverIDs)
+	case message.RelayedType:
+		var relayed message.Relayed
+		if err := relayed.DecodeLine(line); err != nil {
+			log.Printf("Message in wrong format: %s\n", err.Error())
+			return
+		}
+		cli.resolve(relayed.Ref, response{msgID: relayed.MsgID})
+	case message.CancelType:
+		var reply message.CancelReply
+		if err := reply.DecodeLine(line); err != nil {
+			log.Printf("Message in wrong format: %s\n", err.Error())
+			return
+		}
+		resp := response{msgID: reply.MsgID}
+		if !reply.Canceled {
+			resp.err = ErrUnknownMessage
+		}
+		cli.resolve(cancelKey(reply.MsgID), resp)
+	case message.ExpiredType:
+		var notice message.Expired
+		if err := notice.DecodeLine(line); err != nil {
+			log.Printf("Message in wrong format: %s\n", err.Error())
+			return
+		}
+		cli.rm.Lock()
+		handler := cli.expired
+		cli.rm.Unlock()
+		if handler != nil {
+			handler(notice.MsgID, notice.ReceiverID)
+		}
+	case message.RejectedType:
+		var notice message.Rejected
+		if err := notice.DecodeLine(line); err != nil {
+			log.Printf("Message in wrong format: %s\n", err.Error())
+			return
+		}
+		cli.rm.Lock()
+		handler := cli.rejected
+		cli.rm.Unlock()
+		if handler != nil {
+			handler(notice.MsgID, notice.ReceiverID)
+		}
+	case message.DeniedType:
+		var notice message.Denied
+		if err := notice.DecodeLine(line); err != nil {
+			log.Printf("Message in wrong format: %s\n", err.Error())
+			return
+		}
+		cli.rm.Lock()
+		handler := cli.denied
+		cli.rm.Unlock()
+		if handler != nil {
+			handler(notice.MsgID, notice.Receivers)
 		}
+	case message.ErrorType:
+		var reply message.Error
+		reply.DecodeLine(line)
+		log.Printf("[%d] Server error: %s\n", cli.id, reply.Text)
+	case message.BusyType:
+		var notice message.Busy
+		notice.DecodeLine(line)
+		log.Printf("[%d] Server busy: %s\n", cli.id, notice.Reason)
+	default:
+		log.Println("Unknown message")
 	}
 }
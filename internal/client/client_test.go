@@ -2,10 +2,15 @@ package client
 
 import (
 	"bufio"
+	"context"
+	"fmt"
 	"io"
 	"net"
+	"strconv"
 	"testing"
+	"time"
 
+	"github.com/badboyd/tcp-hub/pkg/message"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -93,6 +98,332 @@ func TestSendMsg(t *testing.T) {
 	require.NoError(t, cli.SendMsg([]uint64{1, 2}, []byte("hello")))
 }
 
+func TestSetNick(t *testing.T) {
+	cli, srvConn := createTestClient(t)
+	defer cli.Close()
+
+	go func() {
+		defer srvConn.Close()
+
+		r := bufio.NewReader(srvConn)
+		cmd, err := r.ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, "nick alice\n", cmd)
+
+		_, err = srvConn.Write([]byte("nick alice\n"))
+		require.NoError(t, err)
+
+		cmd, err = r.ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, "nick bob\n", cmd)
+
+		_, err = srvConn.Write([]byte("error name already taken\n"))
+		require.NoError(t, err)
+	}()
+
+	require.NoError(t, cli.SetNick("alice"))
+	assert.EqualError(t, cli.SetNick("bob"), "name already taken")
+}
+
+func TestWhoIs(t *testing.T) {
+	cli, srvConn := createTestClient(t)
+	defer cli.Close()
+
+	go func() {
+		defer srvConn.Close()
+
+		cmd, err := bufio.NewReader(srvConn).ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, "whois alice\n", cmd)
+
+		_, err = srvConn.Write([]byte("whois 3 alice\n"))
+		require.NoError(t, err)
+	}()
+
+	id, name, err := cli.WhoIs("alice")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), id)
+	assert.Equal(t, "alice", name)
+}
+
+func TestListClients(t *testing.T) {
+	cli, srvConn := createTestClient(t)
+	defer cli.Close()
+
+	go func() {
+		defer srvConn.Close()
+
+		cmd, err := bufio.NewReader(srvConn).ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, "list names\n", cmd)
+
+		_, err = srvConn.Write([]byte("list 1:alice,2\n"))
+		require.NoError(t, err)
+	}()
+
+	clients, err := cli.ListClients()
+	require.NoError(t, err)
+	assert.Equal(t, []ClientInfo{{ID: 1, Name: "alice"}, {ID: 2}}, clients)
+}
+
+func TestSendMsgTo(t *testing.T) {
+	cli, srvConn := createTestClient(t)
+	defer cli.Close()
+
+	go func() {
+		defer srvConn.Close()
+
+		expectedMsg := "relay alice,2 5\nhello"
+		msg := make([]byte, len(expectedMsg))
+
+		_, err := io.ReadFull(srvConn, msg)
+		require.NoError(t, err)
+		assert.Equal(t, expectedMsg, string(msg))
+	}()
+
+	require.NoError(t, cli.SendMsgTo([]string{"alice", "2"}, []byte("hello")))
+}
+
+func TestSetLabels(t *testing.T) {
+	cli, srvConn := createTestClient(t)
+	defer cli.Close()
+
+	go func() {
+		defer srvConn.Close()
+
+		cmd, err := bufio.NewReader(srvConn).ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, "labels region=eu,role=worker\n", cmd)
+
+		_, err = srvConn.Write([]byte("labels region=eu,role=worker\n"))
+		require.NoError(t, err)
+	}()
+
+	require.NoError(t, cli.SetLabels(map[string]string{"role": "worker", "region": "eu"}))
+}
+
+func TestSendMsgToSelector(t *testing.T) {
+	cli, srvConn := createTestClient(t)
+	defer cli.Close()
+
+	go func() {
+		defer srvConn.Close()
+
+		expectedMsg := "relay role=worker,region=eu 5\nhello"
+		msg := make([]byte, len(expectedMsg))
+
+		_, err := io.ReadFull(srvConn, msg)
+		require.NoError(t, err)
+		assert.Equal(t, expectedMsg, string(msg))
+	}()
+
+	assert.Error(t, cli.SendMsgToSelector("role", []byte("hello")))
+	require.NoError(t, cli.SendMsgToSelector("role=worker,region=eu", []byte("hello")))
+}
+
+func TestJoinQueue(t *testing.T) {
+	cli, srvConn := createTestClient(t)
+	defer cli.Close()
+
+	go func() {
+		defer srvConn.Close()
+
+		r := bufio.NewReader(srvConn)
+		cmd, err := r.ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, "qjoin jobs\n", cmd)
+
+		_, err = srvConn.Write([]byte("qjoin jobs\n"))
+		require.NoError(t, err)
+
+		cmd, err = r.ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, "qleave jobs\n", cmd)
+
+		_, err = srvConn.Write([]byte("error not a member of queue group\n"))
+		require.NoError(t, err)
+	}()
+
+	require.NoError(t, cli.JoinQueue("jobs"))
+	assert.EqualError(t, cli.LeaveQueue("jobs"), "not a member of queue group")
+}
+
+func TestSendMsgToQueue(t *testing.T) {
+	cli, srvConn := createTestClient(t)
+	defer cli.Close()
+
+	go func() {
+		defer srvConn.Close()
+
+		expectedMsg := "relay @jobs 5 key=user42 pick=hash\nhello"
+		msg := make([]byte, len(expectedMsg))
+
+		_, err := io.ReadFull(srvConn, msg)
+		require.NoError(t, err)
+		assert.Equal(t, expectedMsg, string(msg))
+	}()
+
+	require.NoError(t, cli.SendMsgToQueue("jobs", []byte("hello"), PickHash("user42")))
+}
+
+func TestHandleIncomingQueueMessages(t *testing.T) {
+	cli, srvConn := createTestClient(t)
+	defer cli.Close()
+
+	acked := make(chan string)
+	go func() {
+		defer srvConn.Close()
+
+		_, err := srvConn.Write([]byte("relay 2 5 ack=1 group=jobs id=7 redelivered=1\nhello"))
+		require.NoError(t, err)
+
+		ack, err := bufio.NewReader(srvConn).ReadString('\n')
+		require.NoError(t, err)
+		acked <- ack
+	}()
+
+	clientChan := make(chan IncomingMessage)
+	defer close(clientChan)
+
+	go cli.HandleIncomingMessages(clientChan)
+
+	receivedMsg := <-clientChan
+	assert.Equal(t, IncomingMessage{SenderID: 2, Body: []byte("hello"), ID: 7, AckRequired: true, Group: "jobs", Redelivered: true}, receivedMsg)
+	assert.Equal(t, "ack 7\n", <-acked)
+}
+
+func TestManualAck(t *testing.T) {
+	cli, srvConn := createTestClient(t)
+	defer cli.Close()
+	WithManualAck()(cli)
+
+	go func() {
+		defer srvConn.Close()
+
+		_, err := srvConn.Write([]byte("relay 2 5 ack=1 id=7\nhello"))
+		require.NoError(t, err)
+
+		expectedMsg := "relay 2 5 qos=1\nhello"
+		msg := make([]byte, len(expectedMsg))
+		_, err = io.ReadFull(srvConn, msg)
+		require.NoError(t, err)
+		assert.Equal(t, expectedMsg, string(msg))
+
+		ack, err := bufio.NewReader(srvConn).ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, "ack 7\n", ack)
+	}()
+
+	clientChan := make(chan IncomingMessage)
+	defer close(clientChan)
+
+	go cli.HandleIncomingMessages(clientChan)
+
+	receivedMsg := <-clientChan
+	assert.True(t, receivedMsg.AckRequired)
+
+	// nothing is acked until the application does it
+	require.NoError(t, cli.SendMsg([]uint64{2}, []byte("hello"), AtLeastOnce()))
+	require.NoError(t, cli.Ack(receivedMsg.ID))
+}
+
+func TestSendMsgWithHeaders(t *testing.T) {
+	cli, srvConn := createTestClient(t)
+	defer cli.Close()
+
+	go func() {
+		defer srvConn.Close()
+
+		expectedMsg := "relay 2 5 h.trace=a+b h.type=text%2Fplain\nhello"
+		msg := make([]byte, len(expectedMsg))
+
+		_, err := io.ReadFull(srvConn, msg)
+		require.NoError(t, err)
+		assert.Equal(t, expectedMsg, string(msg))
+	}()
+
+	headers := map[string]string{}
+	for i := 0; i <= message.MaxHeaders; i++ {
+		headers[strconv.Itoa(i)] = "v"
+	}
+	assert.Equal(t, message.ErrTooManyHeaders, cli.SendMsg([]uint64{2}, []byte("hello"), WithHeaders(headers)))
+
+	require.NoError(t, cli.SendMsg([]uint64{2}, []byte("hello"), WithHeaders(map[string]string{"trace": "a b", "type": "text/plain"})))
+}
+
+func TestSendMsgWithPriority(t *testing.T) {
+	cli, srvConn := createTestClient(t)
+	defer cli.Close()
+
+	go func() {
+		defer srvConn.Close()
+
+		expectedMsg := "relay 2 4 prio=high\nping" + "relay 2 4 prio=bulk\ndump"
+		msg := make([]byte, len(expectedMsg))
+
+		_, err := io.ReadFull(srvConn, msg)
+		require.NoError(t, err)
+		assert.Equal(t, expectedMsg, string(msg))
+	}()
+
+	require.NoError(t, cli.SendMsg([]uint64{2}, []byte("ping"), HighPriority()))
+	require.NoError(t, cli.SendMsg([]uint64{2}, []byte("dump"), BulkPriority()))
+}
+
+func TestHandleIncomingMessagesWithHeaders(t *testing.T) {
+	cli, srvConn := createTestClient(t)
+	defer cli.Close()
+
+	go func() {
+		defer srvConn.Close()
+
+		_, err := srvConn.Write([]byte("relay 2 5 h.trace=a+b id=1\nhello"))
+		require.NoError(t, err)
+	}()
+
+	clientChan := make(chan IncomingMessage)
+	defer close(clientChan)
+
+	go cli.HandleIncomingMessages(clientChan)
+
+	receivedMsg := <-clientChan
+	assert.Equal(t, map[string]string{"trace": "a b"}, receivedMsg.Headers)
+}
+
+func TestSend(t *testing.T) {
+	cli, srvConn := createTestClient(t)
+	defer cli.Close()
+
+	go func() {
+		defer srvConn.Close()
+
+		expectedMsg := "relay alice 5 notify=expired ref=1 ttl=1500\nhello"
+		msg := make([]byte, len(expectedMsg))
+
+		_, err := io.ReadFull(srvConn, msg)
+		require.NoError(t, err)
+		assert.Equal(t, expectedMsg, string(msg))
+
+		_, err = srvConn.Write([]byte("relayed 1 42\nexpired 42 3\n"))
+		require.NoError(t, err)
+	}()
+
+	expired := make(chan [2]uint64, 1)
+	cli.HandleExpired(func(msgID, receiverID uint64) {
+		expired <- [2]uint64{msgID, receiverID}
+	})
+
+	clientChan := make(chan IncomingMessage)
+	defer close(clientChan)
+
+	go cli.HandleIncomingMessages(clientChan)
+
+	msgID, err := cli.Send(context.Background(), []string{"alice"}, []byte("hello"), WithTTL(1500*time.Millisecond), NotifyExpired())
+	require.NoError(t, err)
+	assert.Equal(t, uint64(42), msgID)
+	assert.Equal(t, [2]uint64{42, 3}, <-expired)
+}
+
 func TestHandleIncomingMessages(t *testing.T) {
 	cli, srvConn := createTestClient(t)
 	defer cli.Close()
@@ -124,3 +455,95 @@ func createTestClient(t *testing.T) (*Client, net.Conn) {
 
 	return &cli, srvConn
 }
+
+func TestCancel(t *testing.T) {
+	cli, srvConn := createTestClient(t)
+	defer cli.Close()
+
+	go func() {
+		defer srvConn.Close()
+
+		r := bufio.NewReader(srvConn)
+		expectedMsg := "relay alice 5 delay=1500 ref=1\nhello"
+		msg := make([]byte, len(expectedMsg))
+		_, err := io.ReadFull(r, msg)
+		require.NoError(t, err)
+		assert.Equal(t, expectedMsg, string(msg))
+		_, err = srvConn.Write([]byte("relayed 1 42\n"))
+		require.NoError(t, err)
+
+		for _, reply := range []string{"cancel 42 ok\n", "cancel 42 unknown\n"} {
+			line, err := r.ReadString('\n')
+			require.NoError(t, err)
+			assert.Equal(t, "cancel 42\n", line)
+			_, err = srvConn.Write([]byte(reply))
+			require.NoError(t, err)
+		}
+	}()
+
+	clientChan := make(chan IncomingMessage)
+	defer close(clientChan)
+
+	go cli.HandleIncomingMessages(clientChan)
+
+	msgID, err := cli.Send(context.Background(), []string{"alice"}, []byte("hello"), WithDelay(1500*time.Millisecond))
+	require.NoError(t, err)
+	assert.NoError(t, cli.Cancel(context.Background(), msgID))
+	assert.Equal(t, ErrUnknownMessage, cli.Cancel(context.Background(), msgID))
+}
+
+func TestCredit(t *testing.T) {
+	cli, srvConn := createTestClient(t)
+	defer cli.Close()
+	WithCredit(4, 0)(cli)
+	WithRejectOverCredit()(cli)
+
+	go func() {
+		defer srvConn.Close()
+
+		_, err := srvConn.Write([]byte("relay 2 3\none" + "relay 2 3\ntwo" + "rejected 42 3\n"))
+		require.NoError(t, err)
+
+		line, err := bufio.NewReader(srvConn).ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, "credit 2 0 reject\n", line)
+	}()
+
+	rejected := make(chan [2]uint64, 1)
+	cli.HandleRejected(func(msgID, receiverID uint64) {
+		rejected <- [2]uint64{msgID, receiverID}
+	})
+
+	clientChan := make(chan IncomingMessage)
+	defer close(clientChan)
+
+	go cli.HandleIncomingMessages(clientChan)
+
+	assert.Equal(t, []byte("one"), (<-clientChan).Body)
+	assert.Equal(t, []byte("two"), (<-clientChan).Body)
+	assert.Equal(t, [2]uint64{42, 3}, <-rejected)
+}
+
+func TestHandleDenied(t *testing.T) {
+	cli, srvConn := createTestClient(t)
+	defer cli.Close()
+
+	go func() {
+		defer srvConn.Close()
+		_, err := srvConn.Write([]byte("denied 42 3,5\n" + "denied 43 @jobs\n"))
+		require.NoError(t, err)
+	}()
+
+	denied := make(chan string, 2)
+	cli.HandleDenied(func(msgID uint64, receivers string) {
+		denied <- fmt.Sprintf("%d %s", msgID, receivers)
+	})
+
+	clientChan := make(chan IncomingMessage)
+	defer close(clientChan)
+
+	go cli.HandleIncomingMessages(clientChan)
+
+	assert.Equal(t, "42 3,5", <-denied)
+	assert.Equal(t, "43 @jobs", <-denied)
+}
@@ -0,0 +1,158 @@
+package client
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/badboyd/tcp-hub/pkg/message"
+)
+
+// Option configures a Client
+type Option func(*Client)
+
+// WithManualAck leaves acking received messages to the application through Client.Ack
+func WithManualAck() Option {
+	return func(cli *Client) {
+		cli.manualAck = true
+	}
+}
+
+// WithCredit makes server push at most messages messages or bytes body bytes
+// the application did not consume yet, 0 leaves that dimension unlimited.
+// Further messages wait in server until HandleIncomingMessages grants credit back.
+func WithCredit(messages, bytes int64) Option {
+	return func(cli *Client) {
+		cli.creditMsgs = messages
+		cli.creditBytes = bytes
+	}
+}
+
+// WithRejectOverCredit makes server drop messages beyond the credit given by WithCredit
+// instead of keeping them, their senders are told through Client.HandleRejected
+func WithRejectOverCredit() Option {
+	return func(cli *Client) {
+		cli.rejectOverCredit = true
+	}
+}
+
+// WithPullMode makes server keep messages for the client until it reads them with Client.Fetch
+func WithPullMode() Option {
+	return func(cli *Client) {
+		cli.pullMode = true
+	}
+}
+
+// SendOption sets optional relay fields of a sent message
+type SendOption func(fields map[string]string)
+
+// AtLeastOnce asks server to redeliver the message until the receiver acks it
+func AtLeastOnce() SendOption {
+	return func(fields map[string]string) {
+		fields[message.FieldQoS] = "1"
+	}
+}
+
+// WithTTL drops the message when it cannot be delivered within ttl
+func WithTTL(ttl time.Duration) SendOption {
+	return func(fields map[string]string) {
+		ms := ttl.Milliseconds()
+		if ms < 1 {
+			ms = 1
+		}
+		fields[message.FieldTTL] = strconv.FormatInt(ms, 10)
+	}
+}
+
+// NotifyExpired asks server to tell the sender when the message expires, see Client.HandleExpired
+func NotifyExpired() SendOption {
+	return func(fields map[string]string) {
+		fields[message.FieldNotify] = message.NotifyExpired
+	}
+}
+
+// WithDelay asks server to deliver the message after delay, see Client.Cancel
+func WithDelay(delay time.Duration) SendOption {
+	return func(fields map[string]string) {
+		fields[message.FieldDelay] = strconv.FormatInt(delay.Milliseconds(), 10)
+	}
+}
+
+// At asks server to deliver the message at t, see Client.Cancel
+func At(t time.Time) SendOption {
+	return func(fields map[string]string) {
+		fields[message.FieldAt] = strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10)
+	}
+}
+
+// PickRoundRobin delivers a queue group message to members in turn
+func PickRoundRobin() SendOption {
+	return func(fields map[string]string) {
+		fields[message.FieldPick] = message.PickRoundRobin
+	}
+}
+
+// PickLeastLoaded delivers a queue group message to the member with the fewest unacked messages
+func PickLeastLoaded() SendOption {
+	return func(fields map[string]string) {
+		fields[message.FieldPick] = message.PickLeastLoaded
+	}
+}
+
+// PickHash delivers queue group messages with the same key to the same member
+func PickHash(key string) SendOption {
+	return func(fields map[string]string) {
+		fields[message.FieldPick] = message.PickHash
+		fields[message.FieldKey] = key
+	}
+}
+
+// HighPriority delivers the message ahead of normal and bulk messages queued for the same receiver
+func HighPriority() SendOption {
+	return func(fields map[string]string) {
+		fields[message.FieldPriority] = message.PriorityHigh
+	}
+}
+
+// BulkPriority delivers the message after high and normal messages queued for the same receiver
+func BulkPriority() SendOption {
+	return func(fields map[string]string) {
+		fields[message.FieldPriority] = message.PriorityBulk
+	}
+}
+
+// WithHeaders attaches key/value headers to the message, receivers get them in IncomingMessage.Headers
+func WithHeaders(headers map[string]string) SendOption {
+	return func(fields map[string]string) {
+		for k, v := range headers {
+			fields[message.HeaderPrefix+k] = v
+		}
+	}
+}
+
+// fieldsOf applies opts and returns the resulting relay fields
+func fieldsOf(opts []SendOption) (map[string]string, error) {
+	if len(opts) == 0 {
+		return nil, nil
+	}
+
+	fields := make(map[string]string, len(opts))
+	for _, opt := range opts {
+		opt(fields)
+	}
+
+	// headers are escaped once all options are applied
+	headers := map[string]string{}
+	for k, v := range fields {
+		if message.IsHeader(k) {
+			headers[k[len(message.HeaderPrefix):]] = v
+			delete(fields, k)
+		}
+	}
+	if err := message.AddHeaders(fields, headers); err != nil {
+		return nil, err
+	}
+	if err := message.CheckHeaders(fields); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
@@ -0,0 +1,86 @@
+package client
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/badboyd/tcp-hub/pkg/message"
+)
+
+func (cli *Client) sendMode(mode string) error {
+	if err := (message.Mode{Mode: mode}).Encode(cli.conn); err != nil {
+		return err
+	}
+
+	var reply message.Mode
+	if err := reply.Decode(cli.r); err != nil {
+		return err
+	}
+	if reply.Mode != mode {
+		return fmt.Errorf("Unexpected reply: %+v", reply)
+	}
+	return nil
+}
+
+// Fetch returns up to max messages kept by server for a client created with WithPullMode,
+// waiting up to wait for the first one. It must not run along HandleIncomingMessages.
+// Messages requiring an ack are acked once returned, unless the client was created with WithManualAck.
+func (cli *Client) Fetch(max int, wait time.Duration) ([]IncomingMessage, error) {
+	if err := (message.Fetch{Max: max, Wait: wait}).Encode(cli.conn); err != nil {
+		return nil, err
+	}
+
+	msgs := []IncomingMessage{}
+	for {
+		typ, err := message.PeekType(cli.r)
+		if err != nil {
+			return nil, err
+		}
+		if typ == message.RelayType {
+			// pushed before the client switched to pull mode
+			msg, _, err := cli.readMessage()
+			if err != nil {
+				return nil, err
+			}
+			msgs = append(msgs, msg)
+			continue
+		}
+
+		line, err := cli.readReply()
+		if err != nil {
+			return nil, err
+		}
+
+		switch typ {
+		case message.FetchType:
+			var reply message.FetchReply
+			if err := reply.DecodeLine(line); err != nil {
+				return nil, err
+			}
+			for i := 0; i < reply.Count; i++ {
+				msg, _, err := cli.readMessage()
+				if err != nil {
+					return nil, err
+				}
+				msgs = append(msgs, msg)
+			}
+			return msgs, cli.ackFetched(msgs)
+		default:
+			cli.handleLine(typ, line)
+		}
+	}
+}
+
+func (cli *Client) ackFetched(msgs []IncomingMessage) error {
+	if cli.manualAck {
+		return nil
+	}
+	for _, msg := range msgs {
+		if msg.AckRequired {
+			if err := cli.Ack(msg.ID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
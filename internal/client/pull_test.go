@@ -0,0 +1,44 @@
+package client
+
+import (
+	"bufio"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFetch(t *testing.T) {
+	cli, srvConn := createTestClient(t)
+	defer cli.Close()
+
+	go func() {
+		defer srvConn.Close()
+
+		r := bufio.NewReader(srvConn)
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, "fetch 10 500\n", line)
+
+		_, err = srvConn.Write([]byte("expired 7 3\n" + "fetch 2\n" + "relay 2 3 ack=1 id=8\none" + "relay 2 3 id=9\ntwo"))
+		require.NoError(t, err)
+
+		line, err = r.ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, "ack 8\n", line)
+	}()
+
+	expired := make(chan uint64, 1)
+	cli.HandleExpired(func(msgID, receiverID uint64) {
+		expired <- msgID
+	})
+
+	msgs, err := cli.Fetch(10, 500*time.Millisecond)
+	require.NoError(t, err)
+	require.Len(t, msgs, 2)
+	assert.Equal(t, uint64(8), msgs[0].ID)
+	assert.Equal(t, []byte("one"), msgs[0].Body)
+	assert.Equal(t, []byte("two"), msgs[1].Body)
+	assert.Equal(t, uint64(7), <-expired)
+}
@@ -0,0 +1,290 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/badboyd/tcp-hub/pkg/id"
+	"github.com/badboyd/tcp-hub/pkg/message"
+)
+
+var (
+	// ErrRequestTimeout is returned when the responder did not answer in time
+	ErrRequestTimeout = errors.New("request timed out")
+	// ErrNoResponder is returned when no target of a request is connected
+	ErrNoResponder = errors.New("no responder")
+	// ErrUnreachable is returned for a target that is not connected
+	ErrUnreachable = errors.New("target unreachable")
+	// ErrNoAnswer is set for targets Gather stopped waiting for once its options were satisfied
+	ErrNoAnswer = errors.New("no answer")
+	// ErrQuorumNotReached is returned by Gather when too few targets answered successfully
+	ErrQuorumNotReached = errors.New("quorum not reached")
+	// ErrUnknownMessage is returned by Cancel when the message is not scheduled anymore
+	ErrUnknownMessage = errors.New("unknown scheduled message")
+)
+
+// RequestHandler answers a request, a returned error is sent back to the requester
+type RequestHandler func(req IncomingMessage) ([]byte, error)
+
+// Response is the answer of one target of Gather
+type Response struct {
+	Body []byte
+	Err  error
+}
+
+// GatherOptions tells Gather when to stop waiting before the deadline of its context
+type GatherOptions struct {
+	// Quorum stops gathering once this many targets answered successfully
+	Quorum int
+	// Count stops gathering once this many targets answered, successfully or not
+	Count int
+}
+
+// response is a response or a server notice about a pending request
+type response struct {
+	from uint64
+	body []byte
+	err  error
+	// notice is the server notice type, ids are the targets it is about
+	notice string
+	ids    []uint64
+	// msgID answers a relay sent by Send
+	msgID uint64
+}
+
+// Request sends body to target and waits for its response.
+// The deadline of ctx is passed to server, which reports a timeout when it passes.
+// HandleIncomingMessages must be running to receive the response.
+func (cli *Client) Request(ctx context.Context, target uint64, body []byte) ([]byte, error) {
+	corr, respCh := cli.addPending(1)
+	defer cli.removePending(corr)
+
+	if err := cli.relay(strconv.FormatUint(target, 10), body, requestOptions(ctx, corr)); err != nil {
+		return nil, err
+	}
+
+	select {
+	case resp := <-respCh:
+		return resp.body, resp.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Gather sends body to every target and collects their responses until
+// every target answered, opts are satisfied or ctx is done.
+// Every target has an entry in the result, those which did not answer hold an error.
+// HandleIncomingMessages must be running to receive the responses.
+func (cli *Client) Gather(ctx context.Context, targets []uint64, body []byte, opts GatherOptions) (map[uint64]Response, error) {
+	corr, respCh := cli.addPending(2*len(targets) + 1)
+	defer cli.removePending(corr)
+
+	if err := cli.relay(id.JoinIDArray(targets, ","), body, requestOptions(ctx, corr)); err != nil {
+		return nil, err
+	}
+
+	results := make(map[uint64]Response, len(targets))
+	isTarget := make(map[uint64]bool, len(targets))
+	for _, target := range targets {
+		isTarget[target] = true
+	}
+	fail := func(ids []uint64, err error) {
+		for _, target := range ids {
+			if _, ok := results[target]; !ok && isTarget[target] {
+				results[target] = Response{Err: err}
+			}
+		}
+	}
+
+	answered, succeeded := 0, 0
+	done := func() bool {
+		return len(results) == len(isTarget) ||
+			(opts.Quorum > 0 && succeeded >= opts.Quorum) ||
+			(opts.Count > 0 && answered >= opts.Count)
+	}
+
+Gathering:
+	for !done() {
+		select {
+		case resp := <-respCh:
+			switch resp.notice {
+			case message.NoResponderType:
+				fail(targets, ErrNoResponder)
+			case message.UnreachableType:
+				fail(resp.ids, ErrUnreachable)
+			case message.TimeoutType:
+				fail(targets, ErrRequestTimeout)
+			default:
+				if _, ok := results[resp.from]; ok || !isTarget[resp.from] {
+					continue
+				}
+				results[resp.from] = Response{Body: resp.body, Err: resp.err}
+				answered++
+				if resp.err == nil {
+					succeeded++
+				}
+			}
+		case <-ctx.Done():
+			break Gathering
+		}
+	}
+	if ctx.Err() != nil {
+		fail(targets, ctx.Err())
+	}
+	fail(targets, ErrNoAnswer)
+
+	if opts.Quorum > 0 && succeeded < opts.Quorum {
+		return results, ErrQuorumNotReached
+	}
+	return results, nil
+}
+
+// HandleRequests registers h to answer incoming requests.
+// Without a handler requests are passed to HandleIncomingMessages channel
+// and can be answered with Reply.
+func (cli *Client) HandleRequests(h RequestHandler) {
+	cli.rm.Lock()
+	defer cli.rm.Unlock()
+
+	cli.handler = h
+}
+
+// Reply sends body as the response to req
+func (cli *Client) Reply(req IncomingMessage, body []byte) error {
+	return cli.relay(strconv.FormatUint(req.ReplyTo, 10), body, []SendOption{withResponse(req.CorrelationID, false)})
+}
+
+// ReplyError sends err as the response to req
+func (cli *Client) ReplyError(req IncomingMessage, err error) error {
+	return cli.relay(strconv.FormatUint(req.ReplyTo, 10), []byte(err.Error()), []SendOption{withResponse(req.CorrelationID, true)})
+}
+
+func (cli *Client) addPending(size int) (string, chan response) {
+	cli.rm.Lock()
+	defer cli.rm.Unlock()
+
+	if cli.pending == nil {
+		cli.pending = make(map[string]chan response)
+	}
+	cli.corrSeq++
+	corr := strconv.FormatUint(cli.corrSeq, 10)
+	respCh := make(chan response, size)
+	cli.pending[corr] = respCh
+	return corr, respCh
+}
+
+func (cli *Client) removePending(corr string) {
+	cli.rm.Lock()
+	defer cli.rm.Unlock()
+
+	delete(cli.pending, corr)
+}
+
+// resolve hands resp to the request waiting for it
+func (cli *Client) resolve(corr string, resp response) {
+	cli.rm.Lock()
+	respCh, ok := cli.pending[corr]
+	cli.rm.Unlock()
+	if !ok {
+		log.Printf("[%d] Drop response to unknown request %s\n", cli.id, corr)
+		return
+	}
+
+	select {
+	case respCh <- resp:
+	default:
+	}
+}
+
+// handleNotice resolves a server notice about request corr, ids are the receivers it is about
+func (cli *Client) handleNotice(notice, corr string, ids []uint64) {
+	resp := response{notice: notice, ids: ids}
+	switch notice {
+	case message.TimeoutType:
+		resp.err = ErrRequestTimeout
+	case message.NoResponderType:
+		resp.err = ErrNoResponder
+	case message.UnreachableType:
+		resp.err = ErrUnreachable
+	}
+	cli.resolve(corr, resp)
+}
+
+// handleRPC consumes responses and requests having a handler,
+// it reports whether msg was consumed
+func (cli *Client) handleRPC(msg IncomingMessage, fields map[string]string) bool {
+	if msg.CorrelationID == "" {
+		return false
+	}
+	if fields[message.FieldResp] == "1" {
+		resp := response{from: msg.SenderID, body: msg.Body}
+		if fields[message.FieldError] == "1" {
+			resp = response{from: msg.SenderID, err: errors.New(string(msg.Body))}
+		}
+		cli.resolve(msg.CorrelationID, resp)
+		return true
+	}
+
+	cli.rm.Lock()
+	handler := cli.handler
+	cli.rm.Unlock()
+	if handler == nil || msg.ReplyTo == 0 {
+		return false
+	}
+
+	go func() {
+		body, err := handler(msg)
+		if err != nil {
+			err = cli.ReplyError(msg, err)
+		} else {
+			err = cli.Reply(msg, body)
+		}
+		if err != nil {
+			log.Printf("[%d] Cannot reply to request %s: %s\n", cli.id, msg.CorrelationID, err.Error())
+		}
+	}()
+	return true
+}
+
+func requestOptions(ctx context.Context, corr string) []SendOption {
+	opts := []SendOption{withCorrelation(corr)}
+	if deadline, ok := ctx.Deadline(); ok {
+		opts = append(opts, withTimeout(time.Until(deadline)))
+	}
+	return opts
+}
+
+func withRef(ref string) SendOption {
+	return func(fields map[string]string) {
+		fields[message.FieldRef] = ref
+	}
+}
+
+func withCorrelation(corr string) SendOption {
+	return func(fields map[string]string) {
+		fields[message.FieldCorr] = corr
+	}
+}
+
+func withTimeout(d time.Duration) SendOption {
+	return func(fields map[string]string) {
+		ms := d.Milliseconds()
+		if ms < 1 {
+			ms = 1
+		}
+		fields[message.FieldTimeout] = strconv.FormatInt(ms, 10)
+	}
+}
+
+func withResponse(corr string, isErr bool) SendOption {
+	return func(fields map[string]string) {
+		fields[message.FieldCorr] = corr
+		fields[message.FieldResp] = "1"
+		if isErr {
+			fields[message.FieldError] = "1"
+		}
+	}
+}
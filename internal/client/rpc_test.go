@@ -0,0 +1,162 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequest(t *testing.T) {
+	cli, srvConn := createTestClient(t)
+	defer cli.Close()
+
+	go func() {
+		defer srvConn.Close()
+
+		r := bufio.NewReader(srvConn)
+		expectedMsg := "relay 2 4 corr=1\nping"
+		msg := make([]byte, len(expectedMsg))
+		_, err := io.ReadFull(r, msg)
+		require.NoError(t, err)
+		assert.Equal(t, expectedMsg, string(msg))
+
+		_, err = srvConn.Write([]byte("relay 2 4 corr=1 id=5 resp=1\npong"))
+		require.NoError(t, err)
+
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		assert.Contains(t, line, "corr=2 timeout=")
+		_, err = io.ReadFull(r, make([]byte, 4))
+		require.NoError(t, err)
+
+		_, err = srvConn.Write([]byte("timeout 2\n"))
+		require.NoError(t, err)
+
+		_, err = io.ReadFull(r, msg)
+		require.NoError(t, err)
+
+		_, err = srvConn.Write([]byte("noresponder 3\n"))
+		require.NoError(t, err)
+	}()
+
+	clientChan := make(chan IncomingMessage)
+	defer close(clientChan)
+
+	go cli.HandleIncomingMessages(clientChan)
+
+	resp, err := cli.Request(context.Background(), 2, []byte("ping"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("pong"), resp)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	_, err = cli.Request(ctx, 2, []byte("ping"))
+	assert.Equal(t, ErrRequestTimeout, err)
+
+	_, err = cli.Request(context.Background(), 2, []byte("ping"))
+	assert.Equal(t, ErrNoResponder, err)
+}
+
+func TestHandleRequests(t *testing.T) {
+	cli, srvConn := createTestClient(t)
+	defer cli.Close()
+
+	cli.HandleRequests(func(req IncomingMessage) ([]byte, error) {
+		if string(req.Body) != "ping" {
+			return nil, errors.New("bad request")
+		}
+		return []byte("pong"), nil
+	})
+
+	go func() {
+		defer srvConn.Close()
+
+		r := bufio.NewReader(srvConn)
+		_, err := srvConn.Write([]byte("relay 1 4 corr=7 id=1 replyto=1\nping"))
+		require.NoError(t, err)
+
+		expectedMsg := "relay 1 4 corr=7 resp=1\npong"
+		msg := make([]byte, len(expectedMsg))
+		_, err = io.ReadFull(r, msg)
+		require.NoError(t, err)
+		assert.Equal(t, expectedMsg, string(msg))
+
+		_, err = srvConn.Write([]byte("relay 1 4 corr=8 id=2 replyto=1\npong"))
+		require.NoError(t, err)
+
+		expectedMsg = "relay 1 11 corr=8 error=1 resp=1\nbad request"
+		msg = make([]byte, len(expectedMsg))
+		_, err = io.ReadFull(r, msg)
+		require.NoError(t, err)
+		assert.Equal(t, expectedMsg, string(msg))
+
+		// messages without correlation still reach the channel
+		_, err = srvConn.Write([]byte("relay 1 5 id=3\nhello"))
+		require.NoError(t, err)
+	}()
+
+	clientChan := make(chan IncomingMessage)
+	defer close(clientChan)
+
+	go cli.HandleIncomingMessages(clientChan)
+
+	receivedMsg := <-clientChan
+	assert.Equal(t, []byte("hello"), receivedMsg.Body)
+}
+
+func TestGather(t *testing.T) {
+	cli, srvConn := createTestClient(t)
+	defer cli.Close()
+
+	go func() {
+		defer srvConn.Close()
+
+		r := bufio.NewReader(srvConn)
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		assert.Contains(t, line, "relay 2,3,4,5 4 corr=1 timeout=")
+		_, err = io.ReadFull(r, make([]byte, 4))
+		require.NoError(t, err)
+
+		_, err = srvConn.Write([]byte("unreachable 1 5\n" +
+			"relay 2 4 corr=1 id=1 resp=1\npong" +
+			"relay 3 4 corr=1 error=1 id=2 resp=1\nbusy" +
+			"timeout 1 4\n"))
+		require.NoError(t, err)
+
+		line, err = r.ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, "relay 2,3 4 corr=2\n", line)
+		_, err = io.ReadFull(r, make([]byte, 4))
+		require.NoError(t, err)
+
+		_, err = srvConn.Write([]byte("relay 3 4 corr=2 id=3 resp=1\npong"))
+		require.NoError(t, err)
+	}()
+
+	clientChan := make(chan IncomingMessage)
+	defer close(clientChan)
+
+	go cli.HandleIncomingMessages(clientChan)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	results, err := cli.Gather(ctx, []uint64{2, 3, 4, 5}, []byte("ping"), GatherOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, map[uint64]Response{
+		2: {Body: []byte("pong")},
+		3: {Err: errors.New("busy")},
+		4: {Err: ErrRequestTimeout},
+		5: {Err: ErrUnreachable},
+	}, results)
+
+	results, err = cli.Gather(context.Background(), []uint64{2, 3}, []byte("ping"), GatherOptions{Quorum: 1})
+	require.NoError(t, err)
+	assert.Equal(t, map[uint64]Response{2: {Err: ErrNoAnswer}, 3: {Body: []byte("pong")}}, results)
+}
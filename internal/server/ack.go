@@ -0,0 +1,168 @@
+package server
+
+import (
+	"log"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/badboyd/tcp-hub/pkg/message"
+)
+
+// delivery is a relayed message waiting for an ack from its receiver
+type delivery struct {
+	id       uint64
+	senderID uint64
+	data     []byte
+	// fields are forwarded to the receiver as they are
+	fields map[string]string
+	// group is set for queue group deliveries, receiverID for direct ones
+	group      string
+	receiverID uint64
+	pick       string
+	key        string
+	// atLeastOnce deliveries are redelivered when not acked before deadline,
+	// which is zero until the frame is written to the receiver
+	atLeastOnce bool
+	deadline    time.Time
+	attempts    int
+	redelivered bool
+	// expires is zero for messages without TTL
+	expires       time.Time
+	notifyExpired bool
+	lane          int
+}
+
+func (d *delivery) expired(now time.Time) bool {
+	return !d.expires.IsZero() && now.After(d.expires)
+}
+
+func (d *delivery) frame() *frame {
+	fields := make(map[string]string, len(d.fields)+4)
+	for k, v := range d.fields {
+		fields[k] = v
+	}
+	fields[message.FieldID] = strconv.FormatUint(d.id, 10)
+	fields[message.FieldAck] = "1"
+	if d.group != "" {
+		fields[message.FieldGroup] = d.group
+	}
+	if d.redelivered {
+		fields[message.FieldRedelivered] = "1"
+	}
+	return newFrame(d.senderID, fields, d.data, 1)
+}
+
+// deliver queues d for receiver and keeps it in flight until acked
+func (s *Server) deliver(receiver *client, d *delivery) {
+	s.qm.Lock()
+	if receiver.inflight == nil {
+		receiver.inflight = make(map[uint64]*delivery)
+	}
+	d.redelivered = d.attempts > 0
+	d.attempts++
+	d.deadline = time.Time{}
+	d.receiverID = receiver.id
+	receiver.inflight[d.id] = d
+	frame := d.frame()
+	s.qm.Unlock()
+
+	s.enqueue(receiver, &outbound{
+		frame:    frame,
+		size:     len(d.data),
+		msgID:    d.id,
+		senderID: d.senderID,
+		expires:  d.expires,
+		notify:   d.notifyExpired,
+		lane:     d.lane,
+		d:        d,
+	})
+}
+
+// written starts the ack deadline of the delivery of ob once its frame was written to receiver,
+// a receiver slow to read its outbox is not sent the same message again
+func (s *Server) written(receiver *client, ob *outbound) {
+	if ob.d == nil {
+		return
+	}
+	s.qm.Lock()
+	if receiver.inflight[ob.msgID] == ob.d {
+		ob.d.deadline = s.clock.Now().Add(s.ackTimeout)
+	}
+	s.qm.Unlock()
+}
+
+// ack marks msgID as processed by cli
+func (s *Server) ack(cli *client, msgID uint64) {
+	s.qm.Lock()
+	defer s.qm.Unlock()
+
+	delete(cli.inflight, msgID)
+}
+
+// redeliver requeues d after its receiver failed to ack it
+func (s *Server) redeliver(d *delivery) {
+	if d.attempts > s.maxRedeliveries {
+		log.Printf("Drop message %d after %d attempts\n", d.id, d.attempts)
+		return
+	}
+	if d.expired(s.clock.Now()) {
+		s.expireDelivery(d)
+		return
+	}
+
+	if d.group != "" {
+		if err := s.dispatch(d); err != nil {
+			log.Printf("Drop message %d to queue group %s: %s\n", d.id, d.group, err.Error())
+		}
+		return
+	}
+
+	receiver, ok := s.registry.get(d.receiverID)
+	if !ok {
+		log.Printf("Drop message %d to disconnected receiver %d\n", d.id, d.receiverID)
+		return
+	}
+	s.deliver(receiver, d)
+}
+
+// redeliverLoop redelivers at-least-once messages whose ack deadline passed
+func (s *Server) redeliverLoop() {
+	interval := s.ackTimeout / 2
+	if interval <= 0 {
+		interval = time.Millisecond
+	}
+	tick := s.clock.After(interval)
+	for {
+		select {
+		case <-s.close:
+			return
+		case now := <-tick:
+			for _, d := range s.expiredDeliveries(now) {
+				s.redeliver(d)
+			}
+			tick = s.clock.After(interval)
+		}
+	}
+}
+
+// expiredDeliveries takes the at-least-once deliveries whose ack deadline passed out of flight
+func (s *Server) expiredDeliveries(now time.Time) []*delivery {
+	clients := s.registry.snapshot()
+	s.qm.Lock()
+	defer s.qm.Unlock()
+
+	expired := []*delivery{}
+	for _, cli := range clients {
+		for msgID, d := range cli.inflight {
+			if d.atLeastOnce && !d.deadline.IsZero() && now.After(d.deadline) {
+				delete(cli.inflight, msgID)
+				expired = append(expired, d)
+			}
+		}
+	}
+	sort.Slice(expired, func(i, j int) bool {
+		return expired[i].id < expired[j].id
+	})
+	return expired
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpiredDeliveries(t *testing.T) {
+	srv := New()
+	now := time.Now()
+	cli := &client{id: 1, inflight: map[uint64]*delivery{
+		1: {id: 1, atLeastOnce: true, deadline: now.Add(-time.Second)},
+		2: {id: 2, atLeastOnce: true, deadline: now.Add(time.Second)},
+		3: {id: 3, group: "jobs", deadline: now.Add(-time.Second)},
+		// not written yet
+		4: {id: 4, atLeastOnce: true},
+	}}
+	srv.registry.add(cli)
+
+	expired := srv.expiredDeliveries(now)
+	require.Len(t, expired, 1)
+	assert.Equal(t, uint64(1), expired[0].id)
+	assert.Len(t, cli.inflight, 3)
+}
+
+func TestAckDeadlineStartsOnWrite(t *testing.T) {
+	clock := newFakeClock()
+	srv := New(WithClock(clock), WithAckTimeout(time.Second))
+
+	receiverSrv, receiverConn := net.Pipe()
+	defer receiverConn.Close()
+	receiver := &client{id: 2, conn: receiverSrv}
+	srv.registry.add(receiver)
+
+	d := &delivery{id: 1, senderID: 1, data: []byte("one"), atLeastOnce: true}
+	srv.deliver(receiver, d)
+
+	// the frame waits for the receiver to read it
+	clock.Advance(time.Minute)
+	assert.Empty(t, srv.expiredDeliveries(clock.Now()))
+
+	msg := make([]byte, len("relay 1 3 ack=1 id=1\none"))
+	_, err := io.ReadFull(receiverConn, msg)
+	require.NoError(t, err)
+	assert.Equal(t, "relay 1 3 ack=1 id=1\none", string(msg))
+	require.Eventually(t, func() bool {
+		srv.qm.Lock()
+		defer srv.qm.Unlock()
+		return !d.deadline.IsZero()
+	}, time.Second, time.Millisecond)
+
+	assert.Empty(t, srv.expiredDeliveries(clock.Now()))
+	clock.Advance(2 * time.Second)
+	assert.Equal(t, []*delivery{d}, srv.expiredDeliveries(clock.Now()))
+}
+
+func TestAtLeastOnce(t *testing.T) {
+	srv := New(WithAckTimeout(50*time.Millisecond), WithMaxRedeliveries(1))
+	defer srv.Stop()
+
+	serverAddr := net.TCPAddr{Port: serverPort}
+	require.NoError(t, srv.Start(&serverAddr))
+
+	conn1, err := net.Dial(serverAddr.Network(), serverAddr.String())
+	require.NoError(t, err)
+	defer conn1.Close()
+	waitForClients(t, srv, 1)
+
+	conn2, err := net.Dial(serverAddr.Network(), serverAddr.String())
+	require.NoError(t, err)
+	defer conn2.Close()
+	waitForClients(t, srv, 2)
+
+	r2 := bufio.NewReader(conn2)
+	expect := func(expected string) {
+		msg := make([]byte, len(expected))
+		_, err := io.ReadFull(r2, msg)
+		require.NoError(t, err)
+		assert.Equal(t, expected, string(msg))
+	}
+
+	// acked message is not redelivered
+	_, err = conn1.Write([]byte("relay 2 3 qos=1\none"))
+	require.NoError(t, err)
+	expect("relay 1 3 ack=1 id=1\none")
+	_, err = conn2.Write([]byte("ack 1\n"))
+	require.NoError(t, err)
+
+	// unacked message is redelivered until max redeliveries
+	_, err = conn1.Write([]byte("relay 2 3 qos=1\ntwo"))
+	require.NoError(t, err)
+	expect("relay 1 3 ack=1 id=2\ntwo")
+	expect("relay 1 3 ack=1 id=2 redelivered=1\ntwo")
+
+	// at-most-once message proves nothing else was queued in between
+	_, err = conn1.Write([]byte("relay 2 5\nthree"))
+	require.NoError(t, err)
+	conn2.SetReadDeadline(time.Now().Add(time.Second))
+	expect("relay 1 5 id=3\nthree")
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// adminDefaultKey names the default limit in admin paths
+const adminDefaultKey = "default"
+
+// adminLimits is the body of GET /limits
+type adminLimits struct {
+	By      LimitBy          `json:"by"`
+	Default Limit            `json:"default"`
+	Keys    map[string]Limit `json:"keys"`
+}
+
+// adminIPRules is the body of GET /iprules
+type adminIPRules struct {
+	Rules []IPRuleStats `json:"rules"`
+	// Unlisted counts the connections refused as no allow rule matched them
+	Unlisted uint64 `json:"unlisted"`
+}
+
+// adminClient is an entry of GET /clients
+type adminClient struct {
+	ID   uint64 `json:"id"`
+	Name string `json:"name,omitempty"`
+	Addr string `json:"addr"`
+	// Proxy is the address of the proxy the client connects through
+	Proxy string `json:"proxy,omitempty"`
+}
+
+// AdminHandler serves the admin interface of the server as JSON over HTTP:
+//
+//	GET /stats             the counters of the server
+//	GET /limits            the default limit and the limits set for client IDs or IPs
+//	PUT /limits/default    sets the default limit from a Limit
+//	PUT /limits/<key>      sets the limit of "name:" and a nick or of an IP, as the server limits by
+//	DELETE /limits/<key>   makes the key use the default limit
+//	GET /clients           the connected clients with their addresses, and those of their proxies
+//	GET /policy            the policy deciding what clients may do, null without one
+//	GET /iprules           the rules deciding which networks may connect, with their hits
+//
+// It has no authentication, it must be served on an address only administrators reach.
+func (s *Server) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, s.Stats())
+	})
+	mux.HandleFunc("/limits", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		def, keys := s.Limits()
+		writeJSON(w, adminLimits{By: s.limits.by, Default: def, Keys: keys})
+	})
+	mux.HandleFunc("/clients", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, s.adminClients())
+	})
+	mux.HandleFunc("/policy", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, s.Policy())
+	})
+	mux.HandleFunc("/iprules", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		rules, unlisted := s.IPRules().Stats()
+		if rules == nil {
+			rules = []IPRuleStats{}
+		}
+		writeJSON(w, adminIPRules{Rules: rules, Unlisted: unlisted})
+	})
+	mux.HandleFunc("/limits/", func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(r.URL.Path, "/limits/")
+		if key == "" || strings.Contains(key, "/") {
+			http.NotFound(w, r)
+			return
+		}
+		if key == adminDefaultKey {
+			key = ""
+		}
+
+		switch r.Method {
+		case http.MethodPut:
+			var limit Limit
+			dec := json.NewDecoder(r.Body)
+			dec.DisallowUnknownFields()
+			if err := dec.Decode(&limit); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := s.SetLimit(key, limit); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		case http.MethodDelete:
+			if key == "" {
+				http.Error(w, "the default limit cannot be removed", http.StatusBadRequest)
+				return
+			}
+			s.RemoveLimit(key)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	return mux
+}
+
+// adminClients returns the connected clients by ID
+func (s *Server) adminClients() []adminClient {
+	clients := s.registry.snapshot()
+	sort.Slice(clients, func(i, j int) bool { return clients[i].id < clients[j].id })
+
+	entries := make([]adminClient, len(clients))
+	for i, cli := range clients {
+		entries[i] = adminClient{ID: cli.id, Name: s.nameOf(cli), Addr: cli.conn.RemoteAddr().String()}
+		if via := proxyAddr(cli.conn); via != nil {
+			entries[i].Proxy = via.String()
+		}
+	}
+	return entries
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,225 @@
+package server
+
+import (
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/badboyd/tcp-hub/pkg/message"
+)
+
+const (
+	// acceptBackoff and maxAcceptBackoff bound the wait before accepting again after a temporary error
+	acceptBackoff    = 5 * time.Millisecond
+	maxAcceptBackoff = time.Second
+)
+
+// Reasons given in busy notices to the connections the server turns away
+const (
+	busyMaxClients = "max clients"
+	busyIPLimit    = "too many clients from ip"
+	busyAcceptRate = "accept rate"
+)
+
+// ipCountShards is how many shards keep the counts of clients by IP
+const ipCountShards = 64
+
+type ipCountShard struct {
+	m      sync.Mutex
+	counts map[string]int
+}
+
+// admission decides which connections are served and counts the connected clients, in total and by IP.
+// Counts by IP are sharded so connects and disconnects from different IPs do not contend on one lock.
+type admission struct {
+	// clients is updated atomically
+	clients int32
+	// serve is held from admitting a connection to counting its client
+	serve sync.Mutex
+	byIP  [ipCountShards]ipCountShard
+	// rate limits accepted connections, it is nil without a rate
+	rate *bucket
+	// m guards ipRules, which decide which networks may connect
+	m       sync.Mutex
+	ipRules *IPRules
+}
+
+func (a *admission) ipShard(ip string) *ipCountShard {
+	// FNV-1a
+	h := uint32(2166136261)
+	for i := 0; i < len(ip); i++ {
+		h ^= uint32(ip[i])
+		h *= 16777619
+	}
+	return &a.byIP[h%ipCountShards]
+}
+
+// countIP adds n clients from ip and returns how many are connected from it
+func (a *admission) countIP(ip string, n int) int {
+	shard := a.ipShard(ip)
+	shard.m.Lock()
+	defer shard.m.Unlock()
+	if n == 0 {
+		return shard.counts[ip]
+	}
+	if shard.counts == nil {
+		shard.counts = make(map[string]int)
+	}
+	count := shard.counts[ip] + n
+	if count <= 0 {
+		delete(shard.counts, ip)
+	} else {
+		shard.counts[ip] = count
+	}
+	return count
+}
+
+// remoteIP returns the IP conn comes from, or its address when it has none
+func remoteIP(conn net.Conn) string {
+	remote := conn.RemoteAddr()
+	if remote == nil {
+		return ""
+	}
+	addr := remote.String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// admitConn tells why a connection from ip is turned away, or returns "" when the server takes it
+func (s *Server) admitConn(ip string) string {
+	if s.admission.rate != nil {
+		if _, err := s.admission.rate.take(s.clock.Now(), 0); err != nil {
+			return busyAcceptRate
+		}
+	}
+
+	if s.maxClients > 0 && int(atomic.LoadInt32(&s.admission.clients)) >= s.maxClients {
+		return busyMaxClients
+	}
+	if s.maxClientsPerIP > 0 && s.admission.countIP(ip, 0) >= s.maxClientsPerIP {
+		return busyIPLimit
+	}
+	return ""
+}
+
+// countClient adds cli to the connected clients, or removes it with -1
+func (s *Server) countClient(cli *client, n int) {
+	atomic.AddInt32(&s.admission.clients, int32(n))
+	s.admission.countIP(cli.ip, n)
+}
+
+// turnAway tells conn the server is busy and closes it
+func (s *Server) turnAway(conn net.Conn, reason string) {
+	atomic.AddUint64(&s.stats.ConnsRejected, 1)
+	conn.SetWriteDeadline(time.Now().Add(refuseTimeout))
+	message.Busy{Reason: reason}.Encode(conn)
+	conn.Close()
+}
+
+// acceptLoop serves the connections of listener until it is closed,
+// temporary errors such as running out of file descriptors are retried with a backoff
+func (s *Server) acceptLoop(listener net.Listener, loop *eventLoop) {
+	var backoff time.Duration
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				atomic.AddUint64(&s.stats.AcceptErrors, 1)
+				if backoff *= 2; backoff == 0 {
+					backoff = acceptBackoff
+				} else if backoff > maxAcceptBackoff {
+					backoff = maxAcceptBackoff
+				}
+				log.Printf("Accept error: %s, retrying in %s", err.Error(), backoff)
+				select {
+				case <-time.After(backoff):
+					continue
+				case <-s.close:
+					return
+				}
+			}
+			log.Printf("Stop accepting conn: %s", err.Error())
+			return
+		}
+		backoff = 0
+
+		if !s.trustsProxy(conn) {
+			s.serveConn(conn, loop)
+			continue
+		}
+		// the header is read aside so a slow proxy does not hold up accepting
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			proxied, err := readProxyHeader(conn)
+			if err != nil {
+				log.Printf("Cannot read PROXY header from %s: %s\n", conn.RemoteAddr(), err.Error())
+				conn.Close()
+				return
+			}
+			s.serveConn(proxied, loop)
+		}()
+	}
+}
+
+// serveConn admits conn as a client and serves it
+func (s *Server) serveConn(conn net.Conn, loop *eventLoop) {
+	ip := remoteIP(conn)
+	addr := net.ParseIP(ip)
+	if !s.IPRules().Allowed(addr) {
+		log.Printf("Deny conn from %s\n", conn.RemoteAddr())
+		atomic.AddUint64(&s.stats.ConnsDenied, 1)
+		conn.Close()
+		return
+	}
+
+	// connections behind proxies are admitted concurrently, a client is counted before the next is checked
+	s.admission.serve.Lock()
+	if reason := s.admitConn(ip); reason != "" {
+		s.admission.serve.Unlock()
+		log.Printf("Turn away conn from %s: %s\n", conn.RemoteAddr(), reason)
+		s.turnAway(conn, reason)
+		return
+	}
+
+	clientID, err := s.ids.Next()
+	if err != nil {
+		s.admission.serve.Unlock()
+		log.Printf("Cannot allocate client ID: %s\n", err.Error())
+		conn.Close()
+		return
+	}
+	cli := &client{
+		id:      clientID,
+		conn:    conn,
+		ip:      ip,
+		addr:    addr,
+		counted: true,
+	}
+	s.addClient(cli)
+	s.countClient(cli, 1)
+	s.admission.serve.Unlock()
+
+	if via := proxyAddr(conn); via != nil {
+		log.Printf("[%d] Serve conn from %s via %s\n", cli.id, conn.RemoteAddr(), via)
+	} else {
+		log.Printf("[%d] Serve conn from %s\n", cli.id, conn.RemoteAddr())
+	}
+	if loop != nil {
+		if err := loop.add(cli); err != nil {
+			log.Printf("[%d] Cannot serve conn: %s\n", cli.id, err.Error())
+			s.removeClient(cli)
+		}
+		return
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.handle(cli)
+	}()
+}
@@ -0,0 +1,201 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startAdmission starts a server with opts on a free local port
+func startAdmission(t *testing.T, opts ...Option) (*Server, string) {
+	srv := New(opts...)
+	require.NoError(t, srv.Start(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}))
+	return srv, srv.listener.Addr().String()
+}
+
+// dialFrom connects to addr from the local IP from and waits to be served
+func dialFrom(t *testing.T, from, addr string) (net.Conn, *bufio.Reader) {
+	dialer := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(from)}, Timeout: 5 * time.Second}
+	conn, err := dialer.Dial("tcp", addr)
+	require.NoError(t, err)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn, bufio.NewReader(conn)
+}
+
+// served tells whether conn is served, or the busy notice it got
+func served(t *testing.T, conn net.Conn, r *bufio.Reader) string {
+	_, err := conn.Write([]byte("identity\n"))
+	require.NoError(t, err)
+	reply, err := r.ReadString('\n')
+	require.NoError(t, err)
+	if strings.HasPrefix(reply, "busy ") {
+		// the connection is closed after the notice
+		_, err = r.ReadByte()
+		assert.Error(t, err)
+	}
+	return reply
+}
+
+func TestMaxClients(t *testing.T) {
+	srv, addr := startAdmission(t, WithMaxClients(2))
+	defer srv.Stop()
+
+	conn1, r1 := dialFrom(t, "127.0.0.1", addr)
+	defer conn1.Close()
+	conn2, r2 := dialFrom(t, "127.0.0.1", addr)
+	defer conn2.Close()
+	assert.Equal(t, "identity 1\n", served(t, conn1, r1))
+	assert.Equal(t, "identity 2\n", served(t, conn2, r2))
+
+	conn3, r3 := dialFrom(t, "127.0.0.1", addr)
+	defer conn3.Close()
+	assert.Equal(t, "busy max clients\n", served(t, conn3, r3))
+	assert.Equal(t, uint64(1), srv.Stats().ConnsRejected)
+
+	// a leaving client makes room
+	conn1.Close()
+	require.Eventually(t, func() bool { return len(srv.registry.snapshot()) == 1 }, 5*time.Second, 10*time.Millisecond)
+	conn4, r4 := dialFrom(t, "127.0.0.1", addr)
+	defer conn4.Close()
+	assert.Equal(t, "identity 3\n", served(t, conn4, r4))
+}
+
+func TestMaxClientsPerIP(t *testing.T) {
+	srv, addr := startAdmission(t, WithMaxClientsPerIP(1))
+	defer srv.Stop()
+
+	conn1, r1 := dialFrom(t, "127.0.0.1", addr)
+	defer conn1.Close()
+	assert.Equal(t, "identity 1\n", served(t, conn1, r1))
+	conn2, r2 := dialFrom(t, "127.0.0.1", addr)
+	defer conn2.Close()
+	assert.Equal(t, "busy too many clients from ip\n", served(t, conn2, r2))
+
+	// another IP has its own cap, the listener takes any IP of 127.0.0.0/8 on linux only
+	dialer := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 2)}}
+	conn3, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		t.Skipf("cannot dial from 127.0.0.2: %s", err)
+	}
+	defer conn3.Close()
+	conn3.SetDeadline(time.Now().Add(5 * time.Second))
+	assert.Equal(t, "identity 2\n", served(t, conn3, bufio.NewReader(conn3)))
+}
+
+func TestCountClient(t *testing.T) {
+	srv := New()
+	a := &client{id: 1, ip: "10.0.0.1", counted: true}
+	b := &client{id: 2, ip: "10.0.0.1", counted: true}
+	srv.countClient(a, 1)
+	srv.countClient(b, 1)
+	assert.Equal(t, 2, srv.admission.countIP("10.0.0.1", 0))
+	assert.Equal(t, 0, srv.admission.countIP("10.0.0.2", 0))
+
+	srv.countClient(a, -1)
+	srv.countClient(b, -1)
+	assert.Equal(t, int32(0), srv.admission.clients)
+	assert.Empty(t, srv.admission.ipShard("10.0.0.1").counts)
+
+	// connections without a remote address, such as test doubles, have no IP
+	assert.Equal(t, "", remoteIP(discardConn{}))
+}
+
+func TestAcceptRate(t *testing.T) {
+	srv, addr := startAdmission(t, WithAcceptRate(1, 2))
+	defer srv.Stop()
+
+	var replies []string
+	for i := 0; i < 3; i++ {
+		conn, r := dialFrom(t, "127.0.0.1", addr)
+		defer conn.Close()
+		replies = append(replies, served(t, conn, r))
+	}
+	assert.Equal(t, []string{"identity 1\n", "identity 2\n", "busy accept rate\n"}, replies)
+}
+
+func TestAcceptRateBelowOne(t *testing.T) {
+	// the burst defaults to the rate, under one connection it still takes one
+	srv, addr := startAdmission(t, WithAcceptRate(0.5, 0))
+	defer srv.Stop()
+
+	var replies []string
+	for i := 0; i < 2; i++ {
+		conn, r := dialFrom(t, "127.0.0.1", addr)
+		defer conn.Close()
+		replies = append(replies, served(t, conn, r))
+	}
+	assert.Equal(t, []string{"identity 1\n", "busy accept rate\n"}, replies)
+}
+
+// flakyListener fails its first accepts with temporary errors
+type flakyListener struct {
+	net.Listener
+	failures int
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if l.failures > 0 {
+		l.failures--
+		return nil, timeoutError{}
+	}
+	return l.Listener.Accept()
+}
+
+func TestAcceptLoopRetries(t *testing.T) {
+	srv := New()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		srv.acceptLoop(&flakyListener{Listener: listener, failures: 3}, nil)
+	}()
+
+	conn, r := dialFrom(t, "127.0.0.1", listener.Addr().String())
+	defer conn.Close()
+	assert.Equal(t, "identity 1\n", served(t, conn, r))
+	assert.Equal(t, uint64(3), srv.Stats().AcceptErrors)
+
+	// permanent errors stop the loop
+	listener.Close()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("accept loop did not stop")
+	}
+	close(srv.close)
+	srv.wg.Wait()
+}
+
+func TestAcceptLoopStopsWhileBackingOff(t *testing.T) {
+	srv := New()
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		srv.acceptLoop(&flakyListener{Listener: errListener{}, failures: 1 << 30}, nil)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(srv.close)
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("accept loop did not stop")
+	}
+}
+
+// errListener fails every accept
+type errListener struct {
+	net.Listener
+}
+
+func (errListener) Accept() (net.Conn, error) {
+	return nil, errors.New("closed")
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"errors"
+	"log"
+
+	"github.com/badboyd/tcp-hub/pkg/message"
+)
+
+var errCreditInvalid = errors.New("invalid credit")
+
+// credit limits what the hub pushes to a receiver which granted credit.
+// Message and byte credit are tracked once granted, byte credit may go
+// negative so a message larger than the window is not stuck forever.
+type credit struct {
+	enabled bool
+	reject  bool
+	byMsgs  bool
+	byBytes bool
+	msgs    int64
+	bytes   int64
+}
+
+// allows tells whether the next frame may be written
+func (c *credit) allows() bool {
+	if !c.enabled {
+		return true
+	}
+	return (!c.byMsgs || c.msgs > 0) && (!c.byBytes || c.bytes > 0)
+}
+
+// covers tells whether a frame queued after queued frames of queuedBytes will be written within credit
+func (c *credit) covers(queued int, queuedBytes int64) bool {
+	return (!c.byMsgs || int64(queued) < c.msgs) && (!c.byBytes || queuedBytes < c.bytes)
+}
+
+func (c *credit) consume(size int) {
+	if c.enabled {
+		c.msgs--
+		c.bytes -= int64(size)
+	}
+}
+
+func (c *credit) refund(size int) {
+	if c.enabled {
+		c.msgs++
+		c.bytes += int64(size)
+	}
+}
+
+// grant adds credit of receiver and restarts its writer when it was waiting for credit
+func (s *Server) grant(receiver *client, msgs, bytes int64, policy string) error {
+	if msgs < 0 || bytes < 0 || (policy != message.CreditBuffer && policy != message.CreditReject) {
+		return errCreditInvalid
+	}
+
+	out := &receiver.out
+	out.m.Lock()
+	c := &out.credit
+	c.enabled = true
+	c.reject = policy == message.CreditReject
+	if msgs > 0 {
+		c.byMsgs = true
+		c.msgs += msgs
+	}
+	if bytes > 0 {
+		c.byBytes = true
+		c.bytes += bytes
+	}
+	start := !out.running && out.queued > 0 && c.allows()
+	if start {
+		out.running = true
+	}
+	out.m.Unlock()
+
+	if start {
+		go s.flush(receiver)
+	}
+	return nil
+}
+
+// reject drops a frame beyond the credit or inbox limits of receiver and tells its sender,
+// deliveries waiting for an ack stay in flight and are redelivered later
+func (s *Server) reject(receiver *client, ob *outbound) {
+	ob.release()
+	if ob.d != nil {
+		log.Printf("Delay message %d to %d out of credit\n", ob.msgID, receiver.id)
+		return
+	}
+	s.notify(ob.senderID, string(message.Rejected{MsgID: ob.msgID, ReceiverID: receiver.id}.AppendTo(nil)))
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCredit(t *testing.T) {
+	c := credit{}
+	assert.True(t, c.allows())
+
+	c = credit{enabled: true, byMsgs: true, msgs: 1}
+	assert.True(t, c.allows())
+	assert.True(t, c.covers(0, 0))
+	assert.False(t, c.covers(1, 0))
+	c.consume(10)
+	assert.False(t, c.allows())
+	c.refund(10)
+	assert.True(t, c.allows())
+
+	// a message larger than the byte credit goes out once some credit is left
+	c = credit{enabled: true, byBytes: true, bytes: 5}
+	assert.True(t, c.covers(3, 4))
+	assert.False(t, c.covers(3, 5))
+	c.consume(10)
+	assert.False(t, c.allows())
+}
+
+func TestGrant(t *testing.T) {
+	srv := New()
+
+	senderSrv, senderConn := net.Pipe()
+	defer senderConn.Close()
+	receiverSrv, receiverConn := net.Pipe()
+	defer receiverConn.Close()
+
+	sender := &client{id: 1, conn: senderSrv}
+	receiver := &client{id: 2, conn: receiverSrv}
+	srv.registry.add(sender)
+	srv.registry.add(receiver)
+
+	assert.Equal(t, errCreditInvalid, srv.grant(receiver, -1, 0, "buffer"))
+	assert.Equal(t, errCreditInvalid, srv.grant(receiver, 1, 0, "drop"))
+
+	require.NoError(t, srv.grant(receiver, 1, 0, "buffer"))
+	srv.relayMessage(sender.id, 10, []uint64{receiver.id}, map[string]string{}, []byte("one"))
+	srv.relayMessage(sender.id, 11, []uint64{receiver.id}, map[string]string{}, []byte("two"))
+
+	expected := "relay 1 3 id=10\none"
+	msg := make([]byte, len(expected))
+	_, err := io.ReadFull(receiverConn, msg)
+	require.NoError(t, err)
+	assert.Equal(t, expected, string(msg))
+
+	// the second message waits for credit
+	require.Eventually(t, func() bool {
+		receiver.out.m.Lock()
+		defer receiver.out.m.Unlock()
+		return !receiver.out.running
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, 1, receiver.out.queued)
+
+	// with the reject policy the hub drops what credit does not cover
+	require.NoError(t, srv.grant(receiver, 1, 0, "reject"))
+	go srv.relayMessage(sender.id, 12, []uint64{receiver.id}, map[string]string{}, []byte("three"))
+	notice, err := bufio.NewReader(senderConn).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "rejected 12 2\n", notice)
+
+	expected = "relay 1 3 id=11\ntwo"
+	msg = make([]byte, len(expected))
+	_, err = io.ReadFull(receiverConn, msg)
+	require.NoError(t, err)
+	assert.Equal(t, expected, string(msg))
+}
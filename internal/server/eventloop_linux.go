@@ -0,0 +1,436 @@
+//go:build linux
+// +build linux
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/badboyd/tcp-hub/pkg/message"
+)
+
+const (
+	eventLoopReadSize = 16 * 1024
+	eventLoopWait     = 100 * time.Millisecond
+	eventLoopEvents   = 256
+	// eventLoopRounds bounds how many reads a worker makes for one connection before serving others
+	eventLoopRounds = 16
+	// eventLoopAhead bounds the room taken ahead for a body, it grows as the body arrives
+	eventLoopAhead = 4 * eventLoopReadSize
+)
+
+// eventConn is a connection served by the event loop
+type eventConn struct {
+	// deadline is when the partial frame in in must be complete in unix nanoseconds, 0 without one
+	deadline int64
+	// m is held by the worker serving the connection, it orders what workers see of it
+	// as epoll handing the connection to the next worker is invisible to the race detector
+	m   sync.Mutex
+	cli *client
+	raw syscall.RawConn
+	// in keeps the start of a command until the rest of it arrives, it is nil for idle connections
+	in []byte
+	// start is when the first byte of the command in in arrived
+	start time.Time
+
+	buf    []byte
+	n      int
+	err    error
+	readFn func(fd uintptr) bool
+	armFn  func(fd uintptr)
+}
+
+// eventLoop serves connections from one epoll instance with a pool of workers.
+// Connections are registered one-shot so a single worker reads a connection at a time.
+type eventLoop struct {
+	s     *Server
+	epfd  int
+	m     sync.Mutex
+	conns map[uint64]*eventConn
+	ready chan *eventConn
+	wg    sync.WaitGroup
+}
+
+func newEventLoop(s *Server) (*eventLoop, error) {
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	return &eventLoop{
+		s:     s,
+		epfd:  epfd,
+		conns: make(map[uint64]*eventConn),
+		ready: make(chan *eventConn, eventLoopEvents),
+	}, nil
+}
+
+// add starts serving the connection of cli
+func (l *eventLoop) add(cli *client) error {
+	sc, ok := cli.conn.(syscall.Conn)
+	if !ok {
+		return fmt.Errorf("connection %T has no file descriptor", cli.conn)
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	c := &eventConn{cli: cli, raw: raw}
+	c.readFn = func(fd uintptr) bool {
+		c.n, c.err = syscall.Read(int(fd), c.buf)
+		return true
+	}
+	// the event carries the client ID, a stale event of a closed connection finds nothing
+	event := syscall.EpollEvent{
+		Events: syscall.EPOLLIN | syscall.EPOLLRDHUP | syscall.EPOLLONESHOT,
+		Fd:     int32(uint32(cli.id)),
+		Pad:    int32(uint32(cli.id >> 32)),
+	}
+	c.armFn = func(fd uintptr) {
+		if err := syscall.EpollCtl(l.epfd, syscall.EPOLL_CTL_MOD, int(fd), &event); err != nil {
+			log.Printf("[%d] Cannot rearm connection: %s\n", cli.id, err.Error())
+		}
+	}
+
+	l.m.Lock()
+	l.conns[cli.id] = c
+	l.m.Unlock()
+
+	var ctlErr error
+	if err := raw.Control(func(fd uintptr) {
+		ctlErr = syscall.EpollCtl(l.epfd, syscall.EPOLL_CTL_ADD, int(fd), &event)
+	}); err != nil {
+		ctlErr = err
+	}
+	if ctlErr != nil {
+		l.remove(c)
+		return ctlErr
+	}
+	return nil
+}
+
+// remove stops serving c and disconnects its client
+func (l *eventLoop) remove(c *eventConn) {
+	l.m.Lock()
+	_, ok := l.conns[c.cli.id]
+	delete(l.conns, c.cli.id)
+	l.m.Unlock()
+	if !ok {
+		return
+	}
+
+	c.raw.Control(func(fd uintptr) {
+		syscall.EpollCtl(l.epfd, syscall.EPOLL_CTL_DEL, int(fd), nil)
+	})
+	l.s.removeClient(c.cli)
+}
+
+// run waits for readable connections and hands them to workers until the server stops
+func (l *eventLoop) run(workers int) {
+	for i := 0; i < workers; i++ {
+		l.wg.Add(1)
+		go func() {
+			defer l.wg.Done()
+			scratch := make([]byte, eventLoopReadSize)
+			r := &frameReader{}
+			for c := range l.ready {
+				l.serve(c, scratch, r)
+			}
+		}()
+	}
+
+	events := make([]syscall.EpollEvent, eventLoopEvents)
+	var swept time.Time
+	for {
+		select {
+		case <-l.s.close:
+			close(l.ready)
+			l.wg.Wait()
+			l.m.Lock()
+			conns := make([]*eventConn, 0, len(l.conns))
+			for _, c := range l.conns {
+				conns = append(conns, c)
+			}
+			l.m.Unlock()
+			for _, c := range conns {
+				l.remove(c)
+			}
+			syscall.Close(l.epfd)
+			return
+		default:
+		}
+
+		if now := time.Now(); now.Sub(swept) >= eventLoopWait {
+			l.expire(now.UnixNano())
+			swept = now
+		}
+
+		n, err := syscall.EpollWait(l.epfd, events, int(eventLoopWait/time.Millisecond))
+		if err != nil {
+			if err == syscall.EINTR {
+				continue
+			}
+			log.Printf("Stop polling connections: %s\n", err.Error())
+			<-l.s.close
+			continue
+		}
+		for _, event := range events[:n] {
+			clientID := uint64(uint32(event.Fd)) | uint64(uint32(event.Pad))<<32
+			l.m.Lock()
+			c, ok := l.conns[clientID]
+			l.m.Unlock()
+			if ok {
+				l.ready <- c
+			}
+		}
+	}
+}
+
+// expire wakes the connections whose partial frame is overdue, the worker serving them disconnects them
+func (l *eventLoop) expire(now int64) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	for _, c := range l.conns {
+		if deadline := atomic.LoadInt64(&c.deadline); deadline != 0 && now > deadline {
+			c.raw.Control(func(fd uintptr) {
+				syscall.Shutdown(int(fd), syscall.SHUT_RD)
+			})
+		}
+	}
+}
+
+// serve reads what arrived on c and runs the complete commands
+func (l *eventLoop) serve(c *eventConn, scratch []byte, r *frameReader) {
+	c.m.Lock()
+	served, handoff := l.read(c, scratch, r)
+	c.m.Unlock()
+
+	switch {
+	case !served:
+		l.remove(c)
+	case handoff:
+		// the command may wait, it runs apart from the workers
+		l.wg.Add(1)
+		go func() {
+			defer l.wg.Done()
+			l.serveBlocking(c)
+		}()
+	default:
+		c.raw.Control(c.armFn)
+	}
+}
+
+// read reads c until it has no more data or other connections need serving.
+// served is false when c must be disconnected, handoff is true when the next command may wait.
+func (l *eventLoop) read(c *eventConn, scratch []byte, r *frameReader) (served, handoff bool) {
+	if deadline := atomic.LoadInt64(&c.deadline); deadline != 0 && time.Now().UnixNano() > deadline {
+		if bytes.IndexByte(c.in, '\n') < 0 {
+			l.s.refuse(c.cli, errLineTimeout)
+		} else {
+			l.s.refuse(c.cli, errFrameTimeout)
+		}
+		return false, false
+	}
+
+	for round := 0; round < eventLoopRounds; round++ {
+		// a partial command waiting for a known size is read in place
+		c.buf = scratch
+		if len(c.in) < cap(c.in) {
+			c.buf = c.in[len(c.in):cap(c.in)]
+		}
+		if err := c.raw.Read(c.readFn); err != nil {
+			return false, false
+		}
+		n, err, full := c.n, c.err, c.n == len(c.buf)
+		c.buf = nil
+		if err == syscall.EAGAIN {
+			break
+		}
+		if err != nil || n <= 0 {
+			if err != nil {
+				log.Printf("[%d] Read error: %s\n", c.cli.id, err.Error())
+			}
+			return false, false
+		}
+
+		var data []byte
+		switch {
+		case len(c.in) < cap(c.in):
+			c.in = c.in[:len(c.in)+n]
+			data = c.in
+		case len(c.in) > 0:
+			c.in = append(c.in, scratch[:n]...)
+			data = c.in
+		default:
+			data = scratch[:n]
+		}
+
+		rest, need, handoff, ok := l.commands(c, data, r, false)
+		if !ok {
+			return false, false
+		}
+		l.keep(c, data, rest, need)
+		if handoff {
+			// waiting is up to the server, not the client
+			atomic.StoreInt64(&c.deadline, 0)
+		}
+		if handoff || !full {
+			return true, handoff
+		}
+	}
+	return true, false
+}
+
+// serveBlocking runs the buffered commands of c allowing them to wait, then hands c back to the workers
+func (l *eventLoop) serveBlocking(c *eventConn) {
+	if !l.s.pause(c.cli) {
+		return
+	}
+
+	c.m.Lock()
+	// the time spent paused does not count for the command
+	c.start = time.Now()
+	data := c.in
+	rest, need, _, ok := l.commands(c, data, &frameReader{}, true)
+	if ok {
+		l.keep(c, data, rest, need)
+	}
+	c.m.Unlock()
+
+	if !ok {
+		l.remove(c)
+		return
+	}
+	c.raw.Control(c.armFn)
+}
+
+// keep stores the partial command rest of data for the next read, growing it to need bytes
+// and sets the deadline of the command when it is incomplete
+func (l *eventLoop) keep(c *eventConn, data, rest []byte, need int) {
+	if len(rest) == 0 {
+		c.in = nil
+		atomic.StoreInt64(&c.deadline, 0)
+		return
+	}
+
+	continued := len(c.in) > 0 && &data[0] == &c.in[0]
+	if !continued || &rest[0] != &c.in[0] {
+		// rest starts a command
+		c.start = time.Now()
+	}
+	switch end := bytes.IndexByte(rest, '\n'); {
+	case end < 0:
+		atomic.StoreInt64(&c.deadline, c.start.Add(l.s.lineTimeout).UnixNano())
+	case need > len(rest):
+		atomic.StoreInt64(&c.deadline, l.s.frameDeadline(c.start, len(rest)-end-1).UnixNano())
+	default:
+		// a complete command waiting to run apart from the workers
+		atomic.StoreInt64(&c.deadline, 0)
+	}
+
+	if need < len(rest) {
+		need = len(rest)
+	}
+	if continued && (cap(c.in) >= need || cap(c.in) > len(rest)) {
+		c.in = c.in[:copy(c.in, rest)]
+		return
+	}
+	// a body is given room as it arrives rather than from its announced size
+	if need > len(rest)+eventLoopAhead {
+		need = len(rest) + eventLoopAhead
+	}
+	in := make([]byte, len(rest), need)
+	copy(in, rest)
+	c.in = in
+}
+
+// commands runs the complete commands at the start of data.
+// It returns the rest of data and how long the next command is when known,
+// handoff is true when the next command may wait and blocking is false.
+func (l *eventLoop) commands(c *eventConn, data []byte, r *frameReader, blocking bool) (rest []byte, need int, handoff bool, ok bool) {
+	for len(data) > 0 {
+		end := bytes.IndexByte(data, '\n')
+		if end < 0 && len(data) > l.s.maxLineLength || end >= l.s.maxLineLength {
+			l.s.refuse(c.cli, errLineTooLong)
+			return nil, 0, false, false
+		}
+		if end < 0 {
+			return data, 0, false, true
+		}
+		size := relayBodySize(data[:end], l.s.maxBodySize)
+		if len(data) < end+1+size {
+			return data, end + 1 + size, false, true
+		}
+		if !blocking && mayWait(data[:end]) {
+			return data, 0, true, true
+		}
+
+		line := string(data[:end+1])
+		r.b = data[end+1 : end+1+size]
+		data = data[end+1+size:]
+
+		msg, ok := l.s.command(c.cli, line, r)
+		r.b = nil
+		if !ok {
+			return nil, 0, false, false
+		}
+		if msg != "" {
+			if _, err := c.cli.write([]byte(msg), l.s.writeTimeout); err != nil {
+				log.Printf("Error write message to %d", c.cli.id)
+				return nil, 0, false, false
+			}
+		}
+
+		// a client over its rate is not read for a while, apart from the workers
+		if !blocking && l.s.throttled(c.cli) > 0 {
+			return data, 0, true, true
+		}
+		if blocking && !l.s.pause(c.cli) {
+			return nil, 0, false, false
+		}
+	}
+	return nil, 0, false, true
+}
+
+// mayWait tells whether the command line is a fetch waiting for messages
+func mayWait(line []byte) bool {
+	if !bytes.HasPrefix(line, []byte(message.FetchType+" ")) {
+		return false
+	}
+	var fetch message.Fetch
+	if err := fetch.DecodeLine(string(line)); err != nil {
+		return false
+	}
+	return fetch.Wait > 0
+}
+
+// frameReader reads the body of a command buffered by the event loop
+type frameReader struct {
+	b []byte
+}
+
+func (r *frameReader) Read(p []byte) (int, error) {
+	if len(r.b) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.b)
+	r.b = r.b[n:]
+	return n, nil
+}
+
+func (r *frameReader) Discard(n int) (int, error) {
+	if n > len(r.b) {
+		n = len(r.b)
+		r.b = nil
+		return n, io.ErrUnexpectedEOF
+	}
+	r.b = r.b[n:]
+	return n, nil
+}
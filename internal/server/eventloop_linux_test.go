@@ -0,0 +1,197 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMayWait(t *testing.T) {
+	assert.True(t, mayWait([]byte("fetch 10 500")))
+	assert.False(t, mayWait([]byte("fetch 10 0")))
+	assert.False(t, mayWait([]byte("list")))
+}
+
+func TestEventLoop(t *testing.T) {
+	srv := New(WithEventLoop(2))
+	defer srv.Stop()
+
+	serverAddr := net.TCPAddr{Port: serverPort}
+	require.NoError(t, srv.Start(&serverAddr))
+
+	conn1, err := net.Dial(serverAddr.Network(), serverAddr.String())
+	require.NoError(t, err)
+	defer conn1.Close()
+	r1 := bufio.NewReader(conn1)
+
+	conn2, err := net.Dial(serverAddr.Network(), serverAddr.String())
+	require.NoError(t, err)
+	defer conn2.Close()
+	r2 := bufio.NewReader(conn2)
+
+	waitForClients(t, srv, 2)
+
+	t.Run("commands in one write", func(t *testing.T) {
+		_, err := conn1.Write([]byte("identity\nlist\n"))
+		require.NoError(t, err)
+		reply, err := r1.ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, "identity 1\n", reply)
+		reply, err = r1.ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, "list 2\n", reply)
+	})
+
+	t.Run("relay split across writes", func(t *testing.T) {
+		for _, part := range []string{"rel", "ay 2 11\nhello", " ", "world"} {
+			_, err := conn1.Write([]byte(part))
+			require.NoError(t, err)
+			time.Sleep(10 * time.Millisecond)
+		}
+		expected := "relay 1 11 id=1\nhello world"
+		relayMsg := make([]byte, len(expected))
+		_, err := io.ReadFull(r2, relayMsg)
+		require.NoError(t, err)
+		assert.Equal(t, expected, string(relayMsg))
+	})
+
+	t.Run("fetch waits apart from the workers", func(t *testing.T) {
+		_, err := conn2.Write([]byte("mode pull\nfetch 1 2000\n"))
+		require.NoError(t, err)
+		reply, err := r2.ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, "mode pull\n", reply)
+
+		// conn1 is served while conn2 waits
+		time.Sleep(50 * time.Millisecond)
+		_, err = conn1.Write([]byte("identity\nrelay 2 2\nhi"))
+		require.NoError(t, err)
+		reply, err = r1.ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, "identity 1\n", reply)
+
+		expected := "fetch 1\nrelay 1 2 id=2\nhi"
+		fetched := make([]byte, len(expected))
+		_, err = io.ReadFull(r2, fetched)
+		require.NoError(t, err)
+		assert.Equal(t, expected, string(fetched))
+	})
+
+	t.Run("disconnect", func(t *testing.T) {
+		require.NoError(t, conn2.Close())
+		waitForClients(t, srv, 1)
+	})
+}
+
+func TestEventLoopLimits(t *testing.T) {
+	testLimits(t, func(t *testing.T, opts []Option) (*Server, net.Conn, func()) {
+		srv := New(append(opts, WithEventLoop(2))...)
+		serverAddr := net.TCPAddr{Port: serverPort}
+		require.NoError(t, srv.Start(&serverAddr))
+
+		conn, err := net.Dial(serverAddr.Network(), serverAddr.String())
+		require.NoError(t, err)
+		return srv, conn, func() {
+			conn.Close()
+			srv.Stop()
+		}
+	})
+}
+
+func TestEventLoopBodyRoom(t *testing.T) {
+	srv := New(WithEventLoop(1))
+	loop, err := newEventLoop(srv)
+	require.NoError(t, err)
+	defer syscall.Close(loop.epfd)
+
+	// a relay announcing a large body gets room as it arrives
+	c := &eventConn{cli: &client{id: 1}}
+	data := []byte("relay 2 1000000000\nhello")
+	loop.keep(c, data, data, 19+1000000000)
+	assert.Equal(t, len(data)+eventLoopAhead, cap(c.in))
+	assert.NotZero(t, c.deadline)
+
+	// complete commands have no deadline
+	data = []byte("fetch 1 500\n")
+	loop.keep(c, data, data, 0)
+	assert.Zero(t, c.deadline)
+}
+
+func TestEventLoopRateLimit(t *testing.T) {
+	srv := New(WithEventLoop(1), WithRateLimit(LimitByClient, Limit{Messages: 10, MessageBurst: 1, Action: LimitDelay}))
+	defer srv.Stop()
+
+	serverAddr := net.TCPAddr{Port: serverPort}
+	require.NoError(t, srv.Start(&serverAddr))
+
+	conn1, err := net.Dial(serverAddr.Network(), serverAddr.String())
+	require.NoError(t, err)
+	defer conn1.Close()
+	conn2, err := net.Dial(serverAddr.Network(), serverAddr.String())
+	require.NoError(t, err)
+	defer conn2.Close()
+	waitForClients(t, srv, 2)
+
+	// conn1 is delayed apart from the only worker, which serves conn2 meanwhile
+	start := time.Now()
+	_, err = conn1.Write([]byte(strings.Repeat("relay 9 5\nhello", 4) + "identity\n"))
+	require.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+	_, err = conn2.Write([]byte("identity\n"))
+	require.NoError(t, err)
+	reply, err := bufio.NewReader(conn2).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "identity 2\n", reply)
+	assert.True(t, time.Since(start) < 200*time.Millisecond, time.Since(start))
+
+	reply, err = bufio.NewReader(conn1).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "identity 1\n", reply)
+	assert.True(t, time.Since(start) >= 250*time.Millisecond, time.Since(start))
+}
+
+func TestEventLoopProxyProtocol(t *testing.T) {
+	testProxyProtocol(t, WithEventLoop(1))
+}
+
+func TestEventLoopUnreadReplies(t *testing.T) {
+	srv := New(WithEventLoop(1), WithWriteTimeout(100*time.Millisecond))
+	defer srv.Stop()
+
+	serverAddr := net.TCPAddr{Port: serverPort}
+	require.NoError(t, srv.Start(&serverAddr))
+
+	// a client sending commands without reading their replies
+	flooder, err := net.Dial(serverAddr.Network(), serverAddr.String())
+	require.NoError(t, err)
+	defer flooder.Close()
+	require.NoError(t, flooder.(*net.TCPConn).SetReadBuffer(4096))
+	waitForClients(t, srv, 1)
+	go func() {
+		commands := []byte(strings.Repeat("identity\n", 4096))
+		for {
+			if _, err := flooder.Write(commands); err != nil {
+				return
+			}
+		}
+	}()
+
+	// it is disconnected and the worker serves the others
+	require.Eventually(t, func() bool { return len(srv.ListClientIDs()) == 0 }, 5*time.Second, 10*time.Millisecond)
+	conn, err := net.Dial(serverAddr.Network(), serverAddr.String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("identity\n"))
+	require.NoError(t, err)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "identity 2\n", reply)
+}
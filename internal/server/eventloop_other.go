@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package server
+
+import "errors"
+
+var errEventLoopUnsupported = errors.New("event loop is only supported on linux")
+
+type eventLoop struct{}
+
+func newEventLoop(s *Server) (*eventLoop, error) {
+	return nil, errEventLoopUnsupported
+}
+
+func (l *eventLoop) add(cli *client) error {
+	return errEventLoopUnsupported
+}
+
+func (l *eventLoop) run(workers int) {}
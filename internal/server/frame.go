@@ -0,0 +1,58 @@
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/badboyd/tcp-hub/pkg/message"
+)
+
+// maxPooledHeader keeps headers with large header fields out of headerPool
+const maxPooledHeader = 1024
+
+var headerPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, 64)
+		return &b
+	},
+}
+
+// frame is a relay encoded once and shared read-only by its receivers,
+// its header goes back to headerPool once every receiver released it
+type frame struct {
+	header *[]byte
+	body   []byte
+	refs   int32
+}
+
+// newFrame encodes a relay from senderID to be written refs times
+func newFrame(senderID uint64, fields map[string]string, body []byte, refs int) *frame {
+	header := headerPool.Get().(*[]byte)
+	*header = message.AppendDeliveryHeader((*header)[:0], senderID, len(body), fields)
+	return &frame{header: header, body: body, refs: int32(refs)}
+}
+
+func (f *frame) appendTo(dst []byte) []byte {
+	dst = append(dst, *f.header...)
+	return append(dst, f.body...)
+}
+
+// release is called by each receiver done with the frame, written or dropped
+func (f *frame) release() {
+	if atomic.AddInt32(&f.refs, -1) == 0 && cap(*f.header) <= maxPooledHeader {
+		headerPool.Put(f.header)
+	}
+}
+
+// writeFrame writes the frame of ob to cli with a single vectored write,
+// frames written by several goroutines do not interleave
+func (cli *client) writeFrame(ob *outbound) error {
+	// the buffers live in ob so that writing does not allocate
+	ob.vec = [2][]byte{*ob.frame.header, ob.frame.body}
+	ob.bufs = ob.vec[:]
+
+	cli.wm.Lock()
+	defer cli.wm.Unlock()
+	_, err := ob.bufs.WriteTo(cli.conn)
+	return err
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// bufferConn is a receiver connection keeping what is written to it
+type bufferConn struct {
+	discardConn
+	buf *bytes.Buffer
+}
+
+func (c bufferConn) Write(p []byte) (int, error) { return c.buf.Write(p) }
+
+func TestNewFrame(t *testing.T) {
+	f := newFrame(1, map[string]string{"id": "7", "corr": "3"}, []byte("hello"), 2)
+	assert.Equal(t, "relay 1 5 corr=3 id=7\nhello", string(f.appendTo(nil)))
+
+	// receivers share the frame until the last one released it
+	for i := 0; i < 2; i++ {
+		buf := &bytes.Buffer{}
+		cli := &client{conn: bufferConn{buf: buf}}
+		require.NoError(t, cli.writeFrame(&outbound{frame: f}))
+		assert.Equal(t, "relay 1 5 corr=3 id=7\nhello", buf.String())
+		f.release()
+	}
+	assert.Equal(t, int32(0), f.refs)
+}
+
+func BenchmarkRelayMessage(b *testing.B) {
+	srv := New()
+	ids := make([]uint64, 99)
+	for i := range ids {
+		ids[i] = uint64(i + 2)
+		srv.registry.add(&client{id: ids[i], conn: discardConn{}})
+	}
+	data := make([]byte, 32*1024)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		srv.relayMessage(1, uint64(i), ids, map[string]string{}, data)
+	}
+}
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// ipRule allows or denies the connections from a network
+type ipRule struct {
+	allow bool
+	net   *net.IPNet
+	hits  uint64
+}
+
+func (r *ipRule) String() string {
+	if r.allow {
+		return "allow " + r.net.String()
+	}
+	return "deny " + r.net.String()
+}
+
+// IPRuleStats tells how many connections a rule decided
+type IPRuleStats struct {
+	Rule string `json:"rule"`
+	Hits uint64 `json:"hits"`
+}
+
+// IPRules decide which networks may connect: a connection from a denied network is refused,
+// and when there are allow rules so is a connection from a network none of them allows.
+// A nil IPRules allows every network.
+type IPRules struct {
+	rules []*ipRule
+	// unlisted counts the connections refused as no allow rule matched them
+	unlisted uint64
+	hasAllow bool
+}
+
+// ParseIPRules reads rules, one per line as "allow <cidr>" or "deny <cidr>".
+// A bare IP stands for itself, blank lines and lines starting with # are skipped.
+func ParseIPRules(r io.Reader) (*IPRules, error) {
+	rules := &IPRules{}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.Fields(line)
+		if len(parts) != 2 || parts[0] != "allow" && parts[0] != "deny" {
+			return nil, fmt.Errorf("line %d: want allow or deny and a CIDR", n)
+		}
+		ipNet, err := parseCIDR(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", n, err.Error())
+		}
+		allow := parts[0] == "allow"
+		rules.hasAllow = rules.hasAllow || allow
+		rules.rules = append(rules.rules, &ipRule{allow: allow, net: ipNet})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// LoadIPRules reads rules from the file at path, see ParseIPRules
+func LoadIPRules(path string) (*IPRules, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseIPRules(f)
+}
+
+// parseCIDR parses a CIDR, or an IP as the network of just itself
+func parseCIDR(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP %q", s)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, ipNet, err := net.ParseCIDR(s)
+	return ipNet, err
+}
+
+// Allowed tells whether ip may connect, deny rules win over allow rules
+func (r *IPRules) Allowed(ip net.IP) bool {
+	if r == nil {
+		return true
+	}
+	var allowed *ipRule
+	for _, rule := range r.rules {
+		if !rule.net.Contains(ip) {
+			continue
+		}
+		if !rule.allow {
+			atomic.AddUint64(&rule.hits, 1)
+			return false
+		}
+		if allowed == nil {
+			allowed = rule
+		}
+	}
+	if allowed != nil {
+		atomic.AddUint64(&allowed.hits, 1)
+		return true
+	}
+	if r.hasAllow {
+		atomic.AddUint64(&r.unlisted, 1)
+		return false
+	}
+	return true
+}
+
+// Stats returns the rules in order with their hits, and the connections refused as no allow rule matched them
+func (r *IPRules) Stats() ([]IPRuleStats, uint64) {
+	if r == nil {
+		return nil, 0
+	}
+	stats := make([]IPRuleStats, len(r.rules))
+	for i, rule := range r.rules {
+		stats[i] = IPRuleStats{Rule: rule.String(), Hits: atomic.LoadUint64(&rule.hits)}
+	}
+	return stats, atomic.LoadUint64(&r.unlisted)
+}
+
+// SetIPRules replaces the rules deciding which networks may connect, nil allows every network.
+// Connected clients are not checked again.
+func (s *Server) SetIPRules(rules *IPRules) {
+	s.admission.m.Lock()
+	defer s.admission.m.Unlock()
+	s.admission.ipRules = rules
+}
+
+// IPRules returns the rules deciding which networks may connect
+func (s *Server) IPRules() *IPRules {
+	s.admission.m.Lock()
+	defer s.admission.m.Unlock()
+	return s.admission.ipRules
+}
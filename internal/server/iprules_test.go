@@ -0,0 +1,81 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseIPRules(t *testing.T) {
+	rules, err := ParseIPRules(strings.NewReader(`
+# office and VPN
+allow 10.0.0.0/8
+allow 2001:db8::/32
+deny 10.0.0.5
+
+deny 10.1.0.0/16
+`))
+	require.NoError(t, err)
+
+	assert.True(t, rules.Allowed(net.ParseIP("10.2.3.4")))
+	assert.True(t, rules.Allowed(net.ParseIP("2001:db8::1")))
+	// deny rules win over allow rules
+	assert.False(t, rules.Allowed(net.ParseIP("10.0.0.5")))
+	assert.False(t, rules.Allowed(net.ParseIP("10.1.2.3")))
+	assert.False(t, rules.Allowed(net.ParseIP("192.168.0.1")))
+
+	stats, unlisted := rules.Stats()
+	assert.Equal(t, []IPRuleStats{
+		{Rule: "allow 10.0.0.0/8", Hits: 1},
+		{Rule: "allow 2001:db8::/32", Hits: 1},
+		{Rule: "deny 10.0.0.5/32", Hits: 1},
+		{Rule: "deny 10.1.0.0/16", Hits: 1},
+	}, stats)
+	assert.Equal(t, uint64(1), unlisted)
+
+	// without allow rules every network not denied may connect
+	rules, err = ParseIPRules(strings.NewReader("deny 192.168.0.0/16\n"))
+	require.NoError(t, err)
+	assert.True(t, rules.Allowed(net.ParseIP("10.0.0.1")))
+	assert.False(t, rules.Allowed(net.ParseIP("192.168.1.1")))
+
+	var none *IPRules
+	assert.True(t, none.Allowed(net.ParseIP("10.0.0.1")))
+
+	for _, bad := range []string{"allow\n", "permit 10.0.0.0/8\n", "deny 10.0.0.0/33\n", "allow host\n", "deny 1.2.3.4 5.6.7.8\n"} {
+		_, err := ParseIPRules(strings.NewReader(bad))
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestIPRulesAccept(t *testing.T) {
+	rules, err := ParseIPRules(strings.NewReader("deny 127.0.0.1\n"))
+	require.NoError(t, err)
+	srv, addr := startAdmission(t, WithIPRules(rules))
+	defer srv.Stop()
+
+	// denied connections are closed before they get an ID
+	conn, r := dialFrom(t, "127.0.0.1", addr)
+	defer conn.Close()
+	_, err = r.ReadByte()
+	assert.Error(t, err)
+	assert.Equal(t, uint64(1), srv.Stats().ConnsDenied)
+
+	// reloaded rules apply to the next connections
+	rules, err = ParseIPRules(strings.NewReader("allow 127.0.0.0/8\n"))
+	require.NoError(t, err)
+	srv.SetIPRules(rules)
+	conn, r = dialFrom(t, "127.0.0.1", addr)
+	defer conn.Close()
+	assert.Equal(t, "identity 1\n", served(t, conn, r))
+
+	w := httptest.NewRecorder()
+	srv.AdminHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/iprules", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"rules":[{"rule":"allow 127.0.0.0/8","hits":1}],"unlisted":0}`, w.Body.String())
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"sort"
+
+	"github.com/badboyd/tcp-hub/pkg/message"
+)
+
+// labelIndex maps label key to value to the IDs of clients carrying it
+type labelIndex map[string]map[string]map[uint64]struct{}
+
+func (idx labelIndex) add(clientID uint64, labels map[string]string) {
+	for k, v := range labels {
+		values, ok := idx[k]
+		if !ok {
+			values = make(map[string]map[uint64]struct{})
+			idx[k] = values
+		}
+		ids, ok := values[v]
+		if !ok {
+			ids = make(map[uint64]struct{})
+			values[v] = ids
+		}
+		ids[clientID] = struct{}{}
+	}
+}
+
+func (idx labelIndex) remove(clientID uint64, labels map[string]string) {
+	for k, v := range labels {
+		ids := idx[k][v]
+		delete(ids, clientID)
+		if len(ids) == 0 {
+			delete(idx[k], v)
+		}
+		if len(idx[k]) == 0 {
+			delete(idx, k)
+		}
+	}
+}
+
+// match returns the sorted IDs of clients matching every requirement of sel
+func (idx labelIndex) match(sel message.Selector) []uint64 {
+	clientIDs := []uint64{}
+	if len(sel) == 0 {
+		return clientIDs
+	}
+
+	// start from the smallest candidate set and filter it by the rest
+	var smallest map[uint64]struct{}
+	for _, req := range sel {
+		ids := idx[req.Key][req.Value]
+		if len(ids) == 0 {
+			return clientIDs
+		}
+		if smallest == nil || len(ids) < len(smallest) {
+			smallest = ids
+		}
+	}
+
+Candidates:
+	for clientID := range smallest {
+		for _, req := range sel {
+			if _, ok := idx[req.Key][req.Value][clientID]; !ok {
+				continue Candidates
+			}
+		}
+		clientIDs = append(clientIDs, clientID)
+	}
+	sort.Slice(clientIDs, func(i, j int) bool {
+		return clientIDs[i] < clientIDs[j]
+	})
+	return clientIDs
+}
+
+// setLabels replaces the labels of cli
+func (s *Server) setLabels(cli *client, labels map[string]string) {
+	s.lm.Lock()
+	defer s.lm.Unlock()
+
+	cli.am.Lock()
+	previous := cli.labels
+	cli.labels = labels
+	cli.am.Unlock()
+	s.labels.remove(cli.id, previous)
+	s.labels.add(cli.id, labels)
+}
+
+// SelectClientIDs returns the connecting clientIDs matching sel
+func (s *Server) SelectClientIDs(sel message.Selector) []uint64 {
+	s.lm.RLock()
+	defer s.lm.RUnlock()
+
+	return s.labels.match(sel)
+}
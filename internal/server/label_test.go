@@ -0,0 +1,84 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/badboyd/tcp-hub/pkg/message"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLabelIndex(t *testing.T) {
+	srv := New()
+	worker := &client{id: 1}
+	euWorker := &client{id: 2}
+	backend := &client{id: 3}
+	srv.setLabels(worker, map[string]string{"role": "worker", "region": "us"})
+	srv.setLabels(euWorker, map[string]string{"role": "worker", "region": "eu"})
+	srv.setLabels(backend, map[string]string{"role": "backend", "region": "eu"})
+
+	sel, err := message.ParseSelector("role=worker")
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{1, 2}, srv.SelectClientIDs(sel))
+
+	sel, err = message.ParseSelector("role=worker,region=eu")
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{2}, srv.SelectClientIDs(sel))
+
+	sel, err = message.ParseSelector("role=db")
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{}, srv.SelectClientIDs(sel))
+
+	// relabeling drops the old entries
+	srv.setLabels(euWorker, map[string]string{"role": "backend"})
+	sel, err = message.ParseSelector("role=worker")
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{1}, srv.SelectClientIDs(sel))
+
+	srv.setLabels(worker, nil)
+	srv.setLabels(euWorker, nil)
+	srv.setLabels(backend, nil)
+	assert.Empty(t, srv.labels)
+}
+
+func TestHandleLabels(t *testing.T) {
+	srv := New()
+	defer srv.Stop()
+
+	serverAddr := net.TCPAddr{Port: serverPort}
+	require.NoError(t, srv.Start(&serverAddr))
+
+	conn1, err := net.Dial(serverAddr.Network(), serverAddr.String())
+	require.NoError(t, err)
+	defer conn1.Close()
+
+	conn2, err := net.Dial(serverAddr.Network(), serverAddr.String())
+	require.NoError(t, err)
+	defer conn2.Close()
+	waitForClients(t, srv, 2)
+
+	r2 := bufio.NewReader(conn2)
+	_, err = conn2.Write([]byte("labels role=worker,region=eu\n"))
+	require.NoError(t, err)
+	reply, err := r2.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "labels region=eu,role=worker\n", reply)
+
+	_, err = conn2.Write([]byte("labels role\n"))
+	require.NoError(t, err)
+	reply, err = r2.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "error invalid label\n", reply)
+
+	_, err = conn1.Write([]byte("relay role=worker,region=eu 5\nhello"))
+	require.NoError(t, err)
+
+	expectedRelayMsg := "relay 1 5 id=1\nhello"
+	relayMsg := make([]byte, len(expectedRelayMsg))
+	_, err = io.ReadFull(r2, relayMsg)
+	require.NoError(t, err)
+	assert.Equal(t, expectedRelayMsg, string(relayMsg))
+}
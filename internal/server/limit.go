@@ -0,0 +1,220 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/badboyd/tcp-hub/pkg/message"
+)
+
+const (
+	defaultMaxLineLength = 64 * 1024
+	defaultLineTimeout   = 10 * time.Second
+	defaultFrameTimeout  = 30 * time.Second
+	defaultWriteTimeout  = 5 * time.Second
+	// refuseTimeout bounds writing the reply to a client being disconnected, it may not read
+	refuseTimeout = time.Second
+)
+
+var (
+	errLineTooLong  = errors.New("line too long")
+	errLineTimeout  = errors.New("line timeout")
+	errFrameTimeout = errors.New("frame timeout")
+)
+
+// Stats counts the protocol violations and the limits clients ran into since the server started
+type Stats struct {
+	// LinesTooLong counts command lines longer than the line limit
+	LinesTooLong uint64 `json:"lines_too_long"`
+	// LineTimeouts counts command lines not completed within the line timeout
+	LineTimeouts uint64 `json:"line_timeouts"`
+	// FrameTimeouts counts relay bodies not completed within the frame timeout
+	FrameTimeouts uint64 `json:"frame_timeouts"`
+	// BodiesTooLarge counts relays announcing a body over the body size limit
+	BodiesTooLarge uint64 `json:"bodies_too_large"`
+	// RateLimited and QuotaExceeded count relays over the rate or the daily quota of their sender
+	RateLimited   uint64 `json:"rate_limited"`
+	QuotaExceeded uint64 `json:"quota_exceeded"`
+	// Delayed counts the times a client was not read to bring it back within its rate
+	Delayed uint64 `json:"delayed"`
+	// PolicyDenied counts the actions the policy denied, a relay counts once for every receiver denied
+	PolicyDenied uint64 `json:"policy_denied"`
+	// ConnsRejected counts the connections turned away by admission control
+	ConnsRejected uint64 `json:"conns_rejected"`
+	// ConnsDenied counts the connections from networks the IP rules deny
+	ConnsDenied uint64 `json:"conns_denied"`
+	// AcceptErrors counts the temporary errors accepting connections
+	AcceptErrors uint64 `json:"accept_errors"`
+}
+
+// Stats returns the counters of the server
+func (s *Server) Stats() Stats {
+	return Stats{
+		LinesTooLong:   atomic.LoadUint64(&s.stats.LinesTooLong),
+		LineTimeouts:   atomic.LoadUint64(&s.stats.LineTimeouts),
+		FrameTimeouts:  atomic.LoadUint64(&s.stats.FrameTimeouts),
+		BodiesTooLarge: atomic.LoadUint64(&s.stats.BodiesTooLarge),
+		RateLimited:    atomic.LoadUint64(&s.stats.RateLimited),
+		QuotaExceeded:  atomic.LoadUint64(&s.stats.QuotaExceeded),
+		Delayed:        atomic.LoadUint64(&s.stats.Delayed),
+		PolicyDenied:   atomic.LoadUint64(&s.stats.PolicyDenied),
+		ConnsRejected:  atomic.LoadUint64(&s.stats.ConnsRejected),
+		ConnsDenied:    atomic.LoadUint64(&s.stats.ConnsDenied),
+		AcceptErrors:   atomic.LoadUint64(&s.stats.AcceptErrors),
+	}
+}
+
+// refuse counts the violation err of cli and tells it, the caller disconnects it
+func (s *Server) refuse(cli *client, err error) {
+	switch err {
+	case errLineTooLong:
+		atomic.AddUint64(&s.stats.LinesTooLong, 1)
+	case errLineTimeout:
+		atomic.AddUint64(&s.stats.LineTimeouts, 1)
+	case errFrameTimeout:
+		atomic.AddUint64(&s.stats.FrameTimeouts, 1)
+	case message.ErrBodyTooLarge:
+		atomic.AddUint64(&s.stats.BodiesTooLarge, 1)
+	}
+	log.Printf("[%d] Disconnect client: %s\n", cli.id, err.Error())
+
+	cli.write([]byte(errorReply(err)), refuseTimeout)
+}
+
+// frameDeadline returns when the frame whose first byte arrived at start must be read in full
+// once received bytes of its body arrived. A frame gets the frame timeout and another one
+// for every streamChunkSize bytes received, so large bodies are not cut while a client
+// sending a few bytes at a time is, whatever size it announced.
+func (s *Server) frameDeadline(start time.Time, received int) time.Time {
+	return start.Add(s.frameTimeout * time.Duration(1+received/streamChunkSize))
+}
+
+// relayBodySize returns the body size of a relay command line, 0 for other commands
+// and for bodies over max which the command rejects
+func relayBodySize(line []byte, max int) int {
+	const prefix = message.RelayType + " "
+	if !bytes.HasPrefix(line, []byte(prefix)) {
+		return 0
+	}
+	line = bytes.TrimLeft(line[len(prefix):], " ")
+	sep := bytes.IndexByte(line, ' ')
+	if sep < 0 {
+		return 0
+	}
+	line = bytes.TrimLeft(line[sep:], " ")
+	size := 0
+	for _, b := range line {
+		if b < '0' || b > '9' {
+			break
+		}
+		size = size*10 + int(b-'0')
+		if size > max {
+			// the command rejects it, the body is not waited for
+			return 0
+		}
+	}
+	return size
+}
+
+// lineReader reads command lines up to max bytes, keeping the start of a line across read timeouts
+type lineReader struct {
+	r   *bufio.Reader
+	max int
+	// line holds the start of a line longer than the buffer of r
+	line []byte
+	// pending is set while a line is partly read, since start
+	pending bool
+	start   time.Time
+}
+
+// readLine returns the next line, errLineTooLong when it exceeds max bytes.
+// When reading fails the start of the line is kept for the next call.
+func (l *lineReader) readLine() (string, error) {
+	for {
+		frag, err := l.r.ReadSlice('\n')
+		if len(frag) > 0 && !l.pending {
+			l.pending, l.start = true, time.Now()
+		}
+		if len(l.line)+len(frag) > l.max {
+			return "", errLineTooLong
+		}
+		if err == nil && len(l.line) == 0 {
+			l.pending = false
+			return string(frag), nil
+		}
+		l.line = append(l.line, frag...)
+		switch err {
+		case nil:
+			line := string(l.line)
+			l.line, l.pending = l.line[:0], false
+			if cap(l.line) > l.r.Size() {
+				l.line = nil
+			}
+			return line, nil
+		case bufio.ErrBufferFull:
+		default:
+			return "", err
+		}
+	}
+}
+
+// frameBody reads the body of a frame from r, moving the read deadline of conn as the body arrives
+// and noting whether it passed
+type frameBody struct {
+	r        *bufio.Reader
+	conn     net.Conn
+	s        *Server
+	begin    time.Time
+	received int
+	timedOut bool
+}
+
+// start sets the deadline of the frame whose first byte arrived at begin
+func (b *frameBody) start(begin time.Time) {
+	b.begin, b.received, b.timedOut = begin, 0, false
+	b.conn.SetReadDeadline(b.s.frameDeadline(begin, 0))
+}
+
+func (b *frameBody) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	b.note(n, err)
+	return n, err
+}
+
+func (b *frameBody) Discard(n int) (int, error) {
+	discarded := 0
+	for discarded < n {
+		chunk := n - discarded
+		if chunk > streamChunkSize {
+			chunk = streamChunkSize
+		}
+		d, err := b.r.Discard(chunk)
+		discarded += d
+		b.note(d, err)
+		if err != nil {
+			return discarded, err
+		}
+	}
+	return discarded, nil
+}
+
+func (b *frameBody) note(n int, err error) {
+	if isTimeout(err) {
+		b.timedOut = true
+	}
+	if b.received/streamChunkSize != (b.received+n)/streamChunkSize {
+		b.conn.SetReadDeadline(b.s.frameDeadline(b.begin, b.received+n))
+	}
+	b.received += n
+}
+
+// isTimeout tells whether err is a read deadline passing
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
@@ -0,0 +1,215 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRelayBodySize(t *testing.T) {
+	const max = 1 << 20
+	assert.Equal(t, 5, relayBodySize([]byte("relay 2 5"), max))
+	assert.Equal(t, 12, relayBodySize([]byte("relay  @jobs  12 pick=hash"), max))
+	assert.Equal(t, 0, relayBodySize([]byte("relay 2"), max))
+	assert.Equal(t, 0, relayBodySize([]byte("fetch 1 5"), max))
+	assert.Equal(t, 0, relayBodySize([]byte("relay 2 99999999999999999999"), max))
+	assert.Equal(t, max, relayBodySize([]byte("relay 2 1048576"), max))
+	assert.Equal(t, 0, relayBodySize([]byte("relay 2 1048577"), max))
+}
+
+func TestFrameDeadline(t *testing.T) {
+	srv := New(WithFrameTimeouts(time.Second, 10*time.Second))
+	start := time.Unix(100, 0)
+	assert.Equal(t, start.Add(10*time.Second), srv.frameDeadline(start, 0))
+	assert.Equal(t, start.Add(10*time.Second), srv.frameDeadline(start, streamChunkSize-1))
+	assert.Equal(t, start.Add(30*time.Second), srv.frameDeadline(start, 2*streamChunkSize))
+}
+
+// timeoutReader returns its chunks one read at a time with a timeout after each of them
+type timeoutReader struct {
+	chunks  []string
+	timeout bool
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func (r *timeoutReader) Read(p []byte) (int, error) {
+	if r.timeout {
+		r.timeout = false
+		return 0, timeoutError{}
+	}
+	if len(r.chunks) == 0 {
+		return 0, timeoutError{}
+	}
+	n := copy(p, r.chunks[0])
+	r.chunks[0] = r.chunks[0][n:]
+	if r.chunks[0] == "" {
+		r.chunks = r.chunks[1:]
+		r.timeout = true
+	}
+	return n, nil
+}
+
+func TestLineReader(t *testing.T) {
+	long := strings.Repeat("x", 5000)
+	r := &timeoutReader{chunks: []string{"iden", "tity\nrelay ", long, "\nlist\n", strings.Repeat("y", 7000)}}
+	lines := &lineReader{r: bufio.NewReaderSize(r, 16), max: 6000}
+
+	// a line cut by timeouts is kept until its end arrives
+	var got []string
+	for len(got) < 3 {
+		line, err := lines.readLine()
+		if err != nil {
+			require.True(t, isTimeout(err), err)
+			continue
+		}
+		assert.False(t, lines.pending)
+		got = append(got, line)
+	}
+	assert.Equal(t, []string{"identity\n", "relay " + long + "\n", "list\n"}, got)
+
+	for {
+		_, err := lines.readLine()
+		if isTimeout(err) {
+			continue
+		}
+		assert.Equal(t, errLineTooLong, err)
+		break
+	}
+}
+
+// limitCase feeds an adversarial byte stream to a server
+type limitCase struct {
+	name  string
+	opts  []Option
+	feed  func(conn net.Conn)
+	reply string
+	stat  func(Stats) uint64
+}
+
+var limitCases = []limitCase{
+	{
+		name: "endless line",
+		opts: []Option{WithMaxLineLength(1024)},
+		feed: func(conn net.Conn) {
+			chunk := []byte("relay " + strings.Repeat("1,", 2048))
+			for {
+				if _, err := conn.Write(chunk); err != nil {
+					return
+				}
+			}
+		},
+		reply: "error line too long\n",
+		stat:  func(stats Stats) uint64 { return stats.LinesTooLong },
+	},
+	{
+		name: "line a byte at a time",
+		opts: []Option{WithFrameTimeouts(200*time.Millisecond, time.Second)},
+		feed: func(conn net.Conn) {
+			for {
+				if _, err := conn.Write([]byte("i")); err != nil {
+					return
+				}
+				time.Sleep(20 * time.Millisecond)
+			}
+		},
+		reply: "error line timeout\n",
+		stat:  func(stats Stats) uint64 { return stats.LineTimeouts },
+	},
+	{
+		name: "stalled body",
+		opts: []Option{WithFrameTimeouts(time.Second, 200*time.Millisecond)},
+		feed: func(conn net.Conn) {
+			conn.Write([]byte("relay 1 10\nhel"))
+		},
+		reply: "error frame timeout\n",
+		stat:  func(stats Stats) uint64 { return stats.FrameTimeouts },
+	},
+	{
+		// the timeout follows the bytes received, not the size announced
+		name: "stalled large body",
+		opts: []Option{WithFrameTimeouts(time.Second, 200*time.Millisecond)},
+		feed: func(conn net.Conn) {
+			conn.Write([]byte("relay 1 33554432\nhel"))
+		},
+		reply: "error frame timeout\n",
+		stat:  func(stats Stats) uint64 { return stats.FrameTimeouts },
+	},
+	{
+		name: "body too large",
+		opts: []Option{WithMaxBodySize(1024)},
+		feed: func(conn net.Conn) {
+			conn.Write([]byte("relay 1 1025\n"))
+		},
+		reply: "error body too large\n",
+		stat:  func(stats Stats) uint64 { return stats.BodiesTooLarge },
+	},
+}
+
+// testLimits runs limitCases against servers connected to by dial
+func testLimits(t *testing.T, dial func(t *testing.T, opts []Option) (*Server, net.Conn, func())) {
+	for _, tc := range limitCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			srv, conn, done := dial(t, tc.opts)
+			defer done()
+
+			go tc.feed(conn)
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			r := bufio.NewReader(conn)
+			reply, err := r.ReadString('\n')
+			require.NoError(t, err)
+			assert.Equal(t, tc.reply, reply)
+			assert.Equal(t, uint64(1), tc.stat(srv.Stats()))
+
+			// the client is disconnected
+			_, err = r.ReadByte()
+			assert.Error(t, err)
+		})
+	}
+
+	t.Run("slow client within limits", func(t *testing.T) {
+		_, conn, done := dial(t, []Option{WithFrameTimeouts(time.Second, time.Second)})
+		defer done()
+
+		r := bufio.NewReader(conn)
+		for _, part := range []string{"iden", "tity", "\n"} {
+			_, err := conn.Write([]byte(part))
+			require.NoError(t, err)
+			time.Sleep(50 * time.Millisecond)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		reply, err := r.ReadString('\n')
+		require.NoError(t, err)
+		assert.True(t, strings.HasPrefix(reply, "identity "), reply)
+	})
+}
+
+func TestHandleLimits(t *testing.T) {
+	testLimits(t, func(t *testing.T, opts []Option) (*Server, net.Conn, func()) {
+		srv := New(opts...)
+		srvConn, conn := net.Pipe()
+		cli := &client{id: 1, conn: srvConn}
+		srv.registry.add(cli)
+
+		handled := make(chan struct{})
+		go func() {
+			defer close(handled)
+			srv.handle(cli)
+		}()
+		return srv, conn, func() {
+			conn.Close()
+			close(srv.close)
+			<-handled
+		}
+	})
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/badboyd/tcp-hub/pkg/id"
+	"github.com/badboyd/tcp-hub/pkg/message"
+)
+
+const maxNickLen = 32
+
+// maxReceivers bounds how many client IDs a relay names, ranges make long lists short to write
+const maxReceivers = 1 << 16
+
+var (
+	errNickInvalid = errors.New("invalid name")
+	errNickTaken   = errors.New("name already taken")
+	errNotFound    = errors.New("unknown client")
+
+	errTooManyReceivers = errors.New("too many receivers")
+)
+
+// validNick reports whether name can be used as a nickname.
+// Names must not be numeric nor ranges like "2-40" so they never shadow client IDs.
+func validNick(name string) bool {
+	if name == "" || len(name) > maxNickLen {
+		return false
+	}
+	if _, err := id.ParseIDSet(name); err == nil {
+		return false
+	}
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '_', c == '-', c == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// setNick assigns name to cli, releasing its previous name
+func (s *Server) setNick(cli *client, name string) error {
+	if !validNick(name) {
+		return errNickInvalid
+	}
+
+	s.nm.Lock()
+	defer s.nm.Unlock()
+
+	if owner, ok := s.names[name]; ok {
+		if owner == cli {
+			return nil
+		}
+		return errNickTaken
+	}
+	cli.am.Lock()
+	previous := cli.name
+	cli.name = name
+	cli.am.Unlock()
+	if previous != "" {
+		delete(s.names, previous)
+	}
+	s.names[name] = cli
+	return nil
+}
+
+// lookup finds a connected client by ID or nickname
+func (s *Server) lookup(target string) (*client, error) {
+	if clientID, err := strconv.ParseUint(target, 10, 64); err == nil {
+		if cli, ok := s.registry.get(clientID); ok {
+			return cli, nil
+		}
+		return nil, errNotFound
+	}
+
+	s.nm.RLock()
+	defer s.nm.RUnlock()
+
+	if cli, ok := s.names[target]; ok {
+		return cli, nil
+	}
+	return nil, errNotFound
+}
+
+// resolveReceivers translates a comma separated list of IDs and names,
+// or a label selector, to IDs.
+// Unknown names are skipped, the same way unknown IDs are.
+func (s *Server) resolveReceivers(receivers string) ([]uint64, error) {
+	if message.IsSelector(receivers) {
+		sel, err := message.ParseSelector(receivers)
+		if err != nil {
+			return nil, err
+		}
+		return s.SelectClientIDs(sel), nil
+	}
+
+	// receivers are usually IDs and ranges of IDs only, resolved without locking
+	set, err := id.ParseIDSet(receivers)
+	if err != nil {
+		if set, err = s.resolveNames(receivers); err != nil {
+			return nil, err
+		}
+	}
+	if set.Len() > maxReceivers {
+		return nil, errTooManyReceivers
+	}
+	return set.AppendIDs(make([]uint64, 0, int(set.Len()))), nil
+}
+
+// resolveNames translates a comma separated list of IDs and names to IDs
+func (s *Server) resolveNames(receivers string) (id.IDSet, error) {
+	s.nm.RLock()
+	defer s.nm.RUnlock()
+
+	set := id.IDSet{}
+	for _, word := range strings.Split(receivers, ",") {
+		word = strings.TrimSpace(word)
+		if ids, err := id.ParseIDSet(word); err == nil && !ids.Empty() {
+			set = set.Union(ids)
+			continue
+		}
+		if !validNick(word) {
+			return set, errors.New("Unknown ID format")
+		}
+		if cli, ok := s.names[word]; ok {
+			set = set.Union(id.NewIDSet(cli.id))
+		}
+	}
+	return set, nil
+}
+
+// listClients returns the connected clients listerID may see except itself, with their names when names is set
+func (s *Server) listClients(listerID uint64, names bool) []message.ListEntry {
+	clients := s.registry.snapshot()
+	policy := s.Policy()
+
+	var lister Principal
+	if policy != nil {
+		lister = s.senderPrincipal(listerID)
+	}
+	entries := make([]message.ListEntry, 0, len(clients))
+	for _, cli := range clients {
+		if cli.id == listerID {
+			continue
+		}
+		if policy != nil {
+			to := principal(cli)
+			if !policy.Allowed(PolicyRequest{Action: ActionList, From: lister, To: &to}) {
+				continue
+			}
+		}
+		entry := message.ListEntry{ID: cli.id}
+		if names {
+			entry.Name = s.nameOf(cli)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
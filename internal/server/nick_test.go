@@ -0,0 +1,140 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/badboyd/tcp-hub/pkg/message"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidNick(t *testing.T) {
+	tcs := []struct {
+		name     string
+		in       string
+		expected bool
+	}{
+		{name: "empty", in: "", expected: false},
+		{name: "numeric", in: "42", expected: false},
+		{name: "range", in: "2-40", expected: false},
+		{name: "space", in: "a b", expected: false},
+		{name: "comma", in: "a,b", expected: false},
+		{name: "too long", in: "abcdefghijklmnopqrstuvwxyz0123456", expected: false},
+		{name: "normal", in: "alice", expected: true},
+		{name: "symbols", in: "bob_2.worker-1", expected: true},
+	}
+
+	for _, tc := range tcs {
+		var (
+			in       = tc.in
+			expected = tc.expected
+		)
+
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, expected, validNick(in))
+		})
+	}
+}
+
+func TestSetNick(t *testing.T) {
+	srv := New()
+	alice := &client{id: 1}
+	bob := &client{id: 2}
+	srv.registry.add(alice)
+	srv.registry.add(bob)
+
+	require.NoError(t, srv.setNick(alice, "alice"))
+	require.NoError(t, srv.setNick(alice, "alice"))
+	assert.Equal(t, errNickTaken, srv.setNick(bob, "alice"))
+	assert.Equal(t, errNickInvalid, srv.setNick(bob, "2"))
+
+	// renaming releases the old name
+	require.NoError(t, srv.setNick(alice, "carol"))
+	require.NoError(t, srv.setNick(bob, "alice"))
+
+	cli, err := srv.lookup("carol")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), cli.id)
+
+	cli, err = srv.lookup("2")
+	require.NoError(t, err)
+	assert.Equal(t, "alice", cli.name)
+
+	_, err = srv.lookup("dave")
+	assert.Equal(t, errNotFound, err)
+
+	receiverIDs, err := srv.resolveReceivers("carol,2,dave,7")
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{1, 2, 7}, receiverIDs)
+
+	// ranges and duplicates name each receiver once
+	receiverIDs, err = srv.resolveReceivers("5-7,carol,2,1,6")
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{1, 2, 5, 6, 7}, receiverIDs)
+
+	_, err = srv.resolveReceivers("carol,a b")
+	assert.Error(t, err)
+
+	_, err = srv.resolveReceivers("1-100000")
+	assert.Equal(t, errTooManyReceivers, err)
+
+	assert.Equal(t, []message.ListEntry{{ID: 2, Name: "alice"}}, srv.listClients(1, true))
+}
+
+func TestHandleNick(t *testing.T) {
+	srv := New()
+	defer srv.Stop()
+
+	serverAddr := net.TCPAddr{Port: serverPort}
+	require.NoError(t, srv.Start(&serverAddr))
+
+	conn1, err := net.Dial(serverAddr.Network(), serverAddr.String())
+	require.NoError(t, err)
+	defer conn1.Close()
+	waitForClients(t, srv, 1)
+
+	conn2, err := net.Dial(serverAddr.Network(), serverAddr.String())
+	require.NoError(t, err)
+	defer conn2.Close()
+	waitForClients(t, srv, 2)
+
+	r1 := bufio.NewReader(conn1)
+	r2 := bufio.NewReader(conn2)
+
+	tcs := []struct {
+		conn          net.Conn
+		r             *bufio.Reader
+		msg           string
+		expectedReply string
+	}{
+		{conn: conn1, r: r1, msg: "nick alice\n", expectedReply: "nick alice\n"},
+		{conn: conn2, r: r2, msg: "nick alice\n", expectedReply: "error name already taken\n"},
+		{conn: conn2, r: r2, msg: "nick 12\n", expectedReply: "error invalid name\n"},
+		{conn: conn2, r: r2, msg: "whois alice\n", expectedReply: "whois 1 alice\n"},
+		{conn: conn1, r: r1, msg: "whois 2\n", expectedReply: "whois 2 \n"},
+		{conn: conn1, r: r1, msg: "whois bob\n", expectedReply: "error unknown client\n"},
+		{conn: conn2, r: r2, msg: "list names\n", expectedReply: "list 1:alice\n"},
+		{conn: conn1, r: r1, msg: "list names\n", expectedReply: "list 2\n"},
+	}
+
+	for _, tc := range tcs {
+		_, err := tc.conn.Write([]byte(tc.msg))
+		require.NoError(t, err)
+
+		reply, err := tc.r.ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, tc.expectedReply, reply, tc.msg)
+	}
+
+	_, err = conn2.Write([]byte("relay alice 5\nhello"))
+	require.NoError(t, err)
+
+	expectedRelayMsg := "relay 2 5 id=1\nhello"
+	relayMsg := make([]byte, len(expectedRelayMsg))
+	_, err = io.ReadFull(r1, relayMsg)
+	require.NoError(t, err)
+	assert.Equal(t, expectedRelayMsg, string(relayMsg))
+}
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"net"
+	"runtime"
+	"time"
+
+	"github.com/badboyd/tcp-hub/pkg/id"
+)
+
+const (
+	defaultAckTimeout      = 30 * time.Second
+	defaultMaxRedeliveries = 5
+)
+
+// Option configures a Server
+type Option func(*Server)
+
+// WithAckTimeout sets how long at-least-once deliveries wait for an ack, once written, before redelivery
+func WithAckTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.ackTimeout = d
+	}
+}
+
+// WithMaxRedeliveries sets how many times an unacked message is redelivered before it is dropped
+func WithMaxRedeliveries(n int) Option {
+	return func(s *Server) {
+		s.maxRedeliveries = n
+	}
+}
+
+// WithInboxLimit sets how many messages and body bytes a pull mode client keeps before further messages are rejected
+func WithInboxLimit(messages int, bytes int64) Option {
+	return func(s *Server) {
+		s.inboxMessages = messages
+		s.inboxBytes = bytes
+	}
+}
+
+// WithStreamThreshold sets the body size from which relays are forwarded while they are read,
+// 0 reads every body in full before relaying it
+func WithStreamThreshold(size int) Option {
+	return func(s *Server) {
+		s.streamThreshold = size
+	}
+}
+
+// WithRegistryShards sets how many shards keep the connected clients, rounded up to a power of two,
+// 1 puts them all behind one lock
+func WithRegistryShards(n int) Option {
+	return func(s *Server) {
+		s.registryShards = n
+	}
+}
+
+// WithMaxLineLength sets the longest command line, newline included, a client sending a longer one is disconnected
+func WithMaxLineLength(n int) Option {
+	return func(s *Server) {
+		s.maxLineLength = n
+	}
+}
+
+// WithMaxBodySize sets the largest relay body, a client announcing a larger one is disconnected
+func WithMaxBodySize(size int) Option {
+	return func(s *Server) {
+		s.maxBodySize = size
+	}
+}
+
+// WithFrameTimeouts sets how long a client has to send a command line and a whole frame
+// from their first byte, relay bodies get another frame timeout for every 32KB received.
+// A client missing them is disconnected.
+func WithFrameTimeouts(line, frame time.Duration) Option {
+	return func(s *Server) {
+		s.lineTimeout = line
+		s.frameTimeout = frame
+	}
+}
+
+// WithWriteTimeout sets how long replies and notices may take to be written to a client,
+// the network cores wait for them and a client not reading them in time is disconnected
+func WithWriteTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.writeTimeout = d
+	}
+}
+
+// WithRateLimit sets the limit of every client, or of the clients of every IP with LimitByIP.
+// Limits of single clients or IPs are set with Server.SetLimit.
+func WithRateLimit(by LimitBy, limit Limit) Option {
+	return func(s *Server) {
+		s.limitBy = by
+		s.limit = limit
+	}
+}
+
+// WithMaxClients sets how many clients may be connected at once, 0 is unlimited.
+// Connections over it are told "busy max clients" and closed.
+func WithMaxClients(n int) Option {
+	return func(s *Server) {
+		s.maxClients = n
+	}
+}
+
+// WithIPRules sets the rules deciding which networks may connect, see Server.SetIPRules to change them.
+// Connections from other networks are closed before they get a client ID.
+func WithIPRules(rules *IPRules) Option {
+	return func(s *Server) {
+		s.admission.ipRules = rules
+	}
+}
+
+// WithPolicy sets the policy deciding what clients may do, see Server.SetPolicy to change it
+func WithPolicy(p *Policy) Option {
+	return func(s *Server) {
+		s.policy.Store(p)
+	}
+}
+
+// WithProxyProtocol reads a PROXY protocol v1 or v2 header from the connections of the trusted proxies,
+// their clients are then known by the address in the header, in logs, IP rules, limits and admin views.
+// Connections from other addresses are served as they come.
+func WithProxyProtocol(trusted ...*net.IPNet) Option {
+	return func(s *Server) {
+		s.trustedProxies = trusted
+	}
+}
+
+// WithMaxClientsPerIP sets how many clients may be connected at once from an IP, 0 is unlimited
+func WithMaxClientsPerIP(n int) Option {
+	return func(s *Server) {
+		s.maxClientsPerIP = n
+	}
+}
+
+// WithAcceptRate sets how many connections are accepted per second, in bursts of up to burst
+// which defaults to one second of them. Connections over the rate are told "busy accept rate" and closed.
+func WithAcceptRate(perSecond float64, burst int) Option {
+	return func(s *Server) {
+		s.acceptRate = perSecond
+		s.acceptBurst = burst
+	}
+}
+
+// WithEventLoop serves connections from an epoll event loop with the given number of workers
+// instead of a goroutine per connection, workers below 1 use one per CPU.
+// It is only supported on linux, relays are read in full before they are forwarded.
+func WithEventLoop(workers int) Option {
+	return func(s *Server) {
+		if workers < 1 {
+			workers = runtime.GOMAXPROCS(0)
+		}
+		s.eventLoopWorkers = workers
+	}
+}
+
+// WithIDAllocator sets how client IDs are allocated, by default they count from 1 on every start
+func WithIDAllocator(ids id.Allocator) Option {
+	return func(s *Server) {
+		s.ids = ids
+	}
+}
+
+// WithClock replaces the clock used for TTLs, ack deadlines, request timeouts and scheduled delivery
+func WithClock(clock Clock) Option {
+	return func(s *Server) {
+		s.clock = clock
+	}
+}
@@ -0,0 +1,240 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/badboyd/tcp-hub/pkg/message"
+)
+
+// Outbound lanes, a receiver gets frames of a lower lane first
+const (
+	laneHigh = iota
+	laneNormal
+	laneBulk
+	laneCount
+)
+
+// starvationLimit is how many frames of higher lanes are written
+// before a waiting frame of a lower lane goes first
+const starvationLimit = 8
+
+var errPriorityInvalid = errors.New("invalid priority")
+
+// laneOf returns the outbound lane for the priority of a relay
+func laneOf(fields map[string]string) (int, error) {
+	switch fields[message.FieldPriority] {
+	case message.PriorityHigh:
+		return laneHigh, nil
+	case "", message.PriorityNormal:
+		return laneNormal, nil
+	case message.PriorityBulk:
+		return laneBulk, nil
+	default:
+		return laneNormal, errPriorityInvalid
+	}
+}
+
+// outbound is a frame queued for a receiver
+type outbound struct {
+	frame    *frame
+	vec      [2][]byte
+	bufs     net.Buffers
+	size     int
+	msgID    uint64
+	senderID uint64
+	// expires is zero for messages without TTL
+	expires time.Time
+	notify  bool
+	lane    int
+	// d is set for deliveries waiting for an ack
+	d *delivery
+	// stream is set instead of frame for relays forwarded while they are read, tap is the receiver in it
+	stream *stream
+	tap    int
+}
+
+// release is called once ob is written or dropped
+func (ob *outbound) release() {
+	if ob.stream != nil {
+		ob.stream.release(ob.tap)
+		return
+	}
+	ob.frame.release()
+}
+
+func (ob *outbound) expired(now time.Time) bool {
+	return !ob.expires.IsZero() && now.After(ob.expires)
+}
+
+// outbox queues frames for a receiver in priority lanes,
+// a writer goroutine runs while it is not empty
+type outbox struct {
+	m     sync.Mutex
+	lanes [laneCount][]*outbound
+	// skipped counts frames written while a lane was waiting
+	skipped [laneCount]int
+	running bool
+
+	queued      int
+	queuedBytes int64
+	credit      credit
+	// pull outboxes are not written but read with fetch, ready tells a waiting fetch about new frames
+	pull  bool
+	ready chan struct{}
+}
+
+// pop takes the next frame to write, nil when the outbox is empty
+func (out *outbox) pop() *outbound {
+	lane := -1
+	for l := range out.lanes {
+		if len(out.lanes[l]) > 0 {
+			lane = l
+			break
+		}
+	}
+	if lane < 0 {
+		return nil
+	}
+	// the most starved lower lane goes first once it waited long enough
+	for l := laneCount - 1; l > lane; l-- {
+		if len(out.lanes[l]) > 0 && out.skipped[l] >= starvationLimit {
+			lane = l
+			break
+		}
+	}
+	for l := lane + 1; l < laneCount; l++ {
+		if len(out.lanes[l]) > 0 {
+			out.skipped[l]++
+		}
+	}
+	out.skipped[lane] = 0
+
+	ob := out.lanes[lane][0]
+	out.lanes[lane][0] = nil
+	out.lanes[lane] = out.lanes[lane][1:]
+	out.queued--
+	out.queuedBytes -= int64(ob.size)
+	return ob
+}
+
+// clear drops all queued frames
+func (out *outbox) clear() {
+	for l := range out.lanes {
+		for _, ob := range out.lanes[l] {
+			ob.release()
+		}
+		out.lanes[l] = nil
+		out.skipped[l] = 0
+	}
+	out.queued = 0
+	out.queuedBytes = 0
+}
+
+// enqueue queues ob for receiver and starts its writer when needed
+func (s *Server) enqueue(receiver *client, ob *outbound) {
+	out := &receiver.out
+	out.m.Lock()
+	if out.pull && (out.queued >= s.inboxMessages || out.queuedBytes+int64(ob.size) > s.inboxBytes) ||
+		!out.pull && out.credit.reject && !out.credit.covers(out.queued, out.queuedBytes) {
+		out.m.Unlock()
+		s.reject(receiver, ob)
+		return
+	}
+	out.lanes[ob.lane] = append(out.lanes[ob.lane], ob)
+	out.queued++
+	out.queuedBytes += int64(ob.size)
+	if out.pull {
+		select {
+		case out.ready <- struct{}{}:
+		default:
+		}
+	}
+	start := !out.running && !out.pull && out.credit.allows()
+	if start {
+		out.running = true
+	}
+	out.m.Unlock()
+
+	if start {
+		go s.flush(receiver)
+	}
+}
+
+// flush writes queued frames to receiver until its outbox is empty or it runs out of credit
+func (s *Server) flush(receiver *client) {
+	out := &receiver.out
+	for {
+		out.m.Lock()
+		if out.pull || !out.credit.allows() {
+			out.running = false
+			out.m.Unlock()
+			return
+		}
+		ob := out.pop()
+		if ob == nil {
+			out.running = false
+			out.m.Unlock()
+			return
+		}
+		out.credit.consume(ob.size)
+		out.m.Unlock()
+
+		if ob.expired(s.clock.Now()) {
+			out.m.Lock()
+			out.credit.refund(ob.size)
+			out.m.Unlock()
+			s.expire(receiver, ob)
+			continue
+		}
+		var err error
+		if ob.stream != nil {
+			err = s.writeStream(receiver, ob)
+		} else {
+			err = receiver.writeFrame(ob)
+			ob.frame.release()
+			if err == nil {
+				s.written(receiver, ob)
+			}
+		}
+		if err != nil {
+			log.Printf("Error send msg to %d: %s\n", receiver.id, err.Error())
+			out.m.Lock()
+			out.clear()
+			out.running = false
+			out.m.Unlock()
+			return
+		}
+	}
+}
+
+// sweep drops the expired frames of receiver's outbox
+func (s *Server) sweep(receiver *client, now time.Time) {
+	out := &receiver.out
+	out.m.Lock()
+	expired := []*outbound{}
+	for l, queue := range out.lanes {
+		kept := queue[:0]
+		for _, ob := range queue {
+			if ob.expired(now) {
+				expired = append(expired, ob)
+				out.queued--
+				out.queuedBytes -= int64(ob.size)
+				continue
+			}
+			kept = append(kept, ob)
+		}
+		for i := len(kept); i < len(queue); i++ {
+			queue[i] = nil
+		}
+		out.lanes[l] = kept
+	}
+	out.m.Unlock()
+
+	for _, ob := range expired {
+		s.expire(receiver, ob)
+	}
+}
@@ -0,0 +1,45 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLaneOf(t *testing.T) {
+	for priority, expected := range map[string]int{"": laneNormal, "high": laneHigh, "normal": laneNormal, "bulk": laneBulk} {
+		lane, err := laneOf(map[string]string{"prio": priority})
+		assert.NoError(t, err)
+		assert.Equal(t, expected, lane, priority)
+	}
+	_, err := laneOf(map[string]string{"prio": "urgent"})
+	assert.Equal(t, errPriorityInvalid, err)
+}
+
+func TestOutboxPop(t *testing.T) {
+	out := outbox{}
+	push := func(lane int, n int) {
+		for i := 0; i < n; i++ {
+			out.lanes[lane] = append(out.lanes[lane], &outbound{msgID: uint64(lane*100 + i), lane: lane})
+		}
+	}
+	push(laneBulk, 2)
+	push(laneNormal, 12)
+	push(laneHigh, 10)
+
+	lanes := []int{}
+	for ob := out.pop(); ob != nil; ob = out.pop() {
+		lanes = append(lanes, ob.lane)
+	}
+
+	// waiting lanes get a frame in after starvationLimit frames of higher lanes
+	expected := []int{
+		laneHigh, laneHigh, laneHigh, laneHigh, laneHigh, laneHigh, laneHigh, laneHigh,
+		laneBulk, laneNormal,
+		laneHigh, laneHigh,
+		laneNormal, laneNormal, laneNormal, laneNormal, laneNormal,
+		laneBulk,
+		laneNormal, laneNormal, laneNormal, laneNormal, laneNormal, laneNormal,
+	}
+	assert.Equal(t, expected, lanes)
+}
@@ -0,0 +1,295 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+
+	"github.com/badboyd/tcp-hub/pkg/id"
+	"github.com/badboyd/tcp-hub/pkg/message"
+)
+
+// Effect is the decision of a policy rule
+type Effect string
+
+const (
+	// Allow lets the action through
+	Allow Effect = "allow"
+	// Deny refuses the action, the client is told
+	Deny Effect = "deny"
+)
+
+// Actions decided by policies, named after their commands
+const (
+	// ActionRelay is relaying to a client, or to a queue group
+	ActionRelay = message.RelayType
+	// ActionList is seeing a client in list replies
+	ActionList = message.ListType
+	// ActionWhois is looking a client up with whois
+	ActionWhois = message.WhoisType
+	// ActionQueueJoin is joining a queue group
+	ActionQueueJoin = message.QueueJoinType
+	// ActionLabels is setting labels, the target carries the labels set
+	ActionLabels = message.LabelsType
+	// ActionNick is setting a nick
+	ActionNick = message.NickType
+)
+
+var errNotAllowed = errors.New("not allowed")
+
+// Principal is a client as policies see it
+type Principal struct {
+	ID     uint64
+	Labels map[string]string
+	IP     net.IP
+}
+
+// PolicyRequest asks whether From may take Action on To, a client, or on Group, a queue group
+type PolicyRequest struct {
+	Action string
+	From   Principal
+	To     *Principal
+	Group  string
+}
+
+// PolicyRule decides the requests it matches.
+// A rule matches the requests of one of its actions whose sender has the labels of From and an IP in FromNets,
+// and whose target client has the labels of To or target group is Group. Empty matchers match every request,
+// a label "*" matches any value of the label.
+type PolicyRule struct {
+	Actions  []string          `json:"actions"`
+	From     map[string]string `json:"from,omitempty"`
+	FromNets []string          `json:"from_nets,omitempty"`
+	To       map[string]string `json:"to,omitempty"`
+	Group    string            `json:"group,omitempty"`
+	Effect   Effect            `json:"effect"`
+
+	nets []*net.IPNet
+}
+
+// Policy decides what clients may do, by its first rule matching a request or else by Default.
+// A nil Policy allows everything.
+type Policy struct {
+	Default Effect       `json:"default,omitempty"`
+	Rules   []PolicyRule `json:"rules"`
+}
+
+// ParsePolicy reads a policy from JSON, such as
+//
+//	{"default": "deny", "rules": [
+//		{"actions": ["relay", "list"], "from": {"role": "device"}, "to": {"role": "backend"}, "effect": "allow"},
+//		{"actions": ["relay", "list"], "from": {"role": "backend"}, "effect": "allow"}
+//	]}
+func ParsePolicy(r io.Reader) (*Policy, error) {
+	var p Policy
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&p); err != nil {
+		return nil, err
+	}
+	if p.Default == "" {
+		p.Default = Allow
+	}
+	if p.Default != Allow && p.Default != Deny {
+		return nil, fmt.Errorf("invalid default effect %q", p.Default)
+	}
+	for i := range p.Rules {
+		if err := p.Rules[i].compile(); err != nil {
+			return nil, fmt.Errorf("rule %d: %s", i, err.Error())
+		}
+	}
+	return &p, nil
+}
+
+// LoadPolicy reads a policy from the JSON file at path, see ParsePolicy
+func LoadPolicy(path string) (*Policy, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParsePolicy(f)
+}
+
+// compile checks rule and parses its networks
+func (rule *PolicyRule) compile() error {
+	if rule.Effect != Allow && rule.Effect != Deny {
+		return fmt.Errorf("invalid effect %q", rule.Effect)
+	}
+	if len(rule.Actions) == 0 {
+		return errors.New("no actions")
+	}
+	for _, action := range rule.Actions {
+		switch action {
+		case ActionRelay, ActionList, ActionWhois, ActionQueueJoin, ActionLabels, ActionNick:
+		default:
+			return fmt.Errorf("unknown action %q", action)
+		}
+	}
+	rule.nets = rule.nets[:0]
+	for _, cidr := range rule.FromNets {
+		ipNet, err := parseCIDR(cidr)
+		if err != nil {
+			return err
+		}
+		rule.nets = append(rule.nets, ipNet)
+	}
+	return nil
+}
+
+// Allowed tells whether p allows req
+func (p *Policy) Allowed(req PolicyRequest) bool {
+	if p == nil {
+		return true
+	}
+	for i := range p.Rules {
+		if p.Rules[i].matches(req) {
+			return p.Rules[i].Effect == Allow
+		}
+	}
+	return p.Default != Deny
+}
+
+func (rule *PolicyRule) matches(req PolicyRequest) bool {
+	if !rule.hasAction(req.Action) || !matchLabels(rule.From, req.From.Labels) {
+		return false
+	}
+	if len(rule.nets) > 0 && !containsIP(rule.nets, req.From.IP) {
+		return false
+	}
+	if rule.To != nil && (req.To == nil || !matchLabels(rule.To, req.To.Labels)) {
+		return false
+	}
+	return rule.Group == "" || rule.Group == req.Group
+}
+
+func (rule *PolicyRule) hasAction(action string) bool {
+	for _, a := range rule.Actions {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
+
+// matchLabels tells whether labels have every label of want
+func matchLabels(want, labels map[string]string) bool {
+	for k, v := range want {
+		got, ok := labels[k]
+		if !ok || v != "*" && v != got {
+			return false
+		}
+	}
+	return true
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// principal returns cli as policies see it
+func principal(cli *client) Principal {
+	cli.am.Lock()
+	p := Principal{ID: cli.id, Labels: cli.labels, IP: cli.addr}
+	cli.am.Unlock()
+	return p
+}
+
+// senderPrincipal returns the sender senderID as policies see it, a sender gone has only its ID
+func (s *Server) senderPrincipal(senderID uint64) Principal {
+	if cli, ok := s.registry.get(senderID); ok {
+		return principal(cli)
+	}
+	return Principal{ID: senderID}
+}
+
+// allowed tells whether the policy lets cli take action on target or group
+func (s *Server) allowed(action string, cli, target *client, group string) bool {
+	policy := s.Policy()
+	if policy == nil {
+		return true
+	}
+
+	req := PolicyRequest{Action: action, From: principal(cli), Group: group}
+	if target != nil {
+		to := principal(target)
+		req.To = &to
+	}
+	return s.decide(policy, req)
+}
+
+// decide counts the requests policy denies
+func (s *Server) decide(policy *Policy, req PolicyRequest) bool {
+	if policy.Allowed(req) {
+		return true
+	}
+	atomic.AddUint64(&s.stats.PolicyDenied, 1)
+	return false
+}
+
+// allowedLabels tells whether the policy lets cli set labels
+func (s *Server) allowedLabels(cli *client, labels map[string]string) bool {
+	policy := s.Policy()
+	if policy == nil {
+		return true
+	}
+	return s.decide(policy, PolicyRequest{Action: ActionLabels, From: principal(cli), To: &Principal{ID: cli.id, Labels: labels}})
+}
+
+// authorizeReceivers returns the receivers senderID may relay msgID to,
+// with the denied notice to send back when it may not relay to some
+func (s *Server) authorizeReceivers(senderID, msgID uint64, receiverIDs []uint64) ([]uint64, string) {
+	policy := s.Policy()
+	if policy == nil {
+		return receiverIDs, ""
+	}
+
+	from := s.senderPrincipal(senderID)
+	allowed := receiverIDs[:0:0]
+	var denied []uint64
+	for _, receiverID := range receiverIDs {
+		// receivers not connected are left to relayMessage
+		if receiver, ok := s.registry.get(receiverID); ok && receiverID != senderID {
+			to := principal(receiver)
+			if !s.decide(policy, PolicyRequest{Action: ActionRelay, From: from, To: &to}) {
+				denied = append(denied, receiverID)
+				continue
+			}
+		}
+		allowed = append(allowed, receiverID)
+	}
+	if len(denied) == 0 {
+		return allowed, ""
+	}
+	return allowed, string(message.Denied{MsgID: msgID, Receivers: id.JoinIDArray(denied, ",")}.AppendTo(nil))
+}
+
+// authorizeGroup returns the denied notice to send back when senderID may not relay msgID to group
+func (s *Server) authorizeGroup(senderID, msgID uint64, group string) string {
+	policy := s.Policy()
+	if policy == nil || s.decide(policy, PolicyRequest{Action: ActionRelay, From: s.senderPrincipal(senderID), Group: group}) {
+		return ""
+	}
+	return string(message.Denied{MsgID: msgID, Receivers: message.QueuePrefix + group}.AppendTo(nil))
+}
+
+// SetPolicy replaces the policy deciding what clients may do, nil allows everything.
+// Relays scheduled before are decided by the policy in use when they are due.
+func (s *Server) SetPolicy(p *Policy) {
+	s.policy.Store(p)
+}
+
+// Policy returns the policy deciding what clients may do
+func (s *Server) Policy() *Policy {
+	p, _ := s.policy.Load().(*Policy)
+	return p
+}
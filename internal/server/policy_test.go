@@ -0,0 +1,127 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testPolicy = `{"default": "deny", "rules": [
+	{"actions": ["labels"], "to": {"role": "backend"}, "from_nets": ["10.0.0.0/8"], "effect": "allow"},
+	{"actions": ["labels"], "to": {"role": "backend"}, "effect": "deny"},
+	{"actions": ["labels", "nick"], "effect": "allow"},
+	{"actions": ["relay", "list"], "from": {"role": "device"}, "to": {"role": "backend"}, "effect": "allow"},
+	{"actions": ["relay"], "from": {"role": "device"}, "group": "jobs", "effect": "allow"},
+	{"actions": ["relay", "list", "whois"], "from": {"role": "backend"}, "effect": "allow"},
+	{"actions": ["qjoin"], "from": {"role": "*"}, "group": "jobs", "effect": "allow"}
+]}`
+
+func TestPolicy(t *testing.T) {
+	p, err := ParsePolicy(strings.NewReader(testPolicy))
+	require.NoError(t, err)
+
+	device := Principal{ID: 1, Labels: map[string]string{"role": "device"}, IP: net.ParseIP("192.168.0.1")}
+	backend := Principal{ID: 2, Labels: map[string]string{"role": "backend"}, IP: net.ParseIP("10.0.0.1")}
+	other := Principal{ID: 3}
+
+	tcs := []struct {
+		name    string
+		req     PolicyRequest
+		allowed bool
+	}{
+		{"device to backend", PolicyRequest{Action: ActionRelay, From: device, To: &backend}, true},
+		{"device to device", PolicyRequest{Action: ActionRelay, From: device, To: &device}, false},
+		{"device lists backend", PolicyRequest{Action: ActionList, From: device, To: &backend}, true},
+		{"device lists device", PolicyRequest{Action: ActionList, From: device, To: &device}, false},
+		{"device whois backend", PolicyRequest{Action: ActionWhois, From: device, To: &backend}, false},
+		{"backend to anyone", PolicyRequest{Action: ActionRelay, From: backend, To: &other}, true},
+		{"device to group", PolicyRequest{Action: ActionRelay, From: device, Group: "jobs"}, true},
+		{"device to other group", PolicyRequest{Action: ActionRelay, From: device, Group: "mail"}, false},
+		{"unlabeled joins", PolicyRequest{Action: ActionQueueJoin, From: other, Group: "jobs"}, false},
+		{"labeled joins", PolicyRequest{Action: ActionQueueJoin, From: device, Group: "jobs"}, true},
+		{"backend labels from its network", PolicyRequest{Action: ActionLabels, From: backend, To: &backend}, true},
+		{"backend labels from elsewhere", PolicyRequest{Action: ActionLabels, From: device, To: &backend}, false},
+		{"device labels", PolicyRequest{Action: ActionLabels, From: other, To: &device}, true},
+		{"nick", PolicyRequest{Action: ActionNick, From: other}, true},
+	}
+	for _, tc := range tcs {
+		assert.Equal(t, tc.allowed, p.Allowed(tc.req), tc.name)
+	}
+
+	var none *Policy
+	assert.True(t, none.Allowed(PolicyRequest{Action: ActionRelay, From: device, To: &device}))
+	p, err = ParsePolicy(strings.NewReader(`{"rules": []}`))
+	require.NoError(t, err)
+	assert.True(t, p.Allowed(PolicyRequest{Action: ActionRelay, From: device, To: &device}))
+
+	for _, bad := range []string{
+		`{"default": "maybe"}`,
+		`{"rules": [{"actions": ["relay"], "effect": "permit"}]}`,
+		`{"rules": [{"actions": ["send"], "effect": "allow"}]}`,
+		`{"rules": [{"effect": "allow"}]}`,
+		`{"rules": [{"actions": ["relay"], "from_nets": ["10.0.0.0/40"], "effect": "allow"}]}`,
+		`{"rules": [{"actions": ["relay"], "sender": {}, "effect": "allow"}]}`,
+	} {
+		_, err := ParsePolicy(strings.NewReader(bad))
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestHandlePolicy(t *testing.T) {
+	p, err := ParsePolicy(strings.NewReader(testPolicy))
+	require.NoError(t, err)
+	srv, addr := startAdmission(t, WithPolicy(p))
+	defer srv.Stop()
+
+	readers := make(map[net.Conn]*bufio.Reader)
+	request := func(conn net.Conn, cmd string) string {
+		_, err := conn.Write([]byte(cmd))
+		require.NoError(t, err)
+		reply, err := readers[conn].ReadString('\n')
+		require.NoError(t, err)
+		return reply
+	}
+	var device, backend, device2 net.Conn
+	for _, conn := range []*net.Conn{&device, &backend, &device2} {
+		c, r := dialFrom(t, "127.0.0.1", addr)
+		defer c.Close()
+		*conn, readers[c] = c, r
+		// clients are served in order
+		assert.Regexp(t, "^identity ", request(*conn, "identity\n"))
+	}
+
+	assert.Equal(t, "labels role=device\n", request(device, "labels role=device\n"))
+	// only clients from 10.0.0.0/8 may claim to be a backend
+	assert.Equal(t, "error not allowed\n", request(backend, "labels role=backend\n"))
+	srv.SetPolicy(mustParsePolicy(t, strings.Replace(testPolicy, "10.0.0.0/8", "127.0.0.0/8", 1)))
+	assert.Equal(t, "labels role=backend\n", request(backend, "labels role=backend\n"))
+	assert.Equal(t, "labels role=device\n", request(device2, "labels role=device\n"))
+
+	// list returns the clients a device may message only
+	assert.Equal(t, "list 2\n", request(device, "list\n"))
+	assert.Equal(t, "list 1,3\n", request(backend, "list\n"))
+	assert.Equal(t, "error not allowed\n", request(device, "whois 3\n"))
+
+	// denied receivers are reported, the others get the message
+	assert.Equal(t, "denied 1 3\n", request(device, "relay 2,3 5\nhello"))
+	assert.Equal(t, "relay 1 5 id=1\n", request(backend, ""))
+	assert.Equal(t, "denied 2 @mail\n", request(device, "relay @mail 5\nhelloidentity\n"))
+	assert.Equal(t, "identity 1\n", request(device, ""))
+	assert.Equal(t, uint64(4), srv.Stats().PolicyDenied)
+
+	w := httptest.NewRecorder()
+	srv.AdminHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/policy", nil))
+	assert.Contains(t, w.Body.String(), `"default":"deny"`)
+}
+
+func mustParsePolicy(t *testing.T, s string) *Policy {
+	p, err := ParsePolicy(strings.NewReader(s))
+	require.NoError(t, err)
+	return p
+}
@@ -0,0 +1,177 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// proxyHeaderTimeout bounds the wait for the PROXY protocol header of a trusted proxy
+	proxyHeaderTimeout = 5 * time.Second
+	// proxyV1MaxLength is the longest v1 header, CRLF included
+	proxyV1MaxLength = 107
+)
+
+// proxyV2Signature starts a v2 header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var errInvalidProxyHeader = errors.New("invalid PROXY protocol header")
+
+// proxyConn is a connection from a proxy, it reports the address of the client behind the proxy
+type proxyConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// SyscallConn gives the event loop the descriptor of the connection to the proxy
+func (c *proxyConn) SyscallConn() (syscall.RawConn, error) {
+	sc, ok := c.Conn.(syscall.Conn)
+	if !ok {
+		return nil, errors.New("connection has no file descriptor")
+	}
+	return sc.SyscallConn()
+}
+
+// CloseRead shuts down the reading side of the connection to the proxy
+func (c *proxyConn) CloseRead() error {
+	cr, ok := c.Conn.(interface{ CloseRead() error })
+	if !ok {
+		return errors.New("connection cannot close its reading side")
+	}
+	return cr.CloseRead()
+}
+
+// proxyAddr returns the address of the proxy conn comes from, or nil for a direct connection
+func proxyAddr(conn net.Conn) net.Addr {
+	if pc, ok := conn.(*proxyConn); ok {
+		return pc.Conn.RemoteAddr()
+	}
+	return nil
+}
+
+// trustsProxy tells whether conn comes from a proxy sending PROXY protocol headers
+func (s *Server) trustsProxy(conn net.Conn) bool {
+	if len(s.trustedProxies) == 0 {
+		return false
+	}
+	ip := net.ParseIP(remoteIP(conn))
+	for _, n := range s.trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// readProxyHeader reads the PROXY protocol header of conn and returns conn as from the client behind the proxy.
+// Headers of health checks and of unknown protocols leave the address of the proxy.
+func readProxyHeader(conn net.Conn) (net.Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	// the header is read without reading ahead, the event loop reads the rest from the descriptor
+	var first [1]byte
+	if _, err := io.ReadFull(conn, first[:]); err != nil {
+		return nil, err
+	}
+	var addr net.Addr
+	var err error
+	switch first[0] {
+	case 'P':
+		addr, err = readProxyV1(conn)
+	case proxyV2Signature[0]:
+		addr, err = readProxyV2(conn)
+	default:
+		err = errInvalidProxyHeader
+	}
+	if err != nil {
+		return nil, err
+	}
+	if addr == nil {
+		return conn, nil
+	}
+	return &proxyConn{Conn: conn, remote: addr}, nil
+}
+
+// readProxyV1 reads a v1 header after its first byte:
+// "PROXY TCP4 192.168.0.1 192.168.0.11 56324 8000\r\n" or "PROXY UNKNOWN\r\n"
+func readProxyV1(r io.Reader) (net.Addr, error) {
+	line := []byte{'P'}
+	var b [1]byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) == proxyV1MaxLength {
+			return nil, errInvalidProxyHeader
+		}
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return nil, err
+		}
+		line = append(line, b[0])
+	}
+
+	parts := strings.Split(string(line[:len(line)-2]), " ")
+	if len(parts) < 2 || parts[0] != "PROXY" {
+		return nil, errInvalidProxyHeader
+	}
+	if parts[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(parts) != 6 || parts[1] != "TCP4" && parts[1] != "TCP6" {
+		return nil, errInvalidProxyHeader
+	}
+	ip := net.ParseIP(parts[2])
+	port, err := strconv.ParseUint(parts[4], 10, 16)
+	if ip == nil || err != nil || (ip.To4() != nil) != (parts[1] == "TCP4") {
+		return nil, errInvalidProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 reads a v2 header after its first byte
+func readProxyV2(r io.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	header[0] = proxyV2Signature[0]
+	if _, err := io.ReadFull(r, header[1:]); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:12], proxyV2Signature) || header[12]>>4 != 2 {
+		return nil, errInvalidProxyHeader
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	switch header[12] & 0xf {
+	case 0:
+		// LOCAL is sent by the proxy itself, for health checks
+		return nil, nil
+	case 1:
+	default:
+		return nil, errInvalidProxyHeader
+	}
+	// the addresses of TCP over IPv4 and IPv6, other protocols keep the address of the proxy
+	switch header[13] {
+	case 0x11:
+		if len(body) < 12 {
+			return nil, errInvalidProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IPv4(body[0], body[1], body[2], body[3]), Port: int(binary.BigEndian.Uint16(body[8:]))}, nil
+	case 0x21:
+		if len(body) < 36 {
+			return nil, errInvalidProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(body[:16]), Port: int(binary.BigEndian.Uint16(body[32:]))}, nil
+	}
+	return nil, nil
+}
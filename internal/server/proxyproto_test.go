@@ -0,0 +1,146 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// proxyV2 builds a v2 header of command cmd, family fam and the address block addrs
+func proxyV2(cmd, fam byte, addrs []byte) string {
+	header := append([]byte(nil), proxyV2Signature...)
+	header = append(header, 0x20|cmd, fam, 0, 0)
+	binary.BigEndian.PutUint16(header[14:], uint16(len(addrs)))
+	return string(append(header, addrs...))
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v4 := []byte{10, 0, 0, 9, 127, 0, 0, 1, 0x15, 0xb3, 0x1f, 0x40}
+	v6 := make([]byte, 36)
+	copy(v6, net.ParseIP("2001:db8::9"))
+	binary.BigEndian.PutUint16(v6[32:], 5555)
+
+	tcs := []struct {
+		header string
+		addr   string
+	}{
+		{"PROXY TCP4 10.0.0.9 127.0.0.1 5555 8000\r\n", "10.0.0.9:5555"},
+		{"PROXY TCP6 2001:db8::9 ::1 5555 8000\r\n", "[2001:db8::9]:5555"},
+		{"PROXY UNKNOWN\r\n", "proxy"},
+		{proxyV2(1, 0x11, v4), "10.0.0.9:5555"},
+		// TLVs after the addresses are skipped
+		{proxyV2(1, 0x11, append(v4, 0x04, 0, 1, 0)), "10.0.0.9:5555"},
+		{proxyV2(1, 0x21, v6), "[2001:db8::9]:5555"},
+		{proxyV2(0, 0x00, nil), "proxy"},
+		{proxyV2(1, 0x31, make([]byte, 216)), "proxy"},
+	}
+	for _, tc := range tcs {
+		srvConn, conn := net.Pipe()
+		proxied := addrConn{Conn: srvConn, addr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}}
+		go conn.Write([]byte(tc.header + "identity\n"))
+
+		got, err := readProxyHeader(proxied)
+		require.NoError(t, err, "%q", tc.header)
+		if tc.addr == "proxy" {
+			assert.Nil(t, proxyAddr(got))
+			assert.Equal(t, "127.0.0.1:1", got.RemoteAddr().String())
+		} else {
+			assert.Equal(t, tc.addr, got.RemoteAddr().String())
+			assert.Equal(t, "127.0.0.1:1", proxyAddr(got).String())
+		}
+		// the header is read without reading ahead
+		line, err := bufio.NewReader(got).ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, "identity\n", line)
+		conn.Close()
+	}
+
+	for _, bad := range []string{
+		"identity\n",
+		"PROXY TCP4 10.0.0.9 127.0.0.1 5555\r\n",
+		"PROXY TCP4 2001:db8::9 ::1 5555 8000\r\n",
+		"PROXY TCP4 10.0.0.9 127.0.0.1 99999 8000\r\n",
+		"PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n",
+		proxyV2(2, 0x11, v4),
+		proxyV2(1, 0x11, v4[:8]),
+		"\r\n\r\n\x00\r\nQUIT!" + strings.Repeat("\x00", 4),
+	} {
+		srvConn, conn := net.Pipe()
+		go func() {
+			conn.Write([]byte(bad))
+			conn.Close()
+		}()
+		_, err := readProxyHeader(srvConn)
+		assert.Error(t, err, "%q", bad)
+		srvConn.Close()
+	}
+}
+
+// testProxyProtocol serves a client behind a proxy with the server started with opts
+func testProxyProtocol(t *testing.T, opts ...Option) {
+	_, local, err := net.ParseCIDR("127.0.0.0/8")
+	require.NoError(t, err)
+	rules, err := ParseIPRules(strings.NewReader("deny 10.0.0.1\n"))
+	require.NoError(t, err)
+	srv, addr := startAdmission(t, append(opts, WithProxyProtocol(local), WithIPRules(rules), WithRateLimit(LimitByIP, Limit{}))...)
+	defer srv.Stop()
+
+	conn, r := dialFrom(t, "127.0.0.1", addr)
+	defer conn.Close()
+	_, err = conn.Write([]byte("PROXY TCP4 10.0.0.9 127.0.0.1 5555 8000\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "identity 1\n", served(t, conn, r))
+
+	w := httptest.NewRecorder()
+	srv.AdminHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/clients", nil))
+	assert.JSONEq(t, `[{"id":1,"addr":"10.0.0.9:5555","proxy":"`+conn.LocalAddr().String()+`"}]`, w.Body.String())
+	// limits are keyed by the address of the client
+	require.NoError(t, srv.SetLimit("10.0.0.9", Limit{Messages: 1}))
+	assert.Equal(t, "10.0.0.9", srv.registry.snapshot()[0].limitKey)
+
+	// IP rules apply to the address of the client
+	denied, r := dialFrom(t, "127.0.0.1", addr)
+	defer denied.Close()
+	_, err = denied.Write([]byte(proxyV2(1, 0x11, []byte{10, 0, 0, 1, 127, 0, 0, 1, 0, 1, 0, 2})))
+	require.NoError(t, err)
+	_, err = r.ReadByte()
+	assert.Error(t, err)
+	assert.Equal(t, uint64(1), srv.Stats().ConnsDenied)
+
+	// a proxy failing to send a header is disconnected
+	bad, r := dialFrom(t, "127.0.0.1", addr)
+	defer bad.Close()
+	_, err = bad.Write([]byte("identity\n"))
+	require.NoError(t, err)
+	_, err = r.ReadByte()
+	assert.Error(t, err)
+}
+
+func TestProxyProtocol(t *testing.T) {
+	testProxyProtocol(t)
+}
+
+func TestProxyProtocolUntrusted(t *testing.T) {
+	_, other, err := net.ParseCIDR("192.0.2.0/24")
+	require.NoError(t, err)
+	srv, addr := startAdmission(t, WithProxyProtocol(other))
+	defer srv.Stop()
+
+	// headers from untrusted addresses are not read, they are unknown commands
+	conn, r := dialFrom(t, "127.0.0.1", addr)
+	defer conn.Close()
+	_, err = conn.Write([]byte("PROXY TCP4 10.0.0.9 127.0.0.1 5555 8000\r\n"))
+	require.NoError(t, err)
+	reply, err := r.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "Unknown message\n", reply)
+	assert.Equal(t, "identity 1\n", served(t, conn, r))
+	assert.Equal(t, "127.0.0.1", srv.registry.snapshot()[0].conn.RemoteAddr().(*net.TCPAddr).IP.String())
+}
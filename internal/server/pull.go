@@ -0,0 +1,109 @@
+package server
+
+import (
+	"errors"
+	"time"
+
+	"github.com/badboyd/tcp-hub/pkg/message"
+)
+
+const (
+	defaultInboxMessages = 10000
+	defaultInboxBytes    = 64 << 20
+	maxFetchWait         = time.Minute
+)
+
+var (
+	errModeInvalid  = errors.New("invalid mode")
+	errFetchInvalid = errors.New("invalid fetch")
+	errNotPullMode  = errors.New("not in pull mode")
+)
+
+// setMode switches cli between push delivery and a pull mode inbox read with fetch
+func (s *Server) setMode(cli *client, mode string) error {
+	out := &cli.out
+	out.m.Lock()
+	switch mode {
+	case message.ModePull:
+		out.pull = true
+		if out.ready == nil {
+			out.ready = make(chan struct{}, 1)
+		}
+		out.m.Unlock()
+		return nil
+	case message.ModePush:
+		out.pull = false
+		start := !out.running && out.queued > 0 && out.credit.allows()
+		if start {
+			out.running = true
+		}
+		out.m.Unlock()
+		if start {
+			go s.flush(cli)
+		}
+		return nil
+	default:
+		out.m.Unlock()
+		return errModeInvalid
+	}
+}
+
+// fetch takes up to max messages from the inbox of cli, waiting up to wait for the first one,
+// and returns the fetch reply followed by their frames
+func (s *Server) fetch(cli *client, max int, wait time.Duration) ([]byte, error) {
+	if max <= 0 || wait < 0 || wait > maxFetchWait {
+		return nil, errFetchInvalid
+	}
+
+	out := &cli.out
+	var timer <-chan time.Time
+	out.m.Lock()
+	if !out.pull {
+		out.m.Unlock()
+		return nil, errNotPullMode
+	}
+	for out.queued == 0 && wait > 0 {
+		out.m.Unlock()
+		if timer == nil {
+			timer = s.clock.After(wait)
+		}
+		select {
+		case <-out.ready:
+		case <-timer:
+			wait = 0
+		case <-s.close:
+			wait = 0
+		}
+		out.m.Lock()
+	}
+	obs := []*outbound{}
+	for len(obs) < max {
+		ob := out.pop()
+		if ob == nil {
+			break
+		}
+		obs = append(obs, ob)
+	}
+	out.m.Unlock()
+
+	now := s.clock.Now()
+	frames := []byte{}
+	n := 0
+	for _, ob := range obs {
+		if ob.expired(now) {
+			s.expire(cli, ob)
+			continue
+		}
+		// relays streamed before the client switched to pull mode are not kept
+		if ob.stream != nil {
+			s.reject(cli, ob)
+			continue
+		}
+		frames = ob.frame.appendTo(frames)
+		ob.frame.release()
+		// the frames are written along the reply
+		s.written(cli, ob)
+		n++
+	}
+	return append(message.FetchReply{Count: n}.AppendTo(nil), frames...), nil
+}
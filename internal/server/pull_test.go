@@ -0,0 +1,65 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFetch(t *testing.T) {
+	srv := New(WithInboxLimit(2, 1024))
+
+	senderSrv, senderConn := net.Pipe()
+	defer senderConn.Close()
+	receiverSrv, receiverConn := net.Pipe()
+	defer receiverConn.Close()
+
+	sender := &client{id: 1, conn: senderSrv}
+	receiver := &client{id: 2, conn: receiverSrv}
+	srv.registry.add(sender)
+	srv.registry.add(receiver)
+
+	_, err := srv.fetch(receiver, 1, 0)
+	assert.Equal(t, errNotPullMode, err)
+	assert.Equal(t, errModeInvalid, srv.setMode(receiver, "poll"))
+	require.NoError(t, srv.setMode(receiver, "pull"))
+	_, err = srv.fetch(receiver, 0, 0)
+	assert.Equal(t, errFetchInvalid, err)
+
+	reply, err := srv.fetch(receiver, 10, 0)
+	require.NoError(t, err)
+	assert.Equal(t, "fetch 0\n", string(reply))
+
+	srv.relayMessage(sender.id, 10, []uint64{receiver.id}, map[string]string{}, []byte("one"))
+	srv.relayMessage(sender.id, 11, []uint64{receiver.id}, map[string]string{"prio": "high"}, []byte("two"))
+
+	// the inbox is full
+	go srv.relayMessage(sender.id, 12, []uint64{receiver.id}, map[string]string{}, []byte("three"))
+	notice, err := bufio.NewReader(senderConn).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "rejected 12 2\n", notice)
+
+	reply, err = srv.fetch(receiver, 10, 0)
+	require.NoError(t, err)
+	assert.Equal(t, "fetch 2\n"+"relay 1 3 id=11\ntwo"+"relay 1 3 id=10\none", string(reply))
+
+	// fetch waits for the first message
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		srv.relayMessage(sender.id, 13, []uint64{receiver.id}, map[string]string{}, []byte("four"))
+	}()
+	reply, err = srv.fetch(receiver, 10, time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, "fetch 1\n"+"relay 1 4 id=13\nfour", string(reply))
+
+	// messages kept while in pull mode are pushed once back in push mode
+	srv.relayMessage(sender.id, 14, []uint64{receiver.id}, map[string]string{}, []byte("five"))
+	require.NoError(t, srv.setMode(receiver, "push"))
+	line, err := bufio.NewReader(receiverConn).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "relay 1 4 id=14\n", line)
+}
@@ -0,0 +1,219 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/badboyd/tcp-hub/pkg/message"
+)
+
+// maxGroupBacklog is how many messages a queue group without members keeps for the next one to join
+const maxGroupBacklog = 1024
+
+var (
+	errGroupInvalid = errors.New("invalid queue group")
+	errNotMember    = errors.New("not a member of queue group")
+	errBacklogFull  = errors.New("queue group backlog full")
+)
+
+// queueGroup delivers every message to exactly one of its members
+type queueGroup struct {
+	name    string
+	members []*client // sorted by id
+	next    int
+	// backlog keeps messages to redeliver once a member joins
+	backlog []*delivery
+}
+
+func validGroup(name string) bool {
+	return name != "" && len(name) <= maxNickLen && !strings.ContainsAny(name, " ,=@")
+}
+
+func (g *queueGroup) add(cli *client) bool {
+	i := sort.Search(len(g.members), func(i int) bool { return g.members[i].id >= cli.id })
+	if i < len(g.members) && g.members[i] == cli {
+		return false
+	}
+	g.members = append(g.members, nil)
+	copy(g.members[i+1:], g.members[i:])
+	g.members[i] = cli
+	return true
+}
+
+func (g *queueGroup) remove(cli *client) bool {
+	for i, member := range g.members {
+		if member == cli {
+			g.members = append(g.members[:i], g.members[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// pick chooses the member d is delivered to, g must have members
+func (g *queueGroup) pick(d *delivery) *client {
+	switch d.pick {
+	case message.PickLeastLoaded:
+		picked := g.members[0]
+		for _, member := range g.members[1:] {
+			if len(member.inflight) < len(picked.inflight) {
+				picked = member
+			}
+		}
+		return picked
+	case message.PickHash:
+		// rendezvous hashing keeps most keys on the same member when membership changes
+		var picked *client
+		var best uint64
+		for _, member := range g.members {
+			if sum := rendezvous(d.key, member.id); picked == nil || sum > best {
+				picked, best = member, sum
+			}
+		}
+		return picked
+	default:
+		picked := g.members[g.next%len(g.members)]
+		g.next++
+		return picked
+	}
+}
+
+// rendezvous returns the weight of member for key. The key is length prefixed
+// so that no other key and member ID hash the same input, "user1" with 23 and "user12" with 3.
+func rendezvous(key string, memberID uint64) uint64 {
+	var buf [8]byte
+	h := fnv.New64a()
+	binary.BigEndian.PutUint64(buf[:], uint64(len(key)))
+	h.Write(buf[:])
+	h.Write([]byte(key))
+	binary.BigEndian.PutUint64(buf[:], memberID)
+	h.Write(buf[:])
+	return h.Sum64()
+}
+
+// joinQueue adds cli to group and hands it the group backlog
+func (s *Server) joinQueue(cli *client, group string) error {
+	if !validGroup(group) {
+		return errGroupInvalid
+	}
+
+	s.qm.Lock()
+	g, ok := s.groups[group]
+	if !ok {
+		g = &queueGroup{name: group}
+		s.groups[group] = g
+	}
+	if g.add(cli) {
+		cli.groups = append(cli.groups, group)
+	}
+	backlog := g.backlog
+	g.backlog = nil
+	s.qm.Unlock()
+
+	for _, d := range backlog {
+		if err := s.dispatch(d); err != nil {
+			log.Printf("Drop message %d to queue group %s: %s\n", d.id, d.group, err.Error())
+		}
+	}
+	return nil
+}
+
+// leaveQueue removes cli from group, messages in flight stay with cli
+func (s *Server) leaveQueue(cli *client, group string) error {
+	s.qm.Lock()
+	defer s.qm.Unlock()
+
+	g, ok := s.groups[group]
+	if !ok || !g.remove(cli) {
+		return errNotMember
+	}
+	for i, name := range cli.groups {
+		if name == group {
+			cli.groups = append(cli.groups[:i], cli.groups[i+1:]...)
+			break
+		}
+	}
+	if len(g.members) == 0 && len(g.backlog) == 0 {
+		delete(s.groups, group)
+	}
+	return nil
+}
+
+// leaveQueues removes a disconnected cli from its groups and
+// redelivers its unacked group messages to other members
+func (s *Server) leaveQueues(cli *client) {
+	s.qm.Lock()
+	for _, group := range cli.groups {
+		if g, ok := s.groups[group]; ok {
+			g.remove(cli)
+			if len(g.members) == 0 && len(g.backlog) == 0 {
+				delete(s.groups, group)
+			}
+		}
+	}
+	cli.groups = nil
+
+	unacked := make([]*delivery, 0, len(cli.inflight))
+	for _, d := range cli.inflight {
+		if d.group != "" {
+			unacked = append(unacked, d)
+		}
+	}
+	cli.inflight = nil
+	s.qm.Unlock()
+
+	sort.Slice(unacked, func(i, j int) bool {
+		return unacked[i].id < unacked[j].id
+	})
+	for _, d := range unacked {
+		s.redeliver(d)
+	}
+}
+
+// relayToQueue delivers data to one member of group,
+// it returns errBacklogFull when the group has no members and keeps too many messages already
+func (s *Server) relayToQueue(senderID, msgID uint64, group string, fields map[string]string, data []byte) error {
+	lane, _ := laneOf(fields)
+	return s.dispatch(&delivery{
+		id:          msgID,
+		senderID:    senderID,
+		group:       group,
+		pick:        fields[message.FieldPick],
+		key:         fields[message.FieldKey],
+		atLeastOnce: fields[message.FieldQoS] == "1",
+		fields:      forwardedFields(senderID, fields),
+		data:        data,
+
+		expires:       expiresAt(fields, s.clock.Now()),
+		notifyExpired: fields[message.FieldNotify] == message.NotifyExpired,
+		lane:          lane,
+	})
+}
+
+func (s *Server) dispatch(d *delivery) error {
+	s.qm.Lock()
+	g, ok := s.groups[d.group]
+	if !ok {
+		s.qm.Unlock()
+		log.Printf("Drop message %d to unknown queue group %s\n", d.id, d.group)
+		return nil
+	}
+	if len(g.members) == 0 {
+		if len(g.backlog) >= maxGroupBacklog {
+			s.qm.Unlock()
+			return errBacklogFull
+		}
+		g.backlog = append(g.backlog, d)
+		s.qm.Unlock()
+		return nil
+	}
+	member := g.pick(d)
+	s.qm.Unlock()
+
+	s.deliver(member, d)
+	return nil
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueueGroupPick(t *testing.T) {
+	members := []*client{{id: 1}, {id: 2}, {id: 3}}
+	g := &queueGroup{name: "jobs"}
+	for _, member := range members {
+		require.True(t, g.add(member))
+	}
+	assert.False(t, g.add(members[0]))
+
+	t.Run("round robin", func(t *testing.T) {
+		var picked []uint64
+		for i := 0; i < 4; i++ {
+			picked = append(picked, g.pick(&delivery{}).id)
+		}
+		assert.Equal(t, []uint64{1, 2, 3, 1}, picked)
+	})
+
+	t.Run("least loaded", func(t *testing.T) {
+		members[0].inflight = map[uint64]*delivery{1: {}, 2: {}}
+		members[1].inflight = map[uint64]*delivery{3: {}}
+		members[2].inflight = map[uint64]*delivery{4: {}, 5: {}}
+		assert.Equal(t, uint64(2), g.pick(&delivery{pick: "least"}).id)
+	})
+
+	t.Run("hash", func(t *testing.T) {
+		picked := g.pick(&delivery{pick: "hash", key: "user42"})
+		for i := 0; i < 10; i++ {
+			assert.Equal(t, picked, g.pick(&delivery{pick: "hash", key: "user42"}))
+		}
+
+		// removing another member keeps the key where it was
+		for _, member := range members {
+			if member != picked {
+				require.True(t, g.remove(member))
+				break
+			}
+		}
+		assert.Equal(t, picked, g.pick(&delivery{pick: "hash", key: "user42"}))
+	})
+
+	t.Run("hash input", func(t *testing.T) {
+		assert.NotEqual(t, rendezvous("user1", 23), rendezvous("user12", 3))
+		assert.NotEqual(t, rendezvous("ab", 1), rendezvous("a", 1))
+	})
+}
+
+func TestHandleQueue(t *testing.T) {
+	srv := New()
+	defer srv.Stop()
+
+	serverAddr := net.TCPAddr{Port: serverPort}
+	require.NoError(t, srv.Start(&serverAddr))
+
+	var conns []net.Conn
+	var readers []*bufio.Reader
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial(serverAddr.Network(), serverAddr.String())
+		require.NoError(t, err)
+		defer conn.Close()
+		waitForClients(t, srv, i+1)
+
+		conns = append(conns, conn)
+		readers = append(readers, bufio.NewReader(conn))
+	}
+
+	send := func(i int, msg string) {
+		_, err := conns[i].Write([]byte(msg))
+		require.NoError(t, err)
+	}
+	expect := func(i int, expected string) {
+		msg := make([]byte, len(expected))
+		_, err := io.ReadFull(readers[i], msg)
+		require.NoError(t, err)
+		assert.Equal(t, expected, string(msg))
+	}
+
+	send(1, "qjoin jobs\n")
+	expect(1, "qjoin jobs\n")
+	send(2, "qjoin jobs\n")
+	expect(2, "qjoin jobs\n")
+	send(2, "qleave other\n")
+	expect(2, "error not a member of queue group\n")
+
+	// round robin over members 2 and 3
+	send(0, "relay @jobs 3\none")
+	expect(1, "relay 1 3 ack=1 group=jobs id=1\none")
+	send(1, "ack 1\n")
+	send(0, "relay @jobs 3\ntwo")
+	expect(2, "relay 1 3 ack=1 group=jobs id=2\ntwo")
+
+	// unacked message of a disconnected member goes to another member
+	conns[2].Close()
+	expect(1, "relay 1 3 ack=1 group=jobs id=2 redelivered=1\ntwo")
+	send(1, "ack 2\n")
+
+	// messages wait in the backlog until a member joins
+	send(1, "qleave jobs\n")
+	expect(1, "qleave jobs\n")
+	send(0, "relay @jobs 5\nthree")
+	send(1, "qjoin jobs\n")
+	expect(1, "qjoin jobs\n")
+	expect(1, "relay 1 5 ack=1 group=jobs id=3\nthree")
+}
+
+func TestQueueGroupBacklog(t *testing.T) {
+	srv := New()
+	cli := &client{id: 1}
+
+	// a disconnected member leaves no empty group behind
+	require.NoError(t, srv.joinQueue(cli, "jobs"))
+	srv.leaveQueues(cli)
+	assert.Empty(t, srv.groups)
+
+	// a group without members keeps a bounded backlog
+	srv.groups["jobs"] = &queueGroup{name: "jobs"}
+	for i := 0; i < maxGroupBacklog; i++ {
+		require.NoError(t, srv.dispatch(&delivery{id: uint64(i + 1), group: "jobs"}))
+	}
+	assert.Equal(t, errBacklogFull, srv.dispatch(&delivery{id: maxGroupBacklog + 1, group: "jobs"}))
+	assert.Len(t, srv.groups["jobs"].backlog, maxGroupBacklog)
+}
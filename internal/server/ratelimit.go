@@ -0,0 +1,475 @@
+package server
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LimitBy tells what clients share a limit
+type LimitBy string
+
+const (
+	// LimitByClient gives every named client its own limit, keyed by "name:" and its nick,
+	// clients share the limit of their IP until they set a nick as the hub has no authentication
+	LimitByClient LimitBy = "client"
+	// LimitByIP gives the clients connecting from an IP a common limit, keyed by the IP
+	LimitByIP LimitBy = "ip"
+)
+
+// LimitAction is taken on relays over a limit
+type LimitAction string
+
+const (
+	// LimitReject drops the relay and answers "error rate limited" or "error quota exceeded", it is the default
+	LimitReject LimitAction = "reject"
+	// LimitDelay relays the message and stops reading the client until it is back within the rate,
+	// relays over a daily quota are rejected
+	LimitDelay LimitAction = "delay"
+	// LimitDisconnect answers with the error and disconnects the client
+	LimitDisconnect LimitAction = "disconnect"
+)
+
+// Limit bounds what clients relay, zero fields are unlimited
+type Limit struct {
+	// Messages and Bytes are relayed per second, in bursts of up to MessageBurst and ByteBurst
+	// which default to one second of them
+	Messages     float64 `json:"messages,omitempty"`
+	Bytes        float64 `json:"bytes,omitempty"`
+	MessageBurst float64 `json:"message_burst,omitempty"`
+	ByteBurst    float64 `json:"byte_burst,omitempty"`
+	// DailyMessages and DailyBytes are relayed per UTC day
+	DailyMessages int64 `json:"daily_messages,omitempty"`
+	DailyBytes    int64 `json:"daily_bytes,omitempty"`
+	// Action is taken on relays over the limit
+	Action LimitAction `json:"action,omitempty"`
+}
+
+var (
+	errRateLimited   = errors.New("rate limited")
+	errQuotaExceeded = errors.New("quota exceeded")
+	errInvalidLimit  = errors.New("invalid limit")
+)
+
+func (l Limit) valid() bool {
+	switch l.Action {
+	case "", LimitReject, LimitDelay, LimitDisconnect:
+	default:
+		return false
+	}
+	return l.Messages >= 0 && l.Bytes >= 0 && l.MessageBurst >= 0 && l.ByteBurst >= 0 &&
+		l.DailyMessages >= 0 && l.DailyBytes >= 0
+}
+
+// messageBurst is one message at least, a smaller burst would never hold a token to take
+func (l Limit) messageBurst() float64 {
+	burst := l.MessageBurst
+	if burst <= 0 {
+		burst = l.Messages
+	}
+	if burst < 1 {
+		return 1
+	}
+	return burst
+}
+
+func (l Limit) byteBurst() float64 {
+	if l.ByteBurst > 0 {
+		return l.ByteBurst
+	}
+	return l.Bytes
+}
+
+// bucket holds the tokens and the daily usage of the clients sharing a key
+type bucket struct {
+	m     sync.Mutex
+	limit Limit
+	// refs counts the connected clients using the bucket and
+	// detached places a bucket without clients in limiter.detached, guarded by limiter.m
+	refs     int
+	detached *list.Element
+
+	messages, bytes float64
+	last            time.Time
+	day             int64
+	dayMessages     int64
+	dayBytes        int64
+}
+
+func newBucket(limit Limit, now time.Time) *bucket {
+	return &bucket{
+		limit:    limit,
+		messages: limit.messageBurst(),
+		bytes:    limit.byteBurst(),
+		last:     now,
+		day:      dayOf(now),
+	}
+}
+
+// bucketUsage is the tokens and the daily usage of a bucket
+type bucketUsage struct {
+	messages, bytes float64
+	day             int64
+	dayMessages     int64
+	dayBytes        int64
+}
+
+// usage returns the tokens and the daily usage of b at now
+func (b *bucket) usage(now time.Time) bucketUsage {
+	b.m.Lock()
+	defer b.m.Unlock()
+	b.refill(now)
+	return bucketUsage{messages: b.messages, bytes: b.bytes, day: b.day, dayMessages: b.dayMessages, dayBytes: b.dayBytes}
+}
+
+// inherit takes over the usage of another bucket, keeping the fewer tokens and the larger daily usage
+func (b *bucket) inherit(u bucketUsage, now time.Time) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	b.refill(now)
+	if u.messages < b.messages {
+		b.messages = u.messages
+	}
+	if u.bytes < b.bytes {
+		b.bytes = u.bytes
+	}
+	if u.day == b.day {
+		if u.dayMessages > b.dayMessages {
+			b.dayMessages = u.dayMessages
+		}
+		if u.dayBytes > b.dayBytes {
+			b.dayBytes = u.dayBytes
+		}
+	}
+}
+
+func dayOf(t time.Time) int64 {
+	return t.Unix() / (24 * 60 * 60)
+}
+
+// setLimit changes the limit of b keeping its tokens within the new bursts
+func (b *bucket) setLimit(limit Limit) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	// a rate newly set starts with a full burst
+	if burst := limit.messageBurst(); b.messages > burst || b.limit.Messages == 0 {
+		b.messages = burst
+	}
+	if burst := limit.byteBurst(); b.bytes > burst || b.limit.Bytes == 0 {
+		b.bytes = burst
+	}
+	b.limit = limit
+}
+
+// refill adds the tokens earned since the last refill, must hold b.m
+func (b *bucket) refill(now time.Time) {
+	elapsed := now.Sub(b.last).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+	b.last = now
+	if burst := b.limit.messageBurst(); b.messages < burst {
+		b.messages += elapsed * b.limit.Messages
+		if b.messages > burst {
+			b.messages = burst
+		}
+	}
+	if burst := b.limit.byteBurst(); b.bytes < burst {
+		b.bytes += elapsed * b.limit.Bytes
+		if b.bytes > burst {
+			b.bytes = burst
+		}
+	}
+	if day := dayOf(now); day != b.day {
+		b.day, b.dayMessages, b.dayBytes = day, 0, 0
+	}
+}
+
+// take takes a relay of size bytes from b, it returns errRateLimited or errQuotaExceeded
+// and the action to take when the relay is over the limit
+func (b *bucket) take(now time.Time, size int) (LimitAction, error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	b.refill(now)
+
+	l := b.limit
+	action := l.Action
+	if action == "" {
+		action = LimitReject
+	}
+	if l.DailyMessages > 0 && b.dayMessages >= l.DailyMessages ||
+		l.DailyBytes > 0 && b.dayBytes+int64(size) > l.DailyBytes {
+		if action == LimitDelay {
+			action = LimitReject
+		}
+		return action, errQuotaExceeded
+	}
+	// delayed relays go through and leave tokens owed, a body larger than the burst passes a full bucket
+	if action != LimitDelay && (l.Messages > 0 && b.messages < 1 ||
+		l.Bytes > 0 && b.bytes < float64(size) && b.bytes < l.byteBurst()) {
+		return action, errRateLimited
+	}
+
+	if l.Messages > 0 {
+		b.messages--
+	}
+	if l.Bytes > 0 {
+		b.bytes -= float64(size)
+	}
+	// the daily usage is only needed by quotas
+	if l.DailyMessages > 0 || l.DailyBytes > 0 {
+		b.dayMessages++
+		b.dayBytes += int64(size)
+	}
+	return action, nil
+}
+
+// owed returns how long until the tokens owed by b are paid back
+func (b *bucket) owed(now time.Time) time.Duration {
+	b.m.Lock()
+	defer b.m.Unlock()
+	b.refill(now)
+
+	var wait float64
+	if b.messages < 0 && b.limit.Messages > 0 {
+		wait = -b.messages / b.limit.Messages
+	}
+	if b.bytes < 0 && b.limit.Bytes > 0 {
+		if w := -b.bytes / b.limit.Bytes; w > wait {
+			wait = w
+		}
+	}
+	return time.Duration(wait * float64(time.Second))
+}
+
+// maxDetachedBuckets is how many buckets without clients are kept for their daily usage,
+// the ones detached first are dropped beyond it
+const maxDetachedBuckets = 1 << 16
+
+// limiter keeps the buckets of connected clients by key
+type limiter struct {
+	by LimitBy
+	m  sync.Mutex
+	// def applies to keys without a limit of their own
+	def     Limit
+	limits  map[string]Limit
+	buckets map[string]*bucket
+	day     int64
+	// detached holds the keys of the buckets without clients, the first detached in front
+	detached    *list.List
+	maxDetached int
+}
+
+func newLimiter(by LimitBy, def Limit) *limiter {
+	return &limiter{
+		by:          by,
+		def:         def,
+		limits:      make(map[string]Limit),
+		buckets:     make(map[string]*bucket),
+		detached:    list.New(),
+		maxDetached: maxDetachedBuckets,
+	}
+}
+
+// nameKeyPrefix starts the limit keys of named clients, IPs never contain it
+const nameKeyPrefix = "name:"
+
+// key returns the key of the limit of cli, keys outlive connections so reconnecting keeps the usage
+func (l *limiter) key(cli *client) string {
+	if l.by == LimitByClient {
+		cli.am.Lock()
+		name := cli.name
+		cli.am.Unlock()
+		if name != "" {
+			return nameKeyPrefix + name
+		}
+	}
+	return remoteIP(cli.conn)
+}
+
+func (l *limiter) limitOf(key string) Limit {
+	if limit, ok := l.limits[key]; ok {
+		return limit
+	}
+	return l.def
+}
+
+// attach returns the bucket of key for a connecting client
+func (l *limiter) attach(key string, now time.Time) *bucket {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	// buckets left with a daily usage are kept for the day
+	if day := dayOf(now); day != l.day {
+		l.day = day
+		for e := l.detached.Front(); e != nil; e = e.Next() {
+			delete(l.buckets, e.Value.(string))
+		}
+		l.detached.Init()
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = newBucket(l.limitOf(key), now)
+		l.buckets[key] = b
+	}
+	if b.detached != nil {
+		l.detached.Remove(b.detached)
+		b.detached = nil
+	}
+	b.refs++
+	return b
+}
+
+// detach releases the bucket of key of a leaving client
+func (l *limiter) detach(key string, b *bucket) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	b.refs--
+	if b.refs > 0 {
+		return
+	}
+	// a bucket used against a quota today keeps its usage and tokens for the rest of the day, whatever its limit
+	b.m.Lock()
+	used := b.dayMessages > 0
+	b.m.Unlock()
+	if !used {
+		delete(l.buckets, key)
+		return
+	}
+	b.detached = l.detached.PushBack(key)
+	if l.detached.Len() > l.maxDetached {
+		first := l.detached.Remove(l.detached.Front()).(string)
+		delete(l.buckets, first)
+	}
+}
+
+// rekey moves a client from the bucket b of from to the bucket of to,
+// which inherits the tokens and the daily usage of b so changing keys does not reset them
+func (l *limiter) rekey(from, to string, b *bucket, now time.Time) *bucket {
+	u := b.usage(now)
+	l.detach(from, b)
+	nb := l.attach(to, now)
+	nb.inherit(u, now)
+	return nb
+}
+
+// set sets the limit of key, or the default limit when key is empty
+func (l *limiter) set(key string, limit Limit) error {
+	if !limit.valid() {
+		return errInvalidLimit
+	}
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	if key == "" {
+		l.def = limit
+	} else {
+		l.limits[key] = limit
+	}
+	for k, b := range l.buckets {
+		if key == "" && !l.hasOwn(k) || k == key {
+			b.setLimit(limit)
+		}
+	}
+	return nil
+}
+
+// remove makes key use the default limit again
+func (l *limiter) remove(key string) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	delete(l.limits, key)
+	if b, ok := l.buckets[key]; ok {
+		b.setLimit(l.def)
+	}
+}
+
+func (l *limiter) hasOwn(key string) bool {
+	_, ok := l.limits[key]
+	return ok
+}
+
+// snapshot returns the default limit and the limits of keys
+func (l *limiter) snapshot() (Limit, map[string]Limit) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	limits := make(map[string]Limit, len(l.limits))
+	for k, limit := range l.limits {
+		limits[k] = limit
+	}
+	return l.def, limits
+}
+
+// admit takes a relay of size bytes from the limit of cli.
+// It returns the action to take when the relay is over the limit, with the reason.
+func (s *Server) admit(cli *client, size int) (LimitAction, error) {
+	if cli.bucket == nil {
+		return "", nil
+	}
+	action, err := cli.bucket.take(s.clock.Now(), size)
+	switch err {
+	case errRateLimited:
+		atomic.AddUint64(&s.stats.RateLimited, 1)
+	case errQuotaExceeded:
+		atomic.AddUint64(&s.stats.QuotaExceeded, 1)
+	}
+	return action, err
+}
+
+// throttled returns how long cli must not be read for its delayed relays
+func (s *Server) throttled(cli *client) time.Duration {
+	if cli.bucket == nil {
+		return 0
+	}
+	return cli.bucket.owed(s.clock.Now())
+}
+
+// pause waits until cli may be read again, it returns false when the server stops meanwhile
+func (s *Server) pause(cli *client) bool {
+	wait := s.throttled(cli)
+	if wait <= 0 {
+		return true
+	}
+	atomic.AddUint64(&s.stats.Delayed, 1)
+	select {
+	case <-s.clock.After(wait):
+		return true
+	case <-s.close:
+		return false
+	}
+}
+
+// rekeyLimit moves cli to the limit of its key after it changed, when it set a nick
+func (s *Server) rekeyLimit(cli *client) {
+	if cli.bucket == nil {
+		return
+	}
+	key := s.limits.key(cli)
+	if key == cli.limitKey {
+		return
+	}
+	cli.bucket = s.limits.rekey(cli.limitKey, key, cli.bucket, s.clock.Now())
+	cli.limitKey = key
+}
+
+// SetLimit sets the limit of the clients of key, "name:" and a nick or an IP as the server limits by.
+// The empty key sets the default limit.
+func (s *Server) SetLimit(key string, limit Limit) error {
+	return s.limits.set(key, limit)
+}
+
+// RemoveLimit makes the clients of key use the default limit
+func (s *Server) RemoveLimit(key string) {
+	s.limits.remove(key)
+}
+
+// Limits returns the default limit and the limits set for keys
+func (s *Server) Limits() (Limit, map[string]Limit) {
+	return s.limits.snapshot()
+}
@@ -0,0 +1,295 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBucket(t *testing.T) {
+	now := time.Unix(1000, 0)
+	b := newBucket(Limit{Messages: 2, Bytes: 100}, now)
+
+	for i := 0; i < 2; i++ {
+		_, err := b.take(now, 10)
+		require.NoError(t, err)
+	}
+	action, err := b.take(now, 10)
+	assert.Equal(t, errRateLimited, err)
+	assert.Equal(t, LimitReject, action)
+
+	now = now.Add(500 * time.Millisecond)
+	_, err = b.take(now, 10)
+	require.NoError(t, err)
+
+	// a body larger than the burst passes a full bucket only
+	now = now.Add(time.Second)
+	_, err = b.take(now, 150)
+	require.NoError(t, err)
+	now = now.Add(time.Second)
+	_, err = b.take(now, 60)
+	assert.Equal(t, errRateLimited, err)
+	assert.Zero(t, b.owed(now))
+}
+
+func TestBucketDelay(t *testing.T) {
+	now := time.Unix(1000, 0)
+	b := newBucket(Limit{Messages: 2, Action: LimitDelay}, now)
+	for i := 0; i < 4; i++ {
+		action, err := b.take(now, 10)
+		require.NoError(t, err)
+		assert.Equal(t, LimitDelay, action)
+	}
+	assert.Equal(t, time.Second, b.owed(now))
+	assert.Equal(t, 250*time.Millisecond, b.owed(now.Add(750*time.Millisecond)))
+}
+
+func TestBucketQuota(t *testing.T) {
+	now := time.Date(2020, 1, 1, 23, 0, 0, 0, time.UTC)
+	b := newBucket(Limit{DailyMessages: 2, DailyBytes: 15, Action: LimitDelay}, now)
+
+	_, err := b.take(now, 10)
+	require.NoError(t, err)
+	action, err := b.take(now, 10)
+	assert.Equal(t, errQuotaExceeded, err)
+	// relays over a quota are not delayed to the next day
+	assert.Equal(t, LimitReject, action)
+	_, err = b.take(now, 5)
+	require.NoError(t, err)
+	_, err = b.take(now, 0)
+	assert.Equal(t, errQuotaExceeded, err)
+
+	now = now.Add(time.Hour)
+	_, err = b.take(now, 10)
+	require.NoError(t, err)
+}
+
+// addrConn is a conn from addr
+type addrConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c addrConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+func TestLimiter(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := newLimiter(LimitByIP, Limit{Messages: 1, DailyMessages: 10})
+
+	from := func(id uint64, ip string) *client {
+		return &client{id: id, conn: addrConn{addr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 1000 + int(id)}}}
+	}
+	cli1, cli2, cli3 := from(1, "10.0.0.1"), from(2, "10.0.0.1"), from(3, "10.0.0.2")
+	assert.Equal(t, "10.0.0.1", l.key(cli1))
+
+	// clients from an IP share its limit
+	b1 := l.attach(l.key(cli1), now)
+	b2 := l.attach(l.key(cli2), now)
+	b3 := l.attach(l.key(cli3), now)
+	assert.True(t, b1 == b2)
+	assert.False(t, b1 == b3)
+	_, err := b1.take(now, 1)
+	require.NoError(t, err)
+	_, err = b2.take(now, 1)
+	assert.Equal(t, errRateLimited, err)
+
+	// limits change at runtime, tokens come at the new rate
+	require.NoError(t, l.set("10.0.0.1", Limit{Messages: 10}))
+	_, err = b2.take(now.Add(200*time.Millisecond), 1)
+	require.NoError(t, err)
+	require.NoError(t, l.set("", Limit{}))
+	assert.Equal(t, Limit{}, b3.limit)
+	assert.Equal(t, Limit{Messages: 10}, b1.limit)
+	l.remove("10.0.0.1")
+	assert.Equal(t, Limit{}, b1.limit)
+	assert.Equal(t, errInvalidLimit, l.set("", Limit{Action: "drop"}))
+	assert.Equal(t, errInvalidLimit, l.set("", Limit{Messages: -1}))
+
+	def, keys := l.snapshot()
+	assert.Equal(t, Limit{}, def)
+	assert.Empty(t, keys)
+
+	// buckets go with their last client unless they were used against a quota today
+	l.detach("10.0.0.2", b3)
+	assert.NotContains(t, l.buckets, "10.0.0.2")
+	l.detach("10.0.0.1", b1)
+	l.detach("10.0.0.1", b2)
+	b := l.attach("10.0.0.1", now)
+	assert.True(t, b == b1)
+	// and until the next day
+	l.detach("10.0.0.1", b)
+	assert.False(t, l.attach("10.0.0.1", now.Add(24*time.Hour)) == b1)
+}
+
+func TestLimiterRekey(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := newLimiter(LimitByClient, Limit{Messages: 1})
+
+	// a new key inherits the tokens, a bucket without a quota keeps no daily usage
+	b := l.attach("10.0.0.1", now)
+	_, err := b.take(now, 1)
+	require.NoError(t, err)
+	assert.Zero(t, b.dayMessages)
+	b = l.rekey("10.0.0.1", "name:alice", b, now)
+	_, err = b.take(now, 1)
+	assert.Equal(t, errRateLimited, err)
+	assert.NotContains(t, l.buckets, "10.0.0.1")
+
+	// buckets without clients are dropped first detached first beyond the cap
+	require.NoError(t, l.set("", Limit{DailyMessages: 10}))
+	l.maxDetached = 2
+	for _, key := range []string{"a", "b", "c"} {
+		b := l.attach(key, now)
+		_, err := b.take(now, 1)
+		require.NoError(t, err)
+		l.detach(key, b)
+	}
+	assert.NotContains(t, l.buckets, "a")
+	assert.Contains(t, l.buckets, "b")
+	assert.Contains(t, l.buckets, "c")
+	assert.Equal(t, 2, l.detached.Len())
+
+	// attaching takes a bucket off the detached ones
+	l.attach("b", now)
+	assert.Equal(t, 1, l.detached.Len())
+}
+
+func TestLimitByClient(t *testing.T) {
+	srv := New(WithRateLimit(LimitByClient, Limit{DailyMessages: 1}))
+	connect := func(id uint64) *client {
+		cli := &client{id: id, conn: addrConn{Conn: discardConn{}, addr: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1000 + int(id)}}}
+		srv.addClient(cli)
+		return cli
+	}
+	command := func(cli *client, line, body string) string {
+		msg, ok := srv.command(cli, line, bufio.NewReader(strings.NewReader(body)))
+		require.True(t, ok)
+		return msg
+	}
+
+	// clients without a nick are limited by IP, named ones by name
+	cli := connect(1)
+	assert.Equal(t, "10.0.0.1", cli.limitKey)
+	assert.Equal(t, "nick alice\n", command(cli, "nick alice\n", ""))
+	assert.Equal(t, "name:alice", cli.limitKey)
+	assert.Equal(t, "", command(cli, "relay 9 2\n", "hi"))
+	assert.Equal(t, "error quota exceeded\n", command(cli, "relay 9 2\n", "hi"))
+
+	// reconnecting keeps the quota used
+	srv.removeClient(cli)
+	cli = connect(2)
+	assert.Equal(t, "", command(cli, "relay 9 2\n", "hi"))
+	command(cli, "nick alice\n", "")
+	assert.Equal(t, "error quota exceeded\n", command(cli, "relay 9 2\n", "hi"))
+	require.NoError(t, srv.SetLimit("name:alice", Limit{DailyMessages: 2}))
+	assert.Equal(t, "", command(cli, "relay 9 2\n", "hi"))
+
+	// renaming keeps the quota used
+	assert.Equal(t, "nick bob\n", command(cli, "nick bob\n", ""))
+	assert.Equal(t, "error quota exceeded\n", command(cli, "relay 9 2\n", "hi"))
+}
+
+// limitedClient serves a client added to a server with limit through handle
+func limitedClient(t *testing.T, limit Limit) (*Server, net.Conn, *bufio.Reader, func()) {
+	srv := New(WithRateLimit(LimitByClient, limit))
+	srvConn, conn := net.Pipe()
+	cli := &client{id: 1, conn: srvConn}
+	srv.addClient(cli)
+
+	handled := make(chan struct{})
+	go func() {
+		defer close(handled)
+		srv.handle(cli)
+	}()
+	return srv, conn, bufio.NewReader(conn), func() {
+		conn.Close()
+		close(srv.close)
+		<-handled
+	}
+}
+
+func TestHandleRateLimit(t *testing.T) {
+	t.Run("reject", func(t *testing.T) {
+		srv, conn, r, done := limitedClient(t, Limit{Messages: 1, MessageBurst: 1})
+		defer done()
+
+		_, err := conn.Write([]byte("relay 9 5\nhellorelay 9 5\nhelloidentity\n"))
+		require.NoError(t, err)
+		reply, err := r.ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, "error rate limited\n", reply)
+		// the body of the rejected relay is skipped
+		reply, err = r.ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, "identity 1\n", reply)
+		assert.Equal(t, uint64(1), srv.Stats().RateLimited)
+	})
+
+	t.Run("disconnect", func(t *testing.T) {
+		_, conn, r, done := limitedClient(t, Limit{DailyMessages: 1, Action: LimitDisconnect})
+		defer done()
+
+		go conn.Write([]byte("relay 9 5\nhellorelay 9 5\nhello"))
+		reply, err := r.ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, "error quota exceeded\n", reply)
+		_, err = r.ReadByte()
+		assert.Error(t, err)
+	})
+
+	t.Run("delay", func(t *testing.T) {
+		srv, conn, r, done := limitedClient(t, Limit{Messages: 10, MessageBurst: 1, Action: LimitDelay})
+		defer done()
+
+		start := time.Now()
+		_, err := conn.Write([]byte(strings.Repeat("relay 9 5\nhello", 3) + "identity\n"))
+		require.NoError(t, err)
+		reply, err := r.ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, "identity 1\n", reply)
+		// the second and third relays owe a tenth of a second each
+		assert.True(t, time.Since(start) >= 150*time.Millisecond, time.Since(start))
+		assert.Equal(t, uint64(0), srv.Stats().RateLimited)
+		assert.NotZero(t, srv.Stats().Delayed)
+	})
+}
+
+func TestAdminHandler(t *testing.T) {
+	srv := New(WithRateLimit(LimitByIP, Limit{Messages: 100}))
+	admin := srv.AdminHandler()
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w
+	}
+
+	assert.Equal(t, http.StatusNoContent, do(http.MethodPut, "/limits/default", `{"messages":50,"action":"delay"}`).Code)
+	assert.Equal(t, http.StatusNoContent, do(http.MethodPut, "/limits/10.0.0.1", `{"bytes":1024,"daily_messages":10}`).Code)
+	w := do(http.MethodGet, "/limits", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"by":"ip","default":{"messages":50,"action":"delay"},"keys":{"10.0.0.1":{"bytes":1024,"daily_messages":10}}}`, w.Body.String())
+
+	assert.Equal(t, http.StatusNoContent, do(http.MethodDelete, "/limits/10.0.0.1", "").Code)
+	_, keys := srv.Limits()
+	assert.Empty(t, keys)
+
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodPut, "/limits/default", `{"action":"drop"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodPut, "/limits/default", `{"msgs":1}`).Code)
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodDelete, "/limits/default", "").Code)
+	assert.Equal(t, http.StatusMethodNotAllowed, do(http.MethodPost, "/limits/default", "{}").Code)
+	assert.Equal(t, http.StatusNotFound, do(http.MethodGet, "/limits/a/b", "").Code)
+
+	w = do(http.MethodGet, "/stats", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"rate_limited":0`)
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"math/bits"
+	"sort"
+	"sync"
+)
+
+const defaultRegistryShards = 64
+
+type registryShard struct {
+	m       sync.RWMutex
+	clients map[uint64]*client
+}
+
+// registry keeps the connected clients in shards keyed by ID,
+// so relays, connects and disconnects of different clients do not contend on one lock
+type registry struct {
+	shards []registryShard
+	shift  uint
+}
+
+// newRegistry rounds the shards up to a power of two, 1 at least
+func newRegistry(shards int) *registry {
+	shift := uint(64)
+	if shards > 1 {
+		shift = 64 - uint(bits.Len(uint(shards-1)))
+	}
+	r := &registry{shards: make([]registryShard, 1<<(64-shift)), shift: shift}
+	for i := range r.shards {
+		r.shards[i].clients = make(map[uint64]*client)
+	}
+	return r
+}
+
+// shard mixes the ID with a Fibonacci multiply and keeps its high bits,
+// Snowflake IDs differ in their middle bits and would all share one shard by modulo
+func (r *registry) shard(clientID uint64) *registryShard {
+	return &r.shards[(clientID*0x9E3779B97F4A7C15)>>r.shift]
+}
+
+func (r *registry) get(clientID uint64) (*client, bool) {
+	shard := r.shard(clientID)
+	shard.m.RLock()
+	defer shard.m.RUnlock()
+
+	cli, ok := shard.clients[clientID]
+	return cli, ok
+}
+
+func (r *registry) add(cli *client) {
+	shard := r.shard(cli.id)
+	shard.m.Lock()
+	defer shard.m.Unlock()
+
+	shard.clients[cli.id] = cli
+}
+
+func (r *registry) remove(clientID uint64) {
+	shard := r.shard(clientID)
+	shard.m.Lock()
+	defer shard.m.Unlock()
+
+	delete(shard.clients, clientID)
+}
+
+// snapshot returns the connected clients sorted by ID.
+// All shards are locked together so the result is the set of clients at one point in time.
+func (r *registry) snapshot() []*client {
+	for i := range r.shards {
+		r.shards[i].m.RLock()
+	}
+	count := 0
+	for i := range r.shards {
+		count += len(r.shards[i].clients)
+	}
+	clients := make([]*client, 0, count)
+	for i := range r.shards {
+		for _, cli := range r.shards[i].clients {
+			clients = append(clients, cli)
+		}
+	}
+	for i := range r.shards {
+		r.shards[i].m.RUnlock()
+	}
+
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].id < clients[j].id
+	})
+	return clients
+}
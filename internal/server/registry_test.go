@@ -0,0 +1,150 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry(t *testing.T) {
+	r := newRegistry(4)
+	for _, id := range []uint64{9, 2, 5, 4, 1} {
+		r.add(&client{id: id})
+	}
+
+	cli, ok := r.get(5)
+	require.True(t, ok)
+	assert.Equal(t, uint64(5), cli.id)
+
+	r.remove(5)
+	_, ok = r.get(5)
+	assert.False(t, ok)
+
+	ids := []uint64{}
+	for _, cli := range r.snapshot() {
+		ids = append(ids, cli.id)
+	}
+	assert.Equal(t, []uint64{1, 2, 4, 9}, ids)
+
+	// a single shard keeps working the same way
+	r = newRegistry(0)
+	r.add(&client{id: 3})
+	assert.Len(t, r.snapshot(), 1)
+}
+
+func TestRegistryShardSnowflake(t *testing.T) {
+	r := newRegistry(48)
+	require.Len(t, r.shards, 64)
+
+	// Snowflake IDs of one node, a few per millisecond: ms<<22 | node<<12 | seq
+	counts := make(map[*registryShard]int)
+	const ids = 64 * 100
+	for ms := uint64(1); ms <= ids/4; ms++ {
+		for seq := uint64(0); seq < 4; seq++ {
+			counts[r.shard(ms<<22|7<<12|seq)]++
+		}
+	}
+	assert.Len(t, counts, len(r.shards))
+	for _, n := range counts {
+		assert.True(t, n < 3*ids/len(r.shards), "%d IDs in one shard", n)
+	}
+}
+
+// BenchmarkRegistryContention relays from thousands of concurrent senders
+// while clients keep connecting, disconnecting and listing the others
+func BenchmarkRegistryContention(b *testing.B) {
+	const senders = 4096
+	const clients = 1024
+	data := []byte("ping")
+
+	for _, shards := range []int{1, defaultRegistryShards} {
+		b.Run(fmt.Sprintf("%d shards", shards), func(b *testing.B) {
+			srv := New(WithRegistryShards(shards))
+			for id := uint64(1); id <= clients; id++ {
+				srv.addClient(&client{id: id, conn: discardConn{}})
+			}
+			var next uint64 = clients
+
+			b.SetParallelism((senders + runtime.GOMAXPROCS(0) - 1) / runtime.GOMAXPROCS(0))
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for i := 0; pb.Next(); i++ {
+					n := atomic.AddUint64(&next, 1)
+					switch {
+					case i%64 == 0:
+						// a client comes and goes
+						cli := &client{id: n, conn: discardConn{}}
+						srv.addClient(cli)
+						srv.removeClient(cli)
+					case i%256 == 1:
+						srv.listClients(0, true)
+					default:
+						srv.relayMessage(n%clients+1, n, []uint64{(n+1)%clients + 1}, map[string]string{}, data)
+					}
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkCommandContention relays through command from thousands of concurrent senders
+// to IDs, names and labels under a policy, while clients rename and relabel themselves
+func BenchmarkCommandContention(b *testing.B) {
+	const senders = 4096
+	const clients = 1024
+	policy, err := ParsePolicy(strings.NewReader(`{"rules": [{"actions": ["relay"], "to": {"role": "admin"}, "effect": "deny"}]}`))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, shards := range []int{1, defaultRegistryShards} {
+		b.Run(fmt.Sprintf("%d shards", shards), func(b *testing.B) {
+			srv := New(WithRegistryShards(shards), WithPolicy(policy))
+			all := make([]*client, clients)
+			for i := range all {
+				all[i] = &client{id: uint64(i + 1), conn: discardConn{}}
+				srv.addClient(all[i])
+				if err := srv.setNick(all[i], fmt.Sprintf("c%d", i+1)); err != nil {
+					b.Fatal(err)
+				}
+				srv.setLabels(all[i], map[string]string{"role": "device", "n": fmt.Sprint(i + 1)})
+			}
+			var next uint64
+
+			b.SetParallelism((senders + runtime.GOMAXPROCS(0) - 1) / runtime.GOMAXPROCS(0))
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for i := 0; pb.Next(); i++ {
+					n := atomic.AddUint64(&next, 1)
+					cli := all[n%clients]
+					receiver := (n+1)%clients + 1
+					var line string
+					switch {
+					case i%64 == 0:
+						line = fmt.Sprintf("nick c%d\n", cli.id)
+					case i%64 == 1:
+						line = fmt.Sprintf("labels role=device,n=%d\n", cli.id)
+					case i%8 == 2:
+						line = fmt.Sprintf("relay c%d 4\n", receiver)
+					case i%8 == 3:
+						line = fmt.Sprintf("relay n=%d 4\n", receiver)
+					default:
+						line = fmt.Sprintf("relay %d 4\n", receiver)
+					}
+					msg, ok := srv.command(cli, line, bufio.NewReader(strings.NewReader("ping")))
+					if !ok || strings.HasPrefix(msg, "error") {
+						b.Fatalf("command %q failed: %q", line, msg)
+					}
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,242 @@
+package server
+
+import (
+	"container/heap"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/badboyd/tcp-hub/pkg/message"
+)
+
+type requestKey struct {
+	requesterID uint64
+	corr        string
+}
+
+// pendingRequest is a request waiting for responses of its receivers until deadline
+type pendingRequest struct {
+	key      requestKey
+	deadline time.Time
+	index    int
+	waiting  map[uint64]struct{}
+}
+
+// requestDeadlines is a min-heap of pending requests ordered by deadline
+type requestDeadlines []*pendingRequest
+
+func (h requestDeadlines) Len() int { return len(h) }
+
+func (h requestDeadlines) Less(i, j int) bool { return h[i].deadline.Before(h[j].deadline) }
+
+func (h requestDeadlines) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *requestDeadlines) Push(x interface{}) {
+	req := x.(*pendingRequest)
+	req.index = len(*h)
+	*h = append(*h, req)
+}
+
+func (h *requestDeadlines) Pop() interface{} {
+	old := *h
+	req := old[len(old)-1]
+	old[len(old)-1] = nil
+	req.index = -1
+	*h = old[:len(old)-1]
+	return req
+}
+
+func isRequest(fields map[string]string) bool {
+	return fields[message.FieldCorr] != "" && fields[message.FieldResp] != "1"
+}
+
+func isResponse(fields map[string]string) bool {
+	return fields[message.FieldCorr] != "" && fields[message.FieldResp] == "1"
+}
+
+// trackRequest starts waiting for responses of a request relayed to receivers.
+// The requester is told about the missing receivers, it returns false when
+// there is no receiver at all.
+func (s *Server) trackRequest(senderID uint64, fields map[string]string, receivers []*client, missing []uint64) bool {
+	if !isRequest(fields) {
+		return true
+	}
+	corr := fields[message.FieldCorr]
+	sender, connected := s.registry.get(senderID)
+	if len(receivers) == 0 {
+		if connected {
+			s.send(sender, string(message.NoResponder{CorrelationID: corr}.AppendTo(nil)))
+		}
+		return false
+	}
+	if len(missing) > 0 && connected {
+		s.send(sender, string(message.Unreachable{CorrelationID: corr, ReceiverIDs: missing}.AppendTo(nil)))
+	}
+
+	timeout, err := strconv.ParseUint(fields[message.FieldTimeout], 10, 32)
+	if err != nil || timeout == 0 {
+		return true
+	}
+
+	key := requestKey{requesterID: senderID, corr: corr}
+	req := &pendingRequest{
+		key:      key,
+		deadline: s.clock.Now().Add(time.Duration(timeout) * time.Millisecond),
+		waiting:  make(map[uint64]struct{}, len(receivers)),
+	}
+
+	s.rm.Lock()
+	defer s.rm.Unlock()
+
+	// a receiver removed before s.rm was taken has already dropped its requests,
+	// one removed after that drops this request too
+	gone := []uint64{}
+	for _, receiver := range receivers {
+		if _, ok := s.registry.get(receiver.id); !ok {
+			gone = append(gone, receiver.id)
+			continue
+		}
+		req.waiting[receiver.id] = struct{}{}
+	}
+	if len(gone) > 0 && connected {
+		s.send(sender, string(message.Unreachable{CorrelationID: corr, ReceiverIDs: gone}.AppendTo(nil)))
+	}
+	if len(req.waiting) == 0 {
+		return true
+	}
+
+	if old, ok := s.requests[key]; ok {
+		heap.Remove(&s.requestDeadlines, old.index)
+	}
+	heap.Push(&s.requestDeadlines, req)
+	s.requests[key] = req
+	if s.requestDeadlines[0] == req {
+		select {
+		case s.requestWake <- struct{}{}:
+		default:
+		}
+	}
+	return true
+}
+
+// answerRequest records a response relayed by senderID to its requesters
+func (s *Server) answerRequest(senderID uint64, fields map[string]string, receivers []*client) {
+	if !isResponse(fields) {
+		return
+	}
+
+	s.rm.Lock()
+	defer s.rm.Unlock()
+
+	for _, receiver := range receivers {
+		key := requestKey{requesterID: receiver.id, corr: fields[message.FieldCorr]}
+		req, ok := s.requests[key]
+		if !ok {
+			continue
+		}
+		delete(req.waiting, senderID)
+		if len(req.waiting) == 0 {
+			s.forgetRequest(req)
+		}
+	}
+}
+
+// forgetRequest drops req from the pending requests, s.rm must be held
+func (s *Server) forgetRequest(req *pendingRequest) {
+	heap.Remove(&s.requestDeadlines, req.index)
+	delete(s.requests, req.key)
+}
+
+// expiredRequests takes the requests whose deadline passed at now out of the pending requests
+func (s *Server) expiredRequests(now time.Time) []*pendingRequest {
+	s.rm.Lock()
+	defer s.rm.Unlock()
+
+	expired := []*pendingRequest{}
+	for len(s.requestDeadlines) > 0 && !s.requestDeadlines[0].deadline.After(now) {
+		req := heap.Pop(&s.requestDeadlines).(*pendingRequest)
+		delete(s.requests, req.key)
+		expired = append(expired, req)
+	}
+	return expired
+}
+
+// requestLoop tells requesters about the receivers which did not respond before the request timeout
+func (s *Server) requestLoop() {
+	for {
+		var timer <-chan time.Time
+		s.rm.Lock()
+		if len(s.requestDeadlines) > 0 {
+			timer = s.clock.After(s.requestDeadlines[0].deadline.Sub(s.clock.Now()))
+		}
+		s.rm.Unlock()
+
+		select {
+		case <-s.close:
+			return
+		case <-s.requestWake:
+		case <-timer:
+		}
+
+		for _, req := range s.expiredRequests(s.clock.Now()) {
+			// the waiting receivers of a request taken out of the pending requests do not change
+			s.notify(req.key.requesterID, string(message.Timeout{CorrelationID: req.key.corr, ReceiverIDs: req.waitingIDs()}.AppendTo(nil)))
+		}
+	}
+}
+
+func (req *pendingRequest) waitingIDs() []uint64 {
+	clientIDs := make([]uint64, 0, len(req.waiting))
+	for clientID := range req.waiting {
+		clientIDs = append(clientIDs, clientID)
+	}
+	sort.Slice(clientIDs, func(i, j int) bool {
+		return clientIDs[i] < clientIDs[j]
+	})
+	return clientIDs
+}
+
+// dropRequests forgets the requests of a disconnected client and
+// tells requesters still waiting for its response that it is gone
+func (s *Server) dropRequests(clientID uint64) {
+	s.rm.Lock()
+	abandoned := []requestKey{}
+	for key, req := range s.requests {
+		if key.requesterID == clientID {
+			s.forgetRequest(req)
+			continue
+		}
+		if _, ok := req.waiting[clientID]; !ok {
+			continue
+		}
+		delete(req.waiting, clientID)
+		if len(req.waiting) == 0 {
+			s.forgetRequest(req)
+		}
+		abandoned = append(abandoned, key)
+	}
+	s.rm.Unlock()
+
+	for _, key := range abandoned {
+		s.notify(key.requesterID, string(message.Unreachable{CorrelationID: key.corr, ReceiverIDs: []uint64{clientID}}.AppendTo(nil)))
+	}
+}
+
+// notify writes a server notice to clientID if it is still connected
+func (s *Server) notify(clientID uint64, msg string) {
+	cli, ok := s.registry.get(clientID)
+	if ok {
+		s.send(cli, msg)
+	}
+}
+
+func (s *Server) send(cli *client, msg string) {
+	if _, err := cli.write([]byte(msg), s.writeTimeout); err != nil {
+		log.Printf("Error send notice to %d: %s\n", cli.id, err.Error())
+	}
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequest(t *testing.T) {
+	srv := New()
+	defer srv.Stop()
+
+	serverAddr := net.TCPAddr{Port: serverPort}
+	require.NoError(t, srv.Start(&serverAddr))
+
+	conn1, err := net.Dial(serverAddr.Network(), serverAddr.String())
+	require.NoError(t, err)
+	defer conn1.Close()
+	waitForClients(t, srv, 1)
+
+	conn2, err := net.Dial(serverAddr.Network(), serverAddr.String())
+	require.NoError(t, err)
+	defer conn2.Close()
+	waitForClients(t, srv, 2)
+
+	r1 := bufio.NewReader(conn1)
+	r2 := bufio.NewReader(conn2)
+	expect := func(r *bufio.Reader, expected string) {
+		msg := make([]byte, len(expected))
+		_, err := io.ReadFull(r, msg)
+		require.NoError(t, err)
+		assert.Equal(t, expected, string(msg))
+	}
+
+	t.Run("no responder", func(t *testing.T) {
+		_, err = conn1.Write([]byte("relay 9 4 corr=1 timeout=1000\nping"))
+		require.NoError(t, err)
+		expect(r1, "noresponder 1\n")
+	})
+
+	t.Run("response", func(t *testing.T) {
+		_, err = conn1.Write([]byte("relay 2 4 corr=2 timeout=100\nping"))
+		require.NoError(t, err)
+		expect(r2, "relay 1 4 corr=2 id=2 replyto=1\nping")
+
+		_, err = conn2.Write([]byte("relay 1 4 corr=2 resp=1\npong"))
+		require.NoError(t, err)
+		expect(r1, "relay 2 4 corr=2 id=3 resp=1\npong")
+
+		srv.rm.Lock()
+		assert.Empty(t, srv.requests)
+		assert.Empty(t, srv.requestDeadlines)
+		srv.rm.Unlock()
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		// a replyto given by the sender is replaced with its ID
+		_, err = conn1.Write([]byte("relay 2 4 corr=3 replyto=2 timeout=50\nping"))
+		require.NoError(t, err)
+		expect(r2, "relay 1 4 corr=3 id=4 replyto=1\nping")
+
+		conn1.SetReadDeadline(time.Now().Add(time.Second))
+		expect(r1, "timeout 3 2\n")
+	})
+
+	t.Run("unreachable", func(t *testing.T) {
+		_, err = conn1.Write([]byte("relay 2,9 4 corr=4 timeout=1000\nping"))
+		require.NoError(t, err)
+		expect(r1, "unreachable 4 9\n")
+		expect(r2, "relay 1 4 corr=4 id=5 replyto=1\nping")
+
+		// a receiver leaving while a request waits for it is unreachable too
+		conn2.Close()
+		expect(r1, "unreachable 4 2\n")
+
+		srv.rm.Lock()
+		assert.Empty(t, srv.requests)
+		assert.Empty(t, srv.requestDeadlines)
+		srv.rm.Unlock()
+	})
+}
+
+func TestRequestTimeoutClock(t *testing.T) {
+	clock := newFakeClock()
+	srv := New(WithClock(clock))
+	defer srv.Stop()
+
+	serverAddr := net.TCPAddr{Port: serverPort}
+	require.NoError(t, srv.Start(&serverAddr))
+
+	conn1, err := net.Dial(serverAddr.Network(), serverAddr.String())
+	require.NoError(t, err)
+	defer conn1.Close()
+	waitForClients(t, srv, 1)
+
+	conn2, err := net.Dial(serverAddr.Network(), serverAddr.String())
+	require.NoError(t, err)
+	defer conn2.Close()
+	waitForClients(t, srv, 2)
+
+	r1 := bufio.NewReader(conn1)
+	_, err = conn1.Write([]byte("relay 2 4 corr=1 timeout=1000\nping" + "relay 2 4 corr=2 timeout=5000\nping"))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		srv.rm.Lock()
+		defer srv.rm.Unlock()
+		return len(srv.requests) == 2
+	}, time.Second, time.Millisecond)
+
+	// requests time out by the clock of the server
+	clock.Advance(2 * time.Second)
+	conn1.SetReadDeadline(time.Now().Add(time.Second))
+	line, err := r1.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "timeout 1 2\n", line)
+
+	srv.rm.Lock()
+	assert.Len(t, srv.requests, 1)
+	assert.Len(t, srv.requestDeadlines, 1)
+	srv.rm.Unlock()
+
+	clock.Advance(5 * time.Second)
+	line, err = r1.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "timeout 2 2\n", line)
+}
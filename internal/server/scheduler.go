@@ -0,0 +1,194 @@
+package server
+
+import (
+	"container/heap"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/badboyd/tcp-hub/pkg/message"
+)
+
+const maxScheduleDelay = 30 * 24 * time.Hour
+
+var errScheduleInvalid = errors.New("invalid schedule")
+
+// scheduled is a relay waiting for its delivery time.
+// Receivers are resolved when it is due, so names, selectors and
+// queue groups refer to the clients connected at that time.
+type scheduled struct {
+	due       time.Time
+	msgID     uint64
+	senderID  uint64
+	receivers string
+	fields    map[string]string
+	data      []byte
+	index     int
+}
+
+// schedule is a min-heap of scheduled relays ordered by due time
+type schedule []*scheduled
+
+func (h schedule) Len() int { return len(h) }
+
+func (h schedule) Less(i, j int) bool {
+	if h[i].due.Equal(h[j].due) {
+		return h[i].msgID < h[j].msgID
+	}
+	return h[i].due.Before(h[j].due)
+}
+
+func (h schedule) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *schedule) Push(x interface{}) {
+	item := x.(*scheduled)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *schedule) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	item.index = -1
+	*h = old[:len(old)-1]
+	return item
+}
+
+// scheduler keeps delayed relays until they are due
+type scheduler struct {
+	m     sync.Mutex
+	queue schedule
+	byID  map[uint64]*scheduled
+	wake  chan struct{}
+}
+
+func newScheduler() *scheduler {
+	return &scheduler{
+		byID: make(map[uint64]*scheduled),
+		wake: make(chan struct{}, 1),
+	}
+}
+
+// dueAt returns when a relay with "delay" (milliseconds) or "at" (unix milliseconds)
+// fields is due, ok is false for relays to deliver right away
+func dueAt(fields map[string]string, now time.Time) (due time.Time, ok bool, err error) {
+	if v, found := fields[message.FieldDelay]; found {
+		delay, err := strconv.ParseUint(v, 10, 64)
+		if err != nil || time.Duration(delay)*time.Millisecond > maxScheduleDelay {
+			return time.Time{}, false, errScheduleInvalid
+		}
+		due = now.Add(time.Duration(delay) * time.Millisecond)
+	} else if v, found := fields[message.FieldAt]; found {
+		at, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return time.Time{}, false, errScheduleInvalid
+		}
+		due = time.Unix(0, at*int64(time.Millisecond))
+		if due.Sub(now) > maxScheduleDelay {
+			return time.Time{}, false, errScheduleInvalid
+		}
+	} else {
+		return time.Time{}, false, nil
+	}
+	return due, due.After(now), nil
+}
+
+// schedule keeps item until it is due
+func (s *Server) schedule(item *scheduled) {
+	s.sched.m.Lock()
+	heap.Push(&s.sched.queue, item)
+	s.sched.byID[item.msgID] = item
+	first := s.sched.queue[0] == item
+	s.sched.m.Unlock()
+
+	if first {
+		select {
+		case s.sched.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// cancelScheduled drops the scheduled relay msgID of senderID
+func (s *Server) cancelScheduled(senderID, msgID uint64) bool {
+	s.sched.m.Lock()
+	defer s.sched.m.Unlock()
+
+	item, ok := s.sched.byID[msgID]
+	if !ok || item.senderID != senderID {
+		return false
+	}
+	heap.Remove(&s.sched.queue, item.index)
+	delete(s.sched.byID, msgID)
+	return true
+}
+
+// dueScheduled takes the relays due at now out of the schedule
+func (s *Server) dueScheduled(now time.Time) []*scheduled {
+	s.sched.m.Lock()
+	defer s.sched.m.Unlock()
+
+	due := []*scheduled{}
+	for len(s.sched.queue) > 0 && !s.sched.queue[0].due.After(now) {
+		item := heap.Pop(&s.sched.queue).(*scheduled)
+		delete(s.sched.byID, item.msgID)
+		due = append(due, item)
+	}
+	return due
+}
+
+// scheduleLoop relays scheduled messages when they are due
+func (s *Server) scheduleLoop() {
+	for {
+		var timer <-chan time.Time
+		s.sched.m.Lock()
+		if len(s.sched.queue) > 0 {
+			timer = s.clock.After(s.sched.queue[0].due.Sub(s.clock.Now()))
+		}
+		s.sched.m.Unlock()
+
+		select {
+		case <-s.close:
+			return
+		case <-s.sched.wake:
+		case <-timer:
+		}
+
+		for _, item := range s.dueScheduled(s.clock.Now()) {
+			s.fire(item)
+		}
+	}
+}
+
+// fire relays a scheduled message which is due
+func (s *Server) fire(item *scheduled) {
+	if group := strings.TrimPrefix(item.receivers, message.QueuePrefix); group != item.receivers {
+		if denied := s.authorizeGroup(item.senderID, item.msgID, group); denied != "" {
+			s.notify(item.senderID, denied)
+			return
+		}
+		if err := s.relayToQueue(item.senderID, item.msgID, group, item.fields, item.data); err != nil {
+			s.notify(item.senderID, errorReply(err))
+		}
+		return
+	}
+
+	receiverIDs, err := s.resolveReceivers(item.receivers)
+	if err != nil {
+		log.Printf("Drop scheduled message %d: %s\n", item.msgID, err.Error())
+		return
+	}
+	receiverIDs, denied := s.authorizeReceivers(item.senderID, item.msgID, receiverIDs)
+	if denied != "" {
+		s.notify(item.senderID, denied)
+	}
+	s.relayMessage(item.senderID, item.msgID, receiverIDs, item.fields, item.data)
+}
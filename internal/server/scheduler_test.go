@@ -0,0 +1,171 @@
+package server
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClock only moves forward on Advance
+type fakeClock struct {
+	m       sync.Mutex
+	now     time.Time
+	waiters []fakeTimer
+}
+
+type fakeTimer struct {
+	at time.Time
+	ch chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(1000, 0)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.m.Lock()
+	defer c.m.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.waiters = append(c.waiters, fakeTimer{at: c.now.Add(d), ch: ch})
+	return ch
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.now = c.now.Add(d)
+	waiters := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.at.After(c.now) {
+			waiters = append(waiters, w)
+			continue
+		}
+		w.ch <- c.now
+	}
+	c.waiters = waiters
+}
+
+func TestDueAt(t *testing.T) {
+	now := time.Unix(1000, 0)
+
+	_, ok, err := dueAt(map[string]string{}, now)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	due, ok, err := dueAt(map[string]string{"delay": "1500"}, now)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, now.Add(1500*time.Millisecond), due)
+
+	due, ok, err = dueAt(map[string]string{"at": "1002000"}, now)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, now.Add(2*time.Second), due)
+
+	// a time in the past is delivered right away
+	_, ok, err = dueAt(map[string]string{"at": "999000"}, now)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	for _, fields := range []map[string]string{
+		{"delay": "-1"},
+		{"delay": "x"},
+		{"delay": "2592000001"},
+		{"at": "x"},
+	} {
+		_, _, err := dueAt(fields, now)
+		assert.Equal(t, errScheduleInvalid, err, fields)
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	srv := New()
+
+	srv.schedule(&scheduled{due: time.Unix(3, 0), msgID: 3, senderID: 1})
+	srv.schedule(&scheduled{due: time.Unix(1, 0), msgID: 2, senderID: 1})
+	srv.schedule(&scheduled{due: time.Unix(1, 0), msgID: 1, senderID: 1})
+	srv.schedule(&scheduled{due: time.Unix(2, 0), msgID: 4, senderID: 2})
+
+	// only the sender cancels its messages
+	assert.False(t, srv.cancelScheduled(1, 4))
+	assert.True(t, srv.cancelScheduled(2, 4))
+	assert.False(t, srv.cancelScheduled(2, 4))
+	assert.False(t, srv.cancelScheduled(1, 5))
+
+	ids := func(items []*scheduled) []uint64 {
+		ids := []uint64{}
+		for _, item := range items {
+			ids = append(ids, item.msgID)
+		}
+		return ids
+	}
+	assert.Equal(t, []uint64{}, ids(srv.dueScheduled(time.Unix(0, 0))))
+	assert.Equal(t, []uint64{1, 2}, ids(srv.dueScheduled(time.Unix(2, 0))))
+	assert.Equal(t, []uint64{3}, ids(srv.dueScheduled(time.Unix(5, 0))))
+	assert.Empty(t, srv.sched.byID)
+}
+
+func TestScheduleLoop(t *testing.T) {
+	clock := newFakeClock()
+	srv := New(WithClock(clock))
+	defer close(srv.close)
+
+	receiverSrv, receiverConn := net.Pipe()
+	defer receiverConn.Close()
+	receiver := &client{id: 2, conn: receiverSrv}
+	srv.registry.add(receiver)
+
+	go srv.scheduleLoop()
+
+	srv.schedule(&scheduled{due: clock.Now().Add(2 * time.Second), msgID: 11, senderID: 1, receivers: "2", data: []byte("two")})
+	srv.schedule(&scheduled{due: clock.Now().Add(time.Second), msgID: 10, senderID: 1, receivers: "2", data: []byte("one")})
+	srv.schedule(&scheduled{due: clock.Now().Add(time.Second), msgID: 12, senderID: 1, receivers: "2", data: []byte("gone")})
+	require.True(t, srv.cancelScheduled(1, 12))
+
+	// wait for the loop to wait on the first message
+	require.Eventually(t, func() bool {
+		clock.m.Lock()
+		defer clock.m.Unlock()
+		for _, w := range clock.waiters {
+			if w.at.Equal(clock.now.Add(time.Second)) {
+				return true
+			}
+		}
+		return false
+	}, time.Second, time.Millisecond)
+
+	clock.Advance(time.Second)
+	expected := "relay 1 3 id=10\none"
+	msg := make([]byte, len(expected))
+	_, err := io.ReadFull(receiverConn, msg)
+	require.NoError(t, err)
+	assert.Equal(t, expected, string(msg))
+
+	require.Eventually(t, func() bool {
+		clock.m.Lock()
+		defer clock.m.Unlock()
+		return len(clock.waiters) > 0
+	}, time.Second, time.Millisecond)
+
+	clock.Advance(time.Second)
+	expected = "relay 1 3 id=11\ntwo"
+	msg = make([]byte, len(expected))
+	_, err = io.ReadFull(receiverConn, msg)
+	require.NoError(t, err)
+	assert.Equal(t, expected, string(msg))
+}
@@ -2,13 +2,13 @@ package server
 
 import (
 	"bufio"
-	"fmt"
 	"io"
 	"log"
 	"net"
-	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/badboyd/tcp-hub/pkg/id"
@@ -16,83 +16,217 @@ import (
 )
 
 type client struct {
-	id   uint64
-	conn net.Conn
+	id uint64
+	// am guards name and labels, labels are replaced rather than modified
+	am     sync.Mutex
+	name   string
+	labels map[string]string
+	conn   net.Conn
+	wm     sync.Mutex
+	// streaming is set while a streamed frame is written, held keeps the writes waiting for it, guarded by wm
+	streaming bool
+	held      []byte
+	out       outbox
+	// ip is the remote IP of conn and addr the same parsed, nil when conn has no IP, both set at connect
+	ip   string
+	addr net.IP
+	// bucket holds the limit of the client under limitKey, it is nil for clients never added
+	bucket   *bucket
+	limitKey string
+	// counted is set for clients admitted from a connection, removeClient uncounts them
+	counted bool
+
+	// guarded by Server.qm
+	groups   []string
+	inflight map[uint64]*delivery
 }
 
 // Server handles and stores clients information
 type Server struct {
-	m        sync.RWMutex
-	clients  map[uint64]*client
+	registry *registry
+	// nm guards names and lm labels, relays to client IDs take neither
+	nm     sync.RWMutex
+	names  map[string]*client
+	lm     sync.RWMutex
+	labels labelIndex
+	// policy holds the *Policy deciding what clients may do
+	policy   atomic.Value
 	close    chan struct{}
-	idSeq    id.Seq
-	listener net.Listener
-	wg       sync.WaitGroup
+	ids      id.Allocator
+	msgSeq   id.Seq
+	qm       sync.Mutex
+	groups   map[string]*queueGroup
+	rm       sync.Mutex
+	requests map[requestKey]*pendingRequest
+	// requestDeadlines orders requests by timeout, requestWake tells requestLoop about an earlier one
+	requestDeadlines requestDeadlines
+	requestWake      chan struct{}
+	sched            *scheduler
+	clock            Clock
+
+	ackTimeout      time.Duration
+	maxRedeliveries int
+	sweepInterval   time.Duration
+	inboxMessages   int
+	inboxBytes      int64
+	streamThreshold int
+	registryShards  int
+	maxLineLength   int
+	maxBodySize     int
+	lineTimeout     time.Duration
+	frameTimeout    time.Duration
+	writeTimeout    time.Duration
+	limitBy         LimitBy
+	limit           Limit
+	limits          *limiter
+	maxClients      int
+	maxClientsPerIP int
+	acceptRate      float64
+	acceptBurst     int
+	admission       admission
+	trustedProxies  []*net.IPNet
+	stats           *Stats
+	// eventLoopWorkers is 0 when every connection is served by its own goroutine
+	eventLoopWorkers int
+	listener         net.Listener
+	wg               sync.WaitGroup
 }
 
 // New creates new server
-func New() *Server {
-	return &Server{
-		close:   make(chan struct{}),
-		clients: make(map[uint64]*client),
+func New(opts ...Option) *Server {
+	s := &Server{
+		close:  make(chan struct{}),
+		names:  make(map[string]*client),
+		labels: make(labelIndex),
+		groups: make(map[string]*queueGroup),
+
+		requests:    make(map[requestKey]*pendingRequest),
+		requestWake: make(chan struct{}, 1),
+		sched:       newScheduler(),
+		clock:       realClock{},
+		ids:         id.NewCounter(0),
+
+		ackTimeout:      defaultAckTimeout,
+		maxRedeliveries: defaultMaxRedeliveries,
+		sweepInterval:   defaultSweepInterval,
+		inboxMessages:   defaultInboxMessages,
+		inboxBytes:      defaultInboxBytes,
+		streamThreshold: defaultStreamThreshold,
+		registryShards:  defaultRegistryShards,
+		maxLineLength:   defaultMaxLineLength,
+		maxBodySize:     message.DefaultMaxBodySize,
+		lineTimeout:     defaultLineTimeout,
+		frameTimeout:    defaultFrameTimeout,
+		writeTimeout:    defaultWriteTimeout,
+		limitBy:         LimitByClient,
+		stats:           &Stats{},
+	}
+	for _, opt := range opts {
+		opt(s)
 	}
+	s.registry = newRegistry(s.registryShards)
+	s.limits = newLimiter(s.limitBy, s.limit)
+	if s.acceptRate > 0 {
+		s.admission.rate = newBucket(Limit{Messages: s.acceptRate, MessageBurst: float64(s.acceptBurst)}, s.clock.Now())
+	}
+	return s
 }
 
 // Start server at laddr
 func (s *Server) Start(laddr *net.TCPAddr) error {
 	log.Println("Start server at ", laddr.String())
 
+	var loop *eventLoop
+	if s.eventLoopWorkers > 0 {
+		var err error
+		if loop, err = newEventLoop(s); err != nil {
+			return err
+		}
+	}
+
 	listener, err := net.ListenTCP(laddr.Network(), laddr)
 	if err != nil {
 		return err
 	}
 	s.listener = listener
 
+	s.wg.Add(1)
 	go func() {
-		for {
-			conn, err := listener.Accept()
-			if err != nil {
-				log.Printf("Stop accepting conn: %s", err.Error())
-				return
-			}
+		defer s.wg.Done()
+		s.redeliverLoop()
+	}()
 
-			cli := &client{
-				id:   s.idSeq.Next(),
-				conn: conn,
-			}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.sweepLoop()
+	}()
 
-			s.addClient(cli)
-			s.wg.Add(1)
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.scheduleLoop()
+	}()
 
-			go func() {
-				defer s.wg.Done()
-				s.handle(cli)
-			}()
-		}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.requestLoop()
 	}()
 
+	if loop != nil {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			loop.run(s.eventLoopWorkers)
+		}()
+	}
+
+	go s.acceptLoop(listener, loop)
+
 	return nil
 }
 
 func (s *Server) addClient(cli *client) {
-	s.m.Lock()
-	defer s.m.Unlock()
-
-	s.clients[cli.id] = cli
+	cli.limitKey = s.limits.key(cli)
+	cli.bucket = s.limits.attach(cli.limitKey, s.clock.Now())
+	s.registry.add(cli)
 }
 
 func (s *Server) removeClient(cli *client) {
-	s.m.Lock()
-	defer s.m.Unlock()
-
+	s.registry.remove(cli.id)
 	cli.conn.Close()
-	delete(s.clients, cli.id)
+
+	if name := s.nameOf(cli); name != "" {
+		s.nm.Lock()
+		if s.names[name] == cli {
+			delete(s.names, name)
+		}
+		s.nm.Unlock()
+	}
+	if labels := s.labelsOf(cli); len(labels) > 0 {
+		s.lm.Lock()
+		s.labels.remove(cli.id, labels)
+		s.lm.Unlock()
+	}
+
+	s.leaveQueues(cli)
+	s.dropRequests(cli.id)
+	if cli.bucket != nil {
+		s.limits.detach(cli.limitKey, cli.bucket)
+	}
+	if cli.counted {
+		s.countClient(cli, -1)
+	}
+	s.ids.Release(cli.id)
 }
 
 func (s *Server) handle(cli *client) {
 	defer s.removeClient(cli)
 
 	r := bufio.NewReader(cli.conn)
+	lines := &lineReader{r: r, max: s.maxLineLength}
+	body := &frameBody{r: r, conn: cli.conn, s: s}
 
 ReadLoop:
 	for {
@@ -101,97 +235,416 @@ ReadLoop:
 			log.Printf("Stop serving client %d\n", cli.id)
 			return
 		default:
-			cli.conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
-			line, err := r.ReadString('\n')
+			deadline := time.Now().Add(200 * time.Millisecond)
+			if lineDeadline := lines.start.Add(s.lineTimeout); lines.pending && lineDeadline.Before(deadline) {
+				deadline = lineDeadline
+			}
+			cli.conn.SetReadDeadline(deadline)
+			line, err := lines.readLine()
 			if err != nil {
-				if opErr, ok := err.(*net.OpError); ok && opErr.Timeout() {
+				if isTimeout(err) {
+					if lines.pending && !time.Now().Before(lines.start.Add(s.lineTimeout)) {
+						s.refuse(cli, errLineTimeout)
+						return
+					}
 					continue ReadLoop
 				}
+				if err == errLineTooLong {
+					s.refuse(cli, err)
+					return
+				}
 				log.Printf("[%d] ReadString error: %s\n", cli.id, err.Error())
 				return
 			}
 
-			var msg string
-
-			parts := strings.SplitN(line[:len(line)-1], " ", 2)
-			switch parts[0] {
-			case message.IdentityType:
-				msg = fmt.Sprintf("%s %d\n", message.IdentityType, cli.id)
-			case message.ListType:
-				clientIDs := []uint64{}
-				for _, clientID := range s.ListClientIDs() {
-					if clientID != cli.id {
-						clientIDs = append(clientIDs, clientID)
-					}
-				}
-				msg = fmt.Sprintf("%s %s\n", message.ListType, id.JoinIDArray(clientIDs, ","))
-			case message.RelayType:
-				var err error
-				var size int
-				var receivers string
-
-				if _, err = fmt.Sscanf(parts[1], "%s %d", &receivers, &size); err != nil {
-					log.Printf("Message in wrong format: %s\n", err.Error())
-					return
+			// the body of the frame is read by the frame deadline, it moves as the body arrives
+			body.start(lines.start)
+			msg, ok := s.command(cli, line, body)
+			if !ok {
+				if body.timedOut {
+					s.refuse(cli, errFrameTimeout)
 				}
+				return
+			}
+			if msg != "" {
+				_, err = cli.write([]byte(msg), s.writeTimeout)
+			}
+			if err != nil {
+				log.Printf("Error write message to %d", cli.id)
+				return
+			}
+			if !s.pause(cli) {
+				return
+			}
+		}
+	}
+}
 
-				receiverIDs, err := id.ConvertFromStringToArray(receivers)
-				if err != nil {
-					log.Printf("ReceiverIDs in wrong format: %s\n", err.Error())
-					return
-				}
+// bodyReader reads what follows a command line, the body of a relay
+type bodyReader interface {
+	io.Reader
+	Discard(n int) (int, error)
+}
+
+// command runs the command on line, reading its body from r.
+// It returns the reply to write back, ok is false when the client must be disconnected.
+func (s *Server) command(cli *client, line string, r bodyReader) (string, bool) {
+	var msg string
+	typ := line[:len(line)-1]
+	if i := strings.IndexByte(typ, ' '); i >= 0 {
+		typ = typ[:i]
+	}
+	switch typ {
+	case message.IdentityType:
+		msg = string(message.IdentityReply{ID: cli.id}.AppendTo(nil))
+	case message.ListType:
+		var list message.List
+		if err := list.DecodeLine(line); err != nil {
+			msg = errorReply(err)
+			break
+		}
+		msg = string(message.ListReply{Clients: s.listClients(cli.id, list.Names)}.AppendTo(nil))
+	case message.RelayType:
+		var relay message.Relay
+		size, err := relay.DecodeHeader(line, s.maxBodySize)
+		if err == message.ErrBodyTooLarge {
+			s.refuse(cli, err)
+			return "", false
+		}
+		if err != nil {
+			log.Printf("Message in wrong format: %q\n", line)
+			return "", false
+		}
+		receivers, fields := relay.Receivers, relay.Fields
+
+		if action, err := s.admit(cli, size); err != nil {
+			if action == LimitDisconnect {
+				s.refuse(cli, err)
+				return "", false
+			}
+			if _, err := r.Discard(size); err != nil {
+				log.Printf("Cannot read full data: %s\n", err.Error())
+				return "", false
+			}
+			msg = errorReply(err)
+			break
+		}
 
-				data := make([]byte, size)
-				if _, err = io.ReadFull(r, data); err != nil {
+		var receiverIDs []uint64
+		group := strings.TrimPrefix(receivers, message.QueuePrefix)
+		if group == receivers {
+			if receiverIDs, err = s.resolveReceivers(receivers); err != nil {
+				log.Printf("ReceiverIDs in wrong format: %s\n", err.Error())
+				return "", false
+			}
+		}
+
+		var due time.Time
+		var delayed bool
+		err = message.CheckHeaders(fields)
+		if err == nil {
+			_, err = laneOf(fields)
+		}
+		if err == nil {
+			due, delayed, err = dueAt(fields, s.clock.Now())
+		}
+		if err != nil {
+			if _, err := r.Discard(size); err != nil {
+				log.Printf("Cannot read full data: %s\n", err.Error())
+				return "", false
+			}
+			msg = errorReply(err)
+			break
+		}
+		msgID := s.msgSeq.Next()
+		if ref := fields[message.FieldRef]; ref != "" {
+			msg = string(message.Relayed{Ref: ref, MsgID: msgID}.AppendTo(nil))
+		}
+		// scheduled relays are decided when they are due
+		if !delayed && group != receivers {
+			if denied := s.authorizeGroup(cli.id, msgID, group); denied != "" {
+				if _, err := r.Discard(size); err != nil {
 					log.Printf("Cannot read full data: %s\n", err.Error())
-					return
+					return "", false
 				}
-				go s.relayMessage(cli.id, receiverIDs, data)
-			default:
-				msg = "Unknown message\n"
+				msg += denied
+				break
 			}
+		} else if !delayed {
+			var denied string
+			receiverIDs, denied = s.authorizeReceivers(cli.id, msgID, receiverIDs)
+			msg += denied
+		}
 
-			if msg != "" {
-				_, err = cli.conn.Write([]byte(msg))
+		if !delayed && group == receivers && s.streamable(fields, size) {
+			if streamed, ok := s.streamReceivers(cli.id, receiverIDs); ok {
+				if err := s.streamRelay(cli.id, msgID, streamed, fields, size, r); err != nil {
+					log.Printf("Cannot read full data: %s\n", err.Error())
+					return "", false
+				}
+				break
 			}
-			if err != nil {
-				log.Printf("Error write message to %d", cli.id)
-				return
+		}
+
+		data := make([]byte, size)
+		if _, err = io.ReadFull(r, data); err != nil {
+			log.Printf("Cannot read full data: %s\n", err.Error())
+			return "", false
+		}
+		if delayed {
+			s.schedule(&scheduled{
+				due:       due,
+				msgID:     msgID,
+				senderID:  cli.id,
+				receivers: receivers,
+				fields:    fields,
+				data:      data,
+			})
+			break
+		}
+		if group != receivers {
+			if err := s.relayToQueue(cli.id, msgID, group, fields, data); err != nil {
+				msg += errorReply(err)
 			}
+			break
+		}
+		s.relayMessage(cli.id, msgID, receiverIDs, fields, data)
+	case message.NickType:
+		var nick message.Nick
+		if err := nick.DecodeLine(line); err != nil {
+			msg = errorReply(errNickInvalid)
+			break
+		}
+		if !s.allowed(ActionNick, cli, nil, "") {
+			msg = errorReply(errNotAllowed)
+			break
+		}
+		if err := s.setNick(cli, nick.Name); err != nil {
+			msg = errorReply(err)
+			break
+		}
+		s.rekeyLimit(cli)
+		msg = string(nick.AppendTo(nil))
+	case message.WhoisType:
+		var whois message.Whois
+		if err := whois.DecodeLine(line); err != nil {
+			msg = errorReply(errNotFound)
+			break
+		}
+		target, err := s.lookup(whois.Target)
+		if err == nil && !s.allowed(ActionWhois, cli, target, "") {
+			err = errNotAllowed
+		}
+		if err != nil {
+			msg = errorReply(err)
+			break
+		}
+		msg = string(message.WhoisReply{ID: target.id, Name: s.nameOf(target)}.AppendTo(nil))
+	case message.LabelsType:
+		var labels message.Labels
+		if err := labels.DecodeLine(line); err != nil {
+			msg = errorReply(err)
+			break
+		}
+		if labels.Labels == nil {
+			msg = string(message.LabelsReply{Labels: s.labelsOf(cli)}.AppendTo(nil))
+			break
+		}
+		if !s.allowedLabels(cli, labels.Labels) {
+			msg = errorReply(errNotAllowed)
+			break
+		}
+		s.setLabels(cli, labels.Labels)
+		msg = string(message.LabelsReply{Labels: labels.Labels}.AppendTo(nil))
+	case message.QueueJoinType:
+		var join message.QueueJoin
+		if err := join.DecodeLine(line); err != nil {
+			msg = errorReply(errGroupInvalid)
+			break
+		}
+		if !s.allowed(ActionQueueJoin, cli, nil, join.Group) {
+			msg = errorReply(errNotAllowed)
+			break
+		}
+		if err := s.joinQueue(cli, join.Group); err != nil {
+			msg = errorReply(err)
+			break
+		}
+		msg = string(join.AppendTo(nil))
+	case message.QueueLeaveType:
+		var leave message.QueueLeave
+		if err := leave.DecodeLine(line); err != nil {
+			msg = errorReply(errNotMember)
+			break
+		}
+		if err := s.leaveQueue(cli, leave.Group); err != nil {
+			msg = errorReply(err)
+			break
+		}
+		msg = string(leave.AppendTo(nil))
+	case message.CancelType:
+		var cancel message.Cancel
+		if err := cancel.DecodeLine(line); err != nil {
+			msg = errorReply(errScheduleInvalid)
+			break
 		}
+		canceled := s.cancelScheduled(cli.id, cancel.MsgID)
+		msg = string(message.CancelReply{MsgID: cancel.MsgID, Canceled: canceled}.AppendTo(nil))
+	case message.ModeType:
+		var mode message.Mode
+		if err := mode.DecodeLine(line); err != nil {
+			msg = errorReply(errModeInvalid)
+			break
+		}
+		if err := s.setMode(cli, mode.Mode); err != nil {
+			msg = errorReply(err)
+			break
+		}
+		msg = string(mode.AppendTo(nil))
+	case message.FetchType:
+		var fetch message.Fetch
+		if err := fetch.DecodeLine(line); err != nil {
+			msg = errorReply(errFetchInvalid)
+			break
+		}
+		reply, err := s.fetch(cli, fetch.Max, fetch.Wait)
+		if err != nil {
+			msg = errorReply(err)
+			break
+		}
+		msg = string(reply)
+	case message.CreditType:
+		var credit message.Credit
+		if err := credit.DecodeLine(line); err != nil {
+			msg = errorReply(errCreditInvalid)
+			break
+		}
+		if err := s.grant(cli, credit.Msgs, credit.Bytes, credit.Policy); err != nil {
+			msg = errorReply(err)
+		}
+	case message.AckType:
+		var ack message.Ack
+		if err := ack.DecodeLine(line); err != nil {
+			log.Printf("Message in wrong format: %s\n", err.Error())
+			return "", false
+		}
+		s.ack(cli, ack.MsgID)
+	default:
+		msg = "Unknown message\n"
 	}
+	return msg, true
+}
+
+// errorReply returns the error reply telling a client about err
+func errorReply(err error) string {
+	return string(message.Error{Text: err.Error()}.AppendTo(nil))
 }
 
-func (s *Server) relayMessage(senderID uint64, clientIDs []uint64, data []byte) {
-	s.m.RLock()
-	defer s.m.RUnlock()
+func (s *Server) relayMessage(senderID, msgID uint64, clientIDs []uint64, fields map[string]string, data []byte) {
+	atLeastOnce := fields[message.FieldQoS] == "1"
+	forwarded := forwardedFields(senderID, fields)
+	expires := expiresAt(fields, s.clock.Now())
+	notifyExpired := fields[message.FieldNotify] == message.NotifyExpired
+	lane, _ := laneOf(fields)
 
-	msg := fmt.Sprintf("%s %d %d\n%s", message.RelayType, senderID, len(data), string(data))
+	receivers := make([]*client, 0, len(clientIDs))
+	missing := []uint64{}
 	for _, clientID := range clientIDs {
 		if clientID == senderID {
 			continue
 		}
-		if _, err := s.clients[clientID].conn.Write([]byte(msg)); err != nil {
-			log.Printf("Error send msg to %d: %s\n", clientID, err.Error())
+		receiver, ok := s.registry.get(clientID)
+		if !ok {
+			log.Printf("Unknown receiver %d\n", clientID)
+			missing = append(missing, clientID)
+			continue
+		}
+		receivers = append(receivers, receiver)
+	}
+	if !s.trackRequest(senderID, fields, receivers, missing) {
+		return
+	}
+	s.answerRequest(senderID, fields, receivers)
+
+	var f *frame
+	if !atLeastOnce && len(receivers) > 0 {
+		frameFields := map[string]string{message.FieldID: strconv.FormatUint(msgID, 10)}
+		for k, v := range forwarded {
+			frameFields[k] = v
+		}
+		f = newFrame(senderID, frameFields, data, len(receivers))
+	}
+	for _, receiver := range receivers {
+		if atLeastOnce {
+			s.deliver(receiver, &delivery{
+				id:          msgID,
+				senderID:    senderID,
+				atLeastOnce: true,
+				fields:      forwarded,
+				data:        data,
+
+				expires:       expires,
+				notifyExpired: notifyExpired,
+				lane:          lane,
+			})
+			continue
+		}
+		s.enqueue(receiver, &outbound{
+			frame:    f,
+			size:     len(data),
+			msgID:    msgID,
+			senderID: senderID,
+			expires:  expires,
+			notify:   notifyExpired,
+			lane:     lane,
+		})
+	}
+}
+
+// forwardedFields picks the relay fields passed on to receivers,
+// application headers are passed unchanged. The hub sets replyto of a request to its sender,
+// a client cannot have responses sent to another client
+func forwardedFields(senderID uint64, fields map[string]string) map[string]string {
+	forwarded := map[string]string{}
+	for k, v := range fields {
+		if message.IsHeader(k) {
+			forwarded[k] = v
+		}
+	}
+	for _, k := range []string{message.FieldCorr, message.FieldResp, message.FieldError} {
+		if v, ok := fields[k]; ok {
+			forwarded[k] = v
 		}
 	}
+	if isRequest(fields) {
+		forwarded[message.FieldReplyTo] = strconv.FormatUint(senderID, 10)
+	}
+	return forwarded
 }
 
 // ListClientIDs returns all the connecting clientIDs
 func (s *Server) ListClientIDs() []uint64 {
-	s.m.RLock()
-	defer s.m.RUnlock()
-
 	clientIDs := []uint64{}
-	for clientID := range s.clients {
-		clientIDs = append(clientIDs, clientID)
+	for _, cli := range s.registry.snapshot() {
+		clientIDs = append(clientIDs, cli.id)
 	}
-	sort.Slice(clientIDs, func(i, j int) bool {
-		return clientIDs[i] < clientIDs[j]
-	})
 	return clientIDs
 }
 
+func (s *Server) nameOf(cli *client) string {
+	cli.am.Lock()
+	defer cli.am.Unlock()
+
+	return cli.name
+}
+
+func (s *Server) labelsOf(cli *client) map[string]string {
+	cli.am.Lock()
+	defer cli.am.Unlock()
+
+	return cli.labels
+}
+
 // Stop server
 func (s *Server) Stop() error {
 	log.Println("Stop the server")
@@ -2,10 +2,14 @@ package server
 
 import (
 	"bufio"
+	"fmt"
 	"io"
 	"net"
 	"testing"
+	"time"
 
+	"github.com/badboyd/tcp-hub/pkg/id"
+	"github.com/badboyd/tcp-hub/pkg/message"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -27,6 +31,28 @@ func TestStart(t *testing.T) {
 	require.NoError(t, srv.Start(&serverAddr))
 }
 
+func TestIDAllocator(t *testing.T) {
+	srv := New(WithIDAllocator(id.NewRecycler(0)))
+	defer srv.Stop()
+
+	serverAddr := net.TCPAddr{Port: serverPort}
+	require.NoError(t, srv.Start(&serverAddr))
+
+	conn1, err := net.Dial(serverAddr.Network(), serverAddr.String())
+	require.NoError(t, err)
+	waitForClients(t, srv, 1)
+	assert.Equal(t, []uint64{1}, srv.ListClientIDs())
+
+	// the ID of a gone client is handed out again
+	require.NoError(t, conn1.Close())
+	waitForClients(t, srv, 0)
+	conn2, err := net.Dial(serverAddr.Network(), serverAddr.String())
+	require.NoError(t, err)
+	defer conn2.Close()
+	waitForClients(t, srv, 1)
+	assert.Equal(t, []uint64{1}, srv.ListClientIDs())
+}
+
 func TestListClients(t *testing.T) {
 	srv := New()
 	defer srv.Stop()
@@ -42,6 +68,7 @@ func TestListClients(t *testing.T) {
 	require.NoError(t, err)
 	defer conn2.Close()
 
+	waitForClients(t, srv, 2)
 	clientIDs := srv.ListClientIDs()
 	assert.Equal(t, []uint64{1, 2}, clientIDs)
 }
@@ -66,10 +93,16 @@ func TestHandle(t *testing.T) {
 			expectedReply: "list 2\n",
 			hasReply:      true,
 		},
+		{
+			name:          "list with unknown argument",
+			msg:           "list all\n",
+			expectedReply: "list 2\n",
+			hasReply:      true,
+		},
 		{
 			name:             "relay",
 			msg:              "relay 2 5\nhello",
-			expectedRelayMsg: "relay 1 5\nhello",
+			expectedRelayMsg: "relay 1 5 id=1\nhello",
 		},
 		{
 			name:          "unknown cmd",
@@ -124,3 +157,49 @@ func TestHandle(t *testing.T) {
 	}
 
 }
+
+func TestHandleHeaders(t *testing.T) {
+	srv := New()
+	defer srv.Stop()
+
+	serverAddr := net.TCPAddr{Port: serverPort}
+	require.NoError(t, srv.Start(&serverAddr))
+
+	conn1, err := net.Dial(serverAddr.Network(), serverAddr.String())
+	require.NoError(t, err)
+	defer conn1.Close()
+	waitForClients(t, srv, 1)
+
+	conn2, err := net.Dial(serverAddr.Network(), serverAddr.String())
+	require.NoError(t, err)
+	defer conn2.Close()
+	waitForClients(t, srv, 2)
+
+	_, err = conn1.Write([]byte("relay 2 5 qos=0 h.trace=a%20b h.type=text\nhello"))
+	require.NoError(t, err)
+
+	expectedRelayMsg := "relay 1 5 h.trace=a%20b h.type=text id=1\nhello"
+	relayMsg := make([]byte, len(expectedRelayMsg))
+	_, err = io.ReadFull(conn2, relayMsg)
+	require.NoError(t, err)
+	assert.Equal(t, expectedRelayMsg, string(relayMsg))
+
+	headers := ""
+	for i := 0; i <= message.MaxHeaders; i++ {
+		headers += fmt.Sprintf(" h.%d=v", i)
+	}
+	_, err = conn1.Write([]byte("relay 2 5" + headers + "\nhello"))
+	require.NoError(t, err)
+
+	reply, err := bufio.NewReader(conn1).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "error too many headers\n", reply)
+}
+
+// waitForClients waits until the accept loop has registered n clients
+func waitForClients(t *testing.T, srv *Server, n int) {
+	for i := 0; i < 50 && len(srv.ListClientIDs()) != n; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.Equal(t, n, len(srv.ListClientIDs()))
+}
@@ -0,0 +1,365 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/badboyd/tcp-hub/pkg/message"
+)
+
+const (
+	defaultStreamThreshold = 64 << 10
+	streamChunkSize        = 32 << 10
+	// streamBacklog is how many chunks a stream reads ahead of its slowest receiver
+	streamBacklog = 4
+)
+
+var errStreamDropped = errors.New("stream dropped")
+
+// chunks keeps the ring chunks of finished streams, up to 2MB
+var chunks = make(chan *[]byte, 64)
+
+func getChunk() *[]byte {
+	select {
+	case chunk := <-chunks:
+		return chunk
+	default:
+		b := make([]byte, streamChunkSize)
+		return &b
+	}
+}
+
+func putChunk(chunk *[]byte) {
+	select {
+	case chunks <- chunk:
+	default:
+	}
+}
+
+// write writes a reply or notice p to cli, frames written by several goroutines do not interleave.
+// Writes to a receiver in the middle of a streamed frame are held until the frame is written.
+// A client not taking p within timeout is disconnected.
+func (cli *client) write(p []byte, timeout time.Duration) (int, error) {
+	cli.wm.Lock()
+	defer cli.wm.Unlock()
+	if cli.streaming {
+		cli.held = append(cli.held, p...)
+		return len(p), nil
+	}
+	cli.conn.SetWriteDeadline(time.Now().Add(timeout))
+	n, err := cli.conn.Write(p)
+	cli.conn.SetWriteDeadline(time.Time{})
+	if isTimeout(err) {
+		disconnect(cli.conn)
+	}
+	return n, err
+}
+
+// disconnect makes the core serving conn read its end, so the client is removed the usual way
+func disconnect(conn net.Conn) {
+	if c, ok := conn.(interface{ CloseRead() error }); ok && c.CloseRead() == nil {
+		return
+	}
+	conn.Close()
+}
+
+// streamable tells whether a relay of size bytes with fields can be forwarded while it is read.
+// Messages which may wait in the hub, for redelivery, TTL or a queue group, are read in full.
+func (s *Server) streamable(fields map[string]string, size int) bool {
+	// the event loop has the whole body in memory before the relay runs
+	if s.streamThreshold <= 0 || size < s.streamThreshold || s.eventLoopWorkers > 0 {
+		return false
+	}
+	if fields[message.FieldQoS] == "1" || fields[message.FieldTTL] != "" || isRequest(fields) || isResponse(fields) {
+		return false
+	}
+	return true
+}
+
+// streamReceivers returns the receivers of a streamed relay sorted by ID,
+// ok is false when one of them does not take pushed messages right away
+func (s *Server) streamReceivers(senderID uint64, clientIDs []uint64) (receivers []*client, ok bool) {
+	receivers = make([]*client, 0, len(clientIDs))
+	for _, clientID := range clientIDs {
+		if clientID == senderID {
+			continue
+		}
+		receiver, found := s.registry.get(clientID)
+		if !found {
+			log.Printf("Unknown receiver %d\n", clientID)
+			continue
+		}
+		receiver.out.m.Lock()
+		waiting := receiver.out.pull || receiver.out.credit.enabled
+		receiver.out.m.Unlock()
+		if waiting {
+			return nil, false
+		}
+		receivers = append(receivers, receiver)
+	}
+	sort.Slice(receivers, func(i, j int) bool {
+		return receivers[i].id < receivers[j].id
+	})
+	return receivers, true
+}
+
+// stream is a relay forwarded while it is read. Its sender reads the body into a ring of chunks
+// which the outbox writers of its receivers, its taps, write from.
+type stream struct {
+	header []byte
+
+	m sync.Mutex
+	// readable wakes the taps when a chunk was read, writable the sender when a chunk was written by every tap
+	readable sync.Cond
+	writable sync.Cond
+	ring     [streamBacklog]*[]byte
+	lens     [streamBacklog]int
+	// pending counts the taps still writing the chunk of each ring slot
+	pending [streamBacklog]int
+	// read counts the chunks read, written the chunks each tap wrote, -1 once it is dropped
+	read    int
+	written []int
+	live    int
+	done    bool
+	err     error
+	// timedOut is set when the sender waited a whole timeout in wait number gen
+	gen      int
+	timedOut bool
+}
+
+func newStream(header []byte, taps int) *stream {
+	st := &stream{header: header, written: make([]int, taps), live: taps}
+	st.readable.L = &st.m
+	st.writable.L = &st.m
+	return st
+}
+
+// next returns chunk i for tap, nil once the body is written in full or with the error ending it
+func (st *stream) next(tap, i int) ([]byte, error) {
+	st.m.Lock()
+	defer st.m.Unlock()
+	for {
+		if st.written[tap] < 0 {
+			return nil, errStreamDropped
+		}
+		if i < st.read {
+			slot := i % streamBacklog
+			return (*st.ring[slot])[:st.lens[slot]], nil
+		}
+		if st.done {
+			return nil, st.err
+		}
+		st.readable.Wait()
+	}
+}
+
+// advance records that tap wrote its next chunk
+func (st *stream) advance(tap int) {
+	st.m.Lock()
+	defer st.m.Unlock()
+	if st.written[tap] < 0 {
+		return
+	}
+	slot := st.written[tap] % streamBacklog
+	st.written[tap]++
+	if st.pending[slot]--; st.pending[slot] == 0 {
+		st.writable.Signal()
+	}
+}
+
+// drop stops writing to tap, must hold st.m
+func (st *stream) drop(tap int) {
+	w := st.written[tap]
+	if w < 0 {
+		return
+	}
+	st.written[tap] = -1
+	st.live--
+	for i := w; i < st.read; i++ {
+		st.pending[i%streamBacklog]--
+	}
+	st.readable.Broadcast()
+	st.writable.Signal()
+}
+
+// release drops tap once its outbound is dropped unwritten
+func (st *stream) release(tap int) {
+	st.m.Lock()
+	defer st.m.Unlock()
+	st.drop(tap)
+}
+
+// wait waits until ready holds or timeout passed, it returns false on timeout. Must hold st.m.
+func (st *stream) wait(ready func() bool, timeout time.Duration) bool {
+	if ready() {
+		return true
+	}
+	st.gen++
+	gen := st.gen
+	timer := time.AfterFunc(timeout, func() {
+		st.m.Lock()
+		defer st.m.Unlock()
+		if st.gen == gen {
+			st.timedOut = true
+			st.writable.Signal()
+		}
+	})
+	defer timer.Stop()
+	for !ready() {
+		if st.timedOut {
+			st.timedOut = false
+			st.gen++
+			return false
+		}
+		st.writable.Wait()
+	}
+	st.gen++
+	st.timedOut = false
+	return true
+}
+
+// dropBehind drops the taps which did not write chunk i yet, it returns them
+func (st *stream) dropBehind(i int) []int {
+	behind := []int{}
+	for tap, w := range st.written {
+		if w >= 0 && w <= i {
+			st.drop(tap)
+			behind = append(behind, tap)
+		}
+	}
+	return behind
+}
+
+// streamRelay forwards a body of size bytes from r to receivers chunk by chunk through their outboxes.
+// Receivers are only written between the reads of the sender, a receiver falling a frame timeout behind
+// is disconnected. When the body cannot be read the receivers got a partial frame and are disconnected.
+func (s *Server) streamRelay(senderID, msgID uint64, receivers []*client, fields map[string]string, size int, r io.Reader) error {
+	frameFields := forwardedFields(senderID, fields)
+	frameFields[message.FieldID] = strconv.FormatUint(msgID, 10)
+	header := headerPool.Get().(*[]byte)
+	*header = message.AppendDeliveryHeader((*header)[:0], senderID, size, frameFields)
+
+	lane, _ := laneOf(fields)
+	st := newStream(*header, len(receivers))
+	for i, receiver := range receivers {
+		s.enqueue(receiver, &outbound{stream: st, tap: i, msgID: msgID, senderID: senderID, lane: lane})
+	}
+
+	disconnect := func(taps []int) {
+		for _, tap := range taps {
+			log.Printf("Error send msg to %d: %s\n", receivers[tap].id, errFrameTimeout.Error())
+			receivers[tap].conn.Close()
+		}
+	}
+
+	var err error
+	st.m.Lock()
+	for remaining := size; remaining > 0; {
+		slot := st.read % streamBacklog
+		if !st.wait(func() bool { return st.pending[slot] == 0 }, s.frameTimeout) {
+			disconnect(st.dropBehind(st.read - streamBacklog))
+			// they may still be writing from the slot, it gets another buffer
+			st.ring[slot] = nil
+		}
+		if st.ring[slot] == nil {
+			st.ring[slot] = getChunk()
+		}
+		n := streamChunkSize
+		if remaining < n {
+			n = remaining
+		}
+		chunk := (*st.ring[slot])[:n]
+		st.m.Unlock()
+
+		// receivers are not waited for while the sender is read
+		_, err = io.ReadFull(r, chunk)
+
+		st.m.Lock()
+		if err != nil {
+			break
+		}
+		st.lens[slot] = n
+		st.pending[slot] = st.live
+		st.read++
+		st.readable.Broadcast()
+		remaining -= n
+	}
+	st.done = true
+	st.err = err
+	st.readable.Broadcast()
+
+	// the chunks read are written before the ring is reused
+	finished := func() bool {
+		for _, n := range st.pending {
+			if n > 0 {
+				return false
+			}
+		}
+		return true
+	}
+	if !st.wait(finished, s.frameTimeout) {
+		disconnect(st.dropBehind(st.read - 1))
+	}
+	if st.live == len(receivers) {
+		for _, chunk := range st.ring {
+			if chunk != nil {
+				putChunk(chunk)
+			}
+		}
+		if cap(*header) <= maxPooledHeader {
+			headerPool.Put(header)
+		}
+	}
+	st.m.Unlock()
+	return err
+}
+
+// writeStream writes the streamed frame of ob to receiver as its sender reads it,
+// the writes of other goroutines to receiver are held until the frame is written
+func (s *Server) writeStream(receiver *client, ob *outbound) error {
+	st, tap := ob.stream, ob.tap
+	receiver.wm.Lock()
+	receiver.streaming = true
+	receiver.wm.Unlock()
+
+	err := receiver.writeChunk(st.header, s.frameTimeout)
+	for i := 0; err == nil; i++ {
+		var chunk []byte
+		if chunk, err = st.next(tap, i); chunk == nil {
+			break
+		}
+		if err = receiver.writeChunk(chunk, s.frameTimeout); err == nil {
+			st.advance(tap)
+		}
+	}
+
+	receiver.wm.Lock()
+	defer receiver.wm.Unlock()
+	receiver.streaming = false
+	receiver.conn.SetWriteDeadline(time.Time{})
+	if err == nil && len(receiver.held) > 0 {
+		_, err = receiver.conn.Write(receiver.held)
+	}
+	receiver.held = nil
+	if err != nil {
+		// the receiver got a partial frame
+		st.release(tap)
+		receiver.conn.Close()
+	}
+	return err
+}
+
+// writeChunk writes a chunk of a streamed frame to cli within timeout
+func (cli *client) writeChunk(p []byte, timeout time.Duration) error {
+	cli.wm.Lock()
+	defer cli.wm.Unlock()
+	cli.conn.SetWriteDeadline(time.Now().Add(timeout))
+	_, err := cli.conn.Write(p)
+	return err
+}
@@ -0,0 +1,289 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// discardConn is a receiver connection dropping what is written to it
+type discardConn struct {
+	net.Conn
+}
+
+func (discardConn) Write(p []byte) (int, error) { return len(p), nil }
+
+func (discardConn) Close() error { return nil }
+
+func (discardConn) SetWriteDeadline(time.Time) error { return nil }
+
+func (discardConn) RemoteAddr() net.Addr { return nil }
+
+func TestStreamable(t *testing.T) {
+	srv := New(WithStreamThreshold(100))
+	assert.False(t, srv.streamable(map[string]string{}, 99))
+	assert.True(t, srv.streamable(map[string]string{"h.type": "a"}, 100))
+	assert.False(t, srv.streamable(map[string]string{"qos": "1"}, 100))
+	assert.False(t, srv.streamable(map[string]string{"ttl": "10"}, 100))
+	assert.False(t, srv.streamable(map[string]string{"corr": "1", "timeout": "10"}, 100))
+
+	srv = New(WithStreamThreshold(0))
+	assert.False(t, srv.streamable(map[string]string{}, 1<<20))
+}
+
+func TestStreamReceivers(t *testing.T) {
+	srv := New()
+	for _, id := range []uint64{3, 1, 2} {
+		srv.registry.add(&client{id: id, conn: discardConn{}})
+	}
+
+	receivers, ok := srv.streamReceivers(1, []uint64{3, 2, 1, 9})
+	require.True(t, ok)
+	require.Len(t, receivers, 2)
+	assert.Equal(t, uint64(2), receivers[0].id)
+	assert.Equal(t, uint64(3), receivers[1].id)
+
+	// pull mode receivers keep messages in the hub
+	receiver, ok := srv.registry.get(3)
+	require.True(t, ok)
+	require.NoError(t, srv.setMode(receiver, "pull"))
+	_, ok = srv.streamReceivers(1, []uint64{2, 3})
+	assert.False(t, ok)
+}
+
+func TestStreamRelay(t *testing.T) {
+	srv := New()
+
+	body := bytes.Repeat([]byte("0123456789"), 10000)
+	conns := []net.Conn{}
+	receivers := []*client{}
+	for id := uint64(2); id <= 3; id++ {
+		receiverSrv, receiverConn := net.Pipe()
+		defer receiverConn.Close()
+		conns = append(conns, receiverConn)
+		receivers = append(receivers, &client{id: id, conn: receiverSrv})
+	}
+
+	results := make(chan []byte, len(conns))
+	for _, conn := range conns {
+		go func(conn net.Conn) {
+			frame, _ := ioutil.ReadAll(conn)
+			results <- frame
+		}(conn)
+	}
+
+	require.NoError(t, srv.streamRelay(1, 10, receivers, map[string]string{"h.type": "text"}, len(body), bytes.NewReader(body)))
+	for _, receiver := range receivers {
+		receiver.conn.Close()
+	}
+
+	expected := append([]byte(fmt.Sprintf("relay 1 %d h.type=text id=10\n", len(body))), body...)
+	for range conns {
+		assert.Equal(t, expected, <-results)
+	}
+}
+
+func TestStreamRelayBrokenSender(t *testing.T) {
+	srv := New()
+
+	receiverSrv, receiverConn := net.Pipe()
+	defer receiverConn.Close()
+	receiver := &client{id: 2, conn: receiverSrv}
+
+	result := make(chan []byte)
+	go func() {
+		frame, _ := ioutil.ReadAll(receiverConn)
+		result <- frame
+	}()
+
+	// the sender goes away after half of its body
+	r := io.MultiReader(bytes.NewReader(make([]byte, 50000)), iotest{errors.New("broken")})
+	assert.Error(t, srv.streamRelay(1, 10, []*client{receiver}, map[string]string{}, 100000, r))
+
+	// the receiver got the chunks read before and is disconnected
+	assert.Equal(t, len("relay 1 100000 id=10\n")+streamChunkSize, len(<-result))
+}
+
+func TestStreamRelayStalledSender(t *testing.T) {
+	srv := New()
+
+	receiverSrv, receiverConn := net.Pipe()
+	defer receiverConn.Close()
+	receiver := &client{id: 2, conn: receiverSrv}
+	result := make(chan []byte)
+	go func() {
+		frame, _ := ioutil.ReadAll(receiverConn)
+		result <- frame
+	}()
+
+	body := bytes.Repeat([]byte("x"), 2*streamChunkSize)
+	sender, senderConn := net.Pipe()
+	defer senderConn.Close()
+	relayed := make(chan error)
+	go func() {
+		relayed <- srv.streamRelay(1, 10, []*client{receiver}, map[string]string{}, len(body), sender)
+	}()
+	_, err := senderConn.Write(body[:streamChunkSize])
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		receiver.wm.Lock()
+		defer receiver.wm.Unlock()
+		return receiver.streaming
+	}, time.Second, time.Millisecond)
+
+	// the receiver is written to while the sender stalls, after the frame
+	written := make(chan error)
+	go func() {
+		_, err := receiver.write([]byte("identity 2\n"), time.Second)
+		written <- err
+	}()
+	select {
+	case err := <-written:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("write blocked by a stalled sender")
+	}
+
+	_, err = senderConn.Write(body[streamChunkSize:])
+	require.NoError(t, err)
+	require.NoError(t, <-relayed)
+	require.Eventually(t, func() bool {
+		receiver.out.m.Lock()
+		defer receiver.out.m.Unlock()
+		return !receiver.out.running
+	}, time.Second, time.Millisecond)
+	receiver.conn.Close()
+
+	expected := append([]byte(fmt.Sprintf("relay 1 %d id=10\n", len(body))), body...)
+	assert.Equal(t, append(expected, "identity 2\n"...), <-result)
+}
+
+func TestStreamRelaySlowReceiver(t *testing.T) {
+	srv := New(WithFrameTimeouts(time.Second, 100*time.Millisecond))
+
+	body := bytes.Repeat([]byte("0123456789"), 10000)
+	readerSrv, readerConn := net.Pipe()
+	defer readerConn.Close()
+	slowSrv, slowConn := net.Pipe()
+	defer slowConn.Close()
+	reader := &client{id: 2, conn: readerSrv}
+	slow := &client{id: 3, conn: slowSrv}
+
+	result := make(chan []byte)
+	go func() {
+		frame, _ := ioutil.ReadAll(readerConn)
+		result <- frame
+	}()
+
+	// the receiver not reading is disconnected, the other one gets the whole body
+	require.NoError(t, srv.streamRelay(1, 10, []*client{reader, slow}, map[string]string{}, len(body), bytes.NewReader(body)))
+	_, err := ioutil.ReadAll(slowConn)
+	assert.NoError(t, err)
+	reader.conn.Close()
+
+	expected := append([]byte(fmt.Sprintf("relay 1 %d id=10\n", len(body))), body...)
+	assert.Equal(t, expected, <-result)
+}
+
+type iotest struct {
+	err error
+}
+
+func (r iotest) Read(p []byte) (int, error) { return 0, r.err }
+
+// TestStreamMemory checks that streaming a body takes the same memory whatever its size and receivers
+func TestStreamMemory(t *testing.T) {
+	srv := New()
+	receivers := make([]*client, 255)
+	for i := range receivers {
+		receivers[i] = &client{id: uint64(i + 2), conn: discardConn{}}
+	}
+
+	for _, size := range []int{1 << 20, 4 << 20} {
+		body := make([]byte, size)
+		result := testing.Benchmark(func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				require.NoError(b, srv.streamRelay(1, 10, receivers, map[string]string{}, size, bytes.NewReader(body)))
+			}
+		})
+		assert.Less(t, result.AllocedBytesPerOp(), int64(2*streamChunkSize), "body size %d", size)
+	}
+}
+
+func BenchmarkRelayLargeBody(b *testing.B) {
+	const size = 1 << 20
+	body := make([]byte, size)
+
+	for _, count := range []int{1, 16, 255} {
+		srv := New()
+		ids := make([]uint64, count)
+		for i := range ids {
+			ids[i] = uint64(i + 2)
+			srv.registry.add(&client{id: ids[i], conn: discardConn{}})
+		}
+
+		b.Run(fmt.Sprintf("buffered/%d receivers", count), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				data := make([]byte, size)
+				if _, err := io.ReadFull(bytes.NewReader(body), data); err != nil {
+					b.Fatal(err)
+				}
+				srv.relayMessage(1, uint64(i), ids, map[string]string{}, data)
+			}
+		})
+
+		b.Run(fmt.Sprintf("streamed/%d receivers", count), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				receivers, _ := srv.streamReceivers(1, ids)
+				if err := srv.streamRelay(1, uint64(i), receivers, map[string]string{}, size, bytes.NewReader(body)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestHandleStreamedRelay(t *testing.T) {
+	srv := New()
+	defer srv.Stop()
+
+	serverAddr := net.TCPAddr{Port: serverPort}
+	require.NoError(t, srv.Start(&serverAddr))
+
+	receiver, err := net.Dial(serverAddr.Network(), serverAddr.String())
+	require.NoError(t, err)
+	defer receiver.Close()
+	sender, err := net.Dial(serverAddr.Network(), serverAddr.String())
+	require.NoError(t, err)
+	defer sender.Close()
+	waitForClients(t, srv, 2)
+
+	body := bytes.Repeat([]byte("x"), 3*defaultStreamThreshold)
+	go func() {
+		_, err := sender.Write(append([]byte(fmt.Sprintf("relay 1 %d ref=a\n", len(body))), body...))
+		assert.NoError(t, err)
+	}()
+
+	expected := append([]byte(fmt.Sprintf("relay 2 %d id=1\n", len(body))), body...)
+	frame := make([]byte, len(expected))
+	_, err = io.ReadFull(receiver, frame)
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(expected, frame))
+
+	reply := make([]byte, len("relayed a 1\n"))
+	_, err = io.ReadFull(sender, reply)
+	require.NoError(t, err)
+	assert.Equal(t, "relayed a 1\n", string(reply))
+}
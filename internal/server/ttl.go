@@ -0,0 +1,80 @@
+package server
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/badboyd/tcp-hub/pkg/message"
+)
+
+const defaultSweepInterval = time.Second
+
+// expiresAt returns when a relay with fields expires, zero when it has no TTL
+func expiresAt(fields map[string]string, now time.Time) time.Time {
+	ttl, err := strconv.ParseUint(fields[message.FieldTTL], 10, 32)
+	if err != nil || ttl == 0 {
+		return time.Time{}
+	}
+	return now.Add(time.Duration(ttl) * time.Millisecond)
+}
+
+// expire drops an expired frame queued for receiver and tells its sender when asked to
+func (s *Server) expire(receiver *client, ob *outbound) {
+	ob.release()
+	if ob.d != nil {
+		s.qm.Lock()
+		if receiver.inflight[ob.msgID] == ob.d {
+			delete(receiver.inflight, ob.msgID)
+		}
+		s.qm.Unlock()
+	}
+	if ob.notify {
+		s.notify(ob.senderID, string(message.Expired{MsgID: ob.msgID, ReceiverID: receiver.id}.AppendTo(nil)))
+	}
+}
+
+// expireDelivery drops a delivery which expired while waiting to be redelivered
+func (s *Server) expireDelivery(d *delivery) {
+	if d.notifyExpired {
+		s.notify(d.senderID, string(message.Expired{MsgID: d.id, ReceiverID: d.receiverID}.AppendTo(nil)))
+	}
+}
+
+// sweepLoop periodically drops expired messages from outboxes and queue group backlogs
+func (s *Server) sweepLoop() {
+	tick := s.clock.After(s.sweepInterval)
+	for {
+		select {
+		case <-s.close:
+			return
+		case <-tick:
+			s.sweepExpired(s.clock.Now())
+			tick = s.clock.After(s.sweepInterval)
+		}
+	}
+}
+
+func (s *Server) sweepExpired(now time.Time) {
+	for _, receiver := range s.registry.snapshot() {
+		s.sweep(receiver, now)
+	}
+
+	expired := []*delivery{}
+	s.qm.Lock()
+	for _, g := range s.groups {
+		kept := g.backlog[:0]
+		for _, d := range g.backlog {
+			if d.expired(now) {
+				expired = append(expired, d)
+				continue
+			}
+			kept = append(kept, d)
+		}
+		g.backlog = kept
+	}
+	s.qm.Unlock()
+
+	for _, d := range expired {
+		s.expireDelivery(d)
+	}
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpiresAt(t *testing.T) {
+	now := time.Now()
+	assert.True(t, expiresAt(map[string]string{}, now).IsZero())
+	assert.True(t, expiresAt(map[string]string{"ttl": "x"}, now).IsZero())
+	assert.Equal(t, now.Add(time.Second), expiresAt(map[string]string{"ttl": "1000"}, now))
+}
+
+func TestSweepExpired(t *testing.T) {
+	clock := newFakeClock()
+	srv := New(WithClock(clock))
+
+	senderSrv, senderConn := net.Pipe()
+	defer senderConn.Close()
+	receiverSrv, receiverConn := net.Pipe()
+	defer receiverConn.Close()
+
+	sender := &client{id: 1, conn: senderSrv}
+	receiver := &client{id: 2, conn: receiverSrv}
+	srv.registry.add(sender)
+	srv.registry.add(receiver)
+
+	fields := map[string]string{"ttl": "50", "notify": "expired"}
+	srv.relayMessage(sender.id, 10, []uint64{receiver.id}, fields, []byte("one"))
+	srv.relayMessage(sender.id, 11, []uint64{receiver.id}, fields, []byte("two"))
+	srv.relayMessage(sender.id, 12, []uint64{receiver.id}, map[string]string{}, []byte("three"))
+
+	// messages waiting in a queue group backlog expire too
+	srv.groups["jobs"] = &queueGroup{name: "jobs", backlog: []*delivery{
+		{id: 13, senderID: sender.id, expires: clock.Now().Add(time.Second), notifyExpired: true},
+	}}
+
+	// the writer is stuck on the first frame as nobody reads the receiver
+	require.Eventually(t, func() bool {
+		receiver.out.m.Lock()
+		defer receiver.out.m.Unlock()
+		return receiver.out.queued == 2
+	}, time.Second, time.Millisecond)
+
+	// the sweep runs and expires messages by the clock of the server
+	srv.wg.Add(1)
+	go func() {
+		defer srv.wg.Done()
+		srv.sweepLoop()
+	}()
+	defer srv.Stop()
+	require.Eventually(t, func() bool {
+		clock.m.Lock()
+		defer clock.m.Unlock()
+		return len(clock.waiters) > 0
+	}, time.Second, time.Millisecond)
+	clock.Advance(defaultSweepInterval + time.Second)
+
+	r := bufio.NewReader(senderConn)
+	notices := []string{}
+	for i := 0; i < 2; i++ {
+		notice, err := r.ReadString('\n')
+		require.NoError(t, err)
+		notices = append(notices, notice)
+	}
+	assert.ElementsMatch(t, []string{"expired 11 2\n", "expired 13 0\n"}, notices)
+	assert.Empty(t, srv.groups["jobs"].backlog)
+
+	expected := "relay 1 3 id=10\none" + "relay 1 5 id=12\nthree"
+	msg := make([]byte, len(expected))
+	_, err := io.ReadFull(receiverConn, msg)
+	require.NoError(t, err)
+	assert.Equal(t, expected, string(msg))
+}
+
+func TestHandleRelayRef(t *testing.T) {
+	srv := New()
+	defer srv.Stop()
+
+	serverAddr := net.TCPAddr{Port: serverPort}
+	require.NoError(t, srv.Start(&serverAddr))
+
+	conn, err := net.Dial(serverAddr.Network(), serverAddr.String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("relay 7 5 ref=a ttl=100\nhello"))
+	require.NoError(t, err)
+
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "relayed a 1\n", reply)
+}
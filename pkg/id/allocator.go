@@ -0,0 +1,29 @@
+package id
+
+import "sync/atomic"
+
+// Allocator hands out client IDs
+type Allocator interface {
+	// Next returns an ID which is not in use
+	Next() (uint64, error)
+	// Release tells the allocator id is not in use anymore
+	Release(id uint64)
+}
+
+// Counter allocates increasing IDs without locking, it restarts from its start on every boot
+type Counter struct {
+	seq uint64
+}
+
+// NewCounter returns a Counter whose first ID is start+1
+func NewCounter(start uint64) *Counter {
+	return &Counter{seq: start}
+}
+
+// Next returns the next ID
+func (c *Counter) Next() (uint64, error) {
+	return atomic.AddUint64(&c.seq, 1), nil
+}
+
+// Release does nothing, IDs are never reused
+func (c *Counter) Release(id uint64) {}
@@ -0,0 +1,35 @@
+package id
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCounter(t *testing.T) {
+	c := NewCounter(100)
+	next, err := c.Next()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(101), next)
+
+	// concurrent callers never get the same ID
+	var wg sync.WaitGroup
+	ids := make([]uint64, 1000)
+	for i := range ids {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ids[i], _ = c.Next()
+		}(i)
+	}
+	wg.Wait()
+	seen := map[uint64]bool{}
+	for _, id := range ids {
+		assert.False(t, seen[id])
+		seen[id] = true
+	}
+	next, _ = c.Next()
+	assert.Equal(t, uint64(1102), next)
+}
@@ -0,0 +1,107 @@
+package id
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBlock is how many IDs Persistent reserves with one write
+const DefaultBlock = 1000
+
+// Persistent allocates increasing IDs which survive restarts.
+// It keeps the high-water mark of reserved IDs in a file and reserves them by blocks,
+// after a restart it continues past the last reserved block, skipping its unused IDs.
+type Persistent struct {
+	m        sync.Mutex
+	path     string
+	block    uint64
+	seq      uint64
+	reserved uint64
+}
+
+// NewPersistent opens the high-water mark kept at path, creating it when missing,
+// and reserves the first block of IDs
+func NewPersistent(path string, block uint64) (*Persistent, error) {
+	if block == 0 {
+		block = DefaultBlock
+	}
+	mark, err := readMark(path)
+	if err != nil {
+		return nil, err
+	}
+	p := &Persistent{path: path, block: block, seq: mark, reserved: mark}
+	if err := p.reserve(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Next returns the next ID, it fails when a new block cannot be reserved
+func (p *Persistent) Next() (uint64, error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	if p.seq == p.reserved {
+		if err := p.reserve(); err != nil {
+			return 0, err
+		}
+	}
+	p.seq++
+	return p.seq, nil
+}
+
+// Release does nothing, IDs are never reused
+func (p *Persistent) Release(id uint64) {}
+
+// reserve writes the next high-water mark, it must be called with p.m held
+func (p *Persistent) reserve() error {
+	mark := p.reserved + p.block
+	if err := writeMark(p.path, mark); err != nil {
+		return fmt.Errorf("cannot reserve IDs: %s", err.Error())
+	}
+	p.reserved = mark
+	return nil
+}
+
+func readMark(path string) (uint64, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	mark, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid high-water mark in %s", path)
+	}
+	return mark, nil
+}
+
+// writeMark replaces the mark at path through a synced temporary file,
+// so a crash leaves either the old or the new mark
+func writeMark(path string, mark uint64) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.WriteString(strconv.FormatUint(mark, 10) + "\n"); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
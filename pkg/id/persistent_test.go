@@ -0,0 +1,43 @@
+package id
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPersistent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "id")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ids")
+
+	p, err := NewPersistent(path, 3)
+	require.NoError(t, err)
+	for want := uint64(1); want <= 4; want++ {
+		next, err := p.Next()
+		require.NoError(t, err)
+		assert.Equal(t, want, next)
+	}
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "6\n", string(data))
+
+	// a restart continues past the reserved block
+	p, err = NewPersistent(path, 3)
+	require.NoError(t, err)
+	next, err := p.Next()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(7), next)
+
+	require.NoError(t, ioutil.WriteFile(path, []byte("seven"), 0644))
+	_, err = NewPersistent(path, 3)
+	assert.Error(t, err)
+
+	_, err = NewPersistent(filepath.Join(dir, "missing", "ids"), 3)
+	assert.Error(t, err)
+}
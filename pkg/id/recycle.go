@@ -0,0 +1,49 @@
+package id
+
+import (
+	"sync"
+	"time"
+)
+
+// Recycler allocates small IDs by reusing released ones once they spent a quarantine,
+// so an ID is not handed out again while others may still refer to its previous owner
+type Recycler struct {
+	m          sync.Mutex
+	quarantine time.Duration
+	seq        uint64
+	released   []releasedID
+	now        func() time.Time
+}
+
+type releasedID struct {
+	id uint64
+	at time.Time
+}
+
+// NewRecycler returns a Recycler reusing IDs quarantine after their release
+func NewRecycler(quarantine time.Duration) *Recycler {
+	return &Recycler{quarantine: quarantine, now: time.Now}
+}
+
+// Next returns the ID released the longest ago when its quarantine is over, a new ID otherwise
+func (r *Recycler) Next() (uint64, error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if len(r.released) > 0 && r.now().Sub(r.released[0].at) >= r.quarantine {
+		id := r.released[0].id
+		r.released[0] = releasedID{}
+		r.released = r.released[1:]
+		return id, nil
+	}
+	r.seq++
+	return r.seq, nil
+}
+
+// Release puts id in quarantine
+func (r *Recycler) Release(id uint64) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	r.released = append(r.released, releasedID{id: id, at: r.now()})
+}
@@ -0,0 +1,35 @@
+package id
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecycler(t *testing.T) {
+	r := NewRecycler(time.Minute)
+	now := time.Now()
+	r.now = func() time.Time { return now }
+
+	next := func() uint64 {
+		id, err := r.Next()
+		assert.NoError(t, err)
+		return id
+	}
+	assert.Equal(t, uint64(1), next())
+	assert.Equal(t, uint64(2), next())
+	assert.Equal(t, uint64(3), next())
+
+	r.Release(2)
+	now = now.Add(time.Second)
+	r.Release(1)
+
+	// released IDs wait for their quarantine
+	assert.Equal(t, uint64(4), next())
+	now = now.Add(time.Minute - time.Second)
+	assert.Equal(t, uint64(2), next())
+	assert.Equal(t, uint64(5), next())
+	now = now.Add(time.Second)
+	assert.Equal(t, uint64(1), next())
+}
@@ -27,11 +27,16 @@ func (i *Seq) Next() uint64 {
 	return i.seq
 }
 
-// ConvertFromStringToArray helpers for translate from list of id separated by comma to a id array
+// ConvertFromStringToArray helpers for translate from list of id separated by comma to a id array,
+// duplicates are kept, see ParseIDSet for a set
 func ConvertFromStringToArray(s string) ([]uint64, error) {
-	receivers := []uint64{}
-	for _, word := range strings.Split(s, ",") {
-		id, err := strconv.ParseUint(strings.TrimSpace(word), 10, 64)
+	receivers := make([]uint64, 0, strings.Count(s, ",")+1)
+	for i := 0; i <= len(s); i++ {
+		start := i
+		for i < len(s) && s[i] != ',' {
+			i++
+		}
+		id, err := strconv.ParseUint(strings.TrimSpace(s[start:i]), 10, 64)
 		if err != nil {
 			return nil, fmt.Errorf("Unknown ID format")
 		}
@@ -43,9 +48,12 @@ func ConvertFromStringToArray(s string) ([]uint64, error) {
 
 // JoinIDArray joins a id array to a string separated by delim
 func JoinIDArray(ids []uint64, delim string) string {
-	tmpArr := []string{}
-	for _, id := range ids {
-		tmpArr = append(tmpArr, fmt.Sprint(id))
+	buf := make([]byte, 0, len(ids)*(len(delim)+4))
+	for i, id := range ids {
+		if i > 0 {
+			buf = append(buf, delim...)
+		}
+		buf = strconv.AppendUint(buf, id, 10)
 	}
-	return strings.Join(tmpArr, delim)
+	return string(buf)
 }
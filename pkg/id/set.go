@@ -0,0 +1,369 @@
+package id
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	// ErrInvalidSet is returned for malformed ID sets
+	ErrInvalidSet = errors.New("invalid ID set")
+	// ErrInvalidEncoding is returned for malformed binary ID sets
+	ErrInvalidEncoding = errors.New("invalid ID set encoding")
+)
+
+// IDSet is a set of IDs kept as sorted ranges, e.g. "2-40,42,50-51".
+// The zero value is the empty set, sets are not changed once built and can be shared.
+type IDSet struct {
+	// ranges are sorted and neither overlap nor touch
+	ranges []idRange
+}
+
+// idRange holds the IDs from lo to hi included
+type idRange struct {
+	lo, hi uint64
+}
+
+// NewIDSet returns the set of ids, duplicates are dropped
+func NewIDSet(ids ...uint64) IDSet {
+	ranges := make([]idRange, 0, len(ids))
+	for _, id := range ids {
+		ranges = append(ranges, idRange{id, id})
+	}
+	return IDSet{ranges: normalize(ranges)}
+}
+
+// ParseIDSet parses IDs and ranges of IDs separated by commas, e.g. "1, 5-9,3".
+// The empty string is the empty set.
+func ParseIDSet(s string) (IDSet, error) {
+	if s == "" {
+		return IDSet{}, nil
+	}
+
+	ranges := make([]idRange, 0, strings.Count(s, ",")+1)
+	for i := 0; i <= len(s); i++ {
+		start := i
+		for i < len(s) && s[i] != ',' {
+			i++
+		}
+		r, err := parseRange(s[start:i])
+		if err != nil {
+			return IDSet{}, err
+		}
+		// sorted input, the usual case, merges as it goes
+		if n := len(ranges); n > 0 && r.lo >= ranges[n-1].lo {
+			if last := &ranges[n-1]; r.lo <= last.hi || r.lo-last.hi == 1 {
+				if r.hi > last.hi {
+					last.hi = r.hi
+				}
+				continue
+			}
+		}
+		ranges = append(ranges, r)
+	}
+	return IDSet{ranges: normalize(ranges)}, nil
+}
+
+// parseRange parses "7" or "5-9" surrounded by spaces
+func parseRange(token string) (idRange, error) {
+	token = trimSpaces(token)
+	sep := -1
+	for i := 0; i < len(token); i++ {
+		if token[i] == '-' {
+			sep = i
+			break
+		}
+	}
+	if sep < 0 {
+		id, err := parseID(token)
+		return idRange{id, id}, err
+	}
+	lo, err := parseID(trimSpaces(token[:sep]))
+	if err != nil {
+		return idRange{}, err
+	}
+	hi, err := parseID(trimSpaces(token[sep+1:]))
+	if err != nil || hi < lo {
+		return idRange{}, ErrInvalidSet
+	}
+	return idRange{lo, hi}, nil
+}
+
+func parseID(s string) (uint64, error) {
+	if s == "" {
+		return 0, ErrInvalidSet
+	}
+	var id uint64
+	for i := 0; i < len(s); i++ {
+		d := s[i] - '0'
+		if d > 9 || id > (maxID-uint64(d))/10 {
+			return 0, ErrInvalidSet
+		}
+		id = id*10 + uint64(d)
+	}
+	return id, nil
+}
+
+const maxID = ^uint64(0)
+
+func trimSpaces(s string) string {
+	for len(s) > 0 && s[0] == ' ' {
+		s = s[1:]
+	}
+	for len(s) > 0 && s[len(s)-1] == ' ' {
+		s = s[:len(s)-1]
+	}
+	return s
+}
+
+type byLo []idRange
+
+func (r byLo) Len() int           { return len(r) }
+func (r byLo) Less(i, j int) bool { return r[i].lo < r[j].lo }
+func (r byLo) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+
+// normalize sorts ranges and merges those which overlap or touch, in place
+func normalize(ranges []idRange) []idRange {
+	if len(ranges) == 0 {
+		return nil
+	}
+	for i := 1; i < len(ranges); i++ {
+		if ranges[i].lo < ranges[i-1].lo {
+			sort.Sort(byLo(ranges))
+			break
+		}
+	}
+	merged := ranges[:1]
+	for _, r := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		if r.lo <= last.hi || r.lo-last.hi == 1 {
+			if r.hi > last.hi {
+				last.hi = r.hi
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// Len returns how many IDs the set holds, up to the largest uint64
+func (s IDSet) Len() uint64 {
+	var n uint64
+	for _, r := range s.ranges {
+		size := r.hi - r.lo + 1
+		if size == 0 || n+size < n {
+			return ^uint64(0)
+		}
+		n += size
+	}
+	return n
+}
+
+// Empty tells whether the set holds no ID
+func (s IDSet) Empty() bool {
+	return len(s.ranges) == 0
+}
+
+// Contains tells whether id is in the set
+func (s IDSet) Contains(id uint64) bool {
+	i := sort.Search(len(s.ranges), func(i int) bool { return s.ranges[i].hi >= id })
+	return i < len(s.ranges) && s.ranges[i].lo <= id
+}
+
+// AppendIDs appends the IDs of the set in increasing order to dst
+func (s IDSet) AppendIDs(dst []uint64) []uint64 {
+	for _, r := range s.ranges {
+		for id := r.lo; ; id++ {
+			dst = append(dst, id)
+			if id == r.hi {
+				break
+			}
+		}
+	}
+	return dst
+}
+
+// Union returns the IDs in s or o
+func (s IDSet) Union(o IDSet) IDSet {
+	if len(o.ranges) == 0 {
+		return s
+	}
+	if len(s.ranges) == 0 {
+		return o
+	}
+
+	ranges := make([]idRange, 0, len(s.ranges)+len(o.ranges))
+	i, j := 0, 0
+	for i < len(s.ranges) || j < len(o.ranges) {
+		var r idRange
+		if j == len(o.ranges) || (i < len(s.ranges) && s.ranges[i].lo <= o.ranges[j].lo) {
+			r = s.ranges[i]
+			i++
+		} else {
+			r = o.ranges[j]
+			j++
+		}
+		if n := len(ranges); n > 0 {
+			if last := &ranges[n-1]; r.lo <= last.hi || r.lo-last.hi == 1 {
+				if r.hi > last.hi {
+					last.hi = r.hi
+				}
+				continue
+			}
+		}
+		ranges = append(ranges, r)
+	}
+	return IDSet{ranges: ranges}
+}
+
+// Except returns the IDs in s which are not in o
+func (s IDSet) Except(o IDSet) IDSet {
+	if len(s.ranges) == 0 || len(o.ranges) == 0 {
+		return s
+	}
+
+	ranges := make([]idRange, 0, len(s.ranges)+len(o.ranges))
+	j := 0
+	for _, r := range s.ranges {
+		// skip what o holds below r
+		for j < len(o.ranges) && o.ranges[j].hi < r.lo {
+			j++
+		}
+		lo := r.lo
+		covered := false
+		for k := j; k < len(o.ranges) && o.ranges[k].lo <= r.hi; k++ {
+			cut := o.ranges[k]
+			if cut.lo > lo {
+				ranges = append(ranges, idRange{lo, cut.lo - 1})
+			}
+			if cut.hi >= r.hi {
+				covered = true
+				break
+			}
+			lo = cut.hi + 1
+		}
+		if !covered {
+			ranges = append(ranges, idRange{lo, r.hi})
+		}
+	}
+	if len(ranges) == 0 {
+		return IDSet{}
+	}
+	return IDSet{ranges: ranges}
+}
+
+// Equal tells whether s and o hold the same IDs
+func (s IDSet) Equal(o IDSet) bool {
+	if len(s.ranges) != len(o.ranges) {
+		return false
+	}
+	for i := range s.ranges {
+		if s.ranges[i] != o.ranges[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// String formats the set as ParseIDSet parses it, with ranges of more than two IDs
+func (s IDSet) String() string {
+	return string(s.AppendTo(nil))
+}
+
+// AppendTo appends the set formatted as String does to dst
+func (s IDSet) AppendTo(dst []byte) []byte {
+	for i, r := range s.ranges {
+		if i > 0 {
+			dst = append(dst, ',')
+		}
+		dst = strconv.AppendUint(dst, r.lo, 10)
+		switch {
+		case r.hi == r.lo:
+		case r.hi-r.lo == 1:
+			dst = append(dst, ',')
+			dst = strconv.AppendUint(dst, r.hi, 10)
+		default:
+			dst = append(dst, '-')
+			dst = strconv.AppendUint(dst, r.hi, 10)
+		}
+	}
+	return dst
+}
+
+// MarshalBinary encodes the set as AppendBinary does
+func (s IDSet) MarshalBinary() ([]byte, error) {
+	return s.AppendBinary(nil), nil
+}
+
+// AppendBinary appends the set to dst as uvarints:
+// the number of ranges, then for each range its distance to the end of the previous one,
+// from 0 for the first, and how many IDs follow its start
+func (s IDSet) AppendBinary(dst []byte) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	dst = append(dst, buf[:binary.PutUvarint(buf[:], uint64(len(s.ranges)))]...)
+	var prev uint64
+	for _, r := range s.ranges {
+		dst = append(dst, buf[:binary.PutUvarint(buf[:], r.lo-prev)]...)
+		dst = append(dst, buf[:binary.PutUvarint(buf[:], r.hi-r.lo)]...)
+		prev = r.hi
+	}
+	return dst
+}
+
+// UnmarshalBinary decodes a set encoded by MarshalBinary, it only takes the encoding
+// MarshalBinary produces so a set has one encoding
+func (s *IDSet) UnmarshalBinary(data []byte) error {
+	count, n := uvarint(data)
+	if n <= 0 || count > uint64(len(data)-n)/2 {
+		return ErrInvalidEncoding
+	}
+	data = data[n:]
+
+	var ranges []idRange
+	if count > 0 {
+		ranges = make([]idRange, 0, int(count))
+	}
+	var prev uint64
+	for i := uint64(0); i < count; i++ {
+		delta, n := uvarint(data)
+		if n <= 0 {
+			return ErrInvalidEncoding
+		}
+		data = data[n:]
+		length, n := uvarint(data)
+		if n <= 0 {
+			return ErrInvalidEncoding
+		}
+		data = data[n:]
+
+		// ranges after the first one start past the next ID of the previous one
+		if i > 0 && delta < 2 {
+			return ErrInvalidEncoding
+		}
+		lo := prev + delta
+		hi := lo + length
+		if lo < prev || hi < lo {
+			return ErrInvalidEncoding
+		}
+		ranges = append(ranges, idRange{lo, hi})
+		prev = hi
+	}
+	if len(data) > 0 {
+		return ErrInvalidEncoding
+	}
+	s.ranges = ranges
+	return nil
+}
+
+// uvarint decodes a uvarint encoded in as few bytes as possible
+func uvarint(data []byte) (uint64, int) {
+	v, n := binary.Uvarint(data)
+	if n > 1 && data[n-1] == 0 {
+		return 0, -1
+	}
+	return v, n
+}
@@ -0,0 +1,332 @@
+package id
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseIDSet(t *testing.T) {
+	tcs := []struct {
+		in       string
+		expected string
+		err      bool
+	}{
+		{in: "", expected: ""},
+		{in: "1", expected: "1"},
+		{in: "3,1,2", expected: "1-3"},
+		{in: "2-40", expected: "2-40"},
+		{in: " 1 , 5 - 9,3,3", expected: "1,3,5-9"},
+		{in: "1,2", expected: "1,2"},
+		{in: "10-20,5-12,30", expected: "5-20,30"},
+		{in: "0-18446744073709551615", expected: "0-18446744073709551615"},
+		{in: ",", err: true},
+		{in: "1,", err: true},
+		{in: "a", err: true},
+		{in: "-1", err: true},
+		{in: "+1", err: true},
+		{in: "9-5", err: true},
+		{in: "1-2-3", err: true},
+		{in: "18446744073709551616", err: true},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.in, func(t *testing.T) {
+			set, err := ParseIDSet(tc.in)
+			if tc.err {
+				assert.Equal(t, ErrInvalidSet, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, set.String())
+		})
+	}
+}
+
+func TestIDSet(t *testing.T) {
+	set := NewIDSet(7, 3, 5, 4, 7)
+	assert.Equal(t, "3-5,7", set.String())
+	assert.Equal(t, uint64(4), set.Len())
+	assert.Equal(t, []uint64{3, 4, 5, 7}, set.AppendIDs(nil))
+	assert.True(t, set.Contains(4))
+	assert.False(t, set.Contains(6))
+	assert.False(t, set.Contains(8))
+	assert.True(t, IDSet{}.Empty())
+	assert.False(t, set.Empty())
+
+	full, err := ParseIDSet("0-18446744073709551615")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(math.MaxUint64), full.Len())
+	assert.True(t, full.Contains(math.MaxUint64))
+}
+
+func TestIDSetAlgebra(t *testing.T) {
+	tcs := []struct {
+		a, b   string
+		union  string
+		except string
+	}{
+		{a: "", b: "", union: "", except: ""},
+		{a: "1-5", b: "", union: "1-5", except: "1-5"},
+		{a: "", b: "1-5", union: "1-5", except: ""},
+		{a: "1-5", b: "6-9", union: "1-9", except: "1-5"},
+		{a: "1-10", b: "3,5-6", union: "1-10", except: "1,2,4,7-10"},
+		{a: "1-10", b: "0-20", union: "0-20", except: ""},
+		{a: "1-3,8-10", b: "2-9", union: "1-10", except: "1,10"},
+		{a: "5-9,20", b: "1-5,9-20", union: "1-20", except: "6-8"},
+		{a: "1,3,5", b: "2,4", union: "1-5", except: "1,3,5"},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.a+"/"+tc.b, func(t *testing.T) {
+			a, err := ParseIDSet(tc.a)
+			require.NoError(t, err)
+			b, err := ParseIDSet(tc.b)
+			require.NoError(t, err)
+			assert.Equal(t, tc.union, a.Union(b).String())
+			assert.Equal(t, tc.except, a.Except(b).String())
+		})
+	}
+}
+
+func TestIDSetBinary(t *testing.T) {
+	for _, in := range []string{"", "0", "1-3,7,300-70000", "0-18446744073709551615", "18446744073709551615"} {
+		set, err := ParseIDSet(in)
+		require.NoError(t, err)
+		data, err := set.MarshalBinary()
+		require.NoError(t, err)
+
+		var decoded IDSet
+		require.NoError(t, decoded.UnmarshalBinary(data))
+		assert.True(t, set.Equal(decoded), in)
+	}
+
+	// a range every 2 IDs takes 2 bytes
+	set := NewIDSet()
+	for id := uint64(1); id < 1000; id += 2 {
+		set = set.Union(NewIDSet(id))
+	}
+	assert.Len(t, set.AppendBinary(nil), 2+500*2)
+
+	for _, data := range [][]byte{
+		{},
+		{1},
+		{2, 1, 0},
+		{1, 1, 0, 0},
+		// the second range touches the first
+		{2, 1, 0, 1, 0},
+		// padded uvarint
+		{1, 0x81, 0x00, 0},
+		// overflowing the IDs
+		{2, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01, 0, 2, 0},
+		{0x80},
+	} {
+		var decoded IDSet
+		assert.Equal(t, ErrInvalidEncoding, decoded.UnmarshalBinary(data), "%v", data)
+	}
+}
+
+func TestIDSetAllocs(t *testing.T) {
+	in := JoinIDArray(seqIDs(1000), ",")
+	allocs := testing.AllocsPerRun(100, func() {
+		ParseIDSet(in)
+	})
+	assert.Equal(t, float64(1), allocs)
+
+	set, err := ParseIDSet("1,3,5,7-100,200")
+	require.NoError(t, err)
+	dst := make([]byte, 0, 64)
+	allocs = testing.AllocsPerRun(100, func() {
+		set.AppendTo(dst[:0])
+		set.AppendBinary(dst[:0])
+	})
+	assert.Equal(t, float64(0), allocs)
+}
+
+func seqIDs(n int) []uint64 {
+	ids := make([]uint64, n)
+	for i := range ids {
+		ids[i] = uint64(2*i + 1)
+	}
+	return ids
+}
+
+func BenchmarkParseIDSet(b *testing.B) {
+	for _, n := range []int{10, 1000} {
+		in := JoinIDArray(seqIDs(n), ",")
+		b.Run(fmt.Sprintf("%d IDs", n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := ParseIDSet(in); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("ConvertFromStringToArray/%d IDs", n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := ConvertFromStringToArray(in); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkFormatIDSet(b *testing.B) {
+	for _, n := range []int{10, 1000} {
+		ids := seqIDs(n)
+		set := NewIDSet(ids...)
+		b.Run(fmt.Sprintf("%d IDs", n), func(b *testing.B) {
+			b.ReportAllocs()
+			var dst []byte
+			for i := 0; i < b.N; i++ {
+				dst = set.AppendTo(dst[:0])
+			}
+		})
+		b.Run(fmt.Sprintf("JoinIDArray/%d IDs", n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				JoinIDArray(ids, ",")
+			}
+		})
+	}
+}
+
+func BenchmarkIDSetAlgebra(b *testing.B) {
+	a := NewIDSet(seqIDs(1000)...)
+	o, _ := ParseIDSet("100-500,900-1200,1500")
+	b.Run("union", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			a.Union(o)
+		}
+	})
+	b.Run("except", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			a.Except(o)
+		}
+	})
+}
+
+func BenchmarkIDSetBinary(b *testing.B) {
+	set := NewIDSet(seqIDs(1000)...)
+	data := set.AppendBinary(nil)
+	b.Run("encode", func(b *testing.B) {
+		b.ReportAllocs()
+		var dst []byte
+		for i := 0; i < b.N; i++ {
+			dst = set.AppendBinary(dst[:0])
+		}
+	})
+	b.Run("decode", func(b *testing.B) {
+		b.ReportAllocs()
+		var decoded IDSet
+		for i := 0; i < b.N; i++ {
+			if err := decoded.UnmarshalBinary(data); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func FuzzParseIDSet(f *testing.F) {
+	for _, seed := range []string{"", "1", "3,1,2", "2-40,42", " 1 , 5 - 9", "9-5", "0-18446744073709551615"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, in string) {
+		set, err := ParseIDSet(in)
+		if err != nil {
+			return
+		}
+		// the formatted set parses back to itself
+		again, err := ParseIDSet(set.String())
+		require.NoError(t, err)
+		require.True(t, set.Equal(again), "%q formatted as %q", in, set.String())
+
+		// small sets hold what the IDs of the input are
+		if in == "" || set.Len() > 1000 {
+			return
+		}
+		expected := map[uint64]bool{}
+		for _, token := range strings.Split(in, ",") {
+			r, err := parseRange(token)
+			require.NoError(t, err)
+			for id := r.lo; ; id++ {
+				expected[id] = true
+				if id == r.hi {
+					break
+				}
+			}
+		}
+		require.Equal(t, sortedKeys(expected), set.AppendIDs(nil))
+	})
+}
+
+func FuzzIDSetBinary(f *testing.F) {
+	for _, seed := range []string{"", "1", "1-3,7,300-70000", "0-18446744073709551615"} {
+		set, _ := ParseIDSet(seed)
+		f.Add(set.AppendBinary(nil))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var set IDSet
+		if err := set.UnmarshalBinary(data); err != nil {
+			return
+		}
+		// a set has a single encoding
+		require.Equal(t, data, set.AppendBinary(nil))
+	})
+}
+
+func FuzzIDSetAlgebra(f *testing.F) {
+	f.Add([]byte{1, 5, 9, 3}, []byte{2, 3, 4})
+	f.Fuzz(func(t *testing.T, a, b []byte) {
+		setA, setB := bytesSet(a), bytesSet(b)
+		inA, inB := map[uint64]bool{}, map[uint64]bool{}
+		for _, id := range a {
+			inA[uint64(id)] = true
+		}
+		for _, id := range b {
+			inB[uint64(id)] = true
+		}
+
+		union := map[uint64]bool{}
+		except := map[uint64]bool{}
+		for id := range inA {
+			union[id] = true
+			if !inB[id] {
+				except[id] = true
+			}
+		}
+		for id := range inB {
+			union[id] = true
+		}
+		require.Equal(t, sortedKeys(union), setA.Union(setB).AppendIDs(nil))
+		require.Equal(t, sortedKeys(except), setA.Except(setB).AppendIDs(nil))
+	})
+}
+
+func bytesSet(ids []byte) IDSet {
+	set := IDSet{}
+	for _, id := range ids {
+		set = set.Union(NewIDSet(uint64(id)))
+	}
+	return set
+}
+
+func sortedKeys(m map[uint64]bool) []uint64 {
+	var keys []uint64
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
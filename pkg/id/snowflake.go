@@ -0,0 +1,83 @@
+package id
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Snowflake IDs hold from the high to the low bits
+// the milliseconds since the epoch, the node and a sequence within the millisecond
+const (
+	snowflakeNodeBits = 10
+	snowflakeSeqBits  = 12
+	snowflakeTimeBits = 64 - 1 - snowflakeNodeBits - snowflakeSeqBits
+
+	// MaxNode is the highest node of a Snowflake
+	MaxNode = 1<<snowflakeNodeBits - 1
+	maxSeq  = 1<<snowflakeSeqBits - 1
+	maxTime = 1<<snowflakeTimeBits - 1
+)
+
+// DefaultEpoch is the epoch of Snowflake IDs when none is given
+var DefaultEpoch = time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+var (
+	errNodeInvalid  = errors.New("node out of range")
+	errTimeOverflow = errors.New("time beyond the ID range")
+)
+
+// Snowflake allocates IDs from the time and the node they are allocated on,
+// hubs with distinct nodes never hand out the same ID. IDs increase even when the clock goes back.
+type Snowflake struct {
+	m     sync.Mutex
+	epoch time.Time
+	node  uint64
+	last  uint64
+	seq   uint64
+	now   func() time.Time
+}
+
+// NewSnowflake returns a Snowflake for node, from 0 to MaxNode, counting time from epoch
+func NewSnowflake(node uint16, epoch time.Time) (*Snowflake, error) {
+	if node > MaxNode {
+		return nil, errNodeInvalid
+	}
+	return &Snowflake{epoch: epoch, node: uint64(node), now: time.Now}, nil
+}
+
+// Next returns the next ID, waiting for the next millisecond when this one ran out of IDs
+func (s *Snowflake) Next() (uint64, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	for {
+		elapsed := s.now().Sub(s.epoch)
+		if elapsed < 0 {
+			elapsed = 0
+		}
+		ms := uint64(elapsed / time.Millisecond)
+		if ms < s.last {
+			// the clock went back, keep counting in the last millisecond
+			ms = s.last
+		}
+		if ms > maxTime {
+			return 0, errTimeOverflow
+		}
+
+		if ms == s.last {
+			if s.seq == maxSeq {
+				time.Sleep(time.Millisecond - elapsed%time.Millisecond)
+				continue
+			}
+			s.seq++
+		} else {
+			s.last = ms
+			s.seq = 0
+		}
+		return ms<<(snowflakeNodeBits+snowflakeSeqBits) | s.node<<snowflakeSeqBits | s.seq, nil
+	}
+}
+
+// Release does nothing, IDs are never reused
+func (s *Snowflake) Release(id uint64) {}
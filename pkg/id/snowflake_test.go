@@ -0,0 +1,56 @@
+package id
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnowflake(t *testing.T) {
+	_, err := NewSnowflake(MaxNode+1, DefaultEpoch)
+	assert.Error(t, err)
+
+	s, err := NewSnowflake(5, DefaultEpoch)
+	require.NoError(t, err)
+	now := DefaultEpoch.Add(time.Second)
+	s.now = func() time.Time { return now }
+
+	first, err := s.Next()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1000)<<22|5<<12, first)
+	second, err := s.Next()
+	require.NoError(t, err)
+	assert.Equal(t, first+1, second)
+
+	// IDs keep increasing when the clock goes back
+	now = now.Add(-time.Minute)
+	third, err := s.Next()
+	require.NoError(t, err)
+	assert.Equal(t, second+1, third)
+
+	now = DefaultEpoch.Add(2 * time.Second)
+	fourth, err := s.Next()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2000)<<22|5<<12, fourth)
+
+	now = DefaultEpoch.Add(time.Duration(maxTime+1) * time.Millisecond)
+	_, err = s.Next()
+	assert.Error(t, err)
+}
+
+func TestSnowflakeSequence(t *testing.T) {
+	s, err := NewSnowflake(MaxNode, time.Now())
+	require.NoError(t, err)
+
+	// more IDs than one millisecond holds
+	last := uint64(0)
+	for i := 0; i < 3*(maxSeq+1); i++ {
+		next, err := s.Next()
+		require.NoError(t, err)
+		require.True(t, next > last)
+		assert.Equal(t, uint64(MaxNode), next>>snowflakeSeqBits&MaxNode)
+		last = next
+	}
+}
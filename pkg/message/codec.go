@@ -0,0 +1,506 @@
+package message
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// ErrInvalidMessage is returned when decoding a malformed message or one of another type
+var ErrInvalidMessage = errors.New("invalid message")
+
+// ErrBodyTooLarge is returned when decoding a relay whose body is over the size limit
+var ErrBodyTooLarge = errors.New("body too large")
+
+// DefaultMaxBodySize is the largest relay body Decode accepts
+const DefaultMaxBodySize = 64 << 20
+
+// maxTypeLen is longer than any message type
+const maxTypeLen = 16
+
+// Message is a protocol message, encoded as a line and for relays a body
+type Message interface {
+	// Encode writes the message to w
+	Encode(w io.Writer) error
+	// Decode reads the message from r, an error reply of server is returned as an error
+	Decode(r *bufio.Reader) error
+}
+
+// PeekType returns the type of the next message in r without reading it
+func PeekType(r *bufio.Reader) (string, error) {
+	for n := 1; n <= maxTypeLen; n++ {
+		b, err := r.Peek(n)
+		if err != nil {
+			return "", err
+		}
+		if c := b[n-1]; c == ' ' || c == '\n' {
+			return string(b[:n-1]), nil
+		}
+	}
+	// no message has such a type, reading its line skips it
+	b, err := r.Peek(maxTypeLen)
+	return string(b), err
+}
+
+// decodeLine reads a line from r and decodes it with decode
+func decodeLine(r *bufio.Reader, decode func(line string) error) error {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	return decode(line)
+}
+
+// argumentsOf returns the arguments of line of type typ, without the newline
+func argumentsOf(line, typ string) (string, error) {
+	line = strings.TrimSuffix(line, "\n")
+	if strings.HasPrefix(line, ErrorType+" ") && typ != ErrorType {
+		return "", errors.New(line[len(ErrorType)+1:])
+	}
+	// a connection turned away is told why instead of a reply
+	if strings.HasPrefix(line, BusyType+" ") && typ != BusyType {
+		return "", errors.New(line)
+	}
+	if line == typ {
+		return "", nil
+	}
+	if !strings.HasPrefix(line, typ+" ") {
+		return "", ErrInvalidMessage
+	}
+	return line[len(typ)+1:], nil
+}
+
+func write(w io.Writer, p []byte) error {
+	_, err := w.Write(p)
+	return err
+}
+
+// appendArg appends the line of a message of type typ having a single argument
+func appendArg(dst []byte, typ, arg string) []byte {
+	dst = append(dst, typ...)
+	dst = append(dst, ' ')
+	dst = append(dst, arg...)
+	return append(dst, '\n')
+}
+
+func parseInt(s string, bitSize int) (int64, error) {
+	n, err := strconv.ParseInt(s, 10, bitSize)
+	if err != nil {
+		return 0, ErrInvalidMessage
+	}
+	return n, nil
+}
+
+func parseID(s string) (uint64, error) {
+	id, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, ErrInvalidMessage
+	}
+	return id, nil
+}
+
+// Identity asks server for the client ID, "identity\n"
+type Identity struct{}
+
+// AppendTo appends the encoded message to dst
+func (m Identity) AppendTo(dst []byte) []byte {
+	return append(append(dst, IdentityType...), '\n')
+}
+
+// Encode writes the message to w
+func (m Identity) Encode(w io.Writer) error {
+	return write(w, m.AppendTo(nil))
+}
+
+// Decode reads the message from r
+func (m *Identity) Decode(r *bufio.Reader) error {
+	return decodeLine(r, m.DecodeLine)
+}
+
+// DecodeLine decodes the message from its line
+func (m *Identity) DecodeLine(line string) error {
+	args, err := argumentsOf(line, IdentityType)
+	if err == nil && args != "" {
+		err = ErrInvalidMessage
+	}
+	return err
+}
+
+// IdentityReply tells a client its ID, "identity 1\n"
+type IdentityReply struct {
+	ID uint64
+}
+
+// AppendTo appends the encoded message to dst
+func (m IdentityReply) AppendTo(dst []byte) []byte {
+	dst = append(dst, IdentityType...)
+	dst = append(dst, ' ')
+	dst = strconv.AppendUint(dst, m.ID, 10)
+	return append(dst, '\n')
+}
+
+// Encode writes the message to w
+func (m IdentityReply) Encode(w io.Writer) error {
+	return write(w, m.AppendTo(nil))
+}
+
+// Decode reads the message from r
+func (m *IdentityReply) Decode(r *bufio.Reader) error {
+	return decodeLine(r, m.DecodeLine)
+}
+
+// DecodeLine decodes the message from its line
+func (m *IdentityReply) DecodeLine(line string) error {
+	args, err := argumentsOf(line, IdentityType)
+	if err != nil {
+		return err
+	}
+	m.ID, err = parseID(args)
+	return err
+}
+
+// List asks server for the other clients, "list\n" or with their names "list names\n"
+type List struct {
+	Names bool
+}
+
+// AppendTo appends the encoded message to dst
+func (m List) AppendTo(dst []byte) []byte {
+	dst = append(dst, ListType...)
+	if m.Names {
+		dst = append(dst, ' ')
+		dst = append(dst, ListNamesArg...)
+	}
+	return append(dst, '\n')
+}
+
+// Encode writes the message to w
+func (m List) Encode(w io.Writer) error {
+	return write(w, m.AppendTo(nil))
+}
+
+// Decode reads the message from r
+func (m *List) Decode(r *bufio.Reader) error {
+	return decodeLine(r, m.DecodeLine)
+}
+
+// DecodeLine decodes the message from its line
+func (m *List) DecodeLine(line string) error {
+	args, err := argumentsOf(line, ListType)
+	if err != nil {
+		return err
+	}
+	// any other argument asks for the IDs alone
+	m.Names = args == ListNamesArg
+	return nil
+}
+
+// ListEntry is a client of a ListReply, Name is only set in replies to "list names"
+type ListEntry struct {
+	ID   uint64
+	Name string
+}
+
+// ListReply holds the other clients, "list 1,2\n", "list 1:alice,2\n" or "list \n" for none
+type ListReply struct {
+	Clients []ListEntry
+}
+
+// AppendTo appends the encoded message to dst
+func (m ListReply) AppendTo(dst []byte) []byte {
+	dst = append(dst, ListType...)
+	dst = append(dst, ' ')
+	for i, c := range m.Clients {
+		if i > 0 {
+			dst = append(dst, ',')
+		}
+		dst = strconv.AppendUint(dst, c.ID, 10)
+		if c.Name != "" {
+			dst = append(dst, ':')
+			dst = append(dst, c.Name...)
+		}
+	}
+	return append(dst, '\n')
+}
+
+// Encode writes the message to w, it fails for names which cannot be sent
+func (m ListReply) Encode(w io.Writer) error {
+	for _, c := range m.Clients {
+		if strings.ContainsAny(c.Name, ",:") || hasSpace(c.Name) {
+			return ErrInvalidMessage
+		}
+	}
+	return write(w, m.AppendTo(nil))
+}
+
+// Decode reads the message from r
+func (m *ListReply) Decode(r *bufio.Reader) error {
+	return decodeLine(r, m.DecodeLine)
+}
+
+// DecodeLine decodes the message from its line
+func (m *ListReply) DecodeLine(line string) error {
+	args, err := argumentsOf(line, ListType)
+	if err != nil {
+		return err
+	}
+	m.Clients = nil
+	if args == "" {
+		return nil
+	}
+	m.Clients = make([]ListEntry, 0, strings.Count(args, ",")+1)
+	for _, pair := range strings.Split(args, ",") {
+		kv := strings.SplitN(pair, ":", 2)
+		clientID, err := parseID(kv[0])
+		if err != nil {
+			return err
+		}
+		entry := ListEntry{ID: clientID}
+		if len(kv) == 2 {
+			if kv[1] == "" {
+				return ErrInvalidMessage
+			}
+			entry.Name = kv[1]
+		}
+		m.Clients = append(m.Clients, entry)
+	}
+	return nil
+}
+
+// IDs returns the IDs of the listed clients
+func (m ListReply) IDs() []uint64 {
+	ids := make([]uint64, 0, len(m.Clients))
+	for _, c := range m.Clients {
+		ids = append(ids, c.ID)
+	}
+	return ids
+}
+
+// Relay is a message a client sends to receivers through server, "relay 2,3 5 ttl=100\nhello".
+// Receivers are client IDs or names, a label selector or a queue group.
+type Relay struct {
+	Receivers string
+	Fields    map[string]string
+	Body      []byte
+}
+
+// AppendTo appends the encoded message to dst
+func (m Relay) AppendTo(dst []byte) []byte {
+	dst = appendRelayHeader(dst, m.Receivers, len(m.Body), m.Fields)
+	return append(dst, m.Body...)
+}
+
+// Encode writes the message to w, it fails for receivers or fields which cannot be sent
+func (m Relay) Encode(w io.Writer) error {
+	if m.Receivers == "" || hasSpace(m.Receivers) || !validFields(m.Fields) {
+		return ErrInvalidMessage
+	}
+	return write(w, m.AppendTo(nil))
+}
+
+// Decode reads the message from r, with a body up to DefaultMaxBodySize
+func (m *Relay) Decode(r *bufio.Reader) error {
+	return m.DecodeLimit(r, DefaultMaxBodySize)
+}
+
+// DecodeLimit reads the message from r, with a body up to maxSize bytes
+func (m *Relay) DecodeLimit(r *bufio.Reader, maxSize int) error {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	size, err := m.DecodeHeader(line, maxSize)
+	if err != nil {
+		return err
+	}
+	m.Body = make([]byte, size)
+	_, err = io.ReadFull(r, m.Body)
+	return err
+}
+
+// DecodeHeader parses the line of a relay and returns the size of the body following it,
+// for readers of the body of their own. It fails with ErrBodyTooLarge for a body over maxSize bytes.
+func (m *Relay) DecodeHeader(line string, maxSize int) (int, error) {
+	target, size, fields, err := parseRelayHeader(line, maxSize)
+	if err != nil {
+		return 0, err
+	}
+	m.Receivers, m.Fields = target, fields
+	return size, nil
+}
+
+// Delivery is a relay server delivers to a receiver, "relay 1 5 id=9\nhello"
+type Delivery struct {
+	SenderID uint64
+	Fields   map[string]string
+	Body     []byte
+}
+
+// AppendTo appends the encoded message to dst
+func (m Delivery) AppendTo(dst []byte) []byte {
+	dst = AppendDeliveryHeader(dst, m.SenderID, len(m.Body), m.Fields)
+	return append(dst, m.Body...)
+}
+
+// Encode writes the message to w, it fails for fields which cannot be sent
+func (m Delivery) Encode(w io.Writer) error {
+	if !validFields(m.Fields) {
+		return ErrInvalidMessage
+	}
+	return write(w, m.AppendTo(nil))
+}
+
+// Decode reads the message from r, with a body up to DefaultMaxBodySize
+func (m *Delivery) Decode(r *bufio.Reader) error {
+	return m.DecodeLimit(r, DefaultMaxBodySize)
+}
+
+// DecodeLimit reads the message from r, with a body up to maxSize bytes
+func (m *Delivery) DecodeLimit(r *bufio.Reader, maxSize int) error {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	target, size, fields, err := parseRelayHeader(line, maxSize)
+	if err != nil {
+		return err
+	}
+	if m.SenderID, err = parseID(target); err != nil {
+		return err
+	}
+	m.Fields = fields
+	m.Body = make([]byte, size)
+	_, err = io.ReadFull(r, m.Body)
+	return err
+}
+
+// AppendDeliveryHeader appends the line of a Delivery to dst
+func AppendDeliveryHeader(dst []byte, senderID uint64, size int, fields map[string]string) []byte {
+	dst = append(dst, RelayType...)
+	dst = append(dst, ' ')
+	dst = strconv.AppendUint(dst, senderID, 10)
+	dst = append(dst, ' ')
+	dst = strconv.AppendInt(dst, int64(size), 10)
+	dst = AppendFields(dst, fields)
+	return append(dst, '\n')
+}
+
+func appendRelayHeader(dst []byte, receivers string, size int, fields map[string]string) []byte {
+	dst = append(dst, RelayType...)
+	dst = append(dst, ' ')
+	dst = append(dst, receivers...)
+	dst = append(dst, ' ')
+	dst = strconv.AppendInt(dst, int64(size), 10)
+	dst = AppendFields(dst, fields)
+	return append(dst, '\n')
+}
+
+// parseRelayHeader parses "relay <target> <size>[ key=value...]\n" with a size up to maxSize
+func parseRelayHeader(line string, maxSize int) (target string, size int, fields map[string]string, err error) {
+	args, err := argumentsOf(line, RelayType)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	tokens := strings.Fields(args)
+	if len(tokens) < 2 {
+		return "", 0, nil, ErrInvalidMessage
+	}
+	size64, err := strconv.ParseUint(tokens[1], 10, 64)
+	if err != nil {
+		return "", 0, nil, ErrInvalidMessage
+	}
+	if size64 > uint64(maxSize) {
+		return "", 0, nil, ErrBodyTooLarge
+	}
+	if fields, err = ParseFields(tokens[2:]); err != nil {
+		return "", 0, nil, ErrInvalidMessage
+	}
+	return tokens[0], int(size64), fields, nil
+}
+
+// validFields reports whether fields can be sent as "key=value" tokens
+func validFields(fields map[string]string) bool {
+	for k, v := range fields {
+		if k == "" || strings.Contains(k, "=") || hasSpace(k) || hasSpace(v) {
+			return false
+		}
+	}
+	return true
+}
+
+// hasSpace reports whether s holds a character the tokens of a line are split at
+func hasSpace(s string) bool {
+	return strings.IndexFunc(s, unicode.IsSpace) >= 0
+}
+
+// Ack acknowledges a delivered message, "ack 42\n"
+type Ack struct {
+	MsgID uint64
+}
+
+// AppendTo appends the encoded message to dst
+func (m Ack) AppendTo(dst []byte) []byte {
+	dst = append(dst, AckType...)
+	dst = append(dst, ' ')
+	dst = strconv.AppendUint(dst, m.MsgID, 10)
+	return append(dst, '\n')
+}
+
+// Encode writes the message to w
+func (m Ack) Encode(w io.Writer) error {
+	return write(w, m.AppendTo(nil))
+}
+
+// Decode reads the message from r
+func (m *Ack) Decode(r *bufio.Reader) error {
+	return decodeLine(r, m.DecodeLine)
+}
+
+// DecodeLine decodes the message from its line
+func (m *Ack) DecodeLine(line string) error {
+	args, err := argumentsOf(line, AckType)
+	if err != nil {
+		return err
+	}
+	m.MsgID, err = parseID(args)
+	return err
+}
+
+// Error is an error reply of server, "error name already taken\n"
+type Error struct {
+	Text string
+}
+
+// AppendTo appends the encoded message to dst
+func (m Error) AppendTo(dst []byte) []byte {
+	dst = append(dst, ErrorType...)
+	dst = append(dst, ' ')
+	dst = append(dst, m.Text...)
+	return append(dst, '\n')
+}
+
+// Encode writes the message to w
+func (m Error) Encode(w io.Writer) error {
+	if strings.Contains(m.Text, "\n") {
+		return ErrInvalidMessage
+	}
+	return write(w, m.AppendTo(nil))
+}
+
+// Decode reads the message from r
+func (m *Error) Decode(r *bufio.Reader) error {
+	return decodeLine(r, m.DecodeLine)
+}
+
+// DecodeLine decodes the message from its line
+func (m *Error) DecodeLine(line string) error {
+	args, err := argumentsOf(line, ErrorType)
+	if err != nil {
+		return err
+	}
+	m.Text = args
+	return nil
+}
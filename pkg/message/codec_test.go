@@ -0,0 +1,306 @@
+package message
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMessageRoundTrip(t *testing.T) {
+	tcs := []struct {
+		encoded string
+		msg     Message
+		decoded Message
+	}{
+		{"identity\n", &Identity{}, &Identity{}},
+		{"identity 7\n", &IdentityReply{ID: 7}, &IdentityReply{}},
+		{"list\n", &List{}, &List{}},
+		{"list names\n", &List{Names: true}, &List{}},
+		{"list \n", &ListReply{}, &ListReply{}},
+		{"list 1,2\n", &ListReply{Clients: []ListEntry{{ID: 1}, {ID: 2}}}, &ListReply{}},
+		{"list 1:alice,3\n", &ListReply{Clients: []ListEntry{{ID: 1, Name: "alice"}, {ID: 3}}}, &ListReply{}},
+		{"relay 2,3 5\nhello", &Relay{Receivers: "2,3", Fields: map[string]string{}, Body: []byte("hello")}, &Relay{}},
+		{"relay @jobs 0 pick=rr qos=1\n", &Relay{Receivers: "@jobs", Fields: map[string]string{"qos": "1", "pick": "rr"}, Body: []byte{}}, &Relay{}},
+		{"relay 1 5 id=9\nhello", &Delivery{SenderID: 1, Fields: map[string]string{"id": "9"}, Body: []byte("hello")}, &Delivery{}},
+		{"ack 42\n", &Ack{MsgID: 42}, &Ack{}},
+		{"error name already taken\n", &Error{Text: "name already taken"}, &Error{}},
+		{"nick alice\n", &Nick{Name: "alice"}, &Nick{}},
+		{"whois alice\n", &Whois{Target: "alice"}, &Whois{}},
+		{"whois 1 alice\n", &WhoisReply{ID: 1, Name: "alice"}, &WhoisReply{}},
+		{"whois 1 \n", &WhoisReply{ID: 1}, &WhoisReply{}},
+		{"labels\n", &Labels{}, &Labels{}},
+		{"labels region=eu,role=worker\n", &Labels{Labels: map[string]string{"role": "worker", "region": "eu"}}, &Labels{}},
+		{"labels \n", &LabelsReply{Labels: map[string]string{}}, &LabelsReply{}},
+		{"labels role=worker\n", &LabelsReply{Labels: map[string]string{"role": "worker"}}, &LabelsReply{}},
+		{"qjoin jobs\n", &QueueJoin{Group: "jobs"}, &QueueJoin{}},
+		{"qleave jobs\n", &QueueLeave{Group: "jobs"}, &QueueLeave{}},
+		{"cancel 42\n", &Cancel{MsgID: 42}, &Cancel{}},
+		{"cancel 42 ok\n", &CancelReply{MsgID: 42, Canceled: true}, &CancelReply{}},
+		{"cancel 42 unknown\n", &CancelReply{MsgID: 42}, &CancelReply{}},
+		{"mode pull\n", &Mode{Mode: ModePull}, &Mode{}},
+		{"fetch 10 5000\n", &Fetch{Max: 10, Wait: 5 * time.Second}, &Fetch{}},
+		{"fetch 2\n", &FetchReply{Count: 2}, &FetchReply{}},
+		{"credit 100 0 buffer\n", &Credit{Msgs: 100, Policy: CreditBuffer}, &Credit{}},
+		{"relayed r1 42\n", &Relayed{Ref: "r1", MsgID: 42}, &Relayed{}},
+		{"expired 42 2\n", &Expired{MsgID: 42, ReceiverID: 2}, &Expired{}},
+		{"rejected 42 3\n", &Rejected{MsgID: 42, ReceiverID: 3}, &Rejected{}},
+		{"denied 42 2,4\n", &Denied{MsgID: 42, Receivers: "2,4"}, &Denied{}},
+		{"denied 42 @jobs\n", &Denied{MsgID: 42, Receivers: "@jobs"}, &Denied{}},
+		{"timeout 3 2,4\n", &Timeout{CorrelationID: "3", ReceiverIDs: []uint64{2, 4}}, &Timeout{}},
+		{"timeout 3 \n", &Timeout{CorrelationID: "3"}, &Timeout{}},
+		{"noresponder 3\n", &NoResponder{CorrelationID: "3"}, &NoResponder{}},
+		{"unreachable 3 2\n", &Unreachable{CorrelationID: "3", ReceiverIDs: []uint64{2}}, &Unreachable{}},
+		{"busy max clients\n", &Busy{Reason: "max clients"}, &Busy{}},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(strings.TrimSpace(tc.encoded), func(t *testing.T) {
+			var buf bytes.Buffer
+			require.NoError(t, tc.msg.Encode(&buf))
+			assert.Equal(t, tc.encoded, buf.String())
+
+			// a message followed by another one is read up to its end
+			buf.WriteString("ack 1\n")
+			r := bufio.NewReader(&buf)
+			require.NoError(t, tc.decoded.Decode(r))
+			assert.Equal(t, tc.msg, tc.decoded)
+			rest, err := r.ReadString('\n')
+			require.NoError(t, err)
+			assert.Equal(t, "ack 1\n", rest)
+		})
+	}
+}
+
+func TestMessageDecodeErrors(t *testing.T) {
+	tcs := []struct {
+		encoded string
+		msg     Message
+	}{
+		{"identity 1\n", &Identity{}},
+		{"identity\n", &IdentityReply{}},
+		{"identity -1\n", &IdentityReply{}},
+		{"whois 1 alice\n", &IdentityReply{}},
+		{"list 1,\n", &ListReply{}},
+		{"list 1:\n", &ListReply{}},
+		{"list a\n", &ListReply{}},
+		{"relay 2\n", &Relay{}},
+		{"relay 2 -1\nx", &Relay{}},
+		{"relay 2 18446744073709551616\n", &Relay{}},
+		{"relay 2 1 qos\nx", &Relay{}},
+		{"relay alice 1\nx", &Delivery{}},
+		{"ack\n", &Ack{}},
+		{"ackx 1\n", &Ack{}},
+		{"whois 1\n", &WhoisReply{}},
+		{"whois alice bob\n", &WhoisReply{}},
+		{"labels a\n", &LabelsReply{}},
+		{"cancel\n", &Cancel{}},
+		{"cancel 42 maybe\n", &CancelReply{}},
+		{"fetch 10\n", &Fetch{}},
+		{"fetch 10 soon\n", &Fetch{}},
+		{"fetch -1\n", &FetchReply{}},
+		{"credit 1 0\n", &Credit{}},
+		{"credit x 0 buffer\n", &Credit{}},
+		{"relayed 42\n", &Relayed{}},
+		{"expired 42\n", &Expired{}},
+		{"rejected 42 x\n", &Rejected{}},
+		{"denied 42\n", &Denied{}},
+		{"timeout\n", &Timeout{}},
+		{"timeout 3 2 4\n", &Timeout{}},
+		{"noresponder\n", &NoResponder{}},
+		{"unreachable 3 2,\n", &Unreachable{}},
+	}
+
+	for _, tc := range tcs {
+		assert.Equal(t, ErrInvalidMessage, tc.msg.Decode(bufio.NewReader(strings.NewReader(tc.encoded))), tc.encoded)
+	}
+
+	// invalid labels fail as such, "labels \n" sets no labels
+	var labels Labels
+	assert.Equal(t, ErrInvalidLabel, labels.DecodeLine("labels a\n"))
+	assert.Equal(t, ErrInvalidLabel, labels.DecodeLine("labels \n"))
+
+	// a timeout may leave out the receivers
+	var timeout Timeout
+	require.NoError(t, timeout.DecodeLine("timeout 3\n"))
+	assert.Equal(t, Timeout{CorrelationID: "3"}, timeout)
+
+	// a list with an unknown argument asks for the IDs alone
+	list := List{Names: true}
+	require.NoError(t, list.DecodeLine("list all\n"))
+	assert.Equal(t, List{}, list)
+
+	// a body shorter than its size
+	var relay Relay
+	assert.Equal(t, io.ErrUnexpectedEOF, relay.Decode(bufio.NewReader(strings.NewReader("relay 2 5\nhi"))))
+
+	// bodies over the size limit are not read
+	assert.Equal(t, ErrBodyTooLarge, relay.Decode(bufio.NewReader(strings.NewReader("relay 2 2147483648\n"))))
+	assert.Equal(t, ErrBodyTooLarge, relay.DecodeLimit(bufio.NewReader(strings.NewReader("relay 2 5\nhello")), 4))
+	_, err := relay.DecodeHeader("relay 2 5\n", 4)
+	assert.Equal(t, ErrBodyTooLarge, err)
+	var delivery Delivery
+	assert.Equal(t, ErrBodyTooLarge, delivery.DecodeLimit(bufio.NewReader(strings.NewReader("relay 1 5 id=9\nhello")), 4))
+	assert.NoError(t, delivery.DecodeLimit(bufio.NewReader(strings.NewReader("relay 1 5 id=9\nhello")), 5))
+
+	// error replies of server are returned as errors
+	var reply IdentityReply
+	err = reply.Decode(bufio.NewReader(strings.NewReader("error too many clients\n")))
+	require.Error(t, err)
+	assert.Equal(t, "too many clients", err.Error())
+	err = reply.Decode(bufio.NewReader(strings.NewReader("busy max clients\n")))
+	require.Error(t, err)
+	assert.Equal(t, "busy max clients", err.Error())
+}
+
+func TestMessageEncodeErrors(t *testing.T) {
+	var buf bytes.Buffer
+	for _, msg := range []Message{
+		&Relay{},
+		&Relay{Receivers: "2 3"},
+		&Relay{Receivers: "2", Fields: map[string]string{"k": "a b"}},
+		&Relay{Receivers: "2", Fields: map[string]string{"k=v": "a"}},
+		&Delivery{Fields: map[string]string{"": "a"}},
+		&ListReply{Clients: []ListEntry{{ID: 1, Name: "a,b"}}},
+		&Error{Text: "a\nb"},
+		&Nick{},
+		&Nick{Name: "a b"},
+		&Whois{},
+		&WhoisReply{Name: "a b"},
+		&Labels{Labels: map[string]string{"a b": "c"}},
+		&LabelsReply{Labels: map[string]string{"a": ""}},
+		&QueueJoin{},
+		&QueueLeave{Group: "a b"},
+		&Mode{},
+		&Credit{},
+		&Relayed{MsgID: 1},
+		&Denied{MsgID: 1},
+		&Timeout{},
+		&NoResponder{CorrelationID: "a b"},
+		&Unreachable{},
+		&Busy{Reason: "a\nb"},
+	} {
+		assert.Equal(t, ErrInvalidMessage, msg.Encode(&buf), "%+v", msg)
+	}
+	assert.Zero(t, buf.Len())
+}
+
+func TestPeekType(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("identity\nrelay 1 2\nhilist \n" + strings.Repeat("x", 20) + "\n"))
+	for _, expected := range []string{IdentityType, RelayType} {
+		typ, err := PeekType(r)
+		require.NoError(t, err)
+		assert.Equal(t, expected, typ)
+		if typ == RelayType {
+			var d Delivery
+			require.NoError(t, d.Decode(r))
+			continue
+		}
+		_, err = r.ReadString('\n')
+		require.NoError(t, err)
+	}
+
+	typ, err := PeekType(r)
+	require.NoError(t, err)
+	assert.Equal(t, ListType, typ)
+	_, err = r.ReadString('\n')
+	require.NoError(t, err)
+
+	// unknown types are cut
+	typ, err = PeekType(r)
+	require.NoError(t, err)
+	assert.Equal(t, strings.Repeat("x", maxTypeLen), typ)
+	_, err = r.ReadString('\n')
+	require.NoError(t, err)
+
+	_, err = PeekType(r)
+	assert.Equal(t, io.EOF, err)
+}
+
+func FuzzRelayDecode(f *testing.F) {
+	for _, seed := range []string{"relay 2,3 5\nhello", "relay @jobs 0 pick=rr qos=1\n", "relay 1 5 id=9\nhello", "relay 2 -1\n"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, in string) {
+		var relay Relay
+		if relay.Decode(bufio.NewReader(strings.NewReader(in))) == nil {
+			// a decoded relay encodes to a relay decoding to itself
+			var buf bytes.Buffer
+			require.NoError(t, relay.Encode(&buf))
+			var again Relay
+			require.NoError(t, again.Decode(bufio.NewReader(&buf)))
+			require.Equal(t, relay, again)
+		}
+
+		var delivery Delivery
+		if delivery.Decode(bufio.NewReader(strings.NewReader(in))) == nil {
+			var buf bytes.Buffer
+			require.NoError(t, delivery.Encode(&buf))
+			var again Delivery
+			require.NoError(t, again.Decode(bufio.NewReader(&buf)))
+			require.Equal(t, delivery, again)
+		}
+	})
+}
+
+func FuzzListReply(f *testing.F) {
+	for _, seed := range []string{"list \n", "list 1,2\n", "list 1:alice,3\n", "list 1:\n"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, in string) {
+		var reply ListReply
+		if reply.Decode(bufio.NewReader(strings.NewReader(in))) != nil {
+			return
+		}
+		var again ListReply
+		require.NoError(t, again.DecodeLine(string(reply.AppendTo(nil))))
+		require.Equal(t, reply, again)
+	})
+}
+
+// lineMessage is a message encoded as a single line
+type lineMessage interface {
+	AppendTo(dst []byte) []byte
+	DecodeLine(line string) error
+}
+
+func FuzzLineMessages(f *testing.F) {
+	for _, seed := range []string{"whois 1 alice\n", "labels a=b\n", "cancel 42 ok\n", "fetch 10 5000\n",
+		"credit 100 0 buffer\n", "relayed r1 42\n", "denied 42 @jobs\n", "timeout 3 2,4\n", "unreachable 3 \n"} {
+		f.Add(seed)
+	}
+	messages := []func() lineMessage{
+		func() lineMessage { return &WhoisReply{} },
+		func() lineMessage { return &LabelsReply{} },
+		func() lineMessage { return &CancelReply{} },
+		func() lineMessage { return &Fetch{} },
+		func() lineMessage { return &FetchReply{} },
+		func() lineMessage { return &Credit{} },
+		func() lineMessage { return &Relayed{} },
+		func() lineMessage { return &Expired{} },
+		func() lineMessage { return &Denied{} },
+		func() lineMessage { return &Timeout{} },
+		func() lineMessage { return &Unreachable{} },
+	}
+	f.Fuzz(func(t *testing.T, in string) {
+		if strings.Count(in, "\n") > 1 {
+			return
+		}
+		for _, newMessage := range messages {
+			msg := newMessage()
+			if msg.DecodeLine(in) != nil {
+				continue
+			}
+			// a decoded message encodes to a message decoding to itself
+			again := newMessage()
+			require.NoError(t, again.DecodeLine(string(msg.AppendTo(nil))))
+			require.Equal(t, msg, again)
+		}
+	})
+}
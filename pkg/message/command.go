@@ -0,0 +1,505 @@
+package message
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Nick registers a nickname for the client, "nick alice\n", server answers with the same message
+type Nick struct {
+	Name string
+}
+
+// AppendTo appends the encoded message to dst
+func (m Nick) AppendTo(dst []byte) []byte {
+	return appendArg(dst, NickType, m.Name)
+}
+
+// Encode writes the message to w, it fails for a name which cannot be sent
+func (m Nick) Encode(w io.Writer) error {
+	if m.Name == "" || hasSpace(m.Name) {
+		return ErrInvalidMessage
+	}
+	return write(w, m.AppendTo(nil))
+}
+
+// Decode reads the message from r
+func (m *Nick) Decode(r *bufio.Reader) error {
+	return decodeLine(r, m.DecodeLine)
+}
+
+// DecodeLine decodes the message from its line, the name is checked by server
+func (m *Nick) DecodeLine(line string) error {
+	args, err := argumentsOf(line, NickType)
+	m.Name = args
+	return err
+}
+
+// Whois looks up a client by ID or nickname, "whois alice\n"
+type Whois struct {
+	Target string
+}
+
+// AppendTo appends the encoded message to dst
+func (m Whois) AppendTo(dst []byte) []byte {
+	return appendArg(dst, WhoisType, m.Target)
+}
+
+// Encode writes the message to w, it fails for a target which cannot be sent
+func (m Whois) Encode(w io.Writer) error {
+	if m.Target == "" || hasSpace(m.Target) {
+		return ErrInvalidMessage
+	}
+	return write(w, m.AppendTo(nil))
+}
+
+// Decode reads the message from r
+func (m *Whois) Decode(r *bufio.Reader) error {
+	return decodeLine(r, m.DecodeLine)
+}
+
+// DecodeLine decodes the message from its line
+func (m *Whois) DecodeLine(line string) error {
+	args, err := argumentsOf(line, WhoisType)
+	m.Target = args
+	return err
+}
+
+// WhoisReply holds the client looked up by Whois, "whois 1 alice\n" or "whois 1 \n" without nickname
+type WhoisReply struct {
+	ID   uint64
+	Name string
+}
+
+// AppendTo appends the encoded message to dst
+func (m WhoisReply) AppendTo(dst []byte) []byte {
+	dst = append(dst, WhoisType...)
+	dst = append(dst, ' ')
+	dst = strconv.AppendUint(dst, m.ID, 10)
+	dst = append(dst, ' ')
+	dst = append(dst, m.Name...)
+	return append(dst, '\n')
+}
+
+// Encode writes the message to w, it fails for a name which cannot be sent
+func (m WhoisReply) Encode(w io.Writer) error {
+	if hasSpace(m.Name) {
+		return ErrInvalidMessage
+	}
+	return write(w, m.AppendTo(nil))
+}
+
+// Decode reads the message from r
+func (m *WhoisReply) Decode(r *bufio.Reader) error {
+	return decodeLine(r, m.DecodeLine)
+}
+
+// DecodeLine decodes the message from its line
+func (m *WhoisReply) DecodeLine(line string) error {
+	args, err := argumentsOf(line, WhoisType)
+	if err != nil {
+		return err
+	}
+	parts := strings.Split(args, " ")
+	if len(parts) != 2 {
+		return ErrInvalidMessage
+	}
+	if m.ID, err = parseID(parts[0]); err != nil {
+		return err
+	}
+	m.Name = parts[1]
+	return nil
+}
+
+// Labels sets the labels of the client, "labels region=eu,role=worker\n".
+// Without labels it asks for the current ones, "labels\n". Server answers with a LabelsReply.
+type Labels struct {
+	Labels map[string]string
+}
+
+// AppendTo appends the encoded message to dst
+func (m Labels) AppendTo(dst []byte) []byte {
+	if len(m.Labels) == 0 {
+		return append(append(dst, LabelsType...), '\n')
+	}
+	return appendArg(dst, LabelsType, FormatLabels(m.Labels))
+}
+
+// Encode writes the message to w, it fails for labels which cannot be sent
+func (m Labels) Encode(w io.Writer) error {
+	if !validLabels(m.Labels) {
+		return ErrInvalidMessage
+	}
+	return write(w, m.AppendTo(nil))
+}
+
+// Decode reads the message from r
+func (m *Labels) Decode(r *bufio.Reader) error {
+	return decodeLine(r, m.DecodeLine)
+}
+
+// DecodeLine decodes the message from its line, it fails with ErrInvalidLabel for invalid labels
+func (m *Labels) DecodeLine(line string) error {
+	args, err := argumentsOf(line, LabelsType)
+	if err != nil {
+		return err
+	}
+	m.Labels = nil
+	// "labels \n" sets an empty list of labels, which is invalid
+	if args != "" || strings.TrimSuffix(line, "\n") != LabelsType {
+		m.Labels, err = ParseLabels(args)
+	}
+	return err
+}
+
+// LabelsReply holds the labels of the client, "labels region=eu,role=worker\n" or "labels \n" for none
+type LabelsReply struct {
+	Labels map[string]string
+}
+
+// AppendTo appends the encoded message to dst
+func (m LabelsReply) AppendTo(dst []byte) []byte {
+	return appendArg(dst, LabelsType, FormatLabels(m.Labels))
+}
+
+// Encode writes the message to w, it fails for labels which cannot be sent
+func (m LabelsReply) Encode(w io.Writer) error {
+	if !validLabels(m.Labels) {
+		return ErrInvalidMessage
+	}
+	return write(w, m.AppendTo(nil))
+}
+
+// Decode reads the message from r
+func (m *LabelsReply) Decode(r *bufio.Reader) error {
+	return decodeLine(r, m.DecodeLine)
+}
+
+// DecodeLine decodes the message from its line
+func (m *LabelsReply) DecodeLine(line string) error {
+	args, err := argumentsOf(line, LabelsType)
+	if err != nil {
+		return err
+	}
+	m.Labels = map[string]string{}
+	if args != "" {
+		if m.Labels, err = ParseLabels(args); err != nil {
+			return ErrInvalidMessage
+		}
+	}
+	return nil
+}
+
+// validLabels reports whether labels can be sent as "k1=v1,k2=v2"
+func validLabels(labels map[string]string) bool {
+	if len(labels) > MaxLabels {
+		return false
+	}
+	for k, v := range labels {
+		if !validLabel(k) || !validLabel(v) {
+			return false
+		}
+	}
+	return true
+}
+
+// QueueJoin makes the client a member of a queue group, "qjoin jobs\n", server answers with the same message
+type QueueJoin struct {
+	Group string
+}
+
+// AppendTo appends the encoded message to dst
+func (m QueueJoin) AppendTo(dst []byte) []byte {
+	return appendArg(dst, QueueJoinType, m.Group)
+}
+
+// Encode writes the message to w, it fails for a group which cannot be sent
+func (m QueueJoin) Encode(w io.Writer) error {
+	if m.Group == "" || hasSpace(m.Group) {
+		return ErrInvalidMessage
+	}
+	return write(w, m.AppendTo(nil))
+}
+
+// Decode reads the message from r
+func (m *QueueJoin) Decode(r *bufio.Reader) error {
+	return decodeLine(r, m.DecodeLine)
+}
+
+// DecodeLine decodes the message from its line, the group is checked by server
+func (m *QueueJoin) DecodeLine(line string) error {
+	args, err := argumentsOf(line, QueueJoinType)
+	m.Group = args
+	return err
+}
+
+// QueueLeave stops queue group deliveries to the client, "qleave jobs\n", server answers with the same message
+type QueueLeave struct {
+	Group string
+}
+
+// AppendTo appends the encoded message to dst
+func (m QueueLeave) AppendTo(dst []byte) []byte {
+	return appendArg(dst, QueueLeaveType, m.Group)
+}
+
+// Encode writes the message to w, it fails for a group which cannot be sent
+func (m QueueLeave) Encode(w io.Writer) error {
+	if m.Group == "" || hasSpace(m.Group) {
+		return ErrInvalidMessage
+	}
+	return write(w, m.AppendTo(nil))
+}
+
+// Decode reads the message from r
+func (m *QueueLeave) Decode(r *bufio.Reader) error {
+	return decodeLine(r, m.DecodeLine)
+}
+
+// DecodeLine decodes the message from its line
+func (m *QueueLeave) DecodeLine(line string) error {
+	args, err := argumentsOf(line, QueueLeaveType)
+	m.Group = args
+	return err
+}
+
+// Cancel drops a scheduled relay before it is due, "cancel 42\n"
+type Cancel struct {
+	MsgID uint64
+}
+
+// AppendTo appends the encoded message to dst
+func (m Cancel) AppendTo(dst []byte) []byte {
+	return appendArg(dst, CancelType, strconv.FormatUint(m.MsgID, 10))
+}
+
+// Encode writes the message to w
+func (m Cancel) Encode(w io.Writer) error {
+	return write(w, m.AppendTo(nil))
+}
+
+// Decode reads the message from r
+func (m *Cancel) Decode(r *bufio.Reader) error {
+	return decodeLine(r, m.DecodeLine)
+}
+
+// DecodeLine decodes the message from its line
+func (m *Cancel) DecodeLine(line string) error {
+	args, err := argumentsOf(line, CancelType)
+	if err != nil {
+		return err
+	}
+	m.MsgID, err = parseID(args)
+	return err
+}
+
+// CancelReply answers a Cancel, "cancel 42 ok\n" or "cancel 42 unknown\n"
+type CancelReply struct {
+	MsgID    uint64
+	Canceled bool
+}
+
+// AppendTo appends the encoded message to dst
+func (m CancelReply) AppendTo(dst []byte) []byte {
+	result := CancelUnknown
+	if m.Canceled {
+		result = CancelOK
+	}
+	return appendArg(dst, CancelType, strconv.FormatUint(m.MsgID, 10)+" "+result)
+}
+
+// Encode writes the message to w
+func (m CancelReply) Encode(w io.Writer) error {
+	return write(w, m.AppendTo(nil))
+}
+
+// Decode reads the message from r
+func (m *CancelReply) Decode(r *bufio.Reader) error {
+	return decodeLine(r, m.DecodeLine)
+}
+
+// DecodeLine decodes the message from its line
+func (m *CancelReply) DecodeLine(line string) error {
+	args, err := argumentsOf(line, CancelType)
+	if err != nil {
+		return err
+	}
+	parts := strings.Split(args, " ")
+	if len(parts) != 2 || (parts[1] != CancelOK && parts[1] != CancelUnknown) {
+		return ErrInvalidMessage
+	}
+	if m.MsgID, err = parseID(parts[0]); err != nil {
+		return err
+	}
+	m.Canceled = parts[1] == CancelOK
+	return nil
+}
+
+// Mode switches between push and pull delivery, "mode pull\n", server answers with the same message
+type Mode struct {
+	Mode string
+}
+
+// AppendTo appends the encoded message to dst
+func (m Mode) AppendTo(dst []byte) []byte {
+	return appendArg(dst, ModeType, m.Mode)
+}
+
+// Encode writes the message to w, it fails for a mode which cannot be sent
+func (m Mode) Encode(w io.Writer) error {
+	if m.Mode == "" || hasSpace(m.Mode) {
+		return ErrInvalidMessage
+	}
+	return write(w, m.AppendTo(nil))
+}
+
+// Decode reads the message from r
+func (m *Mode) Decode(r *bufio.Reader) error {
+	return decodeLine(r, m.DecodeLine)
+}
+
+// DecodeLine decodes the message from its line, the mode is checked by server
+func (m *Mode) DecodeLine(line string) error {
+	args, err := argumentsOf(line, ModeType)
+	m.Mode = args
+	return err
+}
+
+// Fetch reads up to Max messages of a pull mode inbox, waiting up to Wait for the first one,
+// "fetch 10 5000\n" with Wait in milliseconds
+type Fetch struct {
+	Max  int
+	Wait time.Duration
+}
+
+// AppendTo appends the encoded message to dst
+func (m Fetch) AppendTo(dst []byte) []byte {
+	dst = append(dst, FetchType...)
+	dst = append(dst, ' ')
+	dst = strconv.AppendInt(dst, int64(m.Max), 10)
+	dst = append(dst, ' ')
+	dst = strconv.AppendInt(dst, int64(m.Wait/time.Millisecond), 10)
+	return append(dst, '\n')
+}
+
+// Encode writes the message to w
+func (m Fetch) Encode(w io.Writer) error {
+	return write(w, m.AppendTo(nil))
+}
+
+// Decode reads the message from r
+func (m *Fetch) Decode(r *bufio.Reader) error {
+	return decodeLine(r, m.DecodeLine)
+}
+
+// DecodeLine decodes the message from its line, the limits are checked by server
+func (m *Fetch) DecodeLine(line string) error {
+	args, err := argumentsOf(line, FetchType)
+	if err != nil {
+		return err
+	}
+	parts := strings.Split(args, " ")
+	if len(parts) != 2 {
+		return ErrInvalidMessage
+	}
+	max, err := parseInt(parts[0], 32)
+	if err != nil {
+		return err
+	}
+	waitMs, err := parseInt(parts[1], 32)
+	if err != nil {
+		return err
+	}
+	m.Max, m.Wait = int(max), time.Duration(waitMs)*time.Millisecond
+	return nil
+}
+
+// FetchReply answers a Fetch with the count of relay frames following it, "fetch 2\n"
+type FetchReply struct {
+	Count int
+}
+
+// AppendTo appends the encoded message to dst
+func (m FetchReply) AppendTo(dst []byte) []byte {
+	return appendArg(dst, FetchType, strconv.Itoa(m.Count))
+}
+
+// Encode writes the message to w
+func (m FetchReply) Encode(w io.Writer) error {
+	return write(w, m.AppendTo(nil))
+}
+
+// Decode reads the message from r, the frames following it are read with Delivery
+func (m *FetchReply) Decode(r *bufio.Reader) error {
+	return decodeLine(r, m.DecodeLine)
+}
+
+// DecodeLine decodes the message from its line
+func (m *FetchReply) DecodeLine(line string) error {
+	args, err := argumentsOf(line, FetchType)
+	if err != nil {
+		return err
+	}
+	count, err := parseInt(args, 32)
+	if err != nil || count < 0 {
+		return ErrInvalidMessage
+	}
+	m.Count = int(count)
+	return nil
+}
+
+// Credit grants the server credit to deliver messages and bytes, zero for no limit,
+// with Policy CreditBuffer or CreditReject for messages beyond it, "credit 100 0 buffer\n". It is not answered.
+type Credit struct {
+	Msgs   int64
+	Bytes  int64
+	Policy string
+}
+
+// AppendTo appends the encoded message to dst
+func (m Credit) AppendTo(dst []byte) []byte {
+	dst = append(dst, CreditType...)
+	dst = append(dst, ' ')
+	dst = strconv.AppendInt(dst, m.Msgs, 10)
+	dst = append(dst, ' ')
+	dst = strconv.AppendInt(dst, m.Bytes, 10)
+	dst = append(dst, ' ')
+	dst = append(dst, m.Policy...)
+	return append(dst, '\n')
+}
+
+// Encode writes the message to w, it fails for a policy which cannot be sent
+func (m Credit) Encode(w io.Writer) error {
+	if m.Policy == "" || hasSpace(m.Policy) {
+		return ErrInvalidMessage
+	}
+	return write(w, m.AppendTo(nil))
+}
+
+// Decode reads the message from r
+func (m *Credit) Decode(r *bufio.Reader) error {
+	return decodeLine(r, m.DecodeLine)
+}
+
+// DecodeLine decodes the message from its line, the credit is checked by server
+func (m *Credit) DecodeLine(line string) error {
+	args, err := argumentsOf(line, CreditType)
+	if err != nil {
+		return err
+	}
+	parts := strings.Split(args, " ")
+	if len(parts) != 3 {
+		return ErrInvalidMessage
+	}
+	if m.Msgs, err = parseInt(parts[0], 64); err != nil {
+		return err
+	}
+	if m.Bytes, err = parseInt(parts[1], 64); err != nil {
+		return err
+	}
+	m.Policy = parts[2]
+	return nil
+}
@@ -0,0 +1,117 @@
+package message
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+// Relay fields are optional "key=value" tokens following the size of a relay,
+// e.g. "relay @jobs 5 pick=hash key=user42\nhello"
+const (
+	// FieldID carries the server assigned message ID
+	FieldID = "id"
+	// FieldAck marks a message the receiver must ack
+	FieldAck = "ack"
+	// FieldQoS set to 1 asks for at-least-once delivery
+	FieldQoS = "qos"
+	// FieldCorr carries the correlation ID of a request and its response
+	FieldCorr = "corr"
+	// FieldReplyTo carries the client ID a request is answered to
+	FieldReplyTo = "replyto"
+	// FieldResp set to 1 marks a response to a request
+	FieldResp = "resp"
+	// FieldTimeout carries how many milliseconds a requester waits for responses
+	FieldTimeout = "timeout"
+	// FieldError set to 1 marks a response whose body is an error message
+	FieldError = "error"
+	// FieldTTL carries how many milliseconds a message may wait for delivery
+	FieldTTL = "ttl"
+	// FieldNotify asks for notices about the message, see NotifyExpired
+	FieldNotify = "notify"
+	// FieldRef asks server to answer the relay with its message ID, see RelayedFmt
+	FieldRef = "ref"
+	// FieldDelay carries how many milliseconds the hub waits before delivering the message
+	FieldDelay = "delay"
+	// FieldAt carries when the hub delivers the message, in unix milliseconds
+	FieldAt = "at"
+	// FieldPriority selects the outbound lane of the message, see PriorityHigh
+	FieldPriority = "prio"
+	// FieldGroup carries the queue group a message was delivered through
+	FieldGroup = "group"
+	// FieldPick selects how a queue group member is picked
+	FieldPick = "pick"
+	// FieldKey is the key hashed by the hash pick strategy
+	FieldKey = "key"
+	// FieldRedelivered marks a message delivered more than once
+	FieldRedelivered = "redelivered"
+)
+
+// Queue group pick strategies
+const (
+	PickRoundRobin  = "rr"
+	PickLeastLoaded = "least"
+	PickHash        = "hash"
+)
+
+// Message priorities, receivers get higher priority messages first
+const (
+	PriorityHigh   = "high"
+	PriorityNormal = "normal"
+	PriorityBulk   = "bulk"
+)
+
+// NotifyExpired asks for an expired notice when the message TTL passes before delivery
+const NotifyExpired = "expired"
+
+// QueuePrefix marks a relay receiver as a queue group, e.g. "@jobs"
+const QueuePrefix = "@"
+
+// ErrInvalidField is returned for malformed relay fields
+var ErrInvalidField = errors.New("invalid field")
+
+// ParseFields parses "key=value" tokens
+func ParseFields(tokens []string) (map[string]string, error) {
+	fields := make(map[string]string, len(tokens))
+	for _, token := range tokens {
+		kv := strings.SplitN(token, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, ErrInvalidField
+		}
+		fields[kv[0]] = kv[1]
+	}
+	return fields, nil
+}
+
+// FormatFields formats fields as " key=value" tokens sorted by key,
+// so the result can be appended right after the size of a relay
+func FormatFields(fields map[string]string) string {
+	return string(AppendFields(nil, fields))
+}
+
+// AppendFields appends fields to dst as FormatFields formats them
+func AppendFields(dst []byte, fields map[string]string) []byte {
+	var buf [8]string
+	keys := buf[:0]
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	if len(keys) > len(buf) {
+		sort.Strings(keys)
+	} else {
+		// relays carry a few fields, insertion sort does not allocate
+		for i := 1; i < len(keys); i++ {
+			for j := i; j > 0 && keys[j] < keys[j-1]; j-- {
+				keys[j], keys[j-1] = keys[j-1], keys[j]
+			}
+		}
+	}
+
+	for _, k := range keys {
+		dst = append(dst, ' ')
+		dst = append(dst, k...)
+		dst = append(dst, '=')
+		dst = append(dst, fields[k]...)
+	}
+	return dst
+}
@@ -0,0 +1,39 @@
+package message
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseFields(t *testing.T) {
+	fields, err := ParseFields([]string{"pick=hash", "key=a=b"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"pick": "hash", "key": "a=b"}, fields)
+	assert.Equal(t, " key=a=b pick=hash", FormatFields(fields))
+
+	_, err = ParseFields([]string{"pick"})
+	assert.Error(t, err)
+
+	_, err = ParseFields([]string{"=hash"})
+	assert.Error(t, err)
+
+	assert.Equal(t, "", FormatFields(nil))
+}
+
+func TestAppendFields(t *testing.T) {
+	fields := map[string]string{}
+	for i := 0; i < 12; i++ {
+		fields[string(rune('l'-i))] = "v"
+	}
+	assert.Equal(t, " a=v b=v c=v d=v e=v f=v g=v h=v i=v j=v k=v l=v", string(AppendFields(nil, fields)))
+	assert.Equal(t, "relay 1 2 id=3 qos=1", string(AppendFields([]byte("relay 1 2"), map[string]string{"qos": "1", "id": "3"})))
+
+	// a few fields are appended without allocating
+	fields = map[string]string{"id": "3", "corr": "1", "resp": "1"}
+	dst := make([]byte, 0, 64)
+	assert.Zero(t, testing.AllocsPerRun(10, func() {
+		AppendFields(dst[:0], fields)
+	}))
+}
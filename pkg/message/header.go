@@ -0,0 +1,81 @@
+package message
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+)
+
+// Application headers travel as relay fields prefixed by HeaderPrefix with
+// query-escaped values, e.g. "relay 2 5 h.trace=abc%20d\nhello".
+const (
+	// HeaderPrefix marks a relay field as an application header
+	HeaderPrefix = "h."
+	// MaxHeaders is the maximum number of headers per relay
+	MaxHeaders = 32
+	// MaxHeaderBytes is the maximum encoded size of all headers of a relay
+	MaxHeaderBytes = 4096
+)
+
+var (
+	// ErrTooManyHeaders is returned when a relay has more than MaxHeaders headers
+	ErrTooManyHeaders = errors.New("too many headers")
+	// ErrHeadersTooLarge is returned when headers of a relay exceed MaxHeaderBytes
+	ErrHeadersTooLarge = errors.New("headers too large")
+	// ErrInvalidHeader is returned for a header key which cannot be sent
+	ErrInvalidHeader = errors.New("invalid header")
+)
+
+// IsHeader reports whether field key is an application header
+func IsHeader(key string) bool {
+	return strings.HasPrefix(key, HeaderPrefix)
+}
+
+// AddHeaders encodes headers into relay fields
+func AddHeaders(fields map[string]string, headers map[string]string) error {
+	for k, v := range headers {
+		if k == "" || strings.ContainsAny(k, " =\n") {
+			return ErrInvalidHeader
+		}
+		fields[HeaderPrefix+k] = url.QueryEscape(v)
+	}
+	return nil
+}
+
+// Headers decodes the application headers of relay fields, nil when there is none
+func Headers(fields map[string]string) (map[string]string, error) {
+	var headers map[string]string
+	for k, v := range fields {
+		if !IsHeader(k) {
+			continue
+		}
+		value, err := url.QueryUnescape(v)
+		if err != nil {
+			return nil, ErrInvalidHeader
+		}
+		if headers == nil {
+			headers = make(map[string]string)
+		}
+		headers[k[len(HeaderPrefix):]] = value
+	}
+	return headers, nil
+}
+
+// CheckHeaders checks the application headers of relay fields against the limits
+func CheckHeaders(fields map[string]string) error {
+	count, size := 0, 0
+	for k, v := range fields {
+		if !IsHeader(k) {
+			continue
+		}
+		count++
+		size += len(k) + len(v) + 2
+	}
+	if count > MaxHeaders {
+		return ErrTooManyHeaders
+	}
+	if size > MaxHeaderBytes {
+		return ErrHeadersTooLarge
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package message
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHeaders(t *testing.T) {
+	fields := map[string]string{FieldID: "1"}
+	require.NoError(t, AddHeaders(fields, map[string]string{"trace": "a b", "type": "application/json"}))
+	assert.Equal(t, " h.trace=a+b h.type=application%2Fjson id=1", FormatFields(fields))
+
+	headers, err := Headers(fields)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"trace": "a b", "type": "application/json"}, headers)
+
+	headers, err = Headers(map[string]string{FieldID: "1"})
+	require.NoError(t, err)
+	assert.Nil(t, headers)
+
+	_, err = Headers(map[string]string{"h.trace": "%zz"})
+	assert.Equal(t, ErrInvalidHeader, err)
+
+	assert.Equal(t, ErrInvalidHeader, AddHeaders(fields, map[string]string{"a=b": "c"}))
+}
+
+func TestCheckHeaders(t *testing.T) {
+	fields := map[string]string{}
+	for i := 0; i < MaxHeaders; i++ {
+		fields[HeaderPrefix+strconv.Itoa(i)] = "v"
+	}
+	assert.NoError(t, CheckHeaders(fields))
+
+	fields[HeaderPrefix+"one-more"] = "v"
+	assert.Equal(t, ErrTooManyHeaders, CheckHeaders(fields))
+
+	fields = map[string]string{HeaderPrefix + "big": strings.Repeat("v", MaxHeaderBytes)}
+	assert.Equal(t, ErrHeadersTooLarge, CheckHeaders(fields))
+}
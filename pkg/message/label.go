@@ -0,0 +1,113 @@
+package message
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+const (
+	// MaxLabels is the maximum number of labels per client
+	MaxLabels = 16
+	// MaxLabelLen is the maximum length of a label key or value
+	MaxLabelLen = 63
+)
+
+// ErrInvalidLabel is returned for malformed labels and selectors
+var ErrInvalidLabel = errors.New("invalid label")
+
+// Requirement matches clients whose label Key equals Value
+type Requirement struct {
+	Key   string
+	Value string
+}
+
+// Selector matches clients having all of its requirements
+type Selector []Requirement
+
+// IsSelector reports whether receivers is a label selector rather than a list of IDs
+func IsSelector(receivers string) bool {
+	return strings.Contains(receivers, "=")
+}
+
+// ParseLabels parses "k1=v1,k2=v2" into a map
+func ParseLabels(s string) (map[string]string, error) {
+	sel, err := ParseSelector(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(sel) > MaxLabels {
+		return nil, ErrInvalidLabel
+	}
+
+	labels := make(map[string]string, len(sel))
+	for _, req := range sel {
+		if _, ok := labels[req.Key]; ok {
+			return nil, ErrInvalidLabel
+		}
+		labels[req.Key] = req.Value
+	}
+	return labels, nil
+}
+
+// FormatLabels formats labels as "k1=v1,k2=v2" sorted by key
+func FormatLabels(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, k+"="+labels[k])
+	}
+	return strings.Join(pairs, ",")
+}
+
+// ParseSelector parses "k1=v1,k2=v2" into a selector
+func ParseSelector(s string) (Selector, error) {
+	sel := Selector{}
+	for _, pair := range strings.Split(s, ",") {
+		kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(kv) != 2 || !validLabel(kv[0]) || !validLabel(kv[1]) {
+			return nil, ErrInvalidLabel
+		}
+		sel = append(sel, Requirement{Key: kv[0], Value: kv[1]})
+	}
+	return sel, nil
+}
+
+// Matches reports whether labels satisfy every requirement of sel
+func (sel Selector) Matches(labels map[string]string) bool {
+	for _, req := range sel {
+		if v, ok := labels[req.Key]; !ok || v != req.Value {
+			return false
+		}
+	}
+	return true
+}
+
+// String formats sel as "k1=v1,k2=v2"
+func (sel Selector) String() string {
+	pairs := make([]string, 0, len(sel))
+	for _, req := range sel {
+		pairs = append(pairs, req.Key+"="+req.Value)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func validLabel(s string) bool {
+	if s == "" || len(s) > MaxLabelLen {
+		return false
+	}
+	for _, c := range s {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '_', c == '-', c == '.', c == '/':
+		default:
+			return false
+		}
+	}
+	return true
+}
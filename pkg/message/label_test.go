@@ -0,0 +1,85 @@
+package message
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSelector(t *testing.T) {
+	tcs := []struct {
+		name        string
+		in          string
+		expectedOut Selector
+		expectedErr bool
+	}{
+		{
+			name:        "empty",
+			in:          "",
+			expectedErr: true,
+		},
+		{
+			name:        "missing value",
+			in:          "role=",
+			expectedErr: true,
+		},
+		{
+			name:        "bad char",
+			in:          "role=a b",
+			expectedErr: true,
+		},
+		{
+			name:        "single",
+			in:          "role=worker",
+			expectedOut: Selector{{Key: "role", Value: "worker"}},
+		},
+		{
+			name:        "multiple",
+			in:          "role=worker,region=eu",
+			expectedOut: Selector{{Key: "role", Value: "worker"}, {Key: "region", Value: "eu"}},
+		},
+	}
+
+	for _, tc := range tcs {
+		var (
+			in          = tc.in
+			expectedOut = tc.expectedOut
+			expectedErr = tc.expectedErr
+		)
+
+		t.Run(tc.name, func(t *testing.T) {
+			out, err := ParseSelector(in)
+			if expectedErr {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, expectedOut, out)
+			assert.Equal(t, in, out.String())
+		})
+	}
+}
+
+func TestSelectorMatches(t *testing.T) {
+	sel, err := ParseSelector("role=worker,region=eu")
+	require.NoError(t, err)
+
+	assert.True(t, sel.Matches(map[string]string{"role": "worker", "region": "eu", "zone": "a"}))
+	assert.False(t, sel.Matches(map[string]string{"role": "worker"}))
+	assert.False(t, sel.Matches(map[string]string{"role": "worker", "region": "us"}))
+}
+
+func TestParseLabels(t *testing.T) {
+	labels, err := ParseLabels("role=worker,region=eu")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"role": "worker", "region": "eu"}, labels)
+	assert.Equal(t, "region=eu,role=worker", FormatLabels(labels))
+
+	_, err = ParseLabels("role=worker,role=backend")
+	assert.Error(t, err)
+
+	assert.True(t, IsSelector("role=worker"))
+	assert.False(t, IsSelector("1,alice"))
+}
@@ -5,6 +5,8 @@ const (
 	ListType = "list"
 	// ListReplyFmt stands for list command reply format
 	ListReplyFmt = "list %s\n" // "list 1,2\n"
+	// ListNamesArg asks list command to reply with id:name pairs
+	ListNamesArg = "names" // "list names\n" -> "list 1:alice,2\n"
 
 	// RelayType stands for relay command
 	RelayType = "relay"
@@ -13,4 +15,111 @@ const (
 	IdentityType = "identity"
 	// IdentityReplyFmt stands for identity command reply format
 	IdentityReplyFmt = "identity %d\n" // "identity 1\n"
+
+	// NickType stands for nick command
+	NickType = "nick"
+	// NickReplyFmt stands for nick command reply format
+	NickReplyFmt = "nick %s\n" // "nick alice\n"
+
+	// WhoisType stands for whois command
+	WhoisType = "whois"
+	// WhoisReplyFmt stands for whois command reply format
+	WhoisReplyFmt = "whois %d %s\n" // "whois 1 alice\n"
+
+	// LabelsType stands for labels command
+	LabelsType = "labels"
+	// LabelsReplyFmt stands for labels command and reply format, see Labels and LabelsReply
+	LabelsReplyFmt = "labels %s\n" // "labels region=eu,role=worker\n"
+
+	// QueueJoinType stands for joining a queue group
+	QueueJoinType = "qjoin"
+	// QueueJoinReplyFmt stands for qjoin command reply format
+	QueueJoinReplyFmt = "qjoin %s\n" // "qjoin jobs\n"
+	// QueueLeaveType stands for leaving a queue group
+	QueueLeaveType = "qleave"
+	// QueueLeaveReplyFmt stands for qleave command reply format
+	QueueLeaveReplyFmt = "qleave %s\n" // "qleave jobs\n"
+
+	// AckType stands for acknowledging a delivered message, it has no reply
+	AckType = "ack"
+	// AckFmt stands for ack command format
+	AckFmt = "ack %d\n" // "ack 42\n"
+
+	// TimeoutType notifies a requester that responses did not arrive in time
+	TimeoutType = "timeout"
+	// TimeoutFmt stands for timeout notice format, followed by the receivers that did not respond
+	TimeoutFmt = "timeout %s %s\n" // "timeout 3 2,4\n"
+	// NoResponderType notifies a requester that no receiver of its request is connected
+	NoResponderType = "noresponder"
+	// NoResponderFmt stands for noresponder notice format
+	NoResponderFmt = "noresponder %s\n" // "noresponder 3\n"
+	// UnreachableType notifies a requester that some receivers of its request are not connected
+	UnreachableType = "unreachable"
+	// UnreachableFmt stands for unreachable notice format
+	UnreachableFmt = "unreachable %s %s\n" // "unreachable 3 2,4\n"
+
+	// RelayedType answers a relay having a ref field with its message ID
+	RelayedType = "relayed"
+	// RelayedFmt stands for relayed reply format
+	RelayedFmt = "relayed %s %d\n" // "relayed 3 42\n"
+	// ExpiredType notifies a sender that its message expired before reaching a receiver
+	ExpiredType = "expired"
+	// ExpiredFmt stands for expired notice format, followed by the receiver ID
+	ExpiredFmt = "expired %d %d\n" // "expired 42 2\n"
+
+	// CancelType stands for canceling a scheduled relay
+	CancelType = "cancel"
+	// CancelFmt stands for cancel command format
+	CancelFmt = "cancel %d\n" // "cancel 42\n"
+	// CancelReplyFmt stands for cancel command reply format, see CancelOK and CancelUnknown
+	CancelReplyFmt = "cancel %d %s\n" // "cancel 42 ok\n"
+	// CancelOK answers a canceled relay
+	CancelOK = "ok"
+	// CancelUnknown answers a relay which is not scheduled, or was sent by another client
+	CancelUnknown = "unknown"
+
+	// ModeType stands for switching between push and pull delivery
+	ModeType = "mode"
+	// ModeFmt stands for mode command and reply format, see ModePush and ModePull
+	ModeFmt = "mode %s\n" // "mode pull\n"
+	// ModePush delivers messages as they come, it is the default
+	ModePush = "push"
+	// ModePull keeps messages in an inbox read with fetch
+	ModePull = "pull"
+
+	// FetchType stands for reading messages from a pull mode inbox
+	FetchType = "fetch"
+	// FetchFmt stands for fetch command format: max messages and milliseconds to wait for the first one
+	FetchFmt = "fetch %d %d\n" // "fetch 10 5000\n"
+	// FetchReplyFmt stands for fetch reply format, the count of relay frames following it
+	FetchReplyFmt = "fetch %d\n" // "fetch 2\n"
+
+	// CreditType stands for granting credit to receive messages, it is not answered
+	CreditType = "credit"
+	// CreditFmt stands for credit command format: messages, bytes and CreditBuffer or CreditReject
+	CreditFmt = "credit %d %d %s\n" // "credit 100 0 buffer\n"
+	// CreditBuffer keeps messages beyond the credit of a receiver until it grants more
+	CreditBuffer = "buffer"
+	// CreditReject drops messages beyond the credit of a receiver, see RejectedFmt
+	CreditReject = "reject"
+
+	// RejectedType stands for a message dropped as the receiver was out of credit
+	RejectedType = "rejected"
+	// RejectedFmt stands for rejected notice format: message ID and receiver ID
+	RejectedFmt = "rejected %d %d\n" // "rejected 42 3\n"
+
+	// DeniedType notifies a sender that the policy of the hub denied some receivers of its message
+	DeniedType = "denied"
+	// DeniedFmt stands for denied notice format: message ID and the receivers denied, IDs or a queue group
+	DeniedFmt = "denied %d %s\n" // "denied 42 2,4\n"
+
+	// BusyType notifies a connection the server turns away before closing it
+	BusyType = "busy"
+	// BusyFmt stands for busy notice format, followed by the reason
+	BusyFmt = "busy %s\n" // "busy max clients\n"
+
+	// ErrorType stands for error reply
+	ErrorType = "error"
+	// ErrorReplyFmt stands for error reply format
+	ErrorReplyFmt = "error %s\n" // "error name already taken\n"
 )
@@ -0,0 +1,352 @@
+package message
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Relayed answers a relay having a ref field with its message ID, "relayed 3 42\n"
+type Relayed struct {
+	Ref   string
+	MsgID uint64
+}
+
+// AppendTo appends the encoded message to dst
+func (m Relayed) AppendTo(dst []byte) []byte {
+	dst = append(dst, RelayedType...)
+	dst = append(dst, ' ')
+	dst = append(dst, m.Ref...)
+	dst = append(dst, ' ')
+	dst = strconv.AppendUint(dst, m.MsgID, 10)
+	return append(dst, '\n')
+}
+
+// Encode writes the message to w, it fails for a ref which cannot be sent
+func (m Relayed) Encode(w io.Writer) error {
+	if m.Ref == "" || hasSpace(m.Ref) {
+		return ErrInvalidMessage
+	}
+	return write(w, m.AppendTo(nil))
+}
+
+// Decode reads the message from r
+func (m *Relayed) Decode(r *bufio.Reader) error {
+	return decodeLine(r, m.DecodeLine)
+}
+
+// DecodeLine decodes the message from its line
+func (m *Relayed) DecodeLine(line string) error {
+	args, err := argumentsOf(line, RelayedType)
+	if err != nil {
+		return err
+	}
+	parts := strings.Split(args, " ")
+	if len(parts) != 2 || parts[0] == "" {
+		return ErrInvalidMessage
+	}
+	if m.MsgID, err = parseID(parts[1]); err != nil {
+		return err
+	}
+	m.Ref = parts[0]
+	return nil
+}
+
+// Expired notifies a sender that its message expired before reaching a receiver, "expired 42 2\n"
+type Expired struct {
+	MsgID      uint64
+	ReceiverID uint64
+}
+
+// AppendTo appends the encoded message to dst
+func (m Expired) AppendTo(dst []byte) []byte {
+	return appendIDPair(dst, ExpiredType, m.MsgID, m.ReceiverID)
+}
+
+// Encode writes the message to w
+func (m Expired) Encode(w io.Writer) error {
+	return write(w, m.AppendTo(nil))
+}
+
+// Decode reads the message from r
+func (m *Expired) Decode(r *bufio.Reader) error {
+	return decodeLine(r, m.DecodeLine)
+}
+
+// DecodeLine decodes the message from its line
+func (m *Expired) DecodeLine(line string) error {
+	return parseIDPair(line, ExpiredType, &m.MsgID, &m.ReceiverID)
+}
+
+// Rejected notifies a sender that its message was dropped as the receiver was out of credit, "rejected 42 3\n"
+type Rejected struct {
+	MsgID      uint64
+	ReceiverID uint64
+}
+
+// AppendTo appends the encoded message to dst
+func (m Rejected) AppendTo(dst []byte) []byte {
+	return appendIDPair(dst, RejectedType, m.MsgID, m.ReceiverID)
+}
+
+// Encode writes the message to w
+func (m Rejected) Encode(w io.Writer) error {
+	return write(w, m.AppendTo(nil))
+}
+
+// Decode reads the message from r
+func (m *Rejected) Decode(r *bufio.Reader) error {
+	return decodeLine(r, m.DecodeLine)
+}
+
+// DecodeLine decodes the message from its line
+func (m *Rejected) DecodeLine(line string) error {
+	return parseIDPair(line, RejectedType, &m.MsgID, &m.ReceiverID)
+}
+
+// appendIDPair appends "<typ> <a> <b>\n" to dst
+func appendIDPair(dst []byte, typ string, a, b uint64) []byte {
+	dst = append(dst, typ...)
+	dst = append(dst, ' ')
+	dst = strconv.AppendUint(dst, a, 10)
+	dst = append(dst, ' ')
+	dst = strconv.AppendUint(dst, b, 10)
+	return append(dst, '\n')
+}
+
+// parseIDPair parses "<typ> <a> <b>\n"
+func parseIDPair(line, typ string, a, b *uint64) error {
+	args, err := argumentsOf(line, typ)
+	if err != nil {
+		return err
+	}
+	parts := strings.Split(args, " ")
+	if len(parts) != 2 {
+		return ErrInvalidMessage
+	}
+	if *a, err = parseID(parts[0]); err != nil {
+		return err
+	}
+	*b, err = parseID(parts[1])
+	return err
+}
+
+// Denied notifies a sender that the policy of server denied some receivers of its message,
+// client IDs or a queue group, "denied 42 2,4\n" or "denied 42 @jobs\n"
+type Denied struct {
+	MsgID     uint64
+	Receivers string
+}
+
+// AppendTo appends the encoded message to dst
+func (m Denied) AppendTo(dst []byte) []byte {
+	dst = append(dst, DeniedType...)
+	dst = append(dst, ' ')
+	dst = strconv.AppendUint(dst, m.MsgID, 10)
+	dst = append(dst, ' ')
+	dst = append(dst, m.Receivers...)
+	return append(dst, '\n')
+}
+
+// Encode writes the message to w, it fails for receivers which cannot be sent
+func (m Denied) Encode(w io.Writer) error {
+	if m.Receivers == "" || hasSpace(m.Receivers) {
+		return ErrInvalidMessage
+	}
+	return write(w, m.AppendTo(nil))
+}
+
+// Decode reads the message from r
+func (m *Denied) Decode(r *bufio.Reader) error {
+	return decodeLine(r, m.DecodeLine)
+}
+
+// DecodeLine decodes the message from its line
+func (m *Denied) DecodeLine(line string) error {
+	args, err := argumentsOf(line, DeniedType)
+	if err != nil {
+		return err
+	}
+	parts := strings.Split(args, " ")
+	if len(parts) != 2 || parts[1] == "" {
+		return ErrInvalidMessage
+	}
+	if m.MsgID, err = parseID(parts[0]); err != nil {
+		return err
+	}
+	m.Receivers = parts[1]
+	return nil
+}
+
+// Timeout notifies a requester that the receivers of request CorrelationID did not respond in time,
+// "timeout 3 2,4\n"
+type Timeout struct {
+	CorrelationID string
+	ReceiverIDs   []uint64
+}
+
+// AppendTo appends the encoded message to dst
+func (m Timeout) AppendTo(dst []byte) []byte {
+	return appendRequestNotice(dst, TimeoutType, m.CorrelationID, m.ReceiverIDs)
+}
+
+// Encode writes the message to w, it fails for a correlation ID which cannot be sent
+func (m Timeout) Encode(w io.Writer) error {
+	if m.CorrelationID == "" || hasSpace(m.CorrelationID) {
+		return ErrInvalidMessage
+	}
+	return write(w, m.AppendTo(nil))
+}
+
+// Decode reads the message from r
+func (m *Timeout) Decode(r *bufio.Reader) error {
+	return decodeLine(r, m.DecodeLine)
+}
+
+// DecodeLine decodes the message from its line
+func (m *Timeout) DecodeLine(line string) error {
+	var err error
+	m.CorrelationID, m.ReceiverIDs, err = parseRequestNotice(line, TimeoutType)
+	return err
+}
+
+// NoResponder notifies a requester that no receiver of request CorrelationID is connected, "noresponder 3\n"
+type NoResponder struct {
+	CorrelationID string
+}
+
+// AppendTo appends the encoded message to dst
+func (m NoResponder) AppendTo(dst []byte) []byte {
+	return appendArg(dst, NoResponderType, m.CorrelationID)
+}
+
+// Encode writes the message to w, it fails for a correlation ID which cannot be sent
+func (m NoResponder) Encode(w io.Writer) error {
+	if m.CorrelationID == "" || hasSpace(m.CorrelationID) {
+		return ErrInvalidMessage
+	}
+	return write(w, m.AppendTo(nil))
+}
+
+// Decode reads the message from r
+func (m *NoResponder) Decode(r *bufio.Reader) error {
+	return decodeLine(r, m.DecodeLine)
+}
+
+// DecodeLine decodes the message from its line
+func (m *NoResponder) DecodeLine(line string) error {
+	args, err := argumentsOf(line, NoResponderType)
+	if err != nil {
+		return err
+	}
+	if args == "" || hasSpace(args) {
+		return ErrInvalidMessage
+	}
+	m.CorrelationID = args
+	return nil
+}
+
+// Unreachable notifies a requester that some receivers of request CorrelationID are not connected,
+// "unreachable 3 2,4\n"
+type Unreachable struct {
+	CorrelationID string
+	ReceiverIDs   []uint64
+}
+
+// AppendTo appends the encoded message to dst
+func (m Unreachable) AppendTo(dst []byte) []byte {
+	return appendRequestNotice(dst, UnreachableType, m.CorrelationID, m.ReceiverIDs)
+}
+
+// Encode writes the message to w, it fails for a correlation ID which cannot be sent
+func (m Unreachable) Encode(w io.Writer) error {
+	if m.CorrelationID == "" || hasSpace(m.CorrelationID) {
+		return ErrInvalidMessage
+	}
+	return write(w, m.AppendTo(nil))
+}
+
+// Decode reads the message from r
+func (m *Unreachable) Decode(r *bufio.Reader) error {
+	return decodeLine(r, m.DecodeLine)
+}
+
+// DecodeLine decodes the message from its line
+func (m *Unreachable) DecodeLine(line string) error {
+	var err error
+	m.CorrelationID, m.ReceiverIDs, err = parseRequestNotice(line, UnreachableType)
+	return err
+}
+
+// appendRequestNotice appends "<typ> <corr> <id1>,<id2>\n" to dst
+func appendRequestNotice(dst []byte, typ, corr string, ids []uint64) []byte {
+	dst = append(dst, typ...)
+	dst = append(dst, ' ')
+	dst = append(dst, corr...)
+	dst = append(dst, ' ')
+	for i, id := range ids {
+		if i > 0 {
+			dst = append(dst, ',')
+		}
+		dst = strconv.AppendUint(dst, id, 10)
+	}
+	return append(dst, '\n')
+}
+
+// parseRequestNotice parses "<typ> <corr> <id1>,<id2>\n", the IDs may be left out
+func parseRequestNotice(line, typ string) (string, []uint64, error) {
+	args, err := argumentsOf(line, typ)
+	if err != nil {
+		return "", nil, err
+	}
+	parts := strings.SplitN(args, " ", 2)
+	if parts[0] == "" || (len(parts) == 2 && hasSpace(parts[1])) {
+		return "", nil, ErrInvalidMessage
+	}
+	var ids []uint64
+	if len(parts) == 2 && parts[1] != "" {
+		ids = make([]uint64, 0, strings.Count(parts[1], ",")+1)
+		for _, s := range strings.Split(parts[1], ",") {
+			id, err := parseID(s)
+			if err != nil {
+				return "", nil, err
+			}
+			ids = append(ids, id)
+		}
+	}
+	return parts[0], ids, nil
+}
+
+// Busy tells a connection the server turns away why before closing it, "busy max clients\n"
+type Busy struct {
+	Reason string
+}
+
+// AppendTo appends the encoded message to dst
+func (m Busy) AppendTo(dst []byte) []byte {
+	return appendArg(dst, BusyType, m.Reason)
+}
+
+// Encode writes the message to w
+func (m Busy) Encode(w io.Writer) error {
+	if strings.Contains(m.Reason, "\n") {
+		return ErrInvalidMessage
+	}
+	return write(w, m.AppendTo(nil))
+}
+
+// Decode reads the message from r
+func (m *Busy) Decode(r *bufio.Reader) error {
+	return decodeLine(r, m.DecodeLine)
+}
+
+// DecodeLine decodes the message from its line
+func (m *Busy) DecodeLine(line string) error {
+	args, err := argumentsOf(line, BusyType)
+	if err != nil {
+		return err
+	}
+	m.Reason = args
+	return nil
+}
@@ -1,6 +1,8 @@
 package test
 
 import (
+	"bufio"
+	"fmt"
 	"net"
 	"testing"
 	"time"
@@ -14,6 +16,32 @@ import (
 const clientCount = 100
 const benchmarkServerPort = 50000
 
+// TestBenchmark measures relays from one client to 99 others end to end, most of it is spent by the receiving clients.
+// Medians of 5 runs on a single CPU Intel Xeon VM with go1.27, the older trees running this TestBenchmark:
+// baseline is the first commit, before is the tree just before relay frames were encoded once and written
+// with net.Buffers, after is this tree. Latencies of single runs vary by up to 30%.
+//
+//	go test -count=1 -run '^TestBenchmark$' -v ./test/
+//
+//	                          latency    deliveries/s   memory        allocs
+//	short messages  baseline  1.01 ms/op  98.0k          26.8 KB/op    824/op
+//	                before    1.17 ms/op  84.4k          79.7 KB/op   1426/op
+//	                after     1.19 ms/op  82.9k          70.9 KB/op   1014/op
+//	long messages   baseline  1.59 ms/op  62.4k         432.8 KB/op    927/op
+//	                before    1.67 ms/op  59.5k         291.2 KB/op   1529/op
+//	                after     1.43 ms/op  69.2k         271.9 KB/op   1015/op
+//	large messages  baseline  7.51 ms/op  13.2k        7409.9 KB/op    943/op
+//	                before    4.42 ms/op  22.4k        3509.0 KB/op   1535/op
+//	                after     4.09 ms/op  24.2k        3310.2 KB/op   1019/op
+//
+// BenchmarkRelayMessage in internal/server measures the hub alone relaying 32KB to 99 receivers,
+// medians of 3 runs with the benchmark ported to the older trees:
+//
+//	go test -count=1 -run '^$' -bench '^BenchmarkRelayMessage$' ./internal/server/
+//
+//	baseline  604 µs/op   164k deliveries/s  4045.3 KB/op  106 allocs/op
+//	before     78 µs/op  1.27M deliveries/s   123.9 KB/op  111 allocs/op
+//	after      67 µs/op  1.48M deliveries/s    19.9 KB/op  105 allocs/op
 func TestBenchmark(t *testing.T) {
 	srv := server.New()
 	serverAddr := net.TCPAddr{Port: benchmarkServerPort}
@@ -43,6 +71,7 @@ func TestBenchmark(t *testing.T) {
 	t.Run("short messages", func(t *testing.T) {
 		payload := []byte("FOOBAR")
 		result := testing.Benchmark(func(b *testing.B) {
+			b.ReportAllocs()
 			for i := 0; i < b.N; i++ {
 				assert.NoError(b, clients[0].SendMsg(srv.ListClientIDs(), payload))
 				for j := 1; j < clientCount; j++ {
@@ -50,12 +79,13 @@ func TestBenchmark(t *testing.T) {
 				}
 			}
 		})
-		t.Logf("Short message benchmark\n%s\n", result.String())
+		t.Logf("Short message benchmark\n%s\t%s\n", result.String(), result.MemString())
 	})
 
 	t.Run("long messages", func(t *testing.T) {
 		payload := []byte("Lorem ipsum dolor sit amet, consectetur adipiscing elit. Duis sed est id mi blandit fringilla vulputate nec urna. Duis non porttitor arcu. Mauris ac ullamcorper turpis, ac tincidunt risus. In rutrum efficitur porttitor. Cras scelerisque eu mi ut tristique. Phasellus enim elit, pretium ut mi vel, semper interdum nisl. Duis gravida blandit risus, a semper ipsum lacinia quis. Nam eros purus, congue in metus id, volutpat dapibus velit. Cras ut dictum libero, non placerat quam. Vivamus sem justo, varius at magna sed, blandit consequat mi. Cras viverra, orci nec feugiat ullamcorper, mauris erat tincidunt nisi, nec rutrum neque est a libero. Nullam pharetra dolor at erat elementum convallis. Phasellus dictum fermentum odio non eleifend. Etiam scelerisque, neque a fringilla molestie, purus turpis posuere erat, ut pulvinar nisl nisl nec nisl. In pellentesque risus sem, id pretium eros gravida sit amet. In vel massa justo. Fusce euismod mattis massa. Fusce at nibh in est condimentum luctus. Integer a molestie arcu. Suspendisse aliquam venenatis nisl, sit amet aliquam ante convallis quis. Praesent nec ipsum lectus. Ut elementum pretium mollis. Etiam tincidunt sapien felis, eget aliquet justo tincidunt at. Integer turpis sem, feugiat quis lorem sed, scelerisque lacinia massa. Aliquam vitae urna et erat sodales accumsan a a enim. Nunc eget diam tristique, ornare nibh sed, laoreet ligula. Mauris sollicitudin consectetur elit nec eleifend. Donec in diam ut ligula porttitor vulputate. Integer finibus, tellus vitae sagittis tincidunt, felis augue pulvinar enim, consectetur sollicitudin lorem lacus vel sem. Mauris condimentum et dolor ac interdum. Praesent bibendum nulla nec dui tempus, non blandit augue iaculis. In pretium erat vel odio dictum, et rhoncus urna tristique. Mauris ut risus orci. Mauris cursus posuere felis, et accumsan ante consequat ac. Cras convallis luctus consequat.")
 		result := testing.Benchmark(func(b *testing.B) {
+			b.ReportAllocs()
 			for i := 0; i < b.N; i++ {
 				assert.NoError(b, clients[0].SendMsg(srv.ListClientIDs(), payload))
 				for j := 1; j < clientCount; j++ {
@@ -63,7 +93,21 @@ func TestBenchmark(t *testing.T) {
 				}
 			}
 		})
-		t.Logf("Long message benchmark\n%s\n", result.String())
+		t.Logf("Long message benchmark\n%s\t%s\n", result.String(), result.MemString())
+	})
+
+	t.Run("large messages", func(t *testing.T) {
+		payload := make([]byte, 32*1024)
+		result := testing.Benchmark(func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				assert.NoError(b, clients[0].SendMsg(srv.ListClientIDs(), payload))
+				for j := 1; j < clientCount; j++ {
+					<-clientChs[j]
+				}
+			}
+		})
+		t.Logf("Large message benchmark\n%s\t%s\n", result.String(), result.MemString())
 	})
 }
 
@@ -78,3 +122,104 @@ func waitForClientsToConnect(t *testing.T, srv *server.Server) {
 	// If even after polling for several seconds, not all clients have connected, stop the test
 	require.Equal(t, clientCount, len(srv.ListClientIDs()))
 }
+
+func TestPriorityBenchmark(t *testing.T) {
+	const bulkSize = 1024 * 1024
+	const bulkWindow = 32
+
+	// bulk messages are kept in the hub rather than streamed to measure the priority lanes
+	srv := server.New(server.WithStreamThreshold(0))
+	serverAddr := net.TCPAddr{Port: benchmarkServerPort}
+	require.NoError(t, srv.Start(&serverAddr))
+	defer func() {
+		assert.NoError(t, srv.Stop())
+	}()
+
+	// the receiver reads frames itself to keep its socket buffer small,
+	// so the bulk backlog stays in the hub where priorities apply
+	receiver, err := net.DialTCP(serverAddr.Network(), nil, &serverAddr)
+	require.NoError(t, err)
+	defer receiver.Close()
+	require.NoError(t, receiver.SetReadBuffer(64*1024))
+	r := bufio.NewReader(receiver)
+	_, err = receiver.Write([]byte("identity\n"))
+	require.NoError(t, err)
+	var receiverID uint64
+	_, err = fmt.Fscanf(r, "identity %d\n", &receiverID)
+	require.NoError(t, err)
+
+	bulkSender := client.New()
+	require.NoError(t, bulkSender.Connect(&serverAddr))
+	defer func() {
+		assert.NoError(t, bulkSender.Close())
+	}()
+
+	pinger := client.New()
+	require.NoError(t, pinger.Connect(&serverAddr))
+	defer func() {
+		assert.NoError(t, pinger.Close())
+	}()
+
+	// the receiver takes a while to process a bulk message
+	// and has up to bulkWindow of them queued at any time,
+	// bulk messages are sent with normal priority like a sender unaware of lanes does
+	window := make(chan struct{}, bulkWindow)
+	pongs := make(chan struct{})
+	go func() {
+		for {
+			header, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			var senderID uint64
+			var size int
+			if _, err := fmt.Sscanf(header, "relay %d %d", &senderID, &size); err != nil {
+				return
+			}
+			if _, err := r.Discard(size); err != nil {
+				return
+			}
+			if size == bulkSize {
+				time.Sleep(5 * time.Millisecond)
+				<-window
+				continue
+			}
+			pongs <- struct{}{}
+		}
+	}()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		payload := make([]byte, bulkSize)
+		for {
+			select {
+			case <-stop:
+				return
+			case window <- struct{}{}:
+			}
+			if err := bulkSender.SendMsg([]uint64{receiverID}, payload); err != nil {
+				return
+			}
+		}
+	}()
+
+	for _, tc := range []struct {
+		name string
+		opts []client.SendOption
+	}{
+		{"normal priority", nil},
+		{"high priority", []client.SendOption{client.HighPriority()}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			payload := []byte("ping")
+			result := testing.Benchmark(func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					assert.NoError(b, pinger.SendMsg([]uint64{receiverID}, payload, tc.opts...))
+					<-pongs
+				}
+			})
+			t.Logf("Latency under bulk load with %s\n%s\n", tc.name, result.String())
+		})
+	}
+}
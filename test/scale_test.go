@@ -0,0 +1,169 @@
+//go:build linux
+// +build linux
+
+package test
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/badboyd/tcp-hub/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// e.g. go test ./test -run TestScale -scale.conns 100000 -timeout 30m,
+// each connection takes two file descriptors as both ends live in the test
+var scaleConns = flag.Int("scale.conns", 2000, "idle connections opened by TestScale")
+
+// connsPerSourceIP stays under the ephemeral port range of a single source address
+const connsPerSourceIP = 20000
+
+// TestScale holds many idle loopback connections to the hub with each network core
+// and logs what one connection costs, the hub must still relay between them.
+// The baseline only accepts the connections, its cost is the one of the test ends and the sockets.
+func TestScale(t *testing.T) {
+	conns := *scaleConns
+	if err := raiseFileLimit(uint64(2*conns + 256)); err != nil {
+		t.Skipf("%d connections need more file descriptors: %s", conns, err)
+	}
+
+	baseline := measure(t, conns, nil)
+	t.Logf("baseline    %s", baseline)
+
+	for _, tc := range []struct {
+		name string
+		opts []server.Option
+	}{
+		{"goroutines", nil},
+		{"event loop", []server.Option{server.WithEventLoop(0)}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := server.New(tc.opts...)
+			cost := measure(t, conns, srv)
+			t.Logf("%-11s %s, hub alone %d bytes and %.2f goroutines per connection", tc.name, cost,
+				(cost.bytes-baseline.bytes)/int64(conns), float64(cost.goroutines-baseline.goroutines)/float64(conns))
+			if len(tc.opts) > 0 {
+				assert.True(t, cost.goroutines-baseline.goroutines < conns/10, "goroutines grow with connections")
+			}
+		})
+	}
+}
+
+type scaleCost struct {
+	bytes      int64
+	goroutines int
+}
+
+func (c scaleCost) String() string {
+	return fmt.Sprintf("%d MB in use, %d goroutines", c.bytes>>20, c.goroutines)
+}
+
+// measure opens conns connections to srv, or to a listener holding them when srv is nil,
+// and returns the memory in use and the goroutines running with them open
+func measure(t *testing.T, conns int, srv *server.Server) scaleCost {
+	serverAddr := net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: serverPort}
+	var accepted chan net.Conn
+	if srv != nil {
+		require.NoError(t, srv.Start(&serverAddr))
+		defer assertDoesNotError(t, srv.Stop)
+	} else {
+		listener, err := net.ListenTCP(serverAddr.Network(), &serverAddr)
+		require.NoError(t, err)
+		accepted = make(chan net.Conn, conns)
+		go func() {
+			defer close(accepted)
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				accepted <- conn
+			}
+		}()
+		defer func() {
+			listener.Close()
+			for conn := range accepted {
+				conn.Close()
+			}
+		}()
+	}
+
+	before := usage()
+	opened := make([]net.Conn, 0, conns)
+	defer func() {
+		for _, conn := range opened {
+			conn.Close()
+		}
+	}()
+	for i := 0; i < conns; i++ {
+		// loopback answers on 127.0.0.0/8, spreading sources gives each its own port range
+		dialer := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 1, byte(1+i/connsPerSourceIP))}}
+		conn, err := dialer.Dial(serverAddr.Network(), serverAddr.String())
+		require.NoError(t, err)
+		opened = append(opened, conn)
+	}
+
+	served := func() int {
+		if srv != nil {
+			return len(srv.ListClientIDs())
+		}
+		return len(accepted)
+	}
+	for i := 0; i < 600 && served() != conns; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	require.Equal(t, conns, served())
+	after := usage()
+
+	if srv != nil && conns >= 2 {
+		// the first connection relays to the last one, client IDs follow the connection order
+		first, last := opened[0], opened[conns-1]
+		_, err := fmt.Fprintf(first, "relay %d 5\nhello", conns)
+		require.NoError(t, err)
+		expected := "relay 1 5 id=1\nhello"
+		relayMsg := make([]byte, len(expected))
+		require.NoError(t, last.SetReadDeadline(time.Now().Add(10*time.Second)))
+		_, err = io.ReadFull(bufio.NewReader(last), relayMsg)
+		require.NoError(t, err)
+		assert.Equal(t, expected, string(relayMsg))
+	}
+
+	return scaleCost{
+		bytes:      after.bytes - before.bytes,
+		goroutines: after.goroutines - before.goroutines,
+	}
+}
+
+func usage() scaleCost {
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return scaleCost{
+		bytes:      int64(stats.HeapInuse + stats.StackInuse),
+		goroutines: runtime.NumGoroutine(),
+	}
+}
+
+// raiseFileLimit raises the soft limit of open files to n when the hard limit allows it
+func raiseFileLimit(n uint64) error {
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+		return err
+	}
+	if limit.Cur >= n {
+		return nil
+	}
+	if limit.Max < n {
+		return fmt.Errorf("hard limit is %d", limit.Max)
+	}
+	limit.Cur = n
+	return syscall.Setrlimit(syscall.RLIMIT_NOFILE, &limit)
+}